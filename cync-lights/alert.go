@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/trace"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+var alertLog = log.For("alert")
+
+const (
+	defaultPattern = "blink3"
+	blinkHold      = 300 * time.Millisecond
+	strobeHold     = 100 * time.Millisecond
+	pulseStep      = 150 * time.Millisecond
+	// maxBlinks keeps a typo like blink100 from taking the lights for a minute
+	maxBlinks = 10
+)
+
+// alert flashes some lights to get attention, then puts them back.
+type alert struct {
+	Color   string `json:"color"`
+	Pattern string `json:"pattern,omitempty"`
+	// Target is a device, group or all
+	Target string `json:"target,omitempty"`
+}
+
+func (a alert) key() string {
+	return strings.ToLower(strings.Join([]string{a.Color, a.Pattern, a.Target}, "|"))
+}
+
+func (a alert) String() string {
+	target := a.Target
+	if target == "" {
+		target = "all"
+	}
+	pattern := a.Pattern
+	if pattern == "" {
+		pattern = defaultPattern
+	}
+	return fmt.Sprintf("%s %s on %s", pattern, a.Color, target)
+}
+
+// alertStep is one beat of a pattern, power and brightness held for a while.
+type alertStep struct {
+	on   bool
+	lum  colors.Brightness
+	hold time.Duration
+}
+
+// alertPattern turns a pattern name into steps: blink, blinkN, strobe,
+// pulse or flash.
+func alertPattern(name string) ([]alertStep, error) {
+	full := colors.Full
+	switch {
+	case name == "flash":
+		return []alertStep{{on: true, lum: full, hold: time.Second}}, nil
+	case name == "strobe":
+		return blinks(8, strobeHold), nil
+	case name == "pulse":
+		var steps []alertStep
+		for i := 0; i < 2; i++ {
+			for lum := colors.Brightness(10); lum <= full; lum += 30 {
+				steps = append(steps, alertStep{on: true, lum: lum, hold: pulseStep})
+			}
+			for lum := full; lum >= 10; lum -= 30 {
+				steps = append(steps, alertStep{on: true, lum: lum, hold: pulseStep})
+			}
+		}
+		return steps, nil
+	case strings.HasPrefix(name, "blink"):
+		n := 1
+		if count := strings.TrimPrefix(name, "blink"); count != "" {
+			var err error
+			if n, err = strconv.Atoi(count); err != nil || n < 1 || n > maxBlinks {
+				return nil, errors.Errorf("blink count must be 1-%d", maxBlinks)
+			}
+		}
+		return blinks(n, blinkHold), nil
+	}
+	return nil, errors.Errorf("unknown pattern %q, use blink, blinkN, strobe, pulse or flash", name)
+}
+
+func blinks(n int, hold time.Duration) []alertStep {
+	var steps []alertStep
+	for i := 0; i < n; i++ {
+		steps = append(steps,
+			alertStep{on: true, lum: colors.Full, hold: hold},
+			alertStep{on: false, hold: hold})
+	}
+	return steps
+}
+
+// alerts queues alerts onto the controller loop. Each one plays to the end
+// before the next, and before the mode runs again, so rainbow or roll can't
+// paint over it. An alert identical to one already waiting or playing is
+// dropped.
+type alerts struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func newAlerts() *alerts {
+	return &alerts{pending: map[string]bool{}}
+}
+
+// enqueueAlert validates an alert and queues it, queued is false for duplicates.
+// It's safe to call from any goroutine.
+func (c *controller) enqueueAlert(a alert) (queued bool, err error) {
+	if a.Pattern == "" {
+		a.Pattern = defaultPattern
+	}
+	color, err := colors.Parse(a.Color)
+	if err != nil {
+		return false, err
+	}
+	steps, err := alertPattern(a.Pattern)
+	if err != nil {
+		return false, err
+	}
+
+	key := a.key()
+	c.alerts.mu.Lock()
+	if c.alerts.pending[key] {
+		c.alerts.mu.Unlock()
+		alertLog.Debug("dropping duplicate alert", log.F("alert", a.String()))
+		return false, nil
+	}
+	c.alerts.pending[key] = true
+	c.alerts.mu.Unlock()
+
+	task := func() {
+		defer func() {
+			c.alerts.mu.Lock()
+			delete(c.alerts.pending, key)
+			c.alerts.mu.Unlock()
+		}()
+		if err := c.playAlert(a, color, steps); err != nil {
+			c.view.Eventf(ui.ErrColor, "alert %s: %v", a, err)
+		}
+	}
+	// posting blocks while the queue is full, which would deadlock when
+	// called from the controller loop itself
+	go c.post(task)
+	return true, nil
+}
+
+// playAlert takes over the target devices, plays the steps and restores
+// exactly what they were doing, power, color and brightness.
+func (c *controller) playAlert(a alert, color colors.RGB, steps []alertStep) (err error) {
+	span := c.tracing.start("alert", trace.KindInternal, trace.String("alert", a.String()))
+	defer func() { c.tracing.end(span, err) }()
+
+	devices, err := c.resolveTarget(a.Target)
+	if err != nil {
+		return err
+	}
+
+	saved := map[*device]config.DeviceState{}
+	for _, d := range devices {
+		saved[d] = c.deviceState(d)
+	}
+	// flashing isn't a state change rules should react to
+	c.alerting = true
+	defer func() { c.alerting = false }()
+
+	alertLog.Info("playing alert", log.F("alert", a.String()), log.F("devices", len(devices)))
+	c.view.Eventf(ui.HeaderColor, "alert: %s", a)
+	for _, d := range devices {
+		c.SetStatus(d, true)
+		c.SetRGBAsync(d, color)
+	}
+
+	lum := colors.Brightness(-1)
+	power := true
+	for _, step := range steps {
+		for _, d := range devices {
+			if step.on != power {
+				c.SetStatus(d, step.on)
+			}
+			if step.on && step.lum != lum {
+				c.SetLumAsync(d, step.lum)
+			}
+		}
+		power = step.on
+		if step.on {
+			lum = step.lum
+		}
+		c.sleep(step.hold)
+	}
+
+	for d, state := range saved {
+		if err := c.restoreAfterAlert(d, state); err != nil {
+			alertLog.Warn("failed to restore after alert", log.F("device", d.Name()), log.Err(err))
+		}
+	}
+	return nil
+}
+
+// restoreAfterAlert is applyState, except devices that were off get their
+// color and brightness back before turning off again, so they come back on
+// as they were.
+func (c *controller) restoreAfterAlert(d *device, state config.DeviceState) error {
+	if state.Power {
+		return c.applyState(d, state)
+	}
+	on := state
+	on.Power = true
+	if err := c.applyState(d, on); err != nil {
+		return err
+	}
+	return c.SetStatus(d, false)
+}
+
+func runAlert(cont *controller, args parsedArgs) error {
+	a := alert{Color: args.str("color"), Pattern: args.str("pattern"), Target: args.str("target")}
+	queued, err := cont.enqueueAlert(a)
+	if err != nil {
+		return err
+	}
+	if !queued {
+		cont.view.Eventf(ui.DimColor, "already alerting %s", a)
+	}
+	return nil
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/ci"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/energy"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/rules"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+var apiLog = log.For("api")
+
+const (
+	defaultListen = "127.0.0.1:7373"
+	apiTimeout    = 5 * time.Second
+	// maxBody is plenty for an alert and stops anyone filling memory
+	maxBody = 64 << 10
+)
+
+// apiResult is what every endpoint answers with.
+type apiResult struct {
+	Queued bool   `json:"queued"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func listenAddr(cfg *config.API) string {
+	if cfg.Listen == "" {
+		return defaultListen
+	}
+	return cfg.Listen
+}
+
+// startAPI serves the HTTP API if the config has an api section:
+//
+//	POST /alert         {"color": "red", "pattern": "blink3", "target": "desk"}
+//	POST /event/<name>  fires the rules waiting on event <name>
+//	POST /ci            {"status": "passing"} for ci mode's webhook source
+//	POST /wake/snooze   snoozes the alarm going off
+//	POST /wake/skip     skips the next alarm, ?alarm=<name> for a particular one
+//	GET  /usage         estimated kWh and cost, ?period=day|week|month&target=<group>
+//	GET  /usage.csv     this month's usage by day and device, or ?period=
+//	GET  /metrics       command counts, latencies and device state for Prometheus
+//	GET  /pending       commands queued while the cloud is unreachable, POST replays them
+//	GET  /reconcile     devices that drifted from what they were sent, POST checks now
+func (c *controller) startAPI() error {
+	if c.config.API == nil {
+		return nil
+	}
+	cfg := *c.config.API
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/alert", c.handleAlert)
+	mux.HandleFunc("/event/", c.handleEvent)
+	mux.HandleFunc("/ci", c.handleCI)
+	mux.HandleFunc("/wake/", c.handleWake)
+	mux.HandleFunc("/usage", c.handleUsage)
+	mux.HandleFunc("/usage.csv", c.handleUsageCSV)
+	mux.HandleFunc("/metrics", c.handleMetrics)
+	mux.HandleFunc("/pending", c.handlePending)
+	mux.HandleFunc("/reconcile", c.handleReconcile)
+
+	listener, err := net.Listen("tcp", listenAddr(&cfg))
+	if err != nil {
+		return errors.Wrap(err, "failed to listen")
+	}
+	c.api = &http.Server{
+		Handler:      c.traced(authorized(cfg.Token, mux)),
+		ReadTimeout:  apiTimeout,
+		WriteTimeout: apiTimeout,
+	}
+	go func() {
+		if err := c.api.Serve(listener); err != nil && err != http.ErrServerClosed {
+			apiLog.Error("api stopped", log.Err(err))
+		}
+	}()
+	apiLog.Info("serving api", log.F("addr", listener.Addr().String()))
+	return nil
+}
+
+// authorized checks the bearer token, if there is one.
+func authorized(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				respond(w, http.StatusUnauthorized, apiResult{Reason: "bad or missing token"})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAlert takes an alert as JSON or as form values, where group and
+// device work as well as target.
+func (c *controller) handleAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use POST"})
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+
+	var a alert
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			respond(w, http.StatusBadRequest, apiResult{Reason: "bad json: " + err.Error()})
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			respond(w, http.StatusBadRequest, apiResult{Reason: err.Error()})
+			return
+		}
+		a = alert{Color: r.Form.Get("color"), Pattern: r.Form.Get("pattern"), Target: r.Form.Get("target")}
+		for _, key := range []string{"group", "device"} {
+			if a.Target == "" {
+				a.Target = r.Form.Get(key)
+			}
+		}
+	}
+
+	queued, err := c.enqueueAlert(a)
+	switch {
+	case err != nil:
+		respond(w, http.StatusBadRequest, apiResult{Reason: err.Error()})
+	case !queued:
+		respond(w, http.StatusOK, apiResult{Reason: "the same alert is already queued"})
+	default:
+		apiLog.Info("queued alert", log.F("alert", a.String()), log.F("remote", r.RemoteAddr))
+		respond(w, http.StatusAccepted, apiResult{Queued: true})
+	}
+}
+
+// handleEvent lets scripts trigger rules with "when": {"event": "<name>"}.
+func (c *controller) handleEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use POST"})
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/event/")
+	if name == "" {
+		respond(w, http.StatusNotFound, apiResult{Reason: "no event name"})
+		return
+	}
+	go c.postFrom(r, func() {
+		c.view.Eventf(ui.DimColor, "api: event %s", name)
+		c.ruleEvent(rules.Event{Kind: rules.KindEvent, Key: name})
+	})
+	respond(w, http.StatusAccepted, apiResult{Queued: true})
+}
+
+// handleCI takes a build status as JSON, a status form value or a plain text
+// body, so a CI job can report with curl -d passing.
+func (c *controller) handleCI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use POST"})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		respond(w, http.StatusBadRequest, apiResult{Reason: err.Error()})
+		return
+	}
+
+	word := strings.TrimSpace(string(body))
+	switch {
+	case strings.HasPrefix(r.Header.Get("Content-Type"), "application/json"):
+		var status struct {
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(body, &status); err != nil {
+			respond(w, http.StatusBadRequest, apiResult{Reason: "bad json: " + err.Error()})
+			return
+		}
+		word = status.Status
+	case strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded"):
+		form, err := url.ParseQuery(word)
+		if err != nil {
+			respond(w, http.StatusBadRequest, apiResult{Reason: err.Error()})
+			return
+		}
+		// curl -d sends a bare word as a form too
+		if form.Has("status") {
+			word = form.Get("status")
+		}
+	}
+
+	state, ok := ci.Parse(word)
+	if !ok {
+		respond(w, http.StatusBadRequest, apiResult{Reason: fmt.Sprintf("unknown status %q, use passing, running or failing", word)})
+		return
+	}
+	c.modes[ModeCIID].(*ModeCI).hook.Push(state)
+	apiLog.Debug("ci status pushed", log.F("status", state.String()))
+	respond(w, http.StatusAccepted, apiResult{Queued: true})
+}
+
+// handleWake snoozes or skips alarms. It waits for the controller loop so
+// the answer says whether it worked.
+func (c *controller) handleWake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use POST"})
+		return
+	}
+	action := strings.TrimPrefix(r.URL.Path, "/wake/")
+	if action != "snooze" && action != "skip" {
+		respond(w, http.StatusNotFound, apiResult{Reason: "use /wake/snooze or /wake/skip"})
+		return
+	}
+	alarm := r.URL.Query().Get("alarm")
+
+	done := make(chan error, 1)
+	go c.postFrom(r, func() {
+		if c.wake == nil {
+			done <- errors.New("no alarms are configured")
+			return
+		}
+		if action == "snooze" {
+			done <- c.snoozeAlarm()
+			return
+		}
+		o, err := c.wake.schedule.Skip(alarm, c.wake.clock.Now())
+		if err == nil {
+			c.view.Eventf(ui.TextColor, "api: skipping %s", o)
+		}
+		done <- err
+	})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			respond(w, http.StatusConflict, apiResult{Reason: err.Error()})
+			return
+		}
+		respond(w, http.StatusOK, apiResult{Queued: true})
+	case <-time.After(apiTimeout / 2):
+		respond(w, http.StatusAccepted, apiResult{Queued: true, Reason: "still waiting for the controller"})
+	}
+}
+
+// handleUsage reports usage as JSON. Groups and devices are read on the
+// controller loop, where the config changes.
+func (c *controller) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use GET"})
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "day"
+	}
+	type answer struct {
+		report usageReport
+		err    error
+	}
+	done := make(chan answer, 1)
+	go c.postFrom(r, func() {
+		report, err := c.usageFor(period, r.URL.Query().Get("target"))
+		done <- answer{report, err}
+	})
+
+	select {
+	case a := <-done:
+		if a.err != nil {
+			respond(w, http.StatusBadRequest, apiResult{Reason: a.err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.report)
+	case <-time.After(apiTimeout / 2):
+		respond(w, http.StatusServiceUnavailable, apiResult{Reason: "the controller is busy, try again"})
+	}
+}
+
+// handleUsageCSV exports usage for spreadsheets, like usage export.
+func (c *controller) handleUsageCSV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use GET"})
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "month"
+	}
+	type answer struct {
+		rows  []energy.Row
+		price float64
+		err   error
+	}
+	done := make(chan answer, 1)
+	go c.postFrom(r, func() {
+		rows, err := c.usageRows(period)
+		price, _ := c.price()
+		done <- answer{rows, price, err}
+	})
+
+	select {
+	case a := <-done:
+		if a.err != nil {
+			respond(w, http.StatusBadRequest, apiResult{Reason: a.err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s.csv", period))
+		if err := energy.WriteCSV(w, a.rows, a.price); err != nil {
+			apiLog.Warn("failed to write usage", log.Err(err))
+		}
+	case <-time.After(apiTimeout / 2):
+		respond(w, http.StatusServiceUnavailable, apiResult{Reason: "the controller is busy, try again"})
+	}
+}
+
+func respond(w http.ResponseWriter, status int, result apiResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// sendAlert is cync-lights alert, which asks the running instance to play an
+// alert through the API rather than logging in itself.
+func sendAlert(args []string) error {
+	cfg, err := config.Load(config.Path())
+	if err != nil {
+		return err
+	}
+	if cfg.API == nil {
+		return errors.Errorf("the api isn't enabled, add an \"api\" section to %s and restart cync-lights", config.Path())
+	}
+
+	a := alert{}
+	a.Color, _ = flagValue(args, "color")
+	a.Pattern, _ = flagValue(args, "pattern")
+	for _, key := range []string{"target", "group", "device"} {
+		if value, ok := flagValue(args, key); ok && a.Target == "" {
+			a.Target = value
+		}
+	}
+	if a.Color == "" {
+		return errors.New("usage: cync-lights alert --color <color> [--pattern blink3] [--group <group>|--device <device>]")
+	}
+
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("http://%s/alert", listenAddr(cfg.API))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.API.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.API.Token)
+	}
+
+	resp, err := (&http.Client{Timeout: apiTimeout}).Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't reach cync-lights at %s, is it running", listenAddr(cfg.API))
+	}
+	defer resp.Body.Close()
+
+	var result apiResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return errors.Wrapf(err, "unexpected response, %s", resp.Status)
+	}
+	switch {
+	case resp.StatusCode >= 300:
+		return errors.New(result.Reason)
+	case result.Queued:
+		fmt.Printf("[alert] queued %s\n", a)
+	default:
+		fmt.Printf("[alert] %s\n", result.Reason)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"github.com/unixpickle/cbyge"
+)
+
+// device is a light the controller drives. cbyge's devices can only be made
+// by cbyge, so the controller works with these and each backend keeps
+// whatever it needs to reach the real thing.
+type device struct {
+	id   string
+	name string
+
+	cync *cbyge.ControllerDevice
+}
+
+func (d *device) DeviceID() string {
+	return d.id
+}
+
+func (d *device) Name() string {
+	return d.name
+}
+
+type deviceStatus struct {
+	Online     bool
+	On         bool
+	Brightness int
+	UseRGB     bool
+	RGB        [3]uint8
+}
+
+// backend is how commands reach devices.
+type backend interface {
+	Devices() ([]*device, error)
+	Status(d *device) deviceStatus
+	SetStatus(d *device, on bool) error
+	SetRGB(d *device, r, g, b uint8, async bool) error
+	SetLum(d *device, lum int, async bool) error
+	// SetCT sets the color tone of tunable white bulbs, 0 warm to 100 cool
+	SetCT(d *device, tone int, async bool) error
+}
+
+// cloudBackend talks to devices through the Cync cloud.
+type cloudBackend struct {
+	wrapped *cbyge.Controller
+}
+
+func newCloudBackend(wrapped *cbyge.Controller) *cloudBackend {
+	return &cloudBackend{wrapped: wrapped}
+}
+
+func (cb *cloudBackend) Devices() ([]*device, error) {
+	cyncDevices, err := cb.wrapped.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]*device, 0, len(cyncDevices))
+	for _, d := range cyncDevices {
+		devices = append(devices, &device{
+			id:   d.DeviceID(),
+			name: d.Name(),
+			cync: d,
+		})
+	}
+	return devices, nil
+}
+
+// Status is whatever cbyge last saw, it's refreshed when devices are listed.
+func (cb *cloudBackend) Status(d *device) deviceStatus {
+	status := d.cync.LastStatus()
+	return deviceStatus{
+		Online:     status.IsOnline,
+		On:         status.IsOn,
+		Brightness: int(status.Brightness),
+		UseRGB:     status.UseRGB,
+		RGB:        status.RGB,
+	}
+}
+
+func (cb *cloudBackend) SetStatus(d *device, on bool) error {
+	return cb.wrapped.SetDeviceStatus(d.cync, on)
+}
+
+func (cb *cloudBackend) SetRGB(d *device, r, g, b uint8, async bool) error {
+	if async {
+		return cb.wrapped.SetDeviceRGBAsync(d.cync, r, g, b)
+	}
+	return cb.wrapped.SetDeviceRGB(d.cync, r, g, b)
+}
+
+func (cb *cloudBackend) SetLum(d *device, lum int, async bool) error {
+	if async {
+		return cb.wrapped.SetDeviceLumAsync(d.cync, lum)
+	}
+	return cb.wrapped.SetDeviceLum(d.cync, lum)
+}
+
+func (cb *cloudBackend) SetCT(d *device, tone int, async bool) error {
+	if async {
+		return cb.wrapped.SetDeviceCTAsync(d.cync, tone)
+	}
+	return cb.wrapped.SetDeviceCT(d.cync, tone)
+}
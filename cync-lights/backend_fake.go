@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// errFakeOutage is what every call fails with while the fake cloud is down.
+var errFakeOutage = errors.New("fake outage: the cloud is unreachable")
+
+// fakeCall is one command the fake backend received.
+type fakeCall struct {
+	Device string
+	Op     string
+	Value  string
+}
+
+func (f fakeCall) String() string {
+	return fmt.Sprintf("%s %s %s", f.Device, f.Op, f.Value)
+}
+
+// fakeBackend keeps device state in memory. It's what --fake runs against and
+// it remembers every call so runs can be compared. It can also pretend the
+// cloud is down.
+type fakeBackend struct {
+	lock    sync.Mutex
+	devices []*device
+	status  map[string]deviceStatus
+	calls   []fakeCall
+	outage  bool
+}
+
+// fakeDeviceCount is how many devices --fake asks for, 3 if it doesn't say.
+func fakeDeviceCount(value string) (int, error) {
+	if value == "" {
+		return 3, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("%q isn't a number of devices", value)
+	}
+	if n < 1 {
+		return 0, errors.Errorf("%d devices, want at least 1", n)
+	}
+	return n, nil
+}
+
+func newFakeBackend(n int) *fakeBackend {
+	fb := &fakeBackend{status: map[string]deviceStatus{}}
+	for i := 1; i <= n; i++ {
+		id := strconv.Itoa(1000 + i)
+		fb.devices = append(fb.devices, &device{id: id, name: fmt.Sprintf("fake-%d", i)})
+		fb.status[id] = deviceStatus{Online: true, On: true, Brightness: 100, UseRGB: true, RGB: [3]uint8{255, 255, 255}}
+	}
+	return fb
+}
+
+func (fb *fakeBackend) Devices() ([]*device, error) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.outage {
+		return nil, errFakeOutage
+	}
+	return append([]*device(nil), fb.devices...), nil
+}
+
+func (fb *fakeBackend) Status(d *device) deviceStatus {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.status[d.id]
+}
+
+func (fb *fakeBackend) SetStatus(d *device, on bool) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.outage {
+		return errFakeOutage
+	}
+
+	s := fb.status[d.id]
+	s.On = on
+	fb.status[d.id] = s
+	fb.calls = append(fb.calls, fakeCall{Device: d.name, Op: "status", Value: strconv.FormatBool(on)})
+	return nil
+}
+
+func (fb *fakeBackend) SetRGB(d *device, r, g, b uint8, async bool) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.outage {
+		return errFakeOutage
+	}
+
+	s := fb.status[d.id]
+	s.On, s.UseRGB, s.RGB = true, true, [3]uint8{r, g, b}
+	fb.status[d.id] = s
+	fb.calls = append(fb.calls, fakeCall{Device: d.name, Op: "rgb", Value: fmt.Sprintf("%d,%d,%d", r, g, b)})
+	return nil
+}
+
+func (fb *fakeBackend) SetLum(d *device, lum int, async bool) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.outage {
+		return errFakeOutage
+	}
+
+	s := fb.status[d.id]
+	s.Brightness = lum
+	fb.status[d.id] = s
+	fb.calls = append(fb.calls, fakeCall{Device: d.name, Op: "lum", Value: strconv.Itoa(lum)})
+	return nil
+}
+
+func (fb *fakeBackend) SetCT(d *device, tone int, async bool) error {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	if fb.outage {
+		return errFakeOutage
+	}
+
+	s := fb.status[d.id]
+	s.On, s.UseRGB = true, false
+	fb.status[d.id] = s
+	fb.calls = append(fb.calls, fakeCall{Device: d.name, Op: "ct", Value: strconv.Itoa(tone)})
+	return nil
+}
+
+// PowerCycle has a device come back the way bulbs do after losing power, on,
+// white and at full brightness.
+func (fb *fakeBackend) PowerCycle(id string) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	s := fb.status[id]
+	s.On, s.Brightness, s.UseRGB, s.RGB = true, 100, false, [3]uint8{}
+	fb.status[id] = s
+}
+
+// Calls returns everything received so far.
+func (fb *fakeBackend) Calls() []fakeCall {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return append([]fakeCall(nil), fb.calls...)
+}
+
+// SetOutage takes the fake cloud down or brings it back.
+func (fb *fakeBackend) SetOutage(down bool) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fb.outage = down
+}
+
+func (fb *fakeBackend) Outage() bool {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	return fb.outage
+}
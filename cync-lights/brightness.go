@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+)
+
+// setScale changes the global brightness and sends every lit device its
+// brightness again at the new scale.
+func (c *controller) setScale(scale colors.Brightness) {
+	if scale == c.scale {
+		return
+	}
+	c.scale = scale
+	for _, d := range c.devices {
+		lum, ok := c.lastLum[d.DeviceID()]
+		if ok && c.lastPower[d.DeviceID()] {
+			c.SetLumAsync(d, lum)
+		}
+	}
+}
+
+func runScale(cont *controller, args parsedArgs) error {
+	if args.has("percent") {
+		cont.setScale(args.brightness("percent"))
+	}
+	cont.view.Eventf(ui.TextColor, "brightness scaled to %s", cont.scale)
+	return nil
+}
@@ -0,0 +1,218 @@
+// Package calibrate corrects colors and brightness for bulbs that don't show
+// them the way they should. Profiles come from the config, by model and by
+// device, and are applied to what's sent without touching what was asked
+// for.
+package calibrate
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/pkg/errors"
+)
+
+// Limits on what a profile can do, far enough to fix any real bulb.
+const (
+	MinGamma  = 0.3
+	MaxGamma  = 3.0
+	MaxGain   = 2.0
+	MaxMinLum = 50
+)
+
+// Profile is a compiled config.Profile.
+type Profile struct {
+	Model  string
+	Gamma  float64
+	White  [3]uint8
+	Gains  [3]float64
+	MinLum int
+}
+
+// Identity changes nothing.
+var Identity = Profile{Gamma: 1, White: [3]uint8{255, 255, 255}, Gains: [3]float64{1, 1, 1}}
+
+// IsIdentity is true if the profile changes nothing.
+func (p Profile) IsIdentity() bool {
+	return p.Gamma == 1 && p.White == Identity.White && p.Gains == Identity.Gains && p.MinLum == 0
+}
+
+// RGB corrects a color: gamma first, then the white point and gains.
+func (p Profile) RGB(rgb [3]uint8) [3]uint8 {
+	var out [3]uint8
+	for c, v := range rgb {
+		f := math.Pow(float64(v)/255, p.Gamma) * float64(p.White[c]) * p.Gains[c]
+		out[c] = uint8(math.Round(math.Max(0, math.Min(255, f))))
+	}
+	return out
+}
+
+// Lum squeezes brightness 1-100 into MinLum-100, off stays off.
+func (p Profile) Lum(lum colors.Brightness) colors.Brightness {
+	if lum <= colors.Off || p.MinLum <= 0 {
+		return lum
+	}
+	if lum >= colors.Full {
+		return colors.Full
+	}
+	span := float64(int(colors.Full) - p.MinLum)
+	return colors.Brightness(p.MinLum + int(math.Round(float64(lum-1)*span/float64(colors.Full-1))))
+}
+
+func (p Profile) String() string {
+	if p.IsIdentity() {
+		return "uncalibrated"
+	}
+	var parts []string
+	if p.Model != "" {
+		parts = append(parts, "model "+p.Model)
+	}
+	if p.Gamma != 1 {
+		parts = append(parts, fmt.Sprintf("gamma %.2f", p.Gamma))
+	}
+	if p.White != Identity.White {
+		parts = append(parts, fmt.Sprintf("white %d,%d,%d", p.White[0], p.White[1], p.White[2]))
+	}
+	if p.Gains != Identity.Gains {
+		parts = append(parts, fmt.Sprintf("gains %.2f,%.2f,%.2f", p.Gains[0], p.Gains[1], p.Gains[2]))
+	}
+	if p.MinLum > 0 {
+		parts = append(parts, fmt.Sprintf("min lum %d%%", p.MinLum))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Config is the profile as it's written to the config, only what differs
+// from the model it builds on.
+func (p Profile) Config(model Profile) config.Profile {
+	out := config.Profile{Model: p.Model}
+	if p.Gamma != model.Gamma {
+		out.Gamma = p.Gamma
+	}
+	if p.White != model.White {
+		out.White = fmt.Sprintf("%d,%d,%d", p.White[0], p.White[1], p.White[2])
+	}
+	if p.Gains != model.Gains {
+		out.Gains = []float64{p.Gains[0], p.Gains[1], p.Gains[2]}
+	}
+	if p.MinLum != model.MinLum {
+		out.MinLum = p.MinLum
+	}
+	return out
+}
+
+// Profiles holds every device's profile. It's safe to use from any
+// goroutine.
+type Profiles struct {
+	mu      sync.RWMutex
+	models  map[string]Profile
+	devices map[string]Profile
+}
+
+// Compile checks the config, returning all the problems at once. Profiles
+// with problems are left out, those devices go uncalibrated.
+func Compile(cfg *config.Calibration) (*Profiles, []error) {
+	p := &Profiles{models: map[string]Profile{}, devices: map[string]Profile{}}
+	if cfg == nil {
+		return p, nil
+	}
+	var problems []error
+	for name, m := range cfg.Models {
+		if m.Model != "" {
+			problems = append(problems, errors.Errorf("model %s: models can't build on other models", name))
+			continue
+		}
+		compiled, err := compile(Identity, m)
+		if err != nil {
+			problems = append(problems, errors.Wrapf(err, "model %s", name))
+			continue
+		}
+		p.models[name] = compiled
+	}
+	for name, d := range cfg.Devices {
+		base := Identity
+		if d.Model != "" {
+			model, ok := p.models[d.Model]
+			if !ok {
+				problems = append(problems, errors.Errorf("device %s: no model called %s", name, d.Model))
+				continue
+			}
+			base = model
+		}
+		compiled, err := compile(base, d)
+		if err != nil {
+			problems = append(problems, errors.Wrapf(err, "device %s", name))
+			continue
+		}
+		compiled.Model = d.Model
+		p.devices[strings.ToLower(name)] = compiled
+	}
+	return p, problems
+}
+
+func compile(base Profile, cfg config.Profile) (Profile, error) {
+	p := base
+	if cfg.Gamma != 0 {
+		if cfg.Gamma < MinGamma || cfg.Gamma > MaxGamma {
+			return Profile{}, errors.Errorf("gamma %v should be between %v and %v", cfg.Gamma, MinGamma, MaxGamma)
+		}
+		p.Gamma = cfg.Gamma
+	}
+	if cfg.White != "" {
+		white, err := colors.Parse(cfg.White)
+		if err != nil {
+			return Profile{}, errors.Wrap(err, "white")
+		}
+		p.White = white.GetRGB()
+	}
+	if len(cfg.Gains) > 0 {
+		if len(cfg.Gains) != 3 {
+			return Profile{}, errors.Errorf("gains should be red, green and blue, not %d numbers", len(cfg.Gains))
+		}
+		for c, g := range cfg.Gains {
+			if g < 0 || g > MaxGain {
+				return Profile{}, errors.Errorf("gain %v should be between 0 and %v", g, MaxGain)
+			}
+			p.Gains[c] = g
+		}
+	}
+	if cfg.MinLum != 0 {
+		if cfg.MinLum < 0 || cfg.MinLum > MaxMinLum {
+			return Profile{}, errors.Errorf("min_lum %d should be between 0 and %d", cfg.MinLum, MaxMinLum)
+		}
+		p.MinLum = cfg.MinLum
+	}
+	return p, nil
+}
+
+// For is the named device's profile, Identity if it has none. Names are
+// matched ignoring case, like everywhere else devices are named.
+func (p *Profiles) For(device string) Profile {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if profile, ok := p.devices[strings.ToLower(device)]; ok {
+		return profile
+	}
+	return Identity
+}
+
+// Model is the named model's profile, Identity if there isn't one.
+func (p *Profiles) Model(name string) Profile {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if profile, ok := p.models[name]; ok {
+		return profile
+	}
+	return Identity
+}
+
+// Set replaces a device's profile until the next Compile, for trying one
+// out before it's saved.
+func (p *Profiles) Set(device string, profile Profile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.devices[strings.ToLower(device)] = profile
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/calibrate"
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/input"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+const ModeCalibrateID = "calibrate"
+
+var calibrateLog = log.For("mode.calibrate")
+
+// loadCalibration compiles the profiles in the config. Devices whose
+// profile has problems go uncalibrated.
+func (c *controller) loadCalibration() {
+	profiles, problems := calibrate.Compile(c.config.Calibration)
+	for _, err := range problems {
+		c.view.Eventf(ui.ErrColor, "calibration %v", err)
+	}
+	c.calibration = profiles
+}
+
+// calibrationStep is one thing to match between the bulbs.
+type calibrationStep struct {
+	name string
+	hint string
+	// rgb and lum are what both bulbs show
+	rgb [3]uint8
+	lum colors.Brightness
+	// adjust nudges the setting being matched by a number of steps
+	adjust func(p *calibrate.Profile, steps int)
+	value  func(p calibrate.Profile) string
+}
+
+func gainStep(channel int, name string) calibrationStep {
+	return calibrationStep{
+		name: "white, " + name,
+		hint: "change " + name + " until the whites match",
+		rgb:  [3]uint8{255, 255, 255},
+		lum:  100,
+		adjust: func(p *calibrate.Profile, steps int) {
+			gain := math.Round((p.Gains[channel]+0.02*float64(steps))*100) / 100
+			p.Gains[channel] = math.Max(0, math.Min(calibrate.MaxGain, gain))
+		},
+		value: func(p calibrate.Profile) string {
+			return fmt.Sprintf("%s gain %.2f", name, p.Gains[channel])
+		},
+	}
+}
+
+var calibrationSteps = []calibrationStep{
+	gainStep(0, "red"),
+	gainStep(1, "green"),
+	gainStep(2, "blue"),
+	{
+		name: "gamma",
+		hint: "change gamma until the oranges match",
+		rgb:  [3]uint8{255, 128, 0},
+		lum:  100,
+		adjust: func(p *calibrate.Profile, steps int) {
+			gamma := math.Round((p.Gamma+0.05*float64(steps))*100) / 100
+			p.Gamma = math.Max(calibrate.MinGamma, math.Min(calibrate.MaxGamma, gamma))
+		},
+		value: func(p calibrate.Profile) string {
+			return fmt.Sprintf("gamma %.2f", p.Gamma)
+		},
+	},
+	{
+		name: "dim",
+		hint: "raise min brightness until both look as dim",
+		rgb:  [3]uint8{255, 255, 255},
+		lum:  1,
+		adjust: func(p *calibrate.Profile, steps int) {
+			p.MinLum += steps
+			if p.MinLum < 0 {
+				p.MinLum = 0
+			}
+			if p.MinLum > calibrate.MaxMinLum {
+				p.MinLum = calibrate.MaxMinLum
+			}
+		},
+		value: func(p calibrate.Profile) string {
+			return fmt.Sprintf("min brightness %d%%", p.MinLum)
+		},
+	},
+}
+
+// ModeCalibrate walks through matching one bulb to another. Both show the
+// same reference colors, the bulb being calibrated through the profile
+// being worked on, and the keys nudge it until they look the same.
+// Stepping past the last step saves the profile, quitting throws it away.
+type ModeCalibrate struct {
+	bindings bindings
+	// device and reference are set by calibrate start
+	device    *device
+	reference *device
+	step      int
+	// before is the profile the device had, put back if it isn't saved
+	before calibrate.Profile
+	draft  calibrate.Profile
+	saved  map[*device]config.DeviceState
+	// dirty is set when the bulbs need to be sent the step again
+	dirty bool
+	done  bool
+}
+
+func (mc *ModeCalibrate) onSwitch(cont *controller) error {
+	if mc.device == nil || mc.reference == nil {
+		return errors.New("use calibrate start <device> [reference]")
+	}
+	mc.saved = map[*device]config.DeviceState{}
+	for _, d := range []*device{mc.device, mc.reference} {
+		mc.saved[d] = cont.deviceState(d)
+		cont.SetStatus(d, true)
+	}
+	mc.before = cont.calibration.For(mc.device.Name())
+	mc.draft = mc.before
+	mc.step = 0
+	mc.dirty = true
+	mc.done = false
+	cont.view.Eventf(ui.TextColor, "Calibrating %s against %s, %s", mc.device.Name(), mc.reference.Name(), mc.draft)
+	return nil
+}
+
+func (mc *ModeCalibrate) run(cont *controller) (time.Duration, error) {
+	step := calibrationSteps[mc.step]
+	if mc.dirty {
+		mc.dirty = false
+		cont.calibration.Set(mc.device.Name(), mc.draft)
+		color := colors.New("reference", step.rgb[0], step.rgb[1], step.rgb[2])
+		for _, d := range []*device{mc.reference, mc.device} {
+			cont.SetRGBAsync(d, color)
+			cont.SetLumAsync(d, step.lum)
+		}
+	}
+	cont.view.SetModeLines(fmt.Sprintf("[Calibrate] %s against %s", mc.device.Name(), mc.reference.Name()),
+		fmt.Sprintf("step %d/%d %s: %s | %s", mc.step+1, len(calibrationSteps), step.name, step.value(mc.draft), step.hint),
+		fmt.Sprintf("%s/%s adjust, %s/%s step, %s cancel, %s on the last step saves",
+			mc.bindings.keyFor(actionFaster), mc.bindings.keyFor(actionSlower), mc.bindings.keyFor(actionBack),
+			mc.bindings.keyFor(actionForward), mc.bindings.keyFor(actionQuit), mc.bindings.keyFor(actionForward)))
+	return pausedSleep, nil
+}
+
+func (mc *ModeCalibrate) wantsKey(k input.Key) bool {
+	switch mc.bindings[keyName(k)] {
+	case actionFaster, actionSlower, actionForward, actionBack, actionQuit, actionHelp:
+		return true
+	}
+	return false
+}
+
+func (mc *ModeCalibrate) handleKey(cont *controller, k input.Key) bool {
+	switch mc.bindings[keyName(k)] {
+	case actionFaster:
+		calibrationSteps[mc.step].adjust(&mc.draft, 1)
+		mc.dirty = true
+	case actionSlower:
+		calibrationSteps[mc.step].adjust(&mc.draft, -1)
+		mc.dirty = true
+	case actionBack:
+		if mc.step > 0 {
+			mc.step--
+			mc.dirty = true
+		}
+	case actionForward:
+		if mc.step < len(calibrationSteps)-1 {
+			mc.step++
+			mc.dirty = true
+			return true
+		}
+		if err := cont.saveCalibration(mc.device, mc.draft); err != nil {
+			cont.view.Eventf(ui.ErrColor, "%v", err)
+			return true
+		}
+		mc.done = true
+		cont.calibration.Set(mc.device.Name(), mc.draft)
+		cont.SwitchMode(ModeCommandID)
+	case actionQuit:
+		cont.SwitchMode(ModeCommandID)
+	case actionHelp:
+		for _, line := range mc.bindings.describe(mc.wantsKey) {
+			cont.view.Eventf(ui.TextColor, "%s", line)
+		}
+		return false
+	}
+	return true
+}
+
+// onExit drops the draft unless it was saved, then puts the bulbs back how
+// they were.
+func (mc *ModeCalibrate) onExit(cont *controller) {
+	if !mc.done {
+		cont.calibration.Set(mc.device.Name(), mc.before)
+	}
+	for d, state := range mc.saved {
+		if err := cont.restoreAfterAlert(d, state); err != nil {
+			calibrateLog.Warn("failed to restore after calibrating", log.F("device", d.Name()), log.Err(err))
+		}
+	}
+	mc.saved = nil
+	if mc.done {
+		cont.view.Eventf(ui.TextColor, "Saved calibration for %s: %s", mc.device.Name(), mc.draft)
+	} else {
+		cont.view.Eventf(ui.TextColor, "Calibration of %s cancelled", mc.device.Name())
+	}
+	mc.device, mc.reference = nil, nil
+}
+
+func (mc *ModeCalibrate) isIndefinite() bool {
+	return true
+}
+
+func (mc *ModeCalibrate) getId() string {
+	return ModeCalibrateID
+}
+
+// saveCalibration writes a device's profile to the config, keeping only
+// what differs from its model.
+func (c *controller) saveCalibration(d *device, p calibrate.Profile) error {
+	if c.config.Calibration == nil {
+		c.config.Calibration = &config.Calibration{}
+	}
+	if c.config.Calibration.Devices == nil {
+		c.config.Calibration.Devices = map[string]config.Profile{}
+	}
+	for name := range c.config.Calibration.Devices {
+		if strings.EqualFold(name, d.Name()) {
+			delete(c.config.Calibration.Devices, name)
+		}
+	}
+	c.config.Calibration.Devices[d.Name()] = p.Config(c.calibration.Model(p.Model))
+	return c.saveConfig()
+}
+
+func runCalibrate(cont *controller, args parsedArgs) error {
+	switch args.str("action") {
+	case "", "show":
+		devices := cont.devices
+		if args.has("device") {
+			d, _ := cont.findDevice(args.str("device"))
+			devices = []*device{d}
+		}
+		for _, d := range devices {
+			cont.view.Eventf(ui.TextColor, "%s: %s", d.Name(), cont.calibration.For(d.Name()))
+		}
+	case "start":
+		if !args.has("device") {
+			return errors.New("usage: calibrate start <device> [reference]")
+		}
+		mc := cont.modes[ModeCalibrateID].(*ModeCalibrate)
+		d, _ := cont.findDevice(args.str("device"))
+		reference, ok := cont.findDevice(args.str("reference"))
+		if !ok {
+			// any other bulb will do
+			for _, other := range cont.devices {
+				if other != d {
+					reference, ok = other, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return errors.New("calibrating needs a second bulb to match against")
+		}
+		if reference == d {
+			return errors.New("pick a different bulb to match against")
+		}
+		mc.device, mc.reference = d, reference
+		return cont.SwitchMode(ModeCalibrateID)
+	case "reset":
+		if !args.has("device") {
+			return errors.New("usage: calibrate reset <device>")
+		}
+		d, _ := cont.findDevice(args.str("device"))
+		key, ok := "", false
+		if cont.config.Calibration != nil {
+			for name := range cont.config.Calibration.Devices {
+				if strings.EqualFold(name, d.Name()) {
+					key, ok = name, true
+				}
+			}
+		}
+		if !ok {
+			return errors.Errorf("%s isn't calibrated", d.Name())
+		}
+		delete(cont.config.Calibration.Devices, key)
+		cont.loadCalibration()
+		cont.view.Eventf(ui.TextColor, "%s: %s", d.Name(), cont.calibration.For(d.Name()))
+		return cont.saveConfig()
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kungfukennyg/home-office/cync-lights/ci"
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+const ModeCIID = "ci"
+
+var ciLog = log.For("mode.ci")
+
+const (
+	defaultCIPoll     = 30 * time.Second
+	defaultCIDebounce = 20 * time.Second
+	// ciFrame is fast enough for a smooth pulse, and slow when not pulsing
+	ciFrame       = 150 * time.Millisecond
+	ciIdleFrame   = time.Second
+	ciPulsePeriod = 2 * time.Second
+	ciPulseMin    = 15
+)
+
+// ModeCI shows build status on a group until stopped: green passing,
+// pulsing yellow running, red failing. Statuses come from a ci.Poller on its
+// own goroutine, debounced there, and posted to the controller loop.
+type ModeCI struct {
+	// hook takes webhook pushes from the api whether or not the mode's running
+	hook *ci.Webhook
+
+	poller  *ci.Poller
+	devices []*device
+	status  ci.State
+	since   time.Time
+	// shown is the status the lights were last set to
+	shown ci.State
+	saved map[*device]config.DeviceState
+}
+
+func (mc *ModeCI) onSwitch(cont *controller) error {
+	// switching to ci while it's running starts over from the saved lights
+	if mc.poller != nil {
+		mc.onExit(cont)
+	}
+	cfg := cont.config.CI
+	if cfg == nil {
+		return errors.New("ci isn't configured, add a ci section to the config")
+	}
+	poll, err := configDuration(cfg.Poll, defaultCIPoll)
+	if err != nil {
+		return errors.Wrap(err, "ci poll")
+	}
+	settle, err := configDuration(cfg.Debounce, defaultCIDebounce)
+	if err != nil {
+		return errors.Wrap(err, "ci debounce")
+	}
+	devices, err := cont.resolveTarget(cfg.Target)
+	if err != nil {
+		return errors.Wrap(err, "ci target")
+	}
+
+	var source ci.Source = mc.hook
+	if cfg.Source != "webhook" {
+		if source, err = ci.Open(cfg.Source, cfg.Field); err != nil {
+			return err
+		}
+	} else if cont.config.API == nil {
+		return errors.New("the ci webhook needs the api, add an api section to the config")
+	}
+
+	mc.devices = devices
+	mc.status, mc.shown = ci.Unknown, ci.Unknown
+	mc.since = time.Now()
+	mc.saved = map[*device]config.DeviceState{}
+	for _, d := range devices {
+		mc.saved[d] = cont.deviceState(d)
+	}
+
+	var poller *ci.Poller
+	poller = ci.NewPoller(source, poll, settle, func(s ci.State) {
+		cont.post(func() {
+			// a poller from an earlier run can still report once
+			if mc.poller != poller {
+				return
+			}
+			mc.status, mc.since = s, time.Now()
+			cont.view.Eventf(statusColor(s), "ci: %s", s)
+		})
+	})
+	mc.poller = poller
+	poller.Start()
+
+	cont.view.Eventf(ui.TextColor, "Starting CI Mode, watching %s", source.Name())
+	ciLog.Info("watching ci status", log.F("source", source.Name()), log.F("poll", poll), log.F("debounce", settle))
+	return nil
+}
+
+func (mc *ModeCI) run(cont *controller) (time.Duration, error) {
+	mc.lines(cont)
+
+	switch mc.status {
+	case ci.Unknown:
+		return ciIdleFrame, nil
+	case ci.Running:
+		mc.show(cont, colors.Yellow)
+		// a cosine from dim to full and back, starting at full
+		phase := float64(time.Since(mc.since)%ciPulsePeriod) / float64(ciPulsePeriod)
+		lum := ciPulseMin + colors.Brightness(float64(colors.Full-ciPulseMin)*(1+math.Cos(2*math.Pi*phase))/2)
+		for _, d := range mc.devices {
+			cont.SetLumAsync(d, lum)
+		}
+		return ciFrame, nil
+	case ci.Passing:
+		mc.show(cont, colors.Green)
+	case ci.Failing:
+		mc.show(cont, colors.Red)
+	}
+	return ciIdleFrame, nil
+}
+
+// show sets the color once per status change, not every frame.
+func (mc *ModeCI) show(cont *controller, rgb colors.RGB) {
+	if mc.shown == mc.status {
+		return
+	}
+	mc.shown = mc.status
+	for _, d := range mc.devices {
+		if !cont.lastPower[d.DeviceID()] {
+			cont.SetStatus(d, true)
+		}
+		cont.SetRGBAsync(d, rgb)
+		cont.SetLumAsync(d, colors.Full)
+	}
+}
+
+func (mc *ModeCI) lines(cont *controller) {
+	status := fmt.Sprintf("%s for %v", mc.status, time.Since(mc.since).Round(time.Second))
+	if mc.status == ci.Unknown {
+		status = "waiting for a status"
+	}
+	_, pending, read, err := mc.poller.Status()
+	detail := "not read yet"
+	switch {
+	case err != nil:
+		detail = "last read failed: " + err.Error()
+	case pending != ci.Unknown:
+		detail = fmt.Sprintf("%s, settling", pending)
+	case !read.IsZero():
+		detail = "checked " + read.Format("15:04:05")
+	}
+	cont.view.SetModeLines("[CI Mode]", fmt.Sprintf("%s | %s | %s", mc.poller.Source().Name(), status, detail))
+}
+
+func (mc *ModeCI) onExit(cont *controller) {
+	mc.poller.Stop()
+	mc.poller = nil
+	for d, state := range mc.saved {
+		if err := cont.applyState(d, state); err != nil {
+			ciLog.Warn("failed to restore after ci mode", log.F("device", d.Name()), log.Err(err))
+		}
+	}
+	cont.view.Eventf(ui.TextColor, "Exiting CI Mode...")
+}
+
+func (mc *ModeCI) isIndefinite() bool {
+	return true
+}
+
+func (mc *ModeCI) getId() string {
+	return ModeCIID
+}
+
+func statusColor(s ci.State) color.Attribute {
+	switch s {
+	case ci.Failing:
+		return ui.ErrColor
+	case ci.Running:
+		return ui.DimColor
+	}
+	return ui.TextColor
+}
+
+// configDuration parses an optional duration from the config.
+func configDuration(s string, fallback time.Duration) (time.Duration, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.Errorf("%q isn't a duration like 30s", s)
+	}
+	return d, nil
+}
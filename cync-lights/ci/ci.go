@@ -0,0 +1,223 @@
+// Package ci reads build status from a file, a command or a webhook. A
+// Poller reads a source on an interval and reports status changes once
+// they've settled, so a flapping build only changes the lights once it
+// makes up its mind.
+package ci
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/pkg/errors"
+)
+
+var ciLog = log.For("ci")
+
+type State int
+
+const (
+	Unknown State = iota
+	Passing
+	Running
+	Failing
+)
+
+func (s State) String() string {
+	switch s {
+	case Passing:
+		return "passing"
+	case Running:
+		return "running"
+	case Failing:
+		return "failing"
+	}
+	return "unknown"
+}
+
+// words covers what the usual CI systems call their states.
+var words = map[string]State{
+	"passing": Passing, "passed": Passing, "pass": Passing, "success": Passing,
+	"succeeded": Passing, "ok": Passing, "green": Passing,
+	"running": Running, "pending": Running, "queued": Running, "in_progress": Running,
+	"started": Running, "building": Running, "yellow": Running,
+	"failing": Failing, "failed": Failing, "fail": Failing, "failure": Failing,
+	"error": Failing, "errored": Failing, "broken": Failing, "red": Failing,
+}
+
+// Parse reads a status word, case doesn't matter.
+func Parse(word string) (State, bool) {
+	s, ok := words[strings.ToLower(strings.TrimSpace(word))]
+	return s, ok
+}
+
+// Source is somewhere to read status from. Read is called from the poller's
+// goroutine only.
+type Source interface {
+	Name() string
+	Read(ctx context.Context) (State, error)
+}
+
+// Open makes a source from its config: file:<path>, command:<command> or
+// webhook. field is the JSON path for files.
+func Open(spec, field string) (Source, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "file":
+		if arg == "" {
+			return nil, errors.New("file ci source needs a path, file:<path>")
+		}
+		if field == "" {
+			field = "status"
+		}
+		return &fileSource{path: arg, field: field}, nil
+	case "command":
+		if arg == "" {
+			return nil, errors.New("command ci source needs a command, command:<command>")
+		}
+		return &commandSource{command: arg}, nil
+	case "webhook":
+		return &Webhook{}, nil
+	}
+	return nil, errors.Errorf("unknown ci source %q, use file:<path>, command:<command> or webhook", spec)
+}
+
+// Debouncer holds back status changes until they've lasted long enough.
+// The first status is taken straight away.
+type Debouncer struct {
+	Settle time.Duration
+
+	current State
+	pending State
+	since   time.Time
+}
+
+// Update takes a reading and returns the settled status, changed is true
+// when it moved.
+func (d *Debouncer) Update(s State, now time.Time) (settled State, changed bool) {
+	if s == d.current {
+		d.pending = d.current
+		return d.current, false
+	}
+	if d.current == Unknown || d.Settle <= 0 {
+		d.current, d.pending = s, s
+		return s, true
+	}
+	if s != d.pending {
+		d.pending = s
+		d.since = now
+	}
+	if now.Sub(d.since) < d.Settle {
+		return d.current, false
+	}
+	d.current = s
+	return s, true
+}
+
+// Pending is the status waiting to settle, and since when, ok is false when
+// nothing is.
+func (d *Debouncer) Pending() (State, time.Time, bool) {
+	return d.pending, d.since, d.pending != d.current
+}
+
+// Poller reads a source every poll and calls changed with settled statuses.
+type Poller struct {
+	source  Source
+	poll    time.Duration
+	changed func(State)
+	ctx     context.Context
+	stop    context.CancelFunc
+
+	mu       sync.Mutex
+	debounce Debouncer
+	read     time.Time
+	err      error
+}
+
+func NewPoller(source Source, poll, settle time.Duration, changed func(State)) *Poller {
+	ctx, stop := context.WithCancel(context.Background())
+	return &Poller{
+		source:   source,
+		poll:     poll,
+		changed:  changed,
+		ctx:      ctx,
+		stop:     stop,
+		debounce: Debouncer{Settle: settle},
+	}
+}
+
+func (p *Poller) Start() {
+	go p.loop()
+}
+
+func (p *Poller) Stop() {
+	p.stop()
+}
+
+func (p *Poller) Source() Source {
+	return p.source
+}
+
+// Status is the settled status, what's waiting to settle, when the source
+// was last read and the last read's error.
+func (p *Poller) Status() (settled, pending State, read time.Time, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, _, ok := p.debounce.Pending()
+	if !ok {
+		pending = Unknown
+	}
+	return p.debounce.current, pending, p.read, p.err
+}
+
+func (p *Poller) loop() {
+	// webhooks push, so check often to let a pushed status settle on time
+	every := p.poll
+	if _, ok := p.source.(*Webhook); ok && every > time.Second {
+		every = time.Second
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		p.check()
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Poller) check() {
+	ctx, cancel := context.WithTimeout(p.ctx, p.poll)
+	state, err := p.source.Read(ctx)
+	cancel()
+	if p.ctx.Err() != nil {
+		return
+	}
+
+	p.mu.Lock()
+	if err != nil && p.err == nil {
+		ciLog.Warn("failed to read ci status", log.F("source", p.source.Name()), log.Err(err))
+	}
+	p.err = err
+	if err != nil {
+		p.mu.Unlock()
+		return
+	}
+	p.read = time.Now()
+	if state == Unknown {
+		p.mu.Unlock()
+		return
+	}
+	settled, changed := p.debounce.Update(state, p.read)
+	p.mu.Unlock()
+
+	if changed {
+		ciLog.Info("ci status changed", log.F("status", settled.String()))
+		p.changed(settled)
+	}
+}
@@ -0,0 +1,125 @@
+package ci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// fileSource reads a JSON file, like one a CI job writes or a cron job
+// fetches from the CI's API, or a plain text file holding just the status.
+type fileSource struct {
+	path  string
+	field string
+}
+
+func (f *fileSource) Name() string {
+	return "file:" + f.path
+}
+
+func (f *fileSource) Read(ctx context.Context) (State, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return Unknown, errors.Wrap(err, "failed to read status file")
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return Unknown, nil
+	}
+	if data[0] != '{' {
+		return word(string(data))
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return Unknown, errors.Wrap(err, "bad json in status file")
+	}
+	value, err := lookup(doc, f.field)
+	if err != nil {
+		return Unknown, err
+	}
+	return word(fmt.Sprint(value))
+}
+
+// lookup follows a dotted path like "build.status" through decoded JSON.
+func lookup(doc interface{}, path string) (interface{}, error) {
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("%s isn't in the status file", path)
+		}
+		if doc, ok = obj[key]; !ok {
+			return nil, errors.Errorf("%s isn't in the status file", path)
+		}
+	}
+	return doc, nil
+}
+
+func word(s string) (State, error) {
+	state, ok := Parse(s)
+	if !ok {
+		return Unknown, errors.Errorf("unknown status %q", s)
+	}
+	return state, nil
+}
+
+// commandSource runs a command through the shell. If it prints a status word
+// that's the status, otherwise exit 0 is passing and anything else failing.
+type commandSource struct {
+	command string
+}
+
+func (c *commandSource) Name() string {
+	return "command:" + c.command
+}
+
+func (c *commandSource) Read(ctx context.Context) (State, error) {
+	out, err := exec.CommandContext(ctx, "sh", "-c", c.command).Output()
+	if ctx.Err() != nil {
+		return Unknown, errors.Wrap(ctx.Err(), "status command took too long")
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) > 0 {
+		if state, ok := Parse(fields[len(fields)-1]); ok {
+			return state, nil
+		}
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return Failing, nil
+	case err != nil:
+		return Unknown, errors.Wrap(err, "failed to run status command")
+	}
+	return Passing, nil
+}
+
+// Webhook is pushed to by the api, Read returns the last status pushed.
+type Webhook struct {
+	mu    sync.Mutex
+	state State
+}
+
+func (w *Webhook) Name() string {
+	return "webhook"
+}
+
+func (w *Webhook) Read(ctx context.Context) (State, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state, nil
+}
+
+func (w *Webhook) Push(s State) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state = s
+}
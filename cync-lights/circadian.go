@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/circadian"
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+const ModeCircadianID = "circadian"
+
+var circadianLog = log.For("mode.circadian")
+
+const (
+	defaultCircadianInterval = 30 * time.Second
+	defaultCircadianOverride = time.Hour
+)
+
+// circadianSent is what the mode last set a device to, to notice when
+// something else changes it.
+type circadianSent struct {
+	setting circadian.Setting
+	rgb     [3]uint8
+}
+
+// ModeCircadian follows the circadian curve until stopped. A light changed
+// by anything else, a rule, presence or a scene, is left alone for a while.
+type ModeCircadian struct {
+	curve    *circadian.Curve
+	devices  []*device
+	white    map[string]bool
+	interval time.Duration
+	override time.Duration
+
+	setting circadian.Setting
+	sent    map[string]circadianSent
+	// paused is when each overridden device is picked up again
+	paused map[string]time.Time
+}
+
+func (mc *ModeCircadian) onSwitch(cont *controller) error {
+	cfg := cont.config.Circadian
+	if cfg == nil {
+		return errors.New("circadian isn't configured, add a circadian section with your latitude and longitude to the config")
+	}
+	curve, err := circadian.Compile(*cfg)
+	if err != nil {
+		return errors.Wrap(err, "circadian")
+	}
+	if mc.interval, err = configDuration(cfg.Interval, defaultCircadianInterval); err != nil {
+		return errors.Wrap(err, "circadian interval")
+	}
+	if mc.override, err = configDuration(cfg.Override, defaultCircadianOverride); err != nil {
+		return errors.Wrap(err, "circadian override")
+	}
+	devices, err := cont.resolveTarget(cfg.Target)
+	if err != nil {
+		return errors.Wrap(err, "circadian target")
+	}
+	mc.white = map[string]bool{}
+	for _, target := range cfg.White {
+		white, err := cont.resolveTarget(target)
+		if err != nil {
+			return errors.Wrap(err, "circadian white")
+		}
+		for _, d := range white {
+			mc.white[d.DeviceID()] = true
+		}
+	}
+
+	mc.curve = curve
+	mc.devices = devices
+	mc.sent = map[string]circadianSent{}
+	mc.paused = map[string]time.Time{}
+	for _, d := range devices {
+		if !cont.lastPower[d.DeviceID()] {
+			cont.SetStatus(d, true)
+		}
+	}
+	cont.view.Eventf(ui.TextColor, "Starting Circadian Mode...")
+	return nil
+}
+
+func (mc *ModeCircadian) run(cont *controller) (time.Duration, error) {
+	now := time.Now()
+	mc.setting = mc.curve.At(now)
+	for _, d := range mc.devices {
+		id := d.DeviceID()
+		if until, ok := mc.paused[id]; ok {
+			if now.Before(until) {
+				continue
+			}
+			delete(mc.paused, id)
+			delete(mc.sent, id)
+			cont.view.Eventf(ui.DimColor, "circadian: picking %s back up", d.Name())
+		}
+		if mc.overridden(cont, d) {
+			mc.paused[id] = now.Add(mc.override)
+			cont.view.Eventf(ui.DimColor, "circadian: %s was changed, leaving it for %v", d.Name(), mc.override)
+			circadianLog.Info("device overridden", log.F("device", d.Name()), log.F("until", mc.paused[id]))
+			continue
+		}
+		mc.apply(cont, d)
+	}
+	mc.lines(cont, now)
+	return mc.interval, nil
+}
+
+// overridden is true if the device isn't how the mode last left it.
+func (mc *ModeCircadian) overridden(cont *controller, d *device) bool {
+	sent, ok := mc.sent[d.DeviceID()]
+	if !ok {
+		return false
+	}
+	id := d.DeviceID()
+	return !cont.lastPower[id] || cont.lastLum[id] != sent.setting.Lum || cont.lastColor[id].GetRGB() != sent.rgb
+}
+
+func (mc *ModeCircadian) apply(cont *controller, d *device) {
+	id := d.DeviceID()
+	sent, ok := mc.sent[id]
+	if ok && sent.setting == mc.setting {
+		return
+	}
+	if !ok || sent.setting.Kelvin != mc.setting.Kelvin {
+		if mc.white[id] {
+			cont.SetCTAsync(d, mc.setting.Kelvin)
+		} else {
+			cont.SetRGBAsync(d, colors.Kelvin(mc.setting.Kelvin))
+		}
+	}
+	if !ok || sent.setting.Lum != mc.setting.Lum {
+		cont.SetLumAsync(d, mc.setting.Lum)
+	}
+	mc.sent[id] = circadianSent{setting: mc.setting, rgb: cont.lastColor[id].GetRGB()}
+}
+
+func (mc *ModeCircadian) lines(cont *controller, now time.Time) {
+	a := mc.curve.Anchors(now)
+	paused := ""
+	if len(mc.paused) > 0 {
+		var names []string
+		for _, d := range mc.devices {
+			if until, ok := mc.paused[d.DeviceID()]; ok {
+				names = append(names, fmt.Sprintf("%s until %s", d.Name(), until.Format("15:04")))
+			}
+		}
+		paused = " | left alone: " + strings.Join(names, ", ")
+	}
+	cont.view.SetModeLines("[Circadian Mode]",
+		fmt.Sprintf("%s | sunrise %s, sunset %s, bedtime %s%s", mc.setting,
+			a.Sunrise.Format("15:04"), a.Sunset.Format("15:04"), a.Bedtime.Format("15:04"), paused))
+}
+
+func (mc *ModeCircadian) onExit(cont *controller) {
+	cont.view.Eventf(ui.TextColor, "Exiting Circadian Mode...")
+}
+
+func (mc *ModeCircadian) isIndefinite() bool {
+	return true
+}
+
+func (mc *ModeCircadian) getId() string {
+	return ModeCircadianID
+}
+
+// runCircadian starts the mode, or with preview prints today's curve.
+func runCircadian(cont *controller, args parsedArgs) error {
+	if args.str("action") != "preview" {
+		return cont.SwitchMode(ModeCircadianID)
+	}
+	cfg := cont.config.Circadian
+	if cfg == nil {
+		return errors.New("circadian isn't configured, add a circadian section with your latitude and longitude to the config")
+	}
+	curve, err := circadian.Compile(*cfg)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	a := curve.Anchors(now)
+	cont.view.Eventf(ui.HeaderColor, "sunrise %s, noon %s, sunset %s, bedtime %s",
+		a.Sunrise.Format("15:04"), a.Noon.Format("15:04"), a.Sunset.Format("15:04"), a.Bedtime.Format("15:04"))
+	for _, stop := range curve.Stops(now) {
+		cont.view.Eventf(ui.TextColor, "  %s  %-12s %s", stop.At.Format("15:04"), stop.Point, stop.Setting)
+	}
+	cont.view.Eventf(ui.TextColor, "now %s", curve.At(now))
+	return nil
+}
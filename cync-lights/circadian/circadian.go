@@ -0,0 +1,215 @@
+// Package circadian turns a curve of color temperatures and brightnesses,
+// anchored to the sun and bedtime, into what the lights should be at any
+// moment.
+package circadian
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/sun"
+	"github.com/pkg/errors"
+)
+
+// DefaultBedtime is when the night light starts unless the config says.
+const DefaultBedtime = "22:30"
+
+// DefaultCurve is warm and dim around sunrise, cool and bright at midday,
+// warming through the evening and a night light after bedtime.
+var DefaultCurve = []config.CurvePoint{
+	{At: "sunrise-30m", Kelvin: 2000, Lum: 5},
+	{At: "sunrise+30m", Kelvin: 2700, Lum: 50},
+	{At: "sunrise+2h", Kelvin: 5000, Lum: 90},
+	{At: "noon", Kelvin: 6000, Lum: 100},
+	{At: "sunset-1h", Kelvin: 4000, Lum: 80},
+	{At: "sunset+30m", Kelvin: 2700, Lum: 60},
+	{At: "bedtime-1h", Kelvin: 2200, Lum: 30},
+	{At: "bedtime", Kelvin: 2000, Lum: 5},
+}
+
+// Anchors are the times of day curve points can be relative to.
+type Anchors struct {
+	Sunrise time.Time
+	Noon    time.Time
+	Sunset  time.Time
+	Bedtime time.Time
+}
+
+// Setting is what the lights should be.
+type Setting struct {
+	Kelvin int
+	Lum    colors.Brightness
+}
+
+func (s Setting) String() string {
+	return fmt.Sprintf("%dK at %s", s.Kelvin, s.Lum)
+}
+
+type point struct {
+	at     string
+	anchor string
+	// offset is from the anchor, or from midnight for a clock time
+	offset  time.Duration
+	setting Setting
+}
+
+// Curve is a compiled list of points.
+type Curve struct {
+	points  []point
+	lat     float64
+	lon     float64
+	bedtime time.Duration
+}
+
+// Compile checks a circadian config and its curve, the default curve if it
+// doesn't have one.
+func Compile(cfg config.Circadian) (*Curve, error) {
+	if cfg.Latitude < -90 || cfg.Latitude > 90 || cfg.Longitude < -180 || cfg.Longitude > 180 {
+		return nil, errors.Errorf("latitude %v, longitude %v isn't on earth", cfg.Latitude, cfg.Longitude)
+	}
+	bedtime := cfg.Bedtime
+	if bedtime == "" {
+		bedtime = DefaultBedtime
+	}
+	bed, err := parseClock(bedtime)
+	if err != nil {
+		return nil, errors.Wrap(err, "bedtime")
+	}
+
+	points := cfg.Curve
+	if len(points) == 0 {
+		points = DefaultCurve
+	}
+	c := &Curve{lat: cfg.Latitude, lon: cfg.Longitude, bedtime: bed}
+	for i, p := range points {
+		compiled, err := compilePoint(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "curve point %d", i+1)
+		}
+		c.points = append(c.points, compiled)
+	}
+	return c, nil
+}
+
+func compilePoint(p config.CurvePoint) (point, error) {
+	if p.Kelvin < 1000 || p.Kelvin > 10000 {
+		return point{}, errors.Errorf("kelvin %d should be between 1000 and 10000", p.Kelvin)
+	}
+	lum, err := colors.NewBrightness(p.Lum)
+	if err != nil {
+		return point{}, err
+	}
+	out := point{at: p.At, setting: Setting{Kelvin: p.Kelvin, Lum: lum}}
+
+	for _, anchor := range []string{"sunrise", "noon", "sunset", "bedtime"} {
+		if !strings.HasPrefix(p.At, anchor) {
+			continue
+		}
+		out.anchor = anchor
+		rest := strings.TrimPrefix(p.At, anchor)
+		if rest == "" {
+			return out, nil
+		}
+		offset, err := time.ParseDuration(strings.TrimPrefix(rest, "+"))
+		if err != nil || (rest[0] != '+' && rest[0] != '-') {
+			return point{}, errors.Errorf("%q should look like %s+1h or %s-30m", p.At, anchor, anchor)
+		}
+		out.offset = offset
+		return out, nil
+	}
+
+	offset, err := parseClock(p.At)
+	if err != nil {
+		return point{}, errors.Errorf("%q isn't a time like 07:30 or sunrise, noon, sunset or bedtime", p.At)
+	}
+	out.offset = offset
+	return out, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("%q isn't a time like 22:30", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Anchors works out the sun and bedtime on the day of t, in t's location.
+// Where the sun doesn't rise or set it falls back to 06:00 and 18:00.
+func (c *Curve) Anchors(t time.Time) Anchors {
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	day := sun.On(t, c.lat, c.lon)
+	a := Anchors{Sunrise: day.Sunrise, Noon: day.Noon, Sunset: day.Sunset, Bedtime: midnight.Add(c.bedtime)}
+	if day.Polar {
+		a.Sunrise = midnight.Add(6 * time.Hour)
+		a.Sunset = midnight.Add(18 * time.Hour)
+	}
+	return a
+}
+
+// Stop is a curve point placed on a particular day.
+type Stop struct {
+	At      time.Time
+	Point   string
+	Setting Setting
+}
+
+// Stops places the points on the day of t. Points are in order through the
+// day, one that would land before the point ahead of it is moved up to it,
+// so a summer sunset after bedtime squeezes the evening rather than
+// reordering it.
+func (c *Curve) Stops(t time.Time) []Stop {
+	a := c.Anchors(t)
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+
+	stops := make([]Stop, 0, len(c.points))
+	for _, p := range c.points {
+		var at time.Time
+		switch p.anchor {
+		case "sunrise":
+			at = a.Sunrise.Add(p.offset)
+		case "noon":
+			at = a.Noon.Add(p.offset)
+		case "sunset":
+			at = a.Sunset.Add(p.offset)
+		case "bedtime":
+			at = a.Bedtime.Add(p.offset)
+		default:
+			at = midnight.Add(p.offset)
+		}
+		if n := len(stops); n > 0 && at.Before(stops[n-1].At) {
+			at = stops[n-1].At
+		}
+		stops = append(stops, Stop{At: at, Point: p.at, Setting: p.setting})
+	}
+	return stops
+}
+
+// At is what the lights should be at t: a blend of the points either side,
+// or the last point between the end of the curve and the start of the next
+// day's.
+func (c *Curve) At(t time.Time) Setting {
+	stops := c.Stops(t)
+	if len(stops) == 0 {
+		return Setting{Kelvin: 4000, Lum: colors.Full}
+	}
+	if t.Before(stops[0].At) || !t.Before(stops[len(stops)-1].At) {
+		return stops[len(stops)-1].Setting
+	}
+	for i := 1; i < len(stops); i++ {
+		if t.Before(stops[i].At) {
+			from, to := stops[i-1], stops[i]
+			p := float64(t.Sub(from.At)) / float64(to.At.Sub(from.At))
+			return Setting{
+				Kelvin: from.Setting.Kelvin + int(float64(to.Setting.Kelvin-from.Setting.Kelvin)*p+0.5),
+				Lum:    from.Setting.Lum + colors.Brightness(float64(to.Setting.Lum-from.Setting.Lum)*p+0.5),
+			}
+		}
+	}
+	return stops[len(stops)-1].Setting
+}
@@ -0,0 +1,66 @@
+package colors
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Brightness is how bright a bulb is, in percent. It's kept apart from RGB so
+// a color only says what hue to show and the same palette works at any
+// brightness.
+type Brightness int
+
+const (
+	Off  Brightness = 0
+	Full Brightness = 100
+)
+
+// NewBrightness checks n is a percentage.
+func NewBrightness(n int) (Brightness, error) {
+	if n < int(Off) || n > int(Full) {
+		return Off, errors.Errorf("brightness %d should be 0-100", n)
+	}
+	return Brightness(n), nil
+}
+
+// ParseBrightness accepts a percentage with or without the %, like 30, 30%
+// or 12.5%, rounded to a whole percent.
+func ParseBrightness(s string) (Brightness, error) {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || math.IsNaN(f) || f < float64(Off) || f > float64(Full) {
+		return Off, errors.Errorf("brightness %q should be 0-100%%", s)
+	}
+	return Brightness(math.Round(f)), nil
+}
+
+// Clamp brings b into 0-100.
+func (b Brightness) Clamp() Brightness {
+	switch {
+	case b < Off:
+		return Off
+	case b > Full:
+		return Full
+	}
+	return b
+}
+
+// Scale is b at some fraction of full, 50% scaled by 50% is 25%. A bulb that
+// was lit stays lit however far it's scaled down, unless by is off.
+func (b Brightness) Scale(by Brightness) Brightness {
+	if by >= Full {
+		return b
+	}
+	scaled := Brightness(math.Round(float64(b) * float64(by) / float64(Full)))
+	if scaled == Off && b > Off && by > Off {
+		return 1
+	}
+	return scaled
+}
+
+func (b Brightness) String() string {
+	return fmt.Sprintf("%d%%", int(b))
+}
@@ -1,35 +1,97 @@
 package colors
 
-import "image/color"
+import (
+	"fmt"
+	"image/color"
+	"strings"
 
-const MaxLum uint8 = 100
+	"github.com/pkg/errors"
+)
+
+// opaque is the alpha every color has. Brightness isn't part of a color, see
+// Brightness.
+const opaque = 0xff
 
+// RGB is a named color. Only the R, G and B of RGBA mean anything, brightness
+// is set separately.
 type RGB struct {
 	Name string
 	RGBA color.RGBA
 }
 
+// New makes a color from its channels.
+func New(name string, r, g, b uint8) RGB {
+	return RGB{Name: name, RGBA: color.RGBA{r, g, b, opaque}}
+}
+
 var BaseColors = []RGB{Red, Orange, Yellow, YellowGreen, Green, TealGreen, Teal, LightBlue, Blue, Purple, Pink, RedPink}
 
 var (
-	Red         = RGB{Name: "red", RGBA: color.RGBA{255, 0, 0, MaxLum}}
-	Orange      = RGB{Name: "orange", RGBA: color.RGBA{255, 128, 0, MaxLum}}       // orange
-	Yellow      = RGB{Name: "yellow", RGBA: color.RGBA{255, 255, 0, MaxLum}}       // yellow
-	YellowGreen = RGB{Name: "yellow-green", RGBA: color.RGBA{128, 255, 0, MaxLum}} // yellow-green
-	Green       = RGB{Name: "green", RGBA: color.RGBA{0, 255, 0, MaxLum}}          // green
-	TealGreen   = RGB{Name: "teal-green", RGBA: color.RGBA{0, 255, 128, MaxLum}}   // teal-green
-	Teal        = RGB{Name: "teal", RGBA: color.RGBA{0, 255, 255, MaxLum}}         // teal
-	LightBlue   = RGB{Name: "light-blue", RGBA: color.RGBA{0, 128, 255, MaxLum}}   // light-blue
-	Blue        = RGB{Name: "blue", RGBA: color.RGBA{0, 0, 255, MaxLum}}           // blue
-	Purple      = RGB{Name: "purple", RGBA: color.RGBA{127, 0, 255, MaxLum}}       // purple
-	Pink        = RGB{Name: "pink", RGBA: color.RGBA{255, 0, 255, MaxLum}}         // pink
-	RedPink     = RGB{Name: "red-pink", RGBA: color.RGBA{255, 0, 127, MaxLum}}     // red-pink
+	Red         = RGB{Name: "red", RGBA: color.RGBA{255, 0, 0, opaque}}
+	Orange      = RGB{Name: "orange", RGBA: color.RGBA{255, 128, 0, opaque}}       // orange
+	Yellow      = RGB{Name: "yellow", RGBA: color.RGBA{255, 255, 0, opaque}}       // yellow
+	YellowGreen = RGB{Name: "yellow-green", RGBA: color.RGBA{128, 255, 0, opaque}} // yellow-green
+	Green       = RGB{Name: "green", RGBA: color.RGBA{0, 255, 0, opaque}}          // green
+	TealGreen   = RGB{Name: "teal-green", RGBA: color.RGBA{0, 255, 128, opaque}}   // teal-green
+	Teal        = RGB{Name: "teal", RGBA: color.RGBA{0, 255, 255, opaque}}         // teal
+	LightBlue   = RGB{Name: "light-blue", RGBA: color.RGBA{0, 128, 255, opaque}}   // light-blue
+	Blue        = RGB{Name: "blue", RGBA: color.RGBA{0, 0, 255, opaque}}           // blue
+	Purple      = RGB{Name: "purple", RGBA: color.RGBA{127, 0, 255, opaque}}       // purple
+	Pink        = RGB{Name: "pink", RGBA: color.RGBA{255, 0, 255, opaque}}         // pink
+	RedPink     = RGB{Name: "red-pink", RGBA: color.RGBA{255, 0, 127, opaque}}     // red-pink
 )
 
 func (r RGB) GetRGB() [3]uint8 {
 	return [3]uint8{r.RGBA.R, r.RGBA.G, r.RGBA.B}
 }
 
-func (r RGB) GetLum() int {
-	return int(r.RGBA.A)
+// Palette is a named set of colors a mode can cycle through.
+type Palette struct {
+	Name   string
+	Colors []RGB
+}
+
+var Palettes = []Palette{
+	{Name: "base", Colors: BaseColors},
+	{Name: "warm", Colors: []RGB{Red, RedPink, Orange, Yellow, Pink}},
+	{Name: "cool", Colors: []RGB{Green, TealGreen, Teal, LightBlue, Blue, Purple}},
+	{Name: "primary", Colors: []RGB{Red, Green, Blue}},
+}
+
+// PaletteByName finds a palette, ok is false if there isn't one by that name.
+func PaletteByName(name string) (Palette, bool) {
+	for _, p := range Palettes {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Palette{}, false
+}
+
+// ByName finds one of the base colors.
+func ByName(name string) (RGB, bool) {
+	for _, c := range BaseColors {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return RGB{}, false
+}
+
+// Parse accepts a base color name, #rrggbb or r,g,b.
+func Parse(s string) (RGB, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := ByName(s); ok {
+		return c, nil
+	}
+
+	var r, g, b uint8
+	if strings.HasPrefix(s, "#") && len(s) == 7 {
+		if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &r, &g, &b); err != nil {
+			return RGB{}, errors.Errorf("invalid hex color %q", s)
+		}
+	} else if _, err := fmt.Sscanf(s, "%d,%d,%d", &r, &g, &b); err != nil {
+		return RGB{}, errors.Errorf("unknown color %q, use a name, #rrggbb or r,g,b", s)
+	}
+	return RGB{Name: s, RGBA: color.RGBA{r, g, b, opaque}}, nil
 }
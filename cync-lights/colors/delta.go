@@ -0,0 +1,84 @@
+package colors
+
+import "math"
+
+// JustNoticeable is about the smallest CIEDE2000 difference people can see
+// side by side. Colors on different lamps need a good deal more than that to
+// read as different, Distinct is a reasonable floor for that.
+const (
+	JustNoticeable = 2.3
+	Distinct       = 20.0
+)
+
+// Distance is how different two colors look, the CIEDE2000 difference of
+// their CIELAB values. Brightness isn't part of it.
+func Distance(a, b RGB) float64 {
+	return DeltaE2000(a.Lab(), b.Lab())
+}
+
+// DeltaE2000 is the CIEDE2000 color difference, following Sharma, Wu and
+// Dalal's notes on implementing it, with the usual weights of 1.
+func DeltaE2000(x, y Lab) float64 {
+	c1 := math.Hypot(x.A, x.B)
+	c2 := math.Hypot(y.A, y.B)
+	cBar7 := math.Pow((c1+c2)/2, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+math.Pow(25, 7))))
+
+	a1, a2 := (1+g)*x.A, (1+g)*y.A
+	c1, c2 = math.Hypot(a1, x.B), math.Hypot(a2, y.B)
+	h1, h2 := hueAngle(x.B, a1), hueAngle(y.B, a2)
+
+	dL := y.L - x.L
+	dC := c2 - c1
+	var dh float64
+	if c1*c2 != 0 {
+		dh = h2 - h1
+		switch {
+		case dh > 180:
+			dh -= 360
+		case dh < -180:
+			dh += 360
+		}
+	}
+	dH := 2 * math.Sqrt(c1*c2) * math.Sin(radians(dh/2))
+
+	lBar := (x.L + y.L) / 2
+	cBar := (c1 + c2) / 2
+	hBar := h1 + h2
+	if c1*c2 != 0 {
+		switch {
+		case math.Abs(h1-h2) <= 180:
+			hBar /= 2
+		case hBar < 360:
+			hBar = (hBar + 360) / 2
+		default:
+			hBar = (hBar - 360) / 2
+		}
+	}
+
+	t := 1 - 0.17*math.Cos(radians(hBar-30)) + 0.24*math.Cos(radians(2*hBar)) +
+		0.32*math.Cos(radians(3*hBar+6)) - 0.20*math.Cos(radians(4*hBar-63))
+	dTheta := 30 * math.Exp(-math.Pow((hBar-275)/25, 2))
+	cBar7 = math.Pow(cBar, 7)
+	rC := 2 * math.Sqrt(cBar7/(cBar7+math.Pow(25, 7)))
+	l50 := (lBar - 50) * (lBar - 50)
+	sL := 1 + 0.015*l50/math.Sqrt(20+l50)
+	sC := 1 + 0.045*cBar
+	sH := 1 + 0.015*cBar*t
+	rT := -math.Sin(radians(2*dTheta)) * rC
+
+	l, c, h := dL/sL, dC/sC, dH/sH
+	return math.Sqrt(l*l + c*c + h*h + rT*c*h)
+}
+
+// hueAngle is atan2 in degrees, 0-360, and 0 for a grey.
+func hueAngle(b, a float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	return wrapHue(math.Atan2(b, a) * 180 / math.Pi)
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
@@ -0,0 +1,66 @@
+package colors
+
+import "math"
+
+// Interpolate blends from a to b, t of the way, in OKLab so the colors in
+// between stay as bright and saturated as the ends.
+func Interpolate(a, b RGB, t float64) RGB {
+	t = math.Max(0, math.Min(1, t))
+	x, y := a.OKLab(), b.OKLab()
+	return OKLab{
+		L: x.L + (y.L-x.L)*t,
+		A: x.A + (y.A-x.A)*t,
+		B: x.B + (y.B-x.B)*t,
+	}.RGB()
+}
+
+// Gradient spreads n colors evenly along the palette, its colors in order,
+// blending between them.
+func (p Palette) Gradient(n int) []RGB {
+	switch {
+	case n <= 0 || len(p.Colors) == 0:
+		return nil
+	case len(p.Colors) == 1 || n == 1:
+		out := make([]RGB, n)
+		for i := range out {
+			out[i] = p.Colors[0]
+		}
+		return out
+	}
+	out := make([]RGB, n)
+	last := float64(len(p.Colors) - 1)
+	for i := range out {
+		pos := float64(i) / float64(n-1) * last
+		from := int(pos)
+		if from >= len(p.Colors)-1 {
+			out[i] = p.Colors[len(p.Colors)-1]
+			continue
+		}
+		out[i] = Interpolate(p.Colors[from], p.Colors[from+1], pos-float64(from))
+	}
+	return out
+}
+
+// rotate turns a color round the hue wheel, keeping its saturation and
+// lightness.
+func rotate(c RGB, degrees float64) RGB {
+	hsl := c.HSL()
+	hsl.H = wrapHue(hsl.H + degrees)
+	return hsl.RGB()
+}
+
+// Complementary is the color and the one opposite it on the wheel.
+func Complementary(c RGB) Palette {
+	return Palette{Name: "complementary", Colors: []RGB{c, rotate(c, 180)}}
+}
+
+// Analogous is the color with its neighbours spread degrees either side,
+// 30 is typical.
+func Analogous(c RGB, spread float64) Palette {
+	return Palette{Name: "analogous", Colors: []RGB{rotate(c, -spread), c, rotate(c, spread)}}
+}
+
+// Triadic is the color and the two a third of the way round the wheel.
+func Triadic(c RGB) Palette {
+	return Palette{Name: "triadic", Colors: []RGB{c, rotate(c, 120), rotate(c, 240)}}
+}
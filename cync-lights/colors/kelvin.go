@@ -0,0 +1,63 @@
+package colors
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// The range Cync tunable white bulbs cover, tone 0 is MinKelvin and 100 is
+// MaxKelvin.
+const (
+	MinKelvin = 2000
+	MaxKelvin = 7000
+)
+
+// Kelvin approximates the color of a white at a color temperature, for RGB
+// bulbs that can't do tunable white. It's Tanner Helland's fit of the
+// blackbody curve, good enough from 1000K to 40000K.
+func Kelvin(k int) RGB {
+	t := float64(k) / 100
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+	switch {
+	case t >= 66:
+		b = 255
+	case t <= 19:
+		b = 0
+	default:
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+	return RGB{
+		Name: fmt.Sprintf("%dK", k),
+		RGBA: color.RGBA{clamp(r), clamp(g), clamp(b), opaque},
+	}
+}
+
+// Tone converts a color temperature to the 0-100 color tone tunable white
+// bulbs take, clamping to what they can do.
+func Tone(k int) int {
+	switch {
+	case k <= MinKelvin:
+		return 0
+	case k >= MaxKelvin:
+		return 100
+	}
+	return int(math.Round(float64(k-MinKelvin) * 100 / (MaxKelvin - MinKelvin)))
+}
+
+func clamp(v float64) uint8 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 255:
+		return 255
+	}
+	return uint8(math.Round(v))
+}
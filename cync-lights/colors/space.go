@@ -0,0 +1,216 @@
+package colors
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// HSV is hue in degrees, 0-360, with saturation and value 0-1.
+type HSV struct {
+	H, S, V float64
+}
+
+// HSL is hue in degrees, 0-360, with saturation and lightness 0-1.
+type HSL struct {
+	H, S, L float64
+}
+
+// Lab is CIELAB with a D65 white, L from 0 to 100.
+type Lab struct {
+	L, A, B float64
+}
+
+// OKLab is Björn Ottosson's perceptual space, L from 0 to 1. Blends in it
+// don't go muddy or change hue the way RGB ones do.
+type OKLab struct {
+	L, A, B float64
+}
+
+// Hex is the color as #rrggbb, which Parse reads back.
+func (r RGB) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", r.RGBA.R, r.RGBA.G, r.RGBA.B)
+}
+
+// fromFloat builds a color from 0-1 channels, named by its hex.
+func fromFloat(r, g, b float64) RGB {
+	out := RGB{RGBA: color.RGBA{clamp(r * 255), clamp(g * 255), clamp(b * 255), opaque}}
+	out.Name = out.Hex()
+	return out
+}
+
+func (r RGB) float() (float64, float64, float64) {
+	return float64(r.RGBA.R) / 255, float64(r.RGBA.G) / 255, float64(r.RGBA.B) / 255
+}
+
+func (r RGB) HSV() HSV {
+	red, green, blue := r.float()
+	max := math.Max(red, math.Max(green, blue))
+	min := math.Min(red, math.Min(green, blue))
+	out := HSV{H: hue(red, green, blue, max, min), V: max}
+	if max > 0 {
+		out.S = (max - min) / max
+	}
+	return out
+}
+
+func (h HSV) RGB() RGB {
+	c := h.V * h.S
+	return fromHue(h.H, c, h.V-c)
+}
+
+func (r RGB) HSL() HSL {
+	red, green, blue := r.float()
+	max := math.Max(red, math.Max(green, blue))
+	min := math.Min(red, math.Min(green, blue))
+	out := HSL{H: hue(red, green, blue, max, min), L: (max + min) / 2}
+	if max != min {
+		out.S = (max - min) / (1 - math.Abs(2*out.L-1))
+	}
+	return out
+}
+
+func (h HSL) RGB() RGB {
+	c := (1 - math.Abs(2*h.L-1)) * h.S
+	return fromHue(h.H, c, h.L-c/2)
+}
+
+// hue is the hue in degrees shared by HSV and HSL, 0 for greys.
+func hue(r, g, b, max, min float64) float64 {
+	d := max - min
+	var h float64
+	switch {
+	case d == 0:
+		return 0
+	case max == r:
+		h = math.Mod((g-b)/d, 6)
+	case max == g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// fromHue places chroma c on the hue wheel and adds m to every channel.
+func fromHue(h, c, m float64) RGB {
+	h = wrapHue(h) / 60
+	x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+	var r, g, b float64
+	switch {
+	case h < 1:
+		r, g = c, x
+	case h < 2:
+		r, g = x, c
+	case h < 3:
+		g, b = c, x
+	case h < 4:
+		g, b = x, c
+	case h < 5:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	return fromFloat(r+m, g+m, b+m)
+}
+
+func wrapHue(h float64) float64 {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+// linear undoes the sRGB gamma.
+func linear(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// gamma applies the sRGB gamma.
+func gamma(c float64) float64 {
+	if c <= 0.0031308 {
+		return c * 12.92
+	}
+	return 1.055*math.Pow(c, 1/2.4) - 0.055
+}
+
+func (r RGB) linear() (float64, float64, float64) {
+	red, green, blue := r.float()
+	return linear(red), linear(green), linear(blue)
+}
+
+// the D65 white point
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+func (r RGB) Lab() Lab {
+	red, green, blue := r.linear()
+	x := (0.4124564*red + 0.3575761*green + 0.1804375*blue) / whiteX
+	y := (0.2126729*red + 0.7151522*green + 0.0721750*blue) / whiteY
+	z := (0.0193339*red + 0.1191920*green + 0.9503041*blue) / whiteZ
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return Lab{L: 116*fy - 16, A: 500 * (fx - fy), B: 200 * (fy - fz)}
+}
+
+func (l Lab) RGB() RGB {
+	fy := (l.L + 16) / 116
+	x := labInverse(fy+l.A/500) * whiteX
+	y := labInverse(fy) * whiteY
+	z := labInverse(fy-l.B/200) * whiteZ
+	return fromFloat(
+		gamma(3.2404542*x-1.5371385*y-0.4985314*z),
+		gamma(-0.9692660*x+1.8760108*y+0.0415560*z),
+		gamma(0.0556434*x-0.2040259*y+1.0572252*z),
+	)
+}
+
+const labEpsilon = 6.0 / 29
+
+func labF(t float64) float64 {
+	if t > labEpsilon*labEpsilon*labEpsilon {
+		return math.Cbrt(t)
+	}
+	return t/(3*labEpsilon*labEpsilon) + 4.0/29
+}
+
+func labInverse(t float64) float64 {
+	if t > labEpsilon {
+		return t * t * t
+	}
+	return 3 * labEpsilon * labEpsilon * (t - 4.0/29)
+}
+
+func (r RGB) OKLab() OKLab {
+	red, green, blue := r.linear()
+	l := math.Cbrt(0.4122214708*red + 0.5363325363*green + 0.0514459929*blue)
+	m := math.Cbrt(0.2119034982*red + 0.6806995451*green + 0.1073969566*blue)
+	s := math.Cbrt(0.0883024619*red + 0.2817188376*green + 0.6299787005*blue)
+	return OKLab{
+		L: 0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		A: 1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		B: 0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+func (o OKLab) RGB() RGB {
+	l := o.L + 0.3963377774*o.A + 0.2158037573*o.B
+	m := o.L - 0.1055613458*o.A - 0.0638541728*o.B
+	s := o.L - 0.0894841775*o.A - 1.2914855480*o.B
+	l, m, s = l*l*l, m*m*m, s*s*s
+	return fromFloat(
+		gamma(4.0767416621*l-3.3077115913*m+0.2309699292*s),
+		gamma(-1.2684380046*l+2.6097574011*m-0.3413193965*s),
+		gamma(-0.0041960863*l-0.7034186147*m+1.7076147010*s),
+	)
+}
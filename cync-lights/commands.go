@@ -0,0 +1,989 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/trace"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+// aliases can expand into other aliases, but not forever
+const maxAliasDepth = 8
+
+var commandLog = log.For("commands")
+
+type argKind int
+
+const (
+	argWord argKind = iota
+	argInt
+	argFloat
+	argPercent
+	argColor
+	// argTarget is a device name, group name or "all"
+	argTarget
+	argDevice
+	argGroup
+	argMode
+	argPalette
+	argScene
+	argRule
+	argAlarm
+)
+
+type argSpec struct {
+	name     string
+	kind     argKind
+	optional bool
+	// variadic takes every remaining word, only valid on the last arg
+	variadic bool
+	// choices restricts an argWord to a fixed set
+	choices []string
+	// when limits the arg to lines whose first arg is one of these, so
+	// actions can take different args
+	when []string
+}
+
+func (a argSpec) usage() string {
+	name := a.name
+	if len(a.choices) > 0 {
+		name = strings.Join(a.choices, "|")
+	}
+	if a.variadic {
+		name += "..."
+	}
+	if a.optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// command is a single entry in the registry. Arguments are parsed and
+// validated against args before run is called.
+type command struct {
+	name    string
+	aliases []string
+	args    []argSpec
+	help    string
+	// raw commands get the rest of the line untouched instead of parsed
+	// args, so they can contain ';'
+	raw bool
+	run func(cont *controller, args parsedArgs) error
+}
+
+func (c *command) usage() string {
+	parts := []string{c.name}
+	for _, a := range c.args {
+		parts = append(parts, a.usage())
+	}
+	return strings.Join(parts, " ")
+}
+
+// argsFor is the args a line takes given its first word, leaving out those
+// for other actions.
+func (c *command) argsFor(first string) []argSpec {
+	var specs []argSpec
+	for _, spec := range c.args {
+		if len(spec.when) == 0 || containsFold(spec.when, first) {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+func containsFold(list []string, word string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, word) {
+			return true
+		}
+	}
+	return false
+}
+
+type usageError struct {
+	cmd *command
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return fmt.Sprintf("%s, usage: %s", e.msg, e.cmd.usage())
+}
+
+type parsedArgs struct {
+	values map[string][]string
+	raw    string
+}
+
+func (p parsedArgs) str(name string) string {
+	if v := p.values[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (p parsedArgs) all(name string) []string {
+	return p.values[name]
+}
+
+func (p parsedArgs) has(name string) bool {
+	return len(p.values[name]) > 0
+}
+
+func (p parsedArgs) float(name string) float64 {
+	f, _ := strconv.ParseFloat(p.str(name), 64)
+	return f
+}
+
+// int is only called for args already validated as numbers
+func (p parsedArgs) int(name string) int {
+	n, _ := strconv.Atoi(p.str(name))
+	return n
+}
+
+// brightness is only called for args already validated as percentages
+func (p parsedArgs) brightness(name string) colors.Brightness {
+	b, _ := colors.ParseBrightness(p.str(name))
+	return b
+}
+
+type registry struct {
+	commands []*command
+	byName   map[string]*command
+}
+
+func newRegistry(cmds ...*command) *registry {
+	r := &registry{byName: map[string]*command{}}
+	for _, cmd := range cmds {
+		r.add(cmd)
+	}
+	return r
+}
+
+func (r *registry) add(cmd *command) {
+	r.commands = append(r.commands, cmd)
+	r.byName[cmd.name] = cmd
+	for _, alias := range cmd.aliases {
+		r.byName[alias] = cmd
+	}
+}
+
+func (r *registry) lookup(name string) (*command, bool) {
+	cmd, ok := r.byName[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// execute runs a line, which may hold several ';' separated commands and
+// user aliases.
+func (r *registry) execute(cont *controller, line string) error {
+	return r.executeDepth(cont, line, 0)
+}
+
+func (r *registry) executeDepth(cont *controller, line string, depth int) error {
+	if depth > maxAliasDepth {
+		return errors.Errorf("aliases nested more than %d deep", maxAliasDepth)
+	}
+
+	for _, statement := range splitStatements(line, r) {
+		words := tokenize(statement)
+		if len(words) == 0 {
+			continue
+		}
+
+		if expansion, ok := cont.config.Aliases[strings.ToLower(words[0])]; ok {
+			if err := r.executeDepth(cont, expansion, depth+1); err != nil {
+				return errors.Wrapf(err, "in alias %s", words[0])
+			}
+			continue
+		}
+
+		cmd, ok := r.lookup(words[0])
+		if !ok {
+			return errors.Errorf("unrecognized command %s, try help", words[0])
+		}
+
+		var args parsedArgs
+		if cmd.raw {
+			args.raw = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(statement), words[0]))
+		} else {
+			parsed, err := r.parse(cont, cmd, words[1:])
+			if err != nil {
+				return err
+			}
+			args = parsed
+		}
+
+		commandLog.Debug("running command", log.F("command", cmd.name), log.F("args", args.values))
+		span := cont.tracing.start("command "+cmd.name, trace.KindInternal, trace.String("command", strings.TrimSpace(statement)))
+		err := cmd.run(cont, args)
+		cont.tracing.end(span, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitStatements breaks a line on ';', except when it starts with a raw
+// command, which gets everything.
+func splitStatements(line string, r *registry) []string {
+	words := tokenize(line)
+	if len(words) > 0 {
+		if cmd, ok := r.lookup(words[0]); ok && cmd.raw {
+			return []string{line}
+		}
+	}
+	return strings.Split(line, ";")
+}
+
+// tokenize splits on spaces, keeping "quoted names" together.
+func tokenize(line string) []string {
+	var words []string
+	var cur strings.Builder
+	inQuote, started := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			started = true
+		case r == ' ' && !inQuote:
+			if started {
+				words = append(words, cur.String())
+				cur.Reset()
+				started = false
+			}
+		default:
+			cur.WriteRune(r)
+			started = true
+		}
+	}
+	if started {
+		words = append(words, cur.String())
+	}
+	return words
+}
+
+func (r *registry) parse(cont *controller, cmd *command, words []string) (parsedArgs, error) {
+	args := parsedArgs{values: map[string][]string{}}
+	var first string
+	if len(words) > 0 {
+		first = words[0]
+	}
+	i := 0
+	for _, spec := range cmd.argsFor(first) {
+		if i >= len(words) {
+			if !spec.optional {
+				return args, &usageError{cmd: cmd, msg: "missing " + spec.name}
+			}
+			break
+		}
+
+		take := words[i : i+1]
+		if spec.variadic {
+			take = words[i:]
+		}
+		for _, word := range take {
+			if err := r.validate(cont, spec, word); err != nil {
+				return args, &usageError{cmd: cmd, msg: err.Error()}
+			}
+		}
+		args.values[spec.name] = take
+		i += len(take)
+	}
+	if i < len(words) {
+		return args, &usageError{cmd: cmd, msg: "too many arguments"}
+	}
+
+	return args, nil
+}
+
+func (r *registry) validate(cont *controller, spec argSpec, word string) error {
+	switch spec.kind {
+	case argInt:
+		if _, err := strconv.Atoi(word); err != nil {
+			return errors.Errorf("%s must be a number", spec.name)
+		}
+	case argFloat:
+		f, err := strconv.ParseFloat(word, 64)
+		if err != nil || f <= 0 {
+			return errors.Errorf("%s must be a positive number", spec.name)
+		}
+	case argPercent:
+		if _, err := colors.ParseBrightness(word); err != nil {
+			return errors.Errorf("%s must be 0-100%%", spec.name)
+		}
+	case argColor:
+		if _, err := colors.Parse(word); err != nil {
+			return err
+		}
+	case argTarget:
+		if _, err := cont.resolveTarget(word); err != nil {
+			return err
+		}
+	case argDevice:
+		if _, ok := cont.findDevice(word); !ok {
+			return errors.Errorf("no device named %q", word)
+		}
+	case argMode:
+		if _, ok := cont.modes[word]; !ok || word == ModeCommandID {
+			return errors.Errorf("unknown mode %q", word)
+		}
+	case argPalette:
+		if _, ok := colors.PaletteByName(word); !ok {
+			return errors.Errorf("unknown palette %q", word)
+		}
+	}
+
+	if len(spec.choices) > 0 {
+		if containsFold(spec.choices, word) {
+			return nil
+		}
+		return errors.Errorf("%s must be one of %s", spec.name, strings.Join(spec.choices, ", "))
+	}
+	return nil
+}
+
+// complete suggests candidates for the word being typed at the end of line.
+func (r *registry) complete(cont *controller, line string) []string {
+	words := tokenize(line)
+	if !strings.HasSuffix(line, " ") && len(words) > 0 {
+		words = words[:len(words)-1]
+	}
+
+	if len(words) == 0 {
+		names := make([]string, 0, len(r.byName)+len(cont.config.Aliases))
+		for name := range r.byName {
+			names = append(names, name)
+		}
+		for name := range cont.config.Aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	cmd, ok := r.lookup(words[0])
+	if !ok || cmd.raw || len(cmd.args) == 0 {
+		return nil
+	}
+	var first string
+	if len(words) > 1 {
+		first = words[1]
+	}
+	specs := cmd.argsFor(first)
+	pos := len(words) - 1
+	if pos >= len(specs) {
+		last := specs[len(specs)-1]
+		if !last.variadic {
+			return nil
+		}
+		pos = len(specs) - 1
+	}
+	return cont.candidates(specs[pos])
+}
+
+func (c *controller) candidates(spec argSpec) []string {
+	if len(spec.choices) > 0 {
+		return spec.choices
+	}
+
+	var out []string
+	switch spec.kind {
+	case argTarget:
+		out = append(out, "all")
+		out = append(out, c.groupNames()...)
+		out = append(out, c.deviceNames()...)
+	case argDevice:
+		out = c.deviceNames()
+	case argGroup:
+		out = c.groupNames()
+	case argMode:
+		out = c.modeNames()
+	case argPalette:
+		for _, p := range colors.Palettes {
+			out = append(out, p.Name)
+		}
+	case argScene:
+		for name := range c.config.Scenes {
+			out = append(out, name)
+		}
+		sort.Strings(out)
+	case argRule:
+		out = c.ruleNames()
+	case argAlarm:
+		out = c.alarmNames()
+	case argColor:
+		for _, color := range colors.BaseColors {
+			out = append(out, color.Name)
+		}
+	}
+	return out
+}
+
+func (c *controller) deviceNames() []string {
+	names := make([]string, 0, len(c.devices))
+	for _, d := range c.devices {
+		name := d.Name()
+		if strings.Contains(name, " ") {
+			name = `"` + name + `"`
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (c *controller) groupNames() []string {
+	names := make([]string, 0, len(c.config.Groups))
+	for name := range c.config.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *controller) findDevice(name string) (*device, bool) {
+	for _, d := range c.devices {
+		if strings.EqualFold(d.Name(), name) || d.DeviceID() == name {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// resolveTarget turns "all", a group or a device name into devices.
+func (c *controller) resolveTarget(target string) ([]*device, error) {
+	if target == "" || strings.EqualFold(target, "all") {
+		return c.devices, nil
+	}
+	if members, ok := c.config.Groups[target]; ok {
+		var devices []*device
+		for _, name := range members {
+			d, ok := c.findDevice(name)
+			if !ok {
+				return nil, errors.Errorf("group %s contains unknown device %q", target, name)
+			}
+			devices = append(devices, d)
+		}
+		return devices, nil
+	}
+	if d, ok := c.findDevice(target); ok {
+		return []*device{d}, nil
+	}
+	return nil, errors.Errorf("no device or group named %q", target)
+}
+
+// complete is the prompt's completer.
+func (c *controller) complete(line string) []string {
+	return c.commands.complete(c, line)
+}
+
+// deviceState snapshots what we last told a device to do.
+func (c *controller) deviceState(d *device) config.DeviceState {
+	id := d.DeviceID()
+	state := config.DeviceState{Power: c.lastPower[id]}
+	if color, ok := c.lastColor[id]; ok {
+		rgb := color.GetRGB()
+		state.Color, state.RGB = color.Name, &rgb
+	}
+	state.Kelvin = c.lastKelvin[id]
+	if lum, ok := c.lastLum[id]; ok {
+		l := int(lum)
+		state.Lum = &l
+	}
+	return state
+}
+
+// applyState puts a device into a saved state. Whatever wasn't known when
+// it was saved is left as it is.
+func (c *controller) applyState(d *device, state config.DeviceState) error {
+	if !state.Power {
+		return c.SetStatus(d, false)
+	}
+	if err := c.SetStatus(d, true); err != nil {
+		return err
+	}
+	switch {
+	case state.Kelvin != 0:
+		if err := c.SetCTAsync(d, state.Kelvin); err != nil {
+			return err
+		}
+	case state.RGB != nil:
+		if err := c.SetRGB(d, colors.New(state.Color, state.RGB[0], state.RGB[1], state.RGB[2])); err != nil {
+			return err
+		}
+	}
+	if state.Lum == nil {
+		return nil
+	}
+	return c.SetLum(d, colors.Brightness(*state.Lum).Clamp())
+}
+
+// loadScene applies a saved scene, skipping devices that have gone away.
+func (c *controller) loadScene(name string) error {
+	scene, ok := c.config.Scenes[name]
+	if !ok {
+		return errors.Errorf("no scene named %q", name)
+	}
+	for deviceName, state := range scene {
+		d, ok := c.findDevice(deviceName)
+		if !ok {
+			c.view.Eventf(ui.ErrColor, "scene %s: no device named %q", name, deviceName)
+			continue
+		}
+		c.applyState(d, state)
+	}
+	return nil
+}
+
+// saveConfig writes the sections commands change over the config on disk,
+// leaving the rest as it is there.
+func (c *controller) saveConfig() error {
+	err := c.config.Update(func(disk *config.Config) {
+		disk.Groups = c.config.Groups
+		disk.Scenes = c.config.Scenes
+		disk.Aliases = c.config.Aliases
+		disk.Calibration = c.config.Calibration
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to save config")
+	}
+	return nil
+}
+
+func defaultCommands(cont *controller) *registry {
+	r := newRegistry(
+		&command{
+			name:    "help",
+			aliases: []string{"h", "?"},
+			args:    []argSpec{{name: "command", kind: argWord, optional: true}},
+			help:    "list commands, or show the usage of one",
+		},
+		&command{
+			name:    "on",
+			aliases: []string{"turnon"},
+			args:    []argSpec{{name: "target", kind: argTarget, optional: true}},
+			help:    "turn devices on, all of them by default",
+			run: func(cont *controller, args parsedArgs) error {
+				devices, _ := cont.resolveTarget(args.str("target"))
+				for _, d := range devices {
+					cont.SetStatus(d, true)
+				}
+				return nil
+			},
+		},
+		&command{
+			name:    "off",
+			aliases: []string{"turnoff"},
+			args:    []argSpec{{name: "target", kind: argTarget, optional: true}},
+			help:    "turn devices off, all of them by default",
+			run: func(cont *controller, args parsedArgs) error {
+				devices, _ := cont.resolveTarget(args.str("target"))
+				for _, d := range devices {
+					cont.SetStatus(d, false)
+				}
+				return nil
+			},
+		},
+		&command{
+			name:    "dim",
+			aliases: []string{"brightness"},
+			args: []argSpec{
+				{name: "percent", kind: argPercent},
+				{name: "target", kind: argTarget, optional: true},
+			},
+			help: "set brightness, 0-100",
+			run: func(cont *controller, args parsedArgs) error {
+				devices, _ := cont.resolveTarget(args.str("target"))
+				for _, d := range devices {
+					cont.SetLum(d, args.brightness("percent"))
+				}
+				return nil
+			},
+		},
+		&command{
+			name: "color",
+			args: []argSpec{
+				{name: "color", kind: argColor},
+				{name: "target", kind: argTarget, optional: true},
+			},
+			help: "set a color by name, #rrggbb or r,g,b",
+			run: func(cont *controller, args parsedArgs) error {
+				color, _ := colors.Parse(args.str("color"))
+				devices, _ := cont.resolveTarget(args.str("target"))
+				for _, d := range devices {
+					cont.SetRGB(d, color)
+				}
+				return nil
+			},
+		},
+		&command{
+			name:    "printdevices",
+			aliases: []string{"devices", "ls"},
+			help:    "list devices and their last known status",
+			run: func(cont *controller, args parsedArgs) error {
+				return cont.PrintDevices()
+			},
+		},
+		&command{
+			name: "mode",
+			args: []argSpec{{name: "mode", kind: argMode}},
+			help: "switch to a mode, any command or q leaves it",
+			run: func(cont *controller, args parsedArgs) error {
+				return cont.SwitchMode(args.str("mode"))
+			},
+		},
+		&command{
+			name: "group",
+			args: []argSpec{
+				{name: "action", kind: argWord, choices: []string{"list", "set", "delete"}},
+				{name: "group", kind: argGroup, optional: true},
+				{name: "devices", kind: argDevice, optional: true, variadic: true},
+			},
+			help: "list groups, set a group's devices or delete one",
+			run:  runGroup,
+		},
+		&command{
+			name: "scene",
+			args: []argSpec{
+				{name: "action", kind: argWord, choices: []string{"list", "save", "load", "delete"}},
+				{name: "scene", kind: argScene, optional: true},
+			},
+			help: "save the current lights as a scene, or load one",
+			run:  runScene,
+		},
+		&command{
+			name: "alias",
+			help: "alias <name> = <command>[; <command>...] defines a macro, alias on its own lists them",
+			raw:  true,
+			run:  runAlias,
+		},
+		&command{
+			name: "unalias",
+			args: []argSpec{{name: "name", kind: argWord}},
+			help: "remove an alias",
+			run: func(cont *controller, args parsedArgs) error {
+				name := strings.ToLower(args.str("name"))
+				if _, ok := cont.config.Aliases[name]; !ok {
+					return errors.Errorf("no alias named %s", name)
+				}
+				delete(cont.config.Aliases, name)
+				return cont.saveConfig()
+			},
+		},
+		&command{
+			name: "record",
+			args: []argSpec{
+				{name: "action", kind: argWord, choices: []string{"start", "stop"}},
+				{name: "file", kind: argWord, optional: true},
+			},
+			help: "record commands and device changes to a file for replay",
+			run:  runRecord,
+		},
+		&command{
+			name: "replay",
+			args: []argSpec{
+				{name: "file", kind: argWord},
+				{name: "speed", kind: argFloat, optional: true},
+			},
+			help: "play a recording back, speed 2 is twice as fast, 0.5 half",
+			run:  runReplay,
+		},
+		&command{
+			name: "show",
+			args: []argSpec{
+				{name: "action", kind: argWord, choices: []string{"play", "preview", "check", "import"}},
+				{name: "file", kind: argWord},
+				{name: "from", kind: argWord, optional: true, when: []string{"play", "preview", "check"}},
+				{name: "output", kind: argWord, optional: true, when: []string{"import"}},
+			},
+			help: "play a cue file, preview it on screen only, or check it; from is a time like 1m30s or a beat. " +
+				"import <mapping> [output] turns an xLights fseq into a cue file named output",
+			run: runShow,
+		},
+		&command{
+			name: "presence",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"status", "pause", "resume"}},
+			},
+			help: "show whether anyone's at the desk, or pause dimming on idle and lock",
+			run:  runPresence,
+		},
+		&command{
+			name: "rules",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"list", "why", "fire", "reload"}},
+				{name: "name", kind: argRule, optional: true, when: []string{"why"}},
+				{name: "event", kind: argWord, optional: true, when: []string{"fire"}},
+			},
+			help: "list rules, explain why one last ran or didn't, fire an event or reload the config",
+			run:  runRules,
+		},
+		&command{
+			name: "alert",
+			args: []argSpec{
+				{name: "color", kind: argColor},
+				{name: "pattern", kind: argWord, optional: true},
+				{name: "target", kind: argTarget, optional: true},
+			},
+			help: "flash lights with a pattern (blink, blinkN, strobe, pulse, flash) then put them back",
+			run:  runAlert,
+		},
+		&command{
+			name: "focus",
+			args: []argSpec{
+				{name: "work", kind: argWord, optional: true},
+				{name: "break", kind: argWord, optional: true},
+			},
+			help: "start a pomodoro timer, e.g. focus 50m 10m, durations default to the config",
+			run:  runFocus,
+		},
+		&command{
+			name: "circadian",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"start", "preview"}},
+			},
+			help: "follow the time of day, or preview today's curve",
+			run:  runCircadian,
+		},
+		&command{
+			name: "wake",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"list", "snooze", "skip", "unskip", "test"}},
+				{name: "alarm", kind: argAlarm, optional: true},
+			},
+			help: "list sunrise alarms, snooze the one going off, skip the next one or try one now",
+			run:  runWake,
+		},
+		&command{
+			name: "scale",
+			args: []argSpec{{name: "percent", kind: argPercent, optional: true}},
+			help: "scale every brightness, e.g. scale 30% then mode rainbow; on its own it shows the scale",
+			run:  runScale,
+		},
+		&command{
+			name: "calibrate",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"show", "start", "reset"}},
+				{name: "device", kind: argDevice, optional: true},
+				{name: "reference", kind: argDevice, optional: true},
+			},
+			help: "show calibration profiles, match a bulb to a reference bulb step by step, or reset one",
+			run:  runCalibrate,
+		},
+		&command{
+			name: "usage",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"day", "week", "month", "export"}},
+				{name: "target", kind: argWord, optional: true},
+			},
+			help: "estimated kWh and cost per device and group today, this week or month; export [file] writes this month as csv",
+			run:  runUsage,
+		},
+		&command{
+			name: "pending",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"list", "replay", "clear"}},
+			},
+			help: "show commands queued while the cloud is unreachable, replay them now or drop them",
+			run:  runPending,
+		},
+		&command{
+			name: "outage",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"on", "off"}},
+			},
+			help: "with --fake, take the fake cloud down or bring it back to try the offline queue",
+			run:  runOutage,
+		},
+		&command{
+			name: "reconcile",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"status", "now"}},
+			},
+			help: "show devices that drifted from what they were sent, or check them all now",
+			run:  runReconcile,
+		},
+		&command{
+			name: "powercycle",
+			args: []argSpec{
+				{name: "device", kind: argDevice},
+			},
+			help: "with --fake, have a fake bulb come back white as if it was power cycled",
+			run:  runPowerCycle,
+		},
+		&command{
+			name: "transport",
+			args: []argSpec{
+				{name: "action", kind: argWord, optional: true, choices: []string{"list", "local", "cloud"}},
+				{name: "target", kind: argTarget, optional: true},
+			},
+			help: "show whether each device goes through the local hub or the cloud, or switch devices between them",
+			run:  runTransport,
+		},
+		&command{
+			name:    "exit",
+			aliases: []string{"quit"},
+			help:    "turn nothing off and quit",
+			run: func(cont *controller, args parsedArgs) error {
+				cont.running = false
+				return nil
+			},
+		},
+	)
+
+	// every mode is also a command of its own
+	for _, id := range cont.modeNames() {
+		id := id
+		if _, ok := r.byName[id]; ok {
+			continue
+		}
+		r.add(&command{
+			name: id,
+			help: "switch to " + id + " mode",
+			run: func(cont *controller, args parsedArgs) error {
+				return cont.SwitchMode(id)
+			},
+		})
+	}
+
+	// help needs the finished registry
+	r.byName["help"].run = func(cont *controller, args parsedArgs) error {
+		return runHelp(cont, r, args)
+	}
+	return r
+}
+
+func runHelp(cont *controller, r *registry, args parsedArgs) error {
+	if !args.has("command") {
+		for _, cmd := range r.commands {
+			cont.view.Eventf(ui.TextColor, "%-14s %s", cmd.name, cmd.help)
+		}
+		if len(cont.config.Aliases) > 0 {
+			cont.view.Eventf(ui.TextColor, "aliases: %s", strings.Join(sortedKeys(cont.config.Aliases), ", "))
+		}
+		cont.view.Eventf(ui.TextColor, "help <command> for details")
+		return nil
+	}
+
+	name := args.str("command")
+	if expansion, ok := cont.config.Aliases[strings.ToLower(name)]; ok {
+		cont.view.Eventf(ui.TextColor, "%s is an alias for: %s", name, expansion)
+		return nil
+	}
+	cmd, ok := r.lookup(name)
+	if !ok {
+		return errors.Errorf("unrecognized command %s", name)
+	}
+	cont.view.Eventf(ui.TextColor, "usage: %s", cmd.usage())
+	cont.view.Eventf(ui.TextColor, "  %s", cmd.help)
+	if len(cmd.aliases) > 0 {
+		cont.view.Eventf(ui.TextColor, "  aliases: %s", strings.Join(cmd.aliases, ", "))
+	}
+	return nil
+}
+
+func runGroup(cont *controller, args parsedArgs) error {
+	name := args.str("group")
+	switch args.str("action") {
+	case "list":
+		for _, group := range cont.groupNames() {
+			cont.view.Eventf(ui.TextColor, "%s: %s", group, strings.Join(cont.config.Groups[group], ", "))
+		}
+		return nil
+	case "set":
+		if name == "" || !args.has("devices") {
+			return errors.New("usage: group set <group> <device>...")
+		}
+		if cont.config.Groups == nil {
+			cont.config.Groups = map[string][]string{}
+		}
+		var members []string
+		for _, word := range args.all("devices") {
+			d, _ := cont.findDevice(word)
+			members = append(members, d.Name())
+		}
+		cont.config.Groups[name] = members
+	case "delete":
+		if _, ok := cont.config.Groups[name]; !ok {
+			return errors.Errorf("no group named %q", name)
+		}
+		delete(cont.config.Groups, name)
+	}
+	return cont.saveConfig()
+}
+
+func runScene(cont *controller, args parsedArgs) error {
+	name := args.str("scene")
+	action := args.str("action")
+	if action != "list" && name == "" {
+		return errors.Errorf("usage: scene %s <scene>", action)
+	}
+
+	switch action {
+	case "list":
+		for _, scene := range sortedKeys(cont.config.Scenes) {
+			cont.view.Eventf(ui.TextColor, "%s (%d devices)", scene, len(cont.config.Scenes[scene]))
+		}
+		return nil
+	case "save":
+		scene := config.Scene{}
+		for _, d := range cont.devices {
+			scene[d.Name()] = cont.deviceState(d)
+		}
+		if cont.config.Scenes == nil {
+			cont.config.Scenes = map[string]config.Scene{}
+		}
+		cont.config.Scenes[name] = scene
+		cont.view.Eventf(ui.TextColor, "saved scene %s", name)
+	case "load":
+		return cont.loadScene(name)
+	case "delete":
+		if _, ok := cont.config.Scenes[name]; !ok {
+			return errors.Errorf("no scene named %q", name)
+		}
+		delete(cont.config.Scenes, name)
+	}
+	return cont.saveConfig()
+}
+
+func runAlias(cont *controller, args parsedArgs) error {
+	if args.raw == "" {
+		for _, name := range sortedKeys(cont.config.Aliases) {
+			cont.view.Eventf(ui.TextColor, "%s = %s", name, cont.config.Aliases[name])
+		}
+		return nil
+	}
+
+	name, expansion, found := strings.Cut(args.raw, "=")
+	name = strings.ToLower(strings.TrimSpace(name))
+	expansion = strings.TrimSpace(expansion)
+	if !found || name == "" || expansion == "" || strings.Contains(name, " ") {
+		return errors.New("usage: alias <name> = <command>[; <command>...]")
+	}
+	if _, ok := cont.commands.lookup(name); ok {
+		return errors.Errorf("%s is already a command", name)
+	}
+
+	if cont.config.Aliases == nil {
+		cont.config.Aliases = map[string]string{}
+	}
+	cont.config.Aliases[name] = expansion
+	cont.view.Eventf(ui.TextColor, "%s = %s", name, expansion)
+	return cont.saveConfig()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
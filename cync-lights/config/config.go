@@ -0,0 +1,339 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const CyncConfig = "CYNC_CONFIG"
+
+// Config is the user's settings file. Everything is optional, missing fields
+// fall back to built in defaults.
+type Config struct {
+	// Bindings maps a live control action to the keys that trigger it, e.g.
+	// "pause": ["p", "space"]
+	Bindings map[string][]string `json:"bindings,omitempty"`
+	// Groups are named sets of device names.
+	Groups map[string][]string `json:"groups,omitempty"`
+	// Scenes are saved device states, keyed by scene then device name.
+	Scenes map[string]Scene `json:"scenes,omitempty"`
+	// Aliases expand a single word into one or more ';' separated commands.
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// Scale is a global brightness every brightness is scaled by, like
+	// "30%", so any mode or scene can run dimmer without changing it
+	Scale string `json:"scale,omitempty"`
+	// Presence dims or turns off lights when nobody is at the desk.
+	Presence *Presence `json:"presence,omitempty"`
+	// Rules run actions when something happens, see Rule.
+	Rules []Rule `json:"rules,omitempty"`
+	MQTT  *MQTT  `json:"mqtt,omitempty"`
+	// API is the local HTTP API, off unless configured.
+	API *API `json:"api,omitempty"`
+	// CI is where ci mode reads build status from.
+	CI *CI `json:"ci,omitempty"`
+	// Focus configures the pomodoro timer in focus mode.
+	Focus *Focus `json:"focus,omitempty"`
+	// Circadian is the curve circadian mode follows through the day.
+	Circadian *Circadian `json:"circadian,omitempty"`
+	// Wake is sunrise alarms.
+	Wake *Wake `json:"wake,omitempty"`
+	// Calibration corrects for bulbs that show colors differently.
+	Calibration *Calibration `json:"calibration,omitempty"`
+	// Energy is how power use and its cost are estimated.
+	Energy *Energy `json:"energy,omitempty"`
+	// Tracing exports spans from commands down to device calls, off unless
+	// configured.
+	Tracing *Tracing `json:"tracing,omitempty"`
+	// Reconcile checks devices are still doing what they were last told,
+	// every minute unless configured.
+	Reconcile *Reconcile `json:"reconcile,omitempty"`
+	// Local sends some devices through a hub on the LAN instead of the
+	// cloud, off unless configured.
+	Local *Local `json:"local,omitempty"`
+
+	path string
+}
+
+// Presence configures what happens when input goes idle or the screen locks.
+// Lights are put back the way they were on the next activity.
+type Presence struct {
+	// Source is auto, logind, x11, interrupts, file:<path> or socket:<path>
+	Source string `json:"source,omitempty"`
+	// IdleAfter is how long without input counts as idle, e.g. "5m"
+	IdleAfter string `json:"idle_after,omitempty"`
+	// Target is the device or group affected, all devices if empty
+	Target string `json:"target,omitempty"`
+	// IdleScene is loaded when idle, otherwise lights are dimmed to IdleLum
+	IdleScene string `json:"idle_scene,omitempty"`
+	IdleLum   int    `json:"idle_lum,omitempty"`
+	// LockScene is loaded when the screen locks, otherwise lights turn off
+	LockScene string `json:"lock_scene,omitempty"`
+}
+
+// API is the HTTP API scripts, CI and cync-lights alert talk to.
+type API struct {
+	// Listen is host:port, 127.0.0.1:7373 if empty
+	Listen string `json:"listen,omitempty"`
+	// Token, if set, has to be sent as a bearer token
+	Token string `json:"token,omitempty"`
+}
+
+// Tracing is where spans are sent, a collector, a file or both.
+type Tracing struct {
+	// Endpoint is an OTLP/HTTP collector, like http://localhost:4318
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are sent with every export, e.g. an API key
+	Headers map[string]string `json:"headers,omitempty"`
+	// File gets a line of OTLP JSON for every batch of spans
+	File string `json:"file,omitempty"`
+	// Service is the service.name spans are from, cync-lights if empty
+	Service string `json:"service,omitempty"`
+}
+
+// Reconcile is how often devices are compared with what they were last sent
+// and whatever drifted, like a bulb that was power cycled and came back
+// white, is sent again.
+type Reconcile struct {
+	// Interval is like "1m", or "off" to never reconcile
+	Interval string `json:"interval,omitempty"`
+}
+
+// Local is a hub or bridge on the LAN that speaks the Cync TCP protocol.
+// Devices routed to it skip the cloud, falling back to it when the hub can't
+// be reached.
+type Local struct {
+	// Addr is the hub's host:port
+	Addr string `json:"addr"`
+	// Devices are the devices and groups sent through the hub, "all" for
+	// every device. Everything else goes through the cloud.
+	Devices []string `json:"devices,omitempty"`
+	// Switch is the ID commands are addressed to, the device relaying them
+	// into the mesh
+	Switch uint32 `json:"switch,omitempty"`
+	// UserID and Code authenticate like the cloud does, for hubs that ask
+	UserID uint32 `json:"user_id,omitempty"`
+	Code   string `json:"code,omitempty"`
+	// Timeout is how long to wait for the hub, "2s" if empty
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// CI shows build status on some lights: green passing, pulsing yellow
+// running, red failing.
+type CI struct {
+	// Source is file:<path>, command:<shell command> or webhook, which
+	// takes POST /ci on the api
+	Source string `json:"source"`
+	// Field is the dotted path to the status in a JSON file, "status" if
+	// empty. Plain text files are read as a single word.
+	Field string `json:"field,omitempty"`
+	// Target is the device or group showing status, all devices if empty
+	Target string `json:"target,omitempty"`
+	// Poll is how often the source is read, e.g. "30s"
+	Poll string `json:"poll,omitempty"`
+	// Debounce is how long a new status has to hold before the lights
+	// change, so flapping builds don't strobe
+	Debounce string `json:"debounce,omitempty"`
+}
+
+// Focus is work and break lengths and the colors for each. Anything left
+// out gets a default: 25m work, 5m break, a 15m break every 4th, a calm blue
+// while working, ramping to orange over the last minute, green on break.
+type Focus struct {
+	Work      string `json:"work,omitempty"`
+	Break     string `json:"break,omitempty"`
+	LongBreak string `json:"long_break,omitempty"`
+	// LongEvery is how many work sessions come before a long break
+	LongEvery int `json:"long_every,omitempty"`
+	// Warning is how long before the end of work the ramp starts
+	Warning    string `json:"warning,omitempty"`
+	Target     string `json:"target,omitempty"`
+	WorkColor  string `json:"work_color,omitempty"`
+	WarnColor  string `json:"warn_color,omitempty"`
+	BreakColor string `json:"break_color,omitempty"`
+}
+
+// Circadian sets color temperature and brightness by the time of day, along
+// a curve anchored to sunrise and sunset where the config says we are.
+type Circadian struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Bedtime is when the night light starts, "22:30" if empty
+	Bedtime string `json:"bedtime,omitempty"`
+	// Curve replaces the default curve, see CurvePoint
+	Curve  []CurvePoint `json:"curve,omitempty"`
+	Target string       `json:"target,omitempty"`
+	// White lists the devices and groups that are tunable white bulbs, set
+	// with color tone rather than an RGB approximation
+	White []string `json:"white,omitempty"`
+	// Override is how long a light changed by something else is left alone,
+	// "1h" if empty
+	Override string `json:"override,omitempty"`
+	// Interval is how often the lights are updated, "30s" if empty
+	Interval string `json:"interval,omitempty"`
+}
+
+// CurvePoint is where the curve passes through. At is a time like "07:00"
+// or sunrise, noon, sunset or bedtime with an optional offset like
+// "sunset-1h". Points go in order through the day. Between points the
+// lights fade, after the last point they hold until the first point of the
+// next day.
+type CurvePoint struct {
+	At     string `json:"at"`
+	Kelvin int    `json:"kelvin"`
+	Lum    int    `json:"lum"`
+}
+
+// Wake is the sunrise alarms and how long snooze lasts, "9m" if empty.
+type Wake struct {
+	Alarms []Alarm `json:"alarms"`
+	Snooze string  `json:"snooze,omitempty"`
+}
+
+// Alarm ramps lights from off through red and orange to daylight, reaching
+// full brightness at At.
+type Alarm struct {
+	Name string `json:"name"`
+	// At is the wake up time, like "07:00"
+	At string `json:"at"`
+	// Days are mon, tue... or weekdays or weekends, every day if empty
+	Days []string `json:"days,omitempty"`
+	// Ramp is how long before At the lights start coming up, "30m" if empty
+	Ramp string `json:"ramp,omitempty"`
+	// Hold is how long the lights stay at daylight after At, "30m" if empty
+	Hold     string `json:"hold,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// Calibration is profiles by bulb model and by device name. A device's
+// profile starts from its model's and overrides whatever it sets itself.
+type Calibration struct {
+	Models  map[string]Profile `json:"models,omitempty"`
+	Devices map[string]Profile `json:"devices,omitempty"`
+}
+
+// Profile is how a bulb's colors and brightness are corrected before they're
+// sent. Anything left out leaves that part alone.
+type Profile struct {
+	// Model is the model profile a device's builds on
+	Model string `json:"model,omitempty"`
+	// Gamma is applied to each channel, above 1 deepens washed out colors
+	Gamma float64 `json:"gamma,omitempty"`
+	// White is the color the bulb needs to show a neutral white, like
+	// "255,230,200"
+	White string `json:"white,omitempty"`
+	// Gains scale red, green and blue after the white point
+	Gains []float64 `json:"gains,omitempty"`
+	// MinLum is the lowest brightness that looks right, brightness 1 is sent
+	// as this and the rest scaled to fit
+	MinLum int `json:"min_lum,omitempty"`
+}
+
+// Energy is bulb wattages and the price of power. Devices without a model
+// use the model from their calibration profile, then "default", which
+// replaces the built in guess at a full color A19 if it's given.
+type Energy struct {
+	Models map[string]Wattage `json:"models,omitempty"`
+	// Devices gives a device's model by name
+	Devices map[string]string `json:"devices,omitempty"`
+	// Price is the cost of a kWh
+	Price    float64 `json:"price,omitempty"`
+	Currency string  `json:"currency,omitempty"`
+}
+
+// Wattage is a bulb's draw at some brightnesses, like
+// {"1": 1.2, "50": 4.5, "100": 9}, blended between them, and while it's
+// switched off but still connected.
+type Wattage struct {
+	Watts   map[string]float64 `json:"watts"`
+	Standby float64            `json:"standby,omitempty"`
+}
+
+// DeviceState is everything needed to put a device back the way it was.
+// RGB, Kelvin and Lum are left out when they weren't known, and aren't
+// restored.
+type DeviceState struct {
+	Power bool      `json:"power"`
+	Color string    `json:"color,omitempty"`
+	RGB   *[3]uint8 `json:"rgb,omitempty"`
+	// Kelvin is set for a tunable white last set to a color temperature, it's
+	// restored as that rather than as RGB
+	Kelvin int  `json:"kelvin,omitempty"`
+	Lum    *int `json:"lum,omitempty"`
+}
+
+type Scene map[string]DeviceState
+
+// Path is where the config lives, $CYNC_CONFIG or the user config dir.
+func Path() string {
+	if path := os.Getenv(CyncConfig); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "cync-lights", "config.json")
+}
+
+// Dir is the directory other state files are kept alongside the config in.
+func (c *Config) Dir() string {
+	return filepath.Dir(c.path)
+}
+
+// File is where the config was loaded from.
+func (c *Config) File() string {
+	return c.path
+}
+
+// Load reads the config at path. A missing file is an empty config.
+func Load(path string) (*Config, error) {
+	cfg := &Config{path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read config %s", path)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse config %s", path)
+	}
+	return cfg, nil
+}
+
+// Update reads the file again, applies change to what's there and saves it.
+// Sections edited on disk since the config was loaded are kept, where Save
+// would write back what was loaded. A file that no longer parses is left
+// alone.
+func (c *Config) Update(change func(disk *Config)) error {
+	disk, err := Load(c.path)
+	if err != nil {
+		return err
+	}
+	change(disk)
+	return disk.Save()
+}
+
+// Save writes the config back to where it was loaded from.
+func (c *Config) Save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to create config dir")
+	}
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode config")
+	}
+
+	// write then rename so a crash never leaves a half written config
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return errors.Wrapf(err, "failed to write config %s", tmp)
+	}
+	return errors.Wrap(os.Rename(tmp, c.path), "failed to replace config")
+}
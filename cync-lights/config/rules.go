@@ -0,0 +1,78 @@
+package config
+
+// Rule runs its actions when its trigger fires and all of its conditions
+// hold, e.g. when the screen locks, if it's after 18:00, load the evening
+// scene.
+type Rule struct {
+	Name string      `json:"name"`
+	When Trigger     `json:"when"`
+	If   []Condition `json:"if,omitempty"`
+	Then []Action    `json:"then"`
+	// Cooldown stops the rule firing again too soon, e.g. "10m"
+	Cooldown string `json:"cooldown,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// Trigger is what a rule waits for, exactly one kind should be set.
+type Trigger struct {
+	// At is a time of day like "07:30", on every day unless Days lists some
+	// of mon, tue, wed, thu, fri, sat and sun
+	At   string   `json:"at,omitempty"`
+	Days []string `json:"days,omitempty"`
+	// Device fires when a device, or any device with "*", changes. State
+	// narrows it to on, off, error or drift, when it's found not doing what
+	// it was last sent.
+	Device string `json:"device,omitempty"`
+	State  string `json:"state,omitempty"`
+	// Event fires on rules fire <event>, which is how scripts and API calls
+	// reach a rule
+	Event string `json:"event,omitempty"`
+	// Topic fires on MQTT messages, + and # wildcards work. Payload narrows
+	// it to one message.
+	Topic   string `json:"topic,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	// File fires whenever the file is written
+	File string `json:"file,omitempty"`
+	// Command is run Every so often, firing when its exit status changes to
+	// Exit, or on any change without Exit
+	Command string `json:"command,omitempty"`
+	Every   string `json:"every,omitempty"`
+	Exit    *int   `json:"exit,omitempty"`
+	// Presence fires on active, idle or locked
+	Presence string `json:"presence,omitempty"`
+}
+
+// Condition must hold for a rule to run, exactly one kind should be set.
+type Condition struct {
+	// Between is a time window, ["22:00", "06:00"] wraps midnight
+	Between []string `json:"between,omitempty"`
+	// Group is on when all of its devices are on and off when none are
+	Group string `json:"group,omitempty"`
+	State string `json:"state,omitempty"`
+	// Mode is the current mode
+	Mode string `json:"mode,omitempty"`
+	// Not inverts the condition
+	Not bool `json:"not,omitempty"`
+}
+
+// Action is one thing a rule does, exactly one kind should be set.
+type Action struct {
+	Scene string `json:"scene,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+	// Color sets Target, a device or group or all, to a color
+	Color  string `json:"color,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Notify shows a message, on the desktop too if notify-send is around
+	Notify string `json:"notify,omitempty"`
+	// Command runs a command line as if typed at the prompt
+	Command string `json:"command,omitempty"`
+}
+
+// MQTT is the broker rules with a topic trigger subscribe through.
+type MQTT struct {
+	// Broker is host:port, tcp://host:port or tls://host:port
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
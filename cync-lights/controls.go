@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/input"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+const (
+	minInterval = 50 * time.Millisecond
+	maxInterval = 10 * time.Second
+	speedFactor = 1.5
+	pausedSleep = 100 * time.Millisecond
+	lumStep     = 10
+)
+
+// keyHandler is implemented by modes that react to single keypresses while
+// they run. wantsKey is called from the input goroutine so it must only look
+// at the key, handleKey runs on the controller loop.
+type keyHandler interface {
+	wantsKey(k input.Key) bool
+	// handleKey returns true if the mode should run again right away
+	handleKey(cont *controller, k input.Key) bool
+}
+
+type action string
+
+const (
+	actionFaster   action = "faster"
+	actionSlower   action = "slower"
+	actionBrighter action = "brighter"
+	actionDimmer   action = "dimmer"
+	actionPause    action = "pause"
+	actionPalette  action = "palette"
+	actionQuit     action = "quit"
+	actionHelp     action = "help"
+	actionForward  action = "forward"
+	actionBack     action = "back"
+	actionSkip     action = "skip"
+	actionSnooze   action = "snooze"
+)
+
+var defaultBindings = map[action][]string{
+	actionFaster:   {"+", "=", "up"},
+	actionSlower:   {"-", "down"},
+	actionBrighter: {"]"},
+	actionDimmer:   {"["},
+	actionPause:    {"p", "space"},
+	actionPalette:  {"n"},
+	actionQuit:     {"q"},
+	actionHelp:     {"?"},
+	actionForward:  {"right", "."},
+	actionBack:     {"left", ","},
+	actionSkip:     {"s"},
+	actionSnooze:   {"z"},
+}
+
+// bindings maps key names, as returned by keyName, to actions. Number keys
+// always solo the device at that position in the table, 0 clears it.
+type bindings map[string]action
+
+// newBindings starts from the defaults and replaces the keys of any action
+// the config mentions.
+func newBindings(overrides map[string][]string) (bindings, error) {
+	merged := make(map[action][]string, len(defaultBindings))
+	for a, keys := range defaultBindings {
+		merged[a] = keys
+	}
+	for name, keys := range overrides {
+		a := action(name)
+		if _, ok := defaultBindings[a]; !ok {
+			return nil, errors.Errorf("unknown key binding action %q", name)
+		}
+		merged[a] = keys
+	}
+
+	b := bindings{}
+	for a, keys := range merged {
+		for _, key := range keys {
+			if len(key) == 1 && key[0] >= '0' && key[0] <= '9' {
+				return nil, errors.Errorf("can't bind %q to %s, number keys are reserved for solo", key, a)
+			}
+			if other, ok := b[key]; ok {
+				return nil, errors.Errorf("key %q is bound to both %s and %s", key, other, a)
+			}
+			b[key] = a
+		}
+	}
+	return b, nil
+}
+
+// describe lists each action and its keys for the help overlay, leaving out
+// keys the mode doesn't want.
+func (b bindings) describe(wants func(input.Key) bool) []string {
+	byAction := map[action][]string{}
+	for key, a := range b {
+		if k, ok := keyFromName(key); ok && wants(k) {
+			byAction[a] = append(byAction[a], key)
+		}
+	}
+
+	var lines []string
+	for a, keys := range byAction {
+		sort.Strings(keys)
+		lines = append(lines, fmt.Sprintf("%-9s %s", a, strings.Join(keys, " ")))
+	}
+	sort.Strings(lines)
+	if wants(input.Key{Code: input.KeyRune, Rune: '1'}) {
+		lines = append(lines, fmt.Sprintf("%-9s %s", "solo", "1-9, 0 to clear"))
+	}
+	return lines
+}
+
+// keyFor is the key to show for an action in a mode's hints, its first
+// default key if that's still bound to it.
+func (b bindings) keyFor(a action) string {
+	for _, key := range defaultBindings[a] {
+		if b[key] == a {
+			return key
+		}
+	}
+	var keys []string
+	for key, bound := range b {
+		if bound == a {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "(unbound)"
+	}
+	sort.Strings(keys)
+	return keys[0]
+}
+
+func keyName(k input.Key) string {
+	if k.Code == input.KeyRune {
+		if k.Rune == ' ' {
+			return "space"
+		}
+		return string(k.Rune)
+	}
+	return k.String()
+}
+
+// keyFromName is the key keyName names.
+func keyFromName(name string) (input.Key, bool) {
+	if name == "space" {
+		return input.Key{Code: input.KeyRune, Rune: ' '}, true
+	}
+	if r := []rune(name); len(r) == 1 {
+		return input.Key{Code: input.KeyRune, Rune: r[0]}, true
+	}
+	for code := input.KeyEnter; code < input.KeyUnknown; code++ {
+		if k := (input.Key{Code: code}); k.String() == name {
+			return k, true
+		}
+	}
+	return input.Key{}, false
+}
+
+func soloIndex(k input.Key) (int, bool) {
+	if k.Code != input.KeyRune || k.Rune < '0' || k.Rune > '9' {
+		return 0, false
+	}
+	return int(k.Rune - '0'), true
+}
+
+// liveControls gives an indefinite mode speed, brightness, pause, palette and
+// solo keys. Modes embed it and read the current settings on every run.
+type liveControls struct {
+	bindings bindings
+	paused   bool
+	interval time.Duration
+	lum      colors.Brightness
+	palette  int
+	// solo is the 1-based table position of the only device being driven,
+	// 0 when every device is
+	solo int
+}
+
+func newLiveControls(b bindings, interval time.Duration) liveControls {
+	return liveControls{
+		bindings: b,
+		interval: interval,
+		lum:      colors.Full,
+	}
+}
+
+func (lc *liveControls) wantsKey(k input.Key) bool {
+	if _, ok := soloIndex(k); ok {
+		return true
+	}
+	switch lc.bindings[keyName(k)] {
+	case actionFaster, actionSlower, actionBrighter, actionDimmer, actionPause, actionPalette, actionQuit, actionHelp:
+		return true
+	}
+	return false
+}
+
+func (lc *liveControls) handleKey(cont *controller, k input.Key) bool {
+	if n, ok := soloIndex(k); ok {
+		lc.setSolo(cont, n)
+		return true
+	}
+
+	switch lc.bindings[keyName(k)] {
+	case actionFaster:
+		lc.interval = clampInterval(time.Duration(float64(lc.interval) / speedFactor))
+	case actionSlower:
+		lc.interval = clampInterval(time.Duration(float64(lc.interval) * speedFactor))
+	case actionBrighter:
+		lc.setLum(cont, lc.lum+lumStep)
+	case actionDimmer:
+		lc.setLum(cont, lc.lum-lumStep)
+	case actionPause:
+		lc.paused = !lc.paused
+		return !lc.paused
+	case actionPalette:
+		lc.palette = (lc.palette + 1) % len(colors.Palettes)
+		cont.view.Eventf(ui.TextColor, "palette: %s", lc.currentPalette().Name)
+		return true
+	case actionQuit:
+		cont.SwitchMode(ModeCommandID)
+		return true
+	case actionHelp:
+		for _, line := range lc.bindings.describe(lc.wantsKey) {
+			cont.view.Eventf(ui.TextColor, "%s", line)
+		}
+	}
+	return false
+}
+
+func (lc *liveControls) currentPalette() colors.Palette {
+	return colors.Palettes[lc.palette%len(colors.Palettes)]
+}
+
+func (lc *liveControls) setLum(cont *controller, lum colors.Brightness) {
+	if lum < lumStep {
+		lum = lumStep
+	}
+	lum = lum.Clamp()
+	lc.lum = lum
+	for _, d := range lc.activeDevices(cont.devices) {
+		cont.SetLumAsync(d, lum)
+	}
+}
+
+// setSolo drives only the nth device, turning the rest off. Picking the solo
+// device again, or 0, brings everything back.
+func (lc *liveControls) setSolo(cont *controller, n int) {
+	if n > len(cont.devices) {
+		return
+	}
+	if n == lc.solo {
+		n = 0
+	}
+	lc.solo = n
+
+	for i, d := range cont.devices {
+		cont.SetStatus(d, n == 0 || i == n-1)
+	}
+	if n == 0 {
+		cont.view.Eventf(ui.TextColor, "solo off")
+		return
+	}
+	cont.view.Eventf(ui.TextColor, "solo: %s", cont.devices[n-1].Name())
+}
+
+// leave brings back the devices solo turned off, so they aren't left dark
+// and the next run of the mode drives them all again.
+func (lc *liveControls) leave(cont *controller) {
+	if lc.solo != 0 {
+		lc.setSolo(cont, 0)
+	}
+}
+
+func (lc *liveControls) activeDevices(devices []*device) []*device {
+	if lc.solo == 0 || lc.solo > len(devices) {
+		return devices
+	}
+	return devices[lc.solo-1 : lc.solo]
+}
+
+// status is the mode panel line describing the current settings.
+func (lc *liveControls) status(cont *controller) string {
+	state := "running"
+	if lc.paused {
+		state = "paused"
+	}
+	solo := "all"
+	if lc.solo > 0 && lc.solo <= len(cont.devices) {
+		solo = cont.devices[lc.solo-1].Name()
+	}
+	brightness := lc.lum.String()
+	if cont.scale < colors.Full {
+		brightness += " scaled to " + cont.scale.String()
+	}
+	return fmt.Sprintf("%s | every %v | brightness %s | palette %s | devices %s | %s for keys",
+		state, lc.interval, brightness, lc.currentPalette().Name, solo, lc.bindings.keyFor(actionHelp))
+}
+
+func clampInterval(d time.Duration) time.Duration {
+	if d < minInterval {
+		return minInterval
+	}
+	if d > maxInterval {
+		return maxInterval
+	}
+	return d.Round(time.Millisecond)
+}
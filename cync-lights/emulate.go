@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/emulator"
+	"github.com/pkg/errors"
+)
+
+// CyncCloud is the address of an emulated cloud's API to use instead of GE's,
+// like --cloud.
+const CyncCloud = "CYNC_CLOUD"
+
+const (
+	defaultEmulatorListen   = "127.0.0.1:8780"
+	defaultEmulatorEmail    = "test@example.com"
+	defaultEmulatorPassword = "password"
+	defaultEmulatorCode     = "123456"
+)
+
+// cloudAddr is the emulated cloud to use, from --cloud or CYNC_CLOUD.
+func cloudAddr(args []string) (string, bool) {
+	if addr, ok := flagValue(args, "cloud"); ok && addr != "" {
+		return addr, true
+	}
+	addr := os.Getenv(CyncCloud)
+	return addr, addr != ""
+}
+
+// runEmulator serves an emulated cloud until interrupted, to run the
+// controller against it with --cloud:
+//
+//	cync-lights emulator [--listen=127.0.0.1:8780] [--devices=3|desk,lamp]
+//	  [--email=] [--password=] [--code=] [--latency=50ms] [--loss=0.1] [--offline=lamp]
+//
+// The control channel listens on port 23778 of the same host, since that's
+// where cbyge dials it. While it runs, lines on stdin change it: offline
+// <device>, online <device>, latency <duration>, loss <fraction> and status.
+func runEmulator(args []string) error {
+	addr, _ := flagValue(args, "listen")
+	if addr == "" {
+		addr = defaultEmulatorListen
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "invalid --listen")
+	}
+	devices, err := emulatedDevices(flagOr(args, "devices", "3"))
+	if err != nil {
+		return errors.Wrap(err, "invalid --devices")
+	}
+	cfg := emulator.Config{
+		Email:    flagOr(args, "email", defaultEmulatorEmail),
+		Password: flagOr(args, "password", defaultEmulatorPassword),
+		Code:     flagOr(args, "code", defaultEmulatorCode),
+		Devices:  devices,
+	}
+	if latency, ok := flagValue(args, "latency"); ok {
+		if cfg.Latency, err = parseLatency(latency); err != nil {
+			return errors.Wrap(err, "invalid --latency")
+		}
+	}
+	if loss, ok := flagValue(args, "loss"); ok {
+		if cfg.Loss, err = parseLoss(loss); err != nil {
+			return errors.Wrap(err, "invalid --loss")
+		}
+	}
+	if offline, ok := flagValue(args, "offline"); ok && offline != "" {
+		cfg.Offline = strings.Split(offline, ",")
+	}
+
+	server, err := emulator.Start(cfg, addr, net.JoinHostPort(host, emulator.ControlPort))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[emulator] API on %s, control channel on %s, %d devices: %s\n", server.APIAddr(), server.ControlAddr(), len(cfg.Devices), strings.Join(cfg.Devices, ", "))
+	fmt.Printf("[emulator] log in with %s=%s cync-lights %s %s, the 2FA code is %s\n", CyncCloud, server.APIAddr(), cfg.Email, cfg.Password, cfg.Code)
+	go emulatorInput(server)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	fmt.Printf("[emulator] %d logins, %d commands received\n", server.Logins(), server.Calls())
+	return server.Close()
+}
+
+// emulatorInput changes the emulator from stdin until it's closed.
+func emulatorInput(server *emulator.Server) {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var arg string
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+		var err error
+		switch fields[0] {
+		case "offline", "online":
+			err = server.SetOffline(arg, fields[0] == "offline")
+		case "latency":
+			d, perr := parseLatency(arg)
+			if err = perr; err == nil {
+				server.SetLatency(d)
+			}
+		case "loss":
+			p, perr := parseLoss(arg)
+			if err = perr; err == nil {
+				server.SetLoss(p)
+			}
+		case "status":
+			for _, name := range server.Devices() {
+				d, _ := server.Device(name)
+				fmt.Printf("[emulator] %s: on %t, brightness %d, tone %d, rgb %t %v\n", name, d.IsOn, d.Brightness, d.ColorTone, d.UseRGB, d.RGB)
+			}
+			fmt.Printf("[emulator] %d logins, %d commands received\n", server.Logins(), server.Calls())
+			continue
+		default:
+			err = errors.New("try offline <device>, online <device>, latency <duration>, loss <fraction> or status")
+		}
+		if err != nil {
+			fmt.Printf("[emulator] %v\n", err)
+		} else {
+			fmt.Printf("[emulator] ok\n")
+		}
+	}
+}
+
+// emulatedDevices is either how many bulbs to make up names for or their
+// names.
+func emulatedDevices(value string) ([]string, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return strings.Split(value, ","), nil
+	}
+	if err := emulator.CheckDevices(n); err != nil {
+		return nil, err
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("bulb-%d", i+1)
+	}
+	return names, nil
+}
+
+// parseLatency is like configDuration, but 0 turns the latency off.
+func parseLatency(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.Errorf("%v is negative", d)
+	}
+	return d, nil
+}
+
+func parseLoss(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, errors.Errorf("%v isn't between 0 and 1", p)
+	}
+	return p, nil
+}
+
+func flagOr(args []string, name, fallback string) string {
+	if value, ok := flagValue(args, name); ok && value != "" {
+		return value
+	}
+	return fallback
+}
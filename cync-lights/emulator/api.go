@@ -0,0 +1,174 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/unixpickle/cbyge"
+)
+
+// errCodeTwoFactor is a wrong or unrequested 2FA code. cbyge has no name for
+// it and only shows the message.
+const errCodeTwoFactor = 4001008
+
+// remoteError is how the API fails, cbyge reads the code out of it.
+type remoteError struct {
+	Error struct {
+		Msg  string `json:"msg"`
+		Code int    `json:"code"`
+	} `json:"error"`
+}
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/user_auth", s.post(s.handleLogin))
+	mux.HandleFunc("/v2/two_factor/email/verifycode", s.post(s.handleSendCode))
+	mux.HandleFunc("/v2/user_auth/two_factor", s.post(s.handleTwoFactor))
+	mux.HandleFunc("/v2/user/", s.authed(s.handleUser))
+	mux.HandleFunc("/v2/product/", s.authed(s.handleProperties))
+	return mux
+}
+
+func (s *Server) post(handler func(w http.ResponseWriter, body map[string]string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.wait()
+		if r.Method != http.MethodPost {
+			fail(w, http.StatusMethodNotAllowed, 0, "use POST")
+			return
+		}
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			fail(w, http.StatusBadRequest, 0, "invalid JSON: "+err.Error())
+			return
+		}
+		handler(w, body)
+	}
+}
+
+// authed checks the Access-Token header a login handed out.
+func (s *Server) authed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.wait()
+		if r.Method != http.MethodGet {
+			fail(w, http.StatusMethodNotAllowed, 0, "use GET")
+			return
+		}
+		if r.Header.Get("Access-Token") != s.session().AccessToken {
+			fail(w, http.StatusForbidden, cbyge.RemoteErrorCodeAccessTokenRefresh, "access-token is invalid")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// handleLogin is the login older accounts use, without 2FA.
+func (s *Server) handleLogin(w http.ResponseWriter, body map[string]string) {
+	if s.checkAccount(w, body) {
+		s.login(w, body["email"])
+	}
+}
+
+// handleSendCode is where the 2FA email would be sent, the code's logged
+// instead since it never changes.
+func (s *Server) handleSendCode(w http.ResponseWriter, body map[string]string) {
+	email := body["email"]
+	if email != s.cfg.Email {
+		fail(w, http.StatusBadRequest, cbyge.RemoteErrorCodeUserNotExists, "user not exists")
+		return
+	}
+	s.mu.Lock()
+	s.codeSent[email] = true
+	s.mu.Unlock()
+	emulatorLog.Info("2FA code requested", log.F("email", email), log.F("code", s.cfg.Code))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleTwoFactor(w http.ResponseWriter, body map[string]string) {
+	if !s.checkAccount(w, body) {
+		return
+	}
+	email := body["email"]
+	s.mu.Lock()
+	sent := s.codeSent[email]
+	s.mu.Unlock()
+	switch {
+	case !sent:
+		fail(w, http.StatusBadRequest, errCodeTwoFactor, "two factor code not requested")
+	case body["two_factor"] != s.cfg.Code:
+		fail(w, http.StatusBadRequest, errCodeTwoFactor, "two factor code is wrong")
+	default:
+		s.login(w, email)
+	}
+}
+
+func (s *Server) checkAccount(w http.ResponseWriter, body map[string]string) bool {
+	switch {
+	case body["email"] != s.cfg.Email:
+		fail(w, http.StatusBadRequest, cbyge.RemoteErrorCodeUserNotExists, "user not exists")
+		return false
+	case body["password"] != s.cfg.Password:
+		fail(w, http.StatusBadRequest, cbyge.RemoteErrorCodePasswordError, "password error")
+		return false
+	}
+	return true
+}
+
+func (s *Server) login(w http.ResponseWriter, email string) {
+	s.mu.Lock()
+	s.logins++
+	delete(s.codeSent, email)
+	s.mu.Unlock()
+	emulatorLog.Info("logged in", log.F("email", email))
+	reply(w, s.session())
+}
+
+// handleUser serves /v2/user/<id> and /v2/user/<id>/subscribe/devices.
+func (s *Server) handleUser(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2/user/")
+	// cbyge's own types don't marshal their dates the way they're read, so
+	// these are built by hand
+	switch path {
+	case fmt.Sprint(userID):
+		reply(w, map[string]interface{}{"id": userID, "email": s.cfg.Email, "nickname": "emulated", "is_valid": true, "passwd_inited": true})
+	case fmt.Sprintf("%d/subscribe/devices", userID):
+		// the home is the one device, its bulbs are its properties
+		reply(w, []map[string]interface{}{{"id": homeID, "name": "Emulated home", "product_id": productID, "is_online": true, "is_active": true}})
+	default:
+		fail(w, http.StatusNotFound, cbyge.RemoteErrorCodeUserNotExists, "user not exists")
+	}
+}
+
+// handleProperties serves /v2/product/<product>/device/<id>/property, the
+// bulbs in the home. Every bulb is its own switch, like wifi bulbs are.
+func (s *Server) handleProperties(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != fmt.Sprintf("/v2/product/%s/device/%d/property", productID, homeID) {
+		fail(w, http.StatusNotFound, cbyge.RemoteErrorCodePropertyNotExists, "property not exists")
+		return
+	}
+	var props cbyge.DeviceProperties
+	for _, name := range s.cfg.Devices {
+		id := int64(homeID)*1000 + int64(s.indexes[name])
+		props.Bulbs = append(props.Bulbs, struct {
+			DeviceID    int64  `json:"deviceID"`
+			DisplayName string `json:"displayName"`
+			SwitchID    uint64 `json:"switchID"`
+		}{DeviceID: id, DisplayName: name, SwitchID: uint64(id)})
+	}
+	reply(w, props)
+}
+
+func reply(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, status, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	var e remoteError
+	e.Error.Msg, e.Error.Code = msg, code
+	json.NewEncoder(w).Encode(e)
+}
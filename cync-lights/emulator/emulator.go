@@ -0,0 +1,221 @@
+// Package emulator stands in for the Cync cloud, to run the controller end to
+// end without GE's servers. It serves the HTTP API cbyge logs in and lists
+// devices with, and the binary control channel with simulated bulbs behind
+// it. Answers can be slowed down, dropped, and bulbs taken offline, to see how
+// the controller copes.
+package emulator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/local"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+var emulatorLog = log.For("emulator")
+
+const (
+	// ControlPort is the port cbyge dials the control channel on, it isn't
+	// configurable there so an emulator redirected to has to use it too
+	ControlPort = "23778"
+	// MaxDevices is how many bulbs fit in the one status answer cbyge reads
+	// per switch
+	MaxDevices = 10
+
+	userID    uint32 = 4200001
+	homeID    uint32 = 2000
+	productID        = "emulated"
+)
+
+// Config is the account and the bulbs it has.
+type Config struct {
+	// Email and Password log in, Code is the 2FA code every login is sent
+	Email, Password, Code string
+	// Devices names the bulbs, at most MaxDevices
+	Devices []string
+	// Latency delays every answer, from the API and the control channel
+	Latency time.Duration
+	// Loss is the fraction of commands dropped without an answer, 0 to 1
+	Loss float64
+	// Offline names bulbs that start out unreachable
+	Offline []string
+}
+
+// Server is a running emulator. It's safe to use from any goroutine.
+type Server struct {
+	cfg      Config
+	listener net.Listener
+	api      *http.Server
+	control  *local.Mock
+	// indexes are the bulbs' places in the mesh by name, from 1
+	indexes map[string]int
+
+	mu      sync.Mutex
+	latency time.Duration
+	// codeSent is the emails a 2FA code was requested for, a login needs
+	// one first
+	codeSent map[string]bool
+	logins   int
+}
+
+// CheckDevices says whether the emulator can have n bulbs.
+func CheckDevices(n int) error {
+	if n < 1 || n > MaxDevices {
+		return errors.Errorf("the emulator needs 1 to %d devices, not %d", MaxDevices, n)
+	}
+	return nil
+}
+
+// Start serves the API on apiAddr and the control channel on controlAddr,
+// either can be port 0 for any free one.
+func Start(cfg Config, apiAddr, controlAddr string) (*Server, error) {
+	if err := CheckDevices(len(cfg.Devices)); err != nil {
+		return nil, err
+	}
+	if cfg.Email == "" || cfg.Password == "" || cfg.Code == "" {
+		return nil, errors.New("the emulator needs an email, password and 2FA code")
+	}
+	s := &Server{
+		cfg:      cfg,
+		indexes:  map[string]int{},
+		latency:  cfg.Latency,
+		codeSent: map[string]bool{},
+	}
+	for i, name := range cfg.Devices {
+		if _, ok := s.indexes[name]; ok {
+			return nil, errors.Errorf("device %q is named twice", name)
+		}
+		s.indexes[name] = i + 1
+	}
+
+	control, err := local.NewMock(controlAddr, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for the control channel")
+	}
+	session := s.session()
+	control.SetAuth(func(id uint32, code string) bool {
+		return id == session.UserID && code == session.Authorize
+	})
+	control.SetLatency(cfg.Latency)
+	control.SetLoss(cfg.Loss)
+	for _, index := range s.indexes {
+		control.Add(index)
+	}
+	s.control = control
+	for _, name := range cfg.Offline {
+		if err := s.SetOffline(name, true); err != nil {
+			control.Close()
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("tcp", apiAddr)
+	if err != nil {
+		control.Close()
+		return nil, errors.Wrap(err, "failed to listen for the API")
+	}
+	s.listener = listener
+	s.api = &http.Server{Handler: s.routes()}
+	go func() {
+		if err := s.api.Serve(listener); err != nil && err != http.ErrServerClosed {
+			emulatorLog.Error("API stopped", log.Err(err))
+		}
+	}()
+	emulatorLog.Info("emulating the cloud", log.F("api", s.APIAddr()), log.F("control", s.ControlAddr()), log.F("devices", len(cfg.Devices)))
+	return s, nil
+}
+
+func (s *Server) APIAddr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) ControlAddr() string {
+	return s.control.Addr()
+}
+
+// Devices are the bulbs' names in mesh order.
+func (s *Server) Devices() []string {
+	return append([]string(nil), s.cfg.Devices...)
+}
+
+// SetOffline has a bulb stop answering, or answer again.
+func (s *Server) SetOffline(name string, offline bool) error {
+	index, ok := s.indexes[name]
+	if !ok {
+		return errors.Errorf("no device named %q", name)
+	}
+	s.control.SetOffline(index, offline)
+	return nil
+}
+
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	s.latency = d
+	s.mu.Unlock()
+	s.control.SetLatency(d)
+}
+
+func (s *Server) SetLoss(p float64) {
+	s.control.SetLoss(p)
+}
+
+// Device is what a bulb is set to.
+func (s *Server) Device(name string) (cbyge.StatusPaginatedResponse, error) {
+	index, ok := s.indexes[name]
+	if !ok {
+		return cbyge.StatusPaginatedResponse{}, errors.Errorf("no device named %q", name)
+	}
+	d, _ := s.control.Device(index)
+	return d, nil
+}
+
+// Calls is how many commands the control channel has received.
+func (s *Server) Calls() int {
+	return s.control.Calls()
+}
+
+// Logins is how many sessions have been handed out.
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+func (s *Server) Close() error {
+	err := s.api.Close()
+	if cerr := s.control.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// session is the same for every login to the account, so a session saved in
+// CYNC_SESSION still works after the emulator restarts.
+func (s *Server) session() *cbyge.SessionInfo {
+	return &cbyge.SessionInfo{
+		AccessToken:  s.token("access"),
+		RefreshToken: s.token("refresh"),
+		UserID:       userID,
+		ExpireIn:     int((7 * 24 * time.Hour).Seconds()),
+		Authorize:    s.token("authorize"),
+	}
+}
+
+func (s *Server) token(kind string) string {
+	sum := sha256.Sum256([]byte(kind + ":" + s.cfg.Email + ":" + s.cfg.Password))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (s *Server) wait() {
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+	time.Sleep(latency)
+}
@@ -0,0 +1,237 @@
+package emulator
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unixpickle/cbyge"
+)
+
+var testConfig = Config{
+	Email:    "test@example.com",
+	Password: "password",
+	Code:     "123456",
+	Devices:  []string{"desk", "lamp", "shelf"},
+	Offline:  []string{"shelf"},
+}
+
+// startRedirected runs an emulator with this process's cbyge pointed at it,
+// undoing the redirect afterwards. cbyge only dials the control channel on
+// ControlPort, so that has to be free.
+func startRedirected(t *testing.T) *Server {
+	t.Helper()
+	s, err := Start(testConfig, "127.0.0.1:0", net.JoinHostPort("127.0.0.1", ControlPort))
+	if err != nil {
+		t.Skipf("can't start the emulator, is one already running? %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	transport, resolver := http.DefaultClient.Transport, net.DefaultResolver
+	t.Cleanup(func() { http.DefaultClient.Transport, net.DefaultResolver = transport, resolver })
+	if err := Redirect(s.APIAddr()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func login(t *testing.T) *cbyge.SessionInfo {
+	t.Helper()
+	callback, err := cbyge.Login2FA(testConfig.Email, testConfig.Password, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := callback("000000"); err == nil {
+		t.Fatal("logged in with the wrong code")
+	}
+	session, err := callback(testConfig.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestLoginAndControl(t *testing.T) {
+	s := startRedirected(t)
+
+	if _, err := cbyge.Login2FAStage2(testConfig.Email, testConfig.Password, "", testConfig.Code); err == nil {
+		t.Fatal("logged in without asking for a code")
+	}
+	if _, err := cbyge.Login2FA(testConfig.Email, "wrong", ""); err != nil {
+		// the password is only checked with the code
+		t.Fatal(err)
+	}
+	session := login(t)
+	if s.Logins() != 1 {
+		t.Errorf("%d logins, want 1", s.Logins())
+	}
+
+	controller := cbyge.NewController(session, time.Second)
+	devices, err := controller.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range devices {
+		names = append(names, d.Name())
+	}
+	if strings.Join(names, ",") != "desk,lamp,shelf" {
+		t.Fatalf("devices %v", names)
+	}
+
+	if err := controller.SetDeviceRGB(devices[0], 10, 20, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.SetDeviceStatus(devices[1], false); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.SetDeviceLum(devices[2], 50); err == nil {
+		t.Error("an offline bulb took a command")
+	}
+
+	desk, err := s.Device("desk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !desk.IsOn || !desk.UseRGB || desk.RGB != [3]uint8{10, 20, 30} {
+		t.Errorf("desk is %+v", desk)
+	}
+	if lamp, _ := s.Device("lamp"); lamp.IsOn {
+		t.Errorf("lamp is %+v", lamp)
+	}
+	if shelf, _ := s.Device("shelf"); shelf.Brightness == 50 {
+		t.Errorf("shelf is %+v", shelf)
+	}
+	if _, err := s.Device("attic"); err == nil {
+		t.Error("found a device that isn't there")
+	}
+
+	// the offline bulb answers again once it's back, cbyge finds its
+	// switch again when the devices are listed
+	if err := s.SetOffline("shelf", false); err != nil {
+		t.Fatal(err)
+	}
+	if devices, err = controller.Devices(); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.SetDeviceLum(devices[2], 50); err != nil {
+		t.Fatal(err)
+	}
+	if shelf, _ := s.Device("shelf"); shelf.Brightness != 50 {
+		t.Errorf("shelf is %+v", shelf)
+	}
+}
+
+// a session saved from one run, like CYNC_SESSION, still works after the
+// emulator restarts, without logging in again
+func TestSessionReuse(t *testing.T) {
+	first := startRedirected(t)
+	session := login(t)
+	first.Close()
+
+	s := startRedirected(t)
+	controller := cbyge.NewController(session, time.Second)
+	devices, err := controller.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.SetDeviceStatus(devices[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if desk, _ := s.Device("desk"); desk.IsOn {
+		t.Errorf("desk is %+v", desk)
+	}
+	if s.Logins() != 0 {
+		t.Errorf("%d logins, want the saved session used", s.Logins())
+	}
+
+	// a made up token is refused
+	bad := *session
+	bad.AccessToken = "made-up"
+	if _, err := cbyge.NewController(&bad, time.Second).Devices(); err == nil {
+		t.Error("listed devices with a made up token")
+	}
+}
+
+func TestDevicesRange(t *testing.T) {
+	for _, n := range []int{-1, 0, MaxDevices + 1} {
+		if err := CheckDevices(n); err == nil {
+			t.Errorf("%d devices allowed", n)
+		}
+	}
+	cfg := testConfig
+	cfg.Devices = nil
+	if _, err := Start(cfg, "127.0.0.1:0", "127.0.0.1:0"); err == nil || !strings.Contains(err.Error(), "1 to 10") {
+		t.Errorf("got %v, want the range", err)
+	}
+}
+
+// query builds a DNS query for name.
+func query(name string, qtype uint16) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	// the type, then class IN
+	return append(q, 0, byte(qtype>>8), byte(qtype), 0, 1)
+}
+
+func TestDNSAnswer(t *testing.T) {
+	ip := net.IPv4(127, 0, 0, 1).To4()
+	answer, ours := dnsAnswer(query("cm.gelighting.com", 1), ip)
+	if !ours || binary.BigEndian.Uint16(answer[6:8]) != 1 || !net.IP(answer[len(answer)-4:]).Equal(ip) {
+		t.Errorf("cm.gelighting.com answered % x", answer)
+	}
+	answer, ours = dnsAnswer(query("api.gelighting.com", 28), ip)
+	if !ours || binary.BigEndian.Uint16(answer[6:8]) != 0 {
+		t.Errorf("an AAAA query answered % x", answer)
+	}
+	if _, ours := dnsAnswer(query("broker.example.com", 1), ip); ours {
+		t.Error("answered for a name outside the cloud's domain")
+	}
+}
+
+// other names go to the nameserver the resolver asked for
+func TestForwardDNS(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, from, err := upstream.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		// echo the query back marked as a response
+		buf[2] |= 0x80
+		upstream.WriteTo(buf[:n], from)
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go answerDNS(server, net.IPv4(127, 0, 0, 1).To4(), func(q []byte) ([]byte, error) {
+		return forwardDNS(ctx, "udp", upstream.LocalAddr().String(), q)
+	})
+
+	q := query("broker.example.com", 1)
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write(append([]byte{0, byte(len(q))}, q...)); err != nil {
+		t.Fatal(err)
+	}
+	answer := make([]byte, 2+len(q))
+	if _, err := client.Read(answer); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint16(answer) != uint16(len(q)) || answer[4]&0x80 == 0 || string(answer[2+12:]) != string(q[12:]) {
+		t.Errorf("forwarded answer % x", answer)
+	}
+}
@@ -0,0 +1,197 @@
+package emulator
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// cloudDomain is what cbyge's API and control channel are under.
+const cloudDomain = "gelighting.com"
+
+// Redirect points this process's cbyge at an emulator whose API is at addr.
+// API requests are sent there over plain HTTP. cbyge dials the control
+// channel by name on a fixed port, so names under the cloud's domain resolve
+// to the emulator's host, where it has to listen on ControlPort. Every DNS
+// lookup goes through here from then on, queries for other names are passed
+// on to the nameserver they were meant for.
+func Redirect(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrap(err, "the emulator's address needs a host and port")
+	}
+	ip := net.ParseIP(host)
+	if host == "localhost" {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip == nil || ip.To4() == nil {
+		return errors.Errorf("the emulator's host has to be an IPv4 address, not %q", host)
+	}
+	next := http.DefaultClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	// http.Post uses the default client too
+	http.DefaultClient.Transport = &redirect{api: addr, next: next}
+	net.DefaultResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go answerDNS(server, ip.To4(), func(query []byte) ([]byte, error) {
+				return forwardDNS(ctx, network, address, query)
+			})
+			return client, nil
+		},
+	}
+	return nil
+}
+
+type redirect struct {
+	api  string
+	next http.RoundTripper
+}
+
+func (r *redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !inCloudDomain(req.URL.Hostname()) {
+		return r.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host, req.Host = "http", r.api, r.api
+	return r.next.RoundTrip(req)
+}
+
+func inCloudDomain(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return name == cloudDomain || strings.HasSuffix(name, "."+cloudDomain)
+}
+
+// answerDNS answers queries on a resolver connection. It isn't a packet
+// conn, so the resolver frames messages like DNS over TCP, each after its
+// length. Names in the cloud's domain get an A record with ip, or no records
+// for other types; anything else is answered by forward.
+func answerDNS(conn net.Conn, ip net.IP, forward func(query []byte) ([]byte, error)) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		answer, ours := dnsAnswer(query, ip)
+		if !ours {
+			var err error
+			if answer, err = forward(query); err != nil {
+				return
+			}
+		}
+		if answer == nil {
+			return
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(answer)))
+		if _, err := conn.Write(append(size[:], answer...)); err != nil {
+			return
+		}
+	}
+}
+
+// dnsAnswer builds the response to a query with one question about a name
+// in the cloud's domain. ours is false for other names, the answer is nil if
+// the query can't be read.
+func dnsAnswer(query []byte, ip net.IP) (answer []byte, ours bool) {
+	const header = 12
+	if len(query) < header || binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return nil, true
+	}
+	var labels []string
+	end := header
+	for {
+		if end >= len(query) {
+			return nil, true
+		}
+		n := int(query[end])
+		end++
+		if n == 0 {
+			break
+		}
+		if n > 63 || end+n > len(query) {
+			return nil, true
+		}
+		labels = append(labels, string(query[end:end+n]))
+		end += n
+	}
+	if end+4 > len(query) {
+		return nil, true
+	}
+	if !inCloudDomain(strings.Join(labels, ".")) {
+		return nil, false
+	}
+	qtype := binary.BigEndian.Uint16(query[end : end+2])
+	question := query[header : end+4]
+
+	answer = make([]byte, header, header+len(question)+16)
+	copy(answer, query[:2])
+	// a response to a recursive query, recursion available
+	flags := uint16(0x8180)
+	var records uint16
+	if qtype == 1 {
+		records = 1
+	}
+	binary.BigEndian.PutUint16(answer[2:], flags)
+	binary.BigEndian.PutUint16(answer[4:], 1)
+	binary.BigEndian.PutUint16(answer[6:], records)
+	answer = append(answer, question...)
+	if records == 1 {
+		// the question's name, type A, class IN, a minute's TTL, 4 bytes
+		answer = append(answer, 0xc0, header, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		answer = append(answer, ip...)
+	}
+	return answer, true
+}
+
+// forwardDNS asks the nameserver the resolver meant to dial, over UDP or
+// TCP as it asked for.
+func forwardDNS(ctx context.Context, network, address string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		answer := make([]byte, 65535)
+		n, err := conn.Read(answer)
+		if err != nil {
+			return nil, err
+		}
+		return answer[:n], nil
+	}
+
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(query)))
+	if _, err := conn.Write(append(size[:], query...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
@@ -0,0 +1,241 @@
+package energy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dateFormat = "2006-01-02"
+	// keep is how many days of totals are kept, a year and a bit so last
+	// year's month is there to compare against
+	keep = 400
+)
+
+// Usage is energy used and time spent on.
+type Usage struct {
+	Wh        float64 `json:"wh"`
+	OnSeconds float64 `json:"on_seconds"`
+}
+
+func (u Usage) KWh() float64 {
+	return u.Wh / 1000
+}
+
+func (u Usage) Hours() float64 {
+	return u.OnSeconds / 3600
+}
+
+func (u *Usage) add(other Usage) {
+	u.Wh += other.Wh
+	u.OnSeconds += other.OnSeconds
+}
+
+// reading is what a device is drawing and since when.
+type reading struct {
+	on    bool
+	watts float64
+	since time.Time
+}
+
+// Meter adds up each device's usage by day. Devices are kept by name so the
+// totals read well in exports. It's safe to use from any goroutine.
+type Meter struct {
+	mu   sync.Mutex
+	path string
+	// days is usage by date, then device
+	days map[string]map[string]*Usage
+	live map[string]reading
+}
+
+// NewMeter is a meter that saves to path, or nowhere if path is empty.
+func NewMeter(path string) *Meter {
+	return &Meter{path: path, days: map[string]map[string]*Usage{}, live: map[string]reading{}}
+}
+
+// Open loads the totals saved at path. A missing file is an empty meter.
+func Open(path string) (*Meter, error) {
+	m := NewMeter(path)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read usage")
+	}
+	if err := json.Unmarshal(data, &m.days); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return m, nil
+}
+
+// Set starts metering a device at a new draw, counting the old one up to
+// now.
+func (m *Meter) Set(device string, on bool, watts float64, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if r, ok := m.live[device]; ok {
+		m.accrue(device, r, now)
+	}
+	m.live[device] = reading{on: on, watts: watts, since: now}
+}
+
+// Flush counts every device's draw up to now.
+func (m *Meter) Flush(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for device, r := range m.live {
+		m.accrue(device, r, now)
+		r.since = now
+		m.live[device] = r
+	}
+}
+
+// accrue adds a reading up to now, split at midnight so each day gets its
+// share.
+func (m *Meter) accrue(device string, r reading, now time.Time) {
+	for from := r.since; from.Before(now); {
+		y, mo, d := from.Date()
+		midnight := time.Date(y, mo, d+1, 0, 0, 0, 0, from.Location())
+		to := now
+		if midnight.Before(now) {
+			to = midnight
+		}
+		seconds := to.Sub(from).Seconds()
+		day, ok := m.days[from.Format(dateFormat)]
+		if !ok {
+			day = map[string]*Usage{}
+			m.days[from.Format(dateFormat)] = day
+		}
+		u, ok := day[device]
+		if !ok {
+			u = &Usage{}
+			day[device] = u
+		}
+		u.Wh += r.watts * seconds / 3600
+		if r.on {
+			u.OnSeconds += seconds
+		}
+		from = to
+	}
+}
+
+// Save writes the totals, dropping days too old to keep. It writes a new
+// file and renames it over the old one so a crash can't leave half a file.
+func (m *Meter) Save(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.path == "" {
+		return nil
+	}
+	oldest := now.AddDate(0, 0, -keep).Format(dateFormat)
+	for date := range m.days {
+		if date < oldest {
+			delete(m.days, date)
+		}
+	}
+	data, err := json.Marshal(m.days)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal usage")
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to save usage")
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.Wrap(err, "failed to save usage")
+	}
+	return errors.Wrap(os.Rename(tmp, m.path), "failed to save usage")
+}
+
+// Totals is each device's usage on the days from from up to today, to
+// included. Call Flush first to count what's being drawn right now.
+func (m *Meter) Totals(from, to time.Time) map[string]Usage {
+	totals := map[string]Usage{}
+	for _, row := range m.Rows(from, to) {
+		u := totals[row.Device]
+		u.add(row.Usage)
+		totals[row.Device] = u
+	}
+	return totals
+}
+
+// Row is a device's usage on a day.
+type Row struct {
+	Date   string
+	Device string
+	// Groups are the groups the device is in, filled in by whoever knows
+	Groups []string
+	Usage
+}
+
+// Rows is every device's usage each day from from to to, both included,
+// oldest first.
+func (m *Meter) Rows(from, to time.Time) []Row {
+	first, last := from.Format(dateFormat), to.Format(dateFormat)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var rows []Row
+	for date, devices := range m.days {
+		if date < first || date > last {
+			continue
+		}
+		for device, u := range devices {
+			rows = append(rows, Row{Date: date, Device: device, Usage: *u})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Date != rows[j].Date {
+			return rows[i].Date < rows[j].Date
+		}
+		return rows[i].Device < rows[j].Device
+	})
+	return rows
+}
+
+// Periods are the spans usage is reported over.
+var Periods = []string{"day", "week", "month"}
+
+// Since is when a period that's still going began: today, this week from
+// Monday or this month.
+func Since(period string, now time.Time) (time.Time, error) {
+	y, mo, d := now.Date()
+	switch period {
+	case "day":
+		return time.Date(y, mo, d, 0, 0, 0, 0, now.Location()), nil
+	case "week":
+		back := (int(now.Weekday()) + 6) % 7
+		return time.Date(y, mo, d-back, 0, 0, 0, 0, now.Location()), nil
+	case "month":
+		return time.Date(y, mo, 1, 0, 0, 0, 0, now.Location()), nil
+	}
+	return time.Time{}, errors.Errorf("unknown period %q, use %s", period, strings.Join(Periods, ", "))
+}
+
+// WriteCSV writes rows for a spreadsheet, costed at price a kWh.
+func WriteCSV(w io.Writer, rows []Row, price float64) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "device", "groups", "kwh", "hours_on", "cost"})
+	for _, row := range rows {
+		out.Write([]string{
+			row.Date,
+			row.Device,
+			strings.Join(row.Groups, ";"),
+			fmt.Sprintf("%.4f", row.KWh()),
+			fmt.Sprintf("%.2f", row.Hours()),
+			fmt.Sprintf("%.4f", row.KWh()*price),
+		})
+	}
+	out.Flush()
+	return errors.Wrap(out.Error(), "failed to write csv")
+}
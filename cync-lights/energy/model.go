@@ -0,0 +1,98 @@
+// Package energy estimates how much power lights use from how long they're
+// on and how bright, and keeps totals by device and day.
+package energy
+
+import (
+	"sort"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/pkg/errors"
+)
+
+// DefaultModel is the name of the model devices without one use.
+const DefaultModel = "default"
+
+type point struct {
+	lum   colors.Brightness
+	watts float64
+}
+
+// Model is a compiled config.Wattage.
+type Model struct {
+	Name    string
+	points  []point
+	standby float64
+}
+
+// Default is roughly a full color A19: 9W at full, about 1W at the bottom
+// and a little while off.
+var Default = Model{
+	Name:    DefaultModel,
+	points:  []point{{lum: 1, watts: 1}, {lum: colors.Full, watts: 9}},
+	standby: 0.3,
+}
+
+// Watts is the draw of a bulb that's on at a brightness, or off.
+func (m Model) Watts(on bool, lum colors.Brightness) float64 {
+	if !on || lum <= colors.Off {
+		return m.standby
+	}
+	if lum <= m.points[0].lum {
+		return m.points[0].watts
+	}
+	for i := 1; i < len(m.points); i++ {
+		to := m.points[i]
+		if lum > to.lum {
+			continue
+		}
+		from := m.points[i-1]
+		p := float64(lum-from.lum) / float64(to.lum-from.lum)
+		return from.watts + (to.watts-from.watts)*p
+	}
+	return m.points[len(m.points)-1].watts
+}
+
+// Compile checks the wattage tables, returning all the problems at once.
+// Default is always there, replaced if the config has a default model.
+func Compile(cfg *config.Energy) (map[string]Model, []error) {
+	models := map[string]Model{DefaultModel: Default}
+	if cfg == nil {
+		return models, nil
+	}
+	var problems []error
+	for name, w := range cfg.Models {
+		m, err := compile(name, w)
+		if err != nil {
+			problems = append(problems, errors.Wrapf(err, "model %s", name))
+			continue
+		}
+		models[name] = m
+	}
+	if cfg.Price < 0 {
+		problems = append(problems, errors.New("price can't be negative"))
+	}
+	return models, problems
+}
+
+func compile(name string, w config.Wattage) (Model, error) {
+	if len(w.Watts) == 0 {
+		return Model{}, errors.New("needs watts at one brightness at least")
+	}
+	if w.Standby < 0 {
+		return Model{}, errors.New("standby can't be negative")
+	}
+	m := Model{Name: name, standby: w.Standby}
+	for at, watts := range w.Watts {
+		lum, err := colors.ParseBrightness(at)
+		if err != nil {
+			return Model{}, err
+		}
+		if watts < 0 {
+			return Model{}, errors.Errorf("watts at %s can't be negative", lum)
+		}
+		m.points = append(m.points, point{lum: lum, watts: watts})
+	}
+	sort.Slice(m.points, func(i, j int) bool { return m.points[i].lum < m.points[j].lum })
+	return m, nil
+}
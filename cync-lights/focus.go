@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/input"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+const ModeFocusID = "focus"
+
+var focusLog = log.For("mode.focus")
+
+const (
+	focusFrame            = 500 * time.Millisecond
+	defaultFocusWork      = 25 * time.Minute
+	defaultFocusBreak     = 5 * time.Minute
+	defaultFocusLongBreak = 15 * time.Minute
+	defaultFocusLongEvery = 4
+	defaultFocusWarning   = time.Minute
+)
+
+var (
+	defaultWorkColor  = colors.LightBlue
+	defaultWarnColor  = colors.Orange
+	defaultBreakColor = colors.Green
+)
+
+type focusPhase int
+
+const (
+	focusWork focusPhase = iota
+	focusBreak
+	focusLongBreak
+)
+
+func (p focusPhase) String() string {
+	switch p {
+	case focusBreak:
+		return "break"
+	case focusLongBreak:
+		return "long break"
+	}
+	return "work"
+}
+
+// focusSettings is the focus config with defaults filled in and parsed.
+type focusSettings struct {
+	work, brk, longBreak, warning  time.Duration
+	longEvery                      int
+	workColor, warnColor, brkColor colors.RGB
+	target                         string
+}
+
+func parseFocus(cfg *config.Focus) (focusSettings, error) {
+	if cfg == nil {
+		cfg = &config.Focus{}
+	}
+	s := focusSettings{longEvery: cfg.LongEvery, target: cfg.Target}
+	if s.longEvery <= 0 {
+		s.longEvery = defaultFocusLongEvery
+	}
+
+	var err error
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+		def   time.Duration
+	}{
+		{"work", cfg.Work, &s.work, defaultFocusWork},
+		{"break", cfg.Break, &s.brk, defaultFocusBreak},
+		{"long_break", cfg.LongBreak, &s.longBreak, defaultFocusLongBreak},
+		{"warning", cfg.Warning, &s.warning, defaultFocusWarning},
+	} {
+		if *d.to, err = configDuration(d.value, d.def); err != nil {
+			return s, errors.Wrapf(err, "focus %s", d.name)
+		}
+	}
+
+	for _, c := range []struct {
+		name  string
+		value string
+		to    *colors.RGB
+		def   colors.RGB
+	}{
+		{"work_color", cfg.WorkColor, &s.workColor, defaultWorkColor},
+		{"warn_color", cfg.WarnColor, &s.warnColor, defaultWarnColor},
+		{"break_color", cfg.BreakColor, &s.brkColor, defaultBreakColor},
+	} {
+		*c.to = c.def
+		if c.value == "" {
+			continue
+		}
+		if *c.to, err = colors.Parse(c.value); err != nil {
+			return s, errors.Wrapf(err, "focus %s", c.name)
+		}
+	}
+	return s, nil
+}
+
+// ModeFocus is a pomodoro timer: work sessions in a calm color that ramps to
+// a warning color over the last minute, then a break in another color. The
+// lights go back to how they were when it stops.
+type ModeFocus struct {
+	bindings bindings
+	// work and brk override the config for the next start, set by the focus
+	// command
+	work, brk time.Duration
+
+	settings focusSettings
+	devices  []*device
+	saved    map[*device]config.DeviceState
+	phase    focusPhase
+	// sessions is how many work sessions have finished
+	sessions int
+	// start is when the phase began, moved forward while paused
+	start   time.Time
+	elapsed time.Duration
+	paused  bool
+	sent    colors.RGB
+}
+
+func (mf *ModeFocus) onSwitch(cont *controller) error {
+	settings, err := parseFocus(cont.config.Focus)
+	if err != nil {
+		return err
+	}
+	if mf.work > 0 {
+		settings.work = mf.work
+	}
+	if mf.brk > 0 {
+		settings.brk = mf.brk
+	}
+	mf.work, mf.brk = 0, 0
+	if settings.warning > settings.work {
+		settings.warning = settings.work
+	}
+
+	devices, err := cont.resolveTarget(settings.target)
+	if err != nil {
+		return errors.Wrap(err, "focus target")
+	}
+	mf.settings = settings
+	mf.devices = devices
+	mf.saved = map[*device]config.DeviceState{}
+	for _, d := range devices {
+		mf.saved[d] = cont.deviceState(d)
+		if !cont.lastPower[d.DeviceID()] {
+			cont.SetStatus(d, true)
+		}
+	}
+	mf.sessions = 0
+	mf.paused = false
+	mf.begin(focusWork)
+
+	cont.view.Eventf(ui.TextColor, "Starting Focus Mode, %v work, %v break", settings.work, settings.brk)
+	return nil
+}
+
+func (mf *ModeFocus) begin(phase focusPhase) {
+	mf.phase = phase
+	mf.start = time.Now()
+	mf.elapsed = 0
+	mf.sent = colors.RGB{}
+}
+
+func (mf *ModeFocus) length() time.Duration {
+	switch mf.phase {
+	case focusBreak:
+		return mf.settings.brk
+	case focusLongBreak:
+		return mf.settings.longBreak
+	}
+	return mf.settings.work
+}
+
+func (mf *ModeFocus) run(cont *controller) (time.Duration, error) {
+	if !mf.paused {
+		mf.elapsed = time.Since(mf.start)
+	}
+	if mf.elapsed >= mf.length() {
+		mf.next(cont)
+	}
+	mf.apply(cont, mf.color())
+	mf.lines(cont)
+	return focusFrame, nil
+}
+
+// next moves on to the following phase, a long break after every few work
+// sessions.
+func (mf *ModeFocus) next(cont *controller) {
+	next := focusWork
+	if mf.phase == focusWork {
+		mf.sessions++
+		next = focusBreak
+		if mf.sessions%mf.settings.longEvery == 0 {
+			next = focusLongBreak
+		}
+	}
+	mf.begin(next)
+	focusLog.Info("focus phase", log.F("phase", next.String()), log.F("sessions", mf.sessions))
+	cont.notify(fmt.Sprintf("focus: %s for %v", next, mf.length()))
+}
+
+// color is the phase's color, blended toward the warning color over the end
+// of a work session.
+func (mf *ModeFocus) color() colors.RGB {
+	if mf.phase != focusWork {
+		return mf.settings.brkColor
+	}
+	left := mf.length() - mf.elapsed
+	if left >= mf.settings.warning {
+		return mf.settings.workColor
+	}
+	p := 1 - float64(left)/float64(mf.settings.warning)
+	return mix(mf.settings.workColor, mf.settings.warnColor, p)
+}
+
+func (mf *ModeFocus) apply(cont *controller, color colors.RGB) {
+	if color.GetRGB() == mf.sent.GetRGB() && mf.sent.Name != "" {
+		return
+	}
+	mf.sent = color
+	for _, d := range mf.devices {
+		cont.SetRGBAsync(d, color)
+	}
+}
+
+func (mf *ModeFocus) lines(cont *controller) {
+	left := mf.length() - mf.elapsed
+	if left < 0 {
+		left = 0
+	}
+	state := fmt.Sprintf("%s %d", mf.phase, mf.sessions+1)
+	if mf.phase != focusWork {
+		state = fmt.Sprintf("%s after %d", mf.phase, mf.sessions)
+	}
+	paused := ""
+	if mf.paused {
+		paused = " | paused"
+	}
+	cont.view.SetModeLines("[Focus Mode]",
+		fmt.Sprintf("%s | %02d:%02d left%s | %s pause, %s skip, %s stop", state, int(left.Minutes()), int(left.Seconds())%60, paused,
+			mf.bindings.keyFor(actionPause), mf.bindings.keyFor(actionSkip), mf.bindings.keyFor(actionQuit)))
+}
+
+func (mf *ModeFocus) wantsKey(k input.Key) bool {
+	switch mf.bindings[keyName(k)] {
+	case actionPause, actionSkip, actionQuit, actionHelp:
+		return true
+	}
+	return false
+}
+
+func (mf *ModeFocus) handleKey(cont *controller, k input.Key) bool {
+	switch mf.bindings[keyName(k)] {
+	case actionPause:
+		mf.paused = !mf.paused
+		if !mf.paused {
+			mf.start = time.Now().Add(-mf.elapsed)
+		}
+		return true
+	case actionSkip:
+		mf.next(cont)
+		return true
+	case actionQuit:
+		cont.SwitchMode(ModeCommandID)
+		return true
+	case actionHelp:
+		for _, line := range mf.bindings.describe(mf.wantsKey) {
+			cont.view.Eventf(ui.TextColor, "%s", line)
+		}
+	}
+	return false
+}
+
+func (mf *ModeFocus) onExit(cont *controller) {
+	for d, state := range mf.saved {
+		if err := cont.applyState(d, state); err != nil {
+			focusLog.Warn("failed to restore after focus", log.F("device", d.Name()), log.Err(err))
+		}
+	}
+	mf.saved = nil
+	cont.view.Eventf(ui.TextColor, "Exiting Focus Mode after %d sessions...", mf.sessions)
+}
+
+func (mf *ModeFocus) isIndefinite() bool {
+	return true
+}
+
+func (mf *ModeFocus) getId() string {
+	return ModeFocusID
+}
+
+// mix blends two colors, p from 0, all a, to 1, all b.
+func mix(a, b colors.RGB, p float64) colors.RGB {
+	channel := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*p + 0.5)
+	}
+	return colors.New(a.Name+"-"+b.Name, channel(a.RGBA.R, b.RGBA.R), channel(a.RGBA.G, b.RGBA.G), channel(a.RGBA.B, b.RGBA.B))
+}
+
+func runFocus(cont *controller, args parsedArgs) error {
+	mf := cont.modes[ModeFocusID].(*ModeFocus)
+	for _, d := range []struct {
+		name string
+		to   *time.Duration
+	}{{"work", &mf.work}, {"break", &mf.brk}} {
+		if !args.has(d.name) {
+			continue
+		}
+		length, err := configDuration(args.str(d.name), 0)
+		if err != nil {
+			return errors.Wrap(err, d.name)
+		}
+		*d.to = length
+	}
+	return cont.SwitchMode(ModeFocusID)
+}
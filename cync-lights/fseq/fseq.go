@@ -0,0 +1,250 @@
+// Package fseq reads FSEQ sequence files, the rendered channel data xLights
+// and the Falcon Player use. Versions 1 and 2 are supported, uncompressed or
+// zlib compressed, including v2 sparse ranges. zstd needs a library this
+// module doesn't pull in, such files have to be exported uncompressed.
+package fseq
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	fixedHeaderV1 = 28
+	fixedHeaderV2 = 32
+
+	compressionNone = 0
+	compressionZstd = 1
+	compressionZlib = 2
+)
+
+// Range is a run of channels stored in a sparse v2 file, Start is 0-based.
+type Range struct {
+	Start int
+	Count int
+}
+
+// Sequence is a decoded FSEQ file. Frames hold the stored channels only, use
+// Value to look channels up by their absolute number.
+type Sequence struct {
+	Major, Minor int
+	// Channels is how many channels each frame stores
+	Channels int
+	Step     time.Duration
+	// Headers are the variable headers, e.g. "mf" is the media file and "sp"
+	// the program that produced the sequence
+	Headers map[string]string
+	Ranges  []Range
+	frames  [][]byte
+}
+
+func Read(path string) (*Sequence, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read sequence %s", path)
+	}
+	seq, err := Parse(data)
+	return seq, errors.Wrapf(err, "failed to parse sequence %s", path)
+}
+
+func Parse(data []byte) (*Sequence, error) {
+	if len(data) < fixedHeaderV1 {
+		return nil, errors.New("too short for an fseq header")
+	}
+	if magic := string(data[0:4]); magic != "PSEQ" && magic != "FSEQ" {
+		return nil, errors.Errorf("not an fseq file, magic is %q", magic)
+	}
+
+	le := binary.LittleEndian
+	dataOffset := int(le.Uint16(data[4:]))
+	seq := &Sequence{
+		Minor:    int(data[6]),
+		Major:    int(data[7]),
+		Channels: int(le.Uint32(data[10:])),
+		Headers:  map[string]string{},
+	}
+	frameCount := int(le.Uint32(data[14:]))
+	headerStart := int(le.Uint16(data[8:]))
+
+	if dataOffset > len(data) {
+		return nil, errors.Errorf("channel data offset %d is past the end of the file", dataOffset)
+	}
+	if seq.Channels == 0 {
+		return nil, errors.New("channel count is 0")
+	}
+
+	compression := compressionNone
+	var blocks []block
+	switch seq.Major {
+	case 1:
+		// v1 has two bytes for the step, v2 one and then flags
+		seq.Step = time.Duration(le.Uint16(data[18:])) * time.Millisecond
+		if headerStart < fixedHeaderV1 {
+			headerStart = fixedHeaderV1
+		}
+	case 2:
+		if len(data) < fixedHeaderV2 {
+			return nil, errors.New("too short for a v2 header")
+		}
+		seq.Step = time.Duration(data[18]) * time.Millisecond
+		compression = int(data[20] & 0x0f)
+		blockCount := int(data[21]) | int(data[20]&0xf0)<<4
+		rangeCount := int(data[22])
+
+		pos := fixedHeaderV2
+		if pos+blockCount*8+rangeCount*6 > dataOffset {
+			return nil, errors.New("block index and sparse ranges overrun the header")
+		}
+		for i := 0; i < blockCount; i++ {
+			blocks = append(blocks, block{frame: int(le.Uint32(data[pos:])), size: int(le.Uint32(data[pos+4:]))})
+			pos += 8
+		}
+		for i := 0; i < rangeCount; i++ {
+			seq.Ranges = append(seq.Ranges, Range{Start: uint24(data[pos:]), Count: uint24(data[pos+3:])})
+			pos += 6
+		}
+		if headerStart < pos {
+			headerStart = pos
+		}
+	default:
+		return nil, errors.Errorf("unsupported fseq version %d.%d", seq.Major, seq.Minor)
+	}
+
+	if seq.Step == 0 {
+		return nil, errors.New("step time is 0")
+	}
+
+	seq.readHeaders(data[:dataOffset], headerStart)
+
+	// the counts come from the file, so nothing's allocated from them until
+	// there's data to back them
+	size := int64(frameCount) * int64(seq.Channels)
+	raw, err := decompress(data[dataOffset:], compression, blocks, size)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) < size {
+		return nil, errors.Errorf("header says %d frames but there's only data for %d", frameCount, len(raw)/seq.Channels)
+	}
+	seq.frames = make([][]byte, frameCount)
+	for i := range seq.frames {
+		seq.frames[i] = raw[i*seq.Channels : (i+1)*seq.Channels]
+	}
+	return seq, nil
+}
+
+// readHeaders reads variable headers: a 2 byte length that includes itself,
+// a 2 character code and a usually nul terminated value.
+func (s *Sequence) readHeaders(header []byte, pos int) {
+	for pos+4 <= len(header) {
+		size := int(binary.LittleEndian.Uint16(header[pos:]))
+		if size < 4 || pos+size > len(header) {
+			return
+		}
+		code := string(header[pos+2 : pos+4])
+		s.Headers[code] = strings.TrimRight(string(header[pos+4:pos+size]), "\x00")
+		pos += size
+	}
+}
+
+type block struct {
+	frame int
+	size  int
+}
+
+// decompress returns the channel data, stopping at limit bytes so a small
+// file can't claim to inflate to anything.
+func decompress(data []byte, compression int, blocks []block, limit int64) ([]byte, error) {
+	switch compression {
+	case compressionNone:
+		return data, nil
+	case compressionZstd:
+		return nil, errors.New("zstd compressed sequences aren't supported, export it uncompressed or with zlib")
+	case compressionZlib:
+	default:
+		return nil, errors.Errorf("unknown compression type %d", compression)
+	}
+
+	var out bytes.Buffer
+	pos := 0
+	for i, b := range blocks {
+		// writers pad the index with empty blocks
+		if b.size == 0 || int64(out.Len()) >= limit {
+			continue
+		}
+		if pos+b.size > len(data) {
+			return nil, errors.Errorf("block %d runs past the end of the file", i)
+		}
+		r, err := zlib.NewReader(bytes.NewReader(data[pos : pos+b.size]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "block %d", i)
+		}
+		if _, err := io.CopyN(&out, r, limit-int64(out.Len())); err != nil && err != io.EOF {
+			return nil, errors.Wrapf(err, "block %d", i)
+		}
+		pos += b.size
+	}
+	return out.Bytes(), nil
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func (s *Sequence) Frames() int {
+	return len(s.frames)
+}
+
+func (s *Sequence) Duration() time.Duration {
+	return time.Duration(len(s.frames)) * s.Step
+}
+
+func (s *Sequence) Version() string {
+	return fmt.Sprintf("%d.%d", s.Major, s.Minor)
+}
+
+// Span is one past the highest absolute channel the file has data for.
+func (s *Sequence) Span() int {
+	if len(s.Ranges) == 0 {
+		return s.Channels
+	}
+	span := 0
+	for _, r := range s.Ranges {
+		if end := r.Start + r.Count; end > span {
+			span = end
+		}
+	}
+	return span
+}
+
+// Value is a channel's value in a frame, by 0-based absolute channel number.
+// Channels a sparse file doesn't store are 0.
+func (s *Sequence) Value(frame, channel int) byte {
+	data := s.frames[frame]
+	if len(s.Ranges) == 0 {
+		if channel < 0 || channel >= len(data) {
+			return 0
+		}
+		return data[channel]
+	}
+
+	offset := 0
+	for _, r := range s.Ranges {
+		if channel >= r.Start && channel < r.Start+r.Count {
+			if i := offset + channel - r.Start; i < len(data) {
+				return data[i]
+			}
+			return 0
+		}
+		offset += r.Count
+	}
+	return 0
+}
@@ -0,0 +1,113 @@
+package fseq
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures hold 4 frames of 6 channels, channel c of frame f is f*10+c,
+// and an "mf" header naming song.mp3.
+func TestRead(t *testing.T) {
+	tests := []struct {
+		file    string
+		version string
+		step    time.Duration
+		ranges  []Range
+	}{
+		// a 300ms step needs both of v1's step bytes
+		{file: "v1.fseq", version: "1.0", step: 300 * time.Millisecond},
+		{file: "v2.fseq", version: "2.0", step: 50 * time.Millisecond},
+		{file: "v2-zlib.fseq", version: "2.0", step: 50 * time.Millisecond},
+		{file: "v2-sparse.fseq", version: "2.0", step: 50 * time.Millisecond, ranges: []Range{{10, 3}, {100, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			seq, err := Read(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seq.Version() != tt.version {
+				t.Errorf("version %s, want %s", seq.Version(), tt.version)
+			}
+			if seq.Frames() != 4 || seq.Channels != 6 {
+				t.Errorf("%d frames of %d channels, want 4 of 6", seq.Frames(), seq.Channels)
+			}
+			if seq.Step != tt.step || seq.Duration() != 4*tt.step {
+				t.Errorf("step %v lasting %v, want %v", seq.Step, seq.Duration(), tt.step)
+			}
+			if seq.Headers["mf"] != "song.mp3" {
+				t.Errorf("mf header %q", seq.Headers["mf"])
+			}
+			if len(seq.Ranges) != len(tt.ranges) {
+				t.Fatalf("ranges %v, want %v", seq.Ranges, tt.ranges)
+			}
+
+			// absolute channel numbers for each stored channel
+			channels := []int{0, 1, 2, 3, 4, 5}
+			span := 6
+			if tt.ranges != nil {
+				channels, span = []int{10, 11, 12, 100, 101, 102}, 103
+			}
+			if seq.Span() != span {
+				t.Errorf("span %d, want %d", seq.Span(), span)
+			}
+			for f := 0; f < 4; f++ {
+				for i, ch := range channels {
+					if got, want := seq.Value(f, ch), byte(f*10+i); got != want {
+						t.Errorf("frame %d channel %d is %d, want %d", f, ch, got, want)
+					}
+				}
+			}
+			if seq.Value(0, 50) != 0 || seq.Value(0, -1) != 0 {
+				t.Error("channels without data should be 0")
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	fixture := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	with := func(data []byte, edit func([]byte)) []byte {
+		data = append([]byte(nil), data...)
+		edit(data)
+		return data
+	}
+	v2 := fixture("v2.fseq")
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"truncated", fixture("truncated.fseq"), "only data for 2"},
+		{"zstd", fixture("v2-zstd.fseq"), "zstd"},
+		{"short", v2[:20], "too short"},
+		{"magic", with(v2, func(d []byte) { copy(d, "RIFF") }), "not an fseq"},
+		{"version", with(v2, func(d []byte) { d[7] = 3 }), "unsupported fseq version"},
+		{"no channels", with(v2, func(d []byte) { binary.LittleEndian.PutUint32(d[10:], 0) }), "channel count is 0"},
+		{"no step", with(v2, func(d []byte) { d[18] = 0 }), "step time is 0"},
+		// a frame count no file could back is refused before allocating
+		{"frame count", with(v2, func(d []byte) { binary.LittleEndian.PutUint32(d[14:], 0xffffffff) }), "only data for 4"},
+		{"data offset", with(v2, func(d []byte) { binary.LittleEndian.PutUint16(d[4:], 0xffff) }), "past the end"},
+		{"block index", with(fixture("v2-zlib.fseq"), func(d []byte) { d[21] = 200 }), "overrun the header"},
+		{"block size", with(fixture("v2-zlib.fseq"), func(d []byte) { binary.LittleEndian.PutUint32(d[36:], 1000) }), "past the end of the file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package input
+
+import (
+	"bufio"
+	"unicode/utf8"
+)
+
+type KeyCode int
+
+const (
+	KeyRune KeyCode = iota
+	KeyEnter
+	KeyTab
+	KeyBackspace
+	KeyDelete
+	KeyEscape
+	KeyUp
+	KeyDown
+	KeyLeft
+	KeyRight
+	KeyHome
+	KeyEnd
+	KeyCtrlA
+	KeyCtrlC
+	KeyCtrlD
+	KeyCtrlE
+	KeyCtrlR
+	KeyCtrlU
+	KeyCtrlW
+	KeyUnknown
+)
+
+// Key is a single decoded keypress. Rune is only set for KeyRune.
+type Key struct {
+	Code KeyCode
+	Rune rune
+}
+
+func (k Key) String() string {
+	switch k.Code {
+	case KeyRune:
+		return string(k.Rune)
+	case KeyEnter:
+		return "enter"
+	case KeyTab:
+		return "tab"
+	case KeyBackspace:
+		return "backspace"
+	case KeyDelete:
+		return "delete"
+	case KeyEscape:
+		return "esc"
+	case KeyUp:
+		return "up"
+	case KeyDown:
+		return "down"
+	case KeyLeft:
+		return "left"
+	case KeyRight:
+		return "right"
+	case KeyHome:
+		return "home"
+	case KeyEnd:
+		return "end"
+	case KeyCtrlA:
+		return "ctrl+a"
+	case KeyCtrlC:
+		return "ctrl+c"
+	case KeyCtrlD:
+		return "ctrl+d"
+	case KeyCtrlE:
+		return "ctrl+e"
+	case KeyCtrlR:
+		return "ctrl+r"
+	case KeyCtrlU:
+		return "ctrl+u"
+	case KeyCtrlW:
+		return "ctrl+w"
+	}
+	return "unknown"
+}
+
+// ReadKey decodes one keypress from a terminal in raw mode, including the
+// common ANSI escape sequences for arrows, home/end and delete. It also works
+// on cooked input, where it just sees the line followed by a newline.
+func ReadKey(r *bufio.Reader) (Key, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return Key{}, err
+	}
+
+	switch b {
+	case '\r', '\n':
+		return Key{Code: KeyEnter}, nil
+	case '\t':
+		return Key{Code: KeyTab}, nil
+	case 0x7f, 0x08:
+		return Key{Code: KeyBackspace}, nil
+	case 0x01:
+		return Key{Code: KeyCtrlA}, nil
+	case 0x03:
+		return Key{Code: KeyCtrlC}, nil
+	case 0x04:
+		return Key{Code: KeyCtrlD}, nil
+	case 0x05:
+		return Key{Code: KeyCtrlE}, nil
+	case 0x12:
+		return Key{Code: KeyCtrlR}, nil
+	case 0x15:
+		return Key{Code: KeyCtrlU}, nil
+	case 0x17:
+		return Key{Code: KeyCtrlW}, nil
+	case 0x1b:
+		return readEscape(r)
+	}
+
+	if b < 0x20 {
+		return Key{Code: KeyUnknown}, nil
+	}
+
+	if b < utf8.RuneSelf {
+		return Key{Code: KeyRune, Rune: rune(b)}, nil
+	}
+
+	// multi-byte rune, put the lead byte back and decode it whole
+	if err := r.UnreadByte(); err != nil {
+		return Key{}, err
+	}
+	ru, _, err := r.ReadRune()
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Code: KeyRune, Rune: ru}, nil
+}
+
+func readEscape(r *bufio.Reader) (Key, error) {
+	// a lone escape has nothing buffered behind it
+	if r.Buffered() == 0 {
+		return Key{Code: KeyEscape}, nil
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return Key{}, err
+	}
+	if b != '[' && b != 'O' {
+		return Key{Code: KeyEscape}, nil
+	}
+
+	b, err = r.ReadByte()
+	if err != nil {
+		return Key{}, err
+	}
+	switch b {
+	case 'A':
+		return Key{Code: KeyUp}, nil
+	case 'B':
+		return Key{Code: KeyDown}, nil
+	case 'C':
+		return Key{Code: KeyRight}, nil
+	case 'D':
+		return Key{Code: KeyLeft}, nil
+	case 'H':
+		return Key{Code: KeyHome}, nil
+	case 'F':
+		return Key{Code: KeyEnd}, nil
+	}
+
+	// numbered sequences such as ESC [ 3 ~
+	if b >= '0' && b <= '9' {
+		num := int(b - '0')
+		for {
+			b, err = r.ReadByte()
+			if err != nil {
+				return Key{}, err
+			}
+			if b < '0' || b > '9' {
+				break
+			}
+			num = num*10 + int(b-'0')
+		}
+		if b != '~' {
+			return Key{Code: KeyUnknown}, nil
+		}
+		switch num {
+		case 1, 7:
+			return Key{Code: KeyHome}, nil
+		case 3:
+			return Key{Code: KeyDelete}, nil
+		case 4, 8:
+			return Key{Code: KeyEnd}, nil
+		}
+	}
+
+	return Key{Code: KeyUnknown}, nil
+}
@@ -0,0 +1,211 @@
+package input
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/pkg/errors"
+)
+
+var muxLog = log.For("input")
+
+// Filter decides, on the reading goroutine, whether a subscriber takes a key.
+// Keys nobody takes fall through to subscribers further down the stack.
+type Filter func(k Key) bool
+
+type subscription struct {
+	id     int
+	filter Filter
+	keys   chan Key
+}
+
+// Mux is the only reader of stdin. In line mode it hands out whole lines
+// through ReadLine, in raw mode every keypress goes to the most recent
+// subscriber whose filter accepts it.
+type Mux struct {
+	in     *os.File
+	reader *bufio.Reader
+
+	lock    sync.Mutex
+	raw     bool
+	restore func() error
+	subs    []*subscription
+	nextID  int
+	line    []rune
+
+	lines chan string
+	done  chan struct{}
+	err   error
+}
+
+func NewMux(in *os.File) *Mux {
+	return &Mux{
+		in:     in,
+		reader: bufio.NewReader(in),
+		lines:  make(chan string, 16),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start begins reading stdin. It stops for good on EOF, see Done.
+func (m *Mux) Start() {
+	go m.readLoop()
+}
+
+// Done is closed once stdin is exhausted.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns why reading stopped, nil for a plain EOF.
+func (m *Mux) Err() error {
+	select {
+	case <-m.done:
+		return m.err
+	default:
+		return nil
+	}
+}
+
+// SetRaw switches between line and single-key mode. Raw mode is best effort,
+// when stdin isn't a terminal keys still arrive but only once a line is sent.
+func (m *Mux) SetRaw(raw bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if raw == m.raw {
+		return nil
+	}
+	m.raw = raw
+	m.line = m.line[:0]
+
+	if !raw {
+		if m.restore == nil {
+			return nil
+		}
+		err := m.restore()
+		m.restore = nil
+		return errors.Wrap(err, "failed to restore terminal")
+	}
+
+	if !IsTerminal(int(m.in.Fd())) {
+		return nil
+	}
+	restore, err := MakeRaw(int(m.in.Fd()))
+	if err != nil {
+		return errors.Wrap(err, "failed to put terminal in raw mode")
+	}
+	m.restore = restore
+	return nil
+}
+
+// Close puts the terminal back the way it was found.
+func (m *Mux) Close() error {
+	return m.SetRaw(false)
+}
+
+// ReadLine blocks for the next line typed in line mode. ok is false once
+// stdin has closed.
+func (m *Mux) ReadLine() (line string, ok bool) {
+	line, ok = <-m.lines
+	return line, ok
+}
+
+// Subscribe registers for keypresses in raw mode. The newest subscriber gets
+// the first look at each key. The returned func unsubscribes and must be
+// called once the keys are no longer wanted.
+func (m *Mux) Subscribe(filter Filter) (<-chan Key, func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.nextID++
+	sub := &subscription{
+		id:     m.nextID,
+		filter: filter,
+		keys:   make(chan Key, 32),
+	}
+	m.subs = append(m.subs, sub)
+
+	return sub.keys, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		for i, s := range m.subs {
+			if s.id == sub.id {
+				m.subs = append(m.subs[:i], m.subs[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (m *Mux) readLoop() {
+	defer close(m.done)
+	defer close(m.lines)
+
+	for {
+		key, err := ReadKey(m.reader)
+		if err != nil {
+			if err != io.EOF {
+				muxLog.Error("failed to read stdin", log.Err(err))
+				m.err = err
+			} else {
+				muxLog.Info("stdin closed")
+			}
+			return
+		}
+
+		m.dispatch(key)
+	}
+}
+
+func (m *Mux) dispatch(key Key) {
+	m.lock.Lock()
+	if !m.raw {
+		line, complete := m.appendLine(key)
+		m.lock.Unlock()
+		if complete {
+			m.lines <- line
+		}
+		return
+	}
+
+	var target *subscription
+	for i := len(m.subs) - 1; i >= 0; i-- {
+		if m.subs[i].filter == nil || m.subs[i].filter(key) {
+			target = m.subs[i]
+			break
+		}
+	}
+	m.lock.Unlock()
+
+	if target == nil {
+		muxLog.Debug("dropped key", log.F("key", key.String()))
+		return
+	}
+	select {
+	case target.keys <- key:
+	default:
+		muxLog.Warn("subscriber is behind, dropped key", log.F("key", key.String()))
+	}
+}
+
+// appendLine builds up a line in line mode. The terminal already did any
+// editing, so only runes and enter matter.
+func (m *Mux) appendLine(key Key) (string, bool) {
+	switch key.Code {
+	case KeyRune:
+		m.line = append(m.line, key.Rune)
+	case KeyEnter:
+		line := string(m.line)
+		m.line = m.line[:0]
+		return line, true
+	case KeyBackspace:
+		if len(m.line) > 0 {
+			m.line = m.line[:len(m.line)-1]
+		}
+	}
+	return "", false
+}
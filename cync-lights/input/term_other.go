@@ -0,0 +1,20 @@
+//go:build !linux
+
+package input
+
+import "errors"
+
+var errNoTerminal = errors.New("terminal control not supported on this platform")
+
+func IsTerminal(fd int) bool {
+	return false
+}
+
+// MakeRaw isn't supported here, callers fall back to line input.
+func MakeRaw(fd int) (func() error, error) {
+	return nil, errNoTerminal
+}
+
+func Size(fd int) (width, height int, err error) {
+	return 0, 0, errNoTerminal
+}
@@ -0,0 +1,288 @@
+// Package local talks to Cync devices through a hub or bridge on the LAN
+// that speaks the same TCP framing as the cloud. cbyge dials the cloud and
+// logs in again for every command, a client here keeps one connection open,
+// which is what makes 50ms effects smooth.
+package local
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+var localLog = log.For("local")
+
+// ErrUnavailable is wrapped by the errors from the hub not being there, when
+// it can't be dialled, written to or doesn't answer in time, as opposed to
+// a command it was never sent.
+var ErrUnavailable = errors.New("hub unavailable")
+
+// unavailableError keeps err's message while being ErrUnavailable.
+type unavailableError struct{ error }
+
+func (e unavailableError) Is(target error) bool { return target == ErrUnavailable }
+func (e unavailableError) Unwrap() error        { return e.error }
+
+func unavailable(err error) error {
+	return unavailableError{err}
+}
+
+// Config is how to reach a hub.
+type Config struct {
+	Addr string
+	// UserID and Code are sent to authenticate like the cloud, if Code is
+	// set
+	UserID uint32
+	Code   string
+	// Timeout is how long to wait connecting and for answers
+	Timeout time.Duration
+}
+
+// Client keeps a connection to a hub, dialled when it's first needed and
+// again after it drops. It's safe to use from any goroutine.
+type Client struct {
+	cfg Config
+
+	mu   sync.Mutex
+	raw  net.Conn
+	conn *cbyge.PacketConn
+	// dialing is the dial in progress, nil when there isn't one
+	dialing *dial
+	seq     uint16
+	// waiting are the calls waiting on an answer, by sequence number
+	waiting map[uint16]chan *cbyge.Packet
+}
+
+// dial is one attempt at connecting, shared by every call that needs it.
+// done is closed once conn or err is set.
+type dial struct {
+	done chan struct{}
+	conn *cbyge.PacketConn
+	err  error
+}
+
+func New(cfg Config) *Client {
+	return &Client{cfg: cfg, waiting: map[uint16]chan *cbyge.Packet{}}
+}
+
+func (c *Client) Addr() string {
+	return c.cfg.Addr
+}
+
+// connect dials and authenticates unless already connected. mu isn't held
+// while dialling, calls that need a connection meanwhile wait for the same
+// dial rather than queueing up behind it to dial again.
+func (c *Client) connect() (*cbyge.PacketConn, error) {
+	c.mu.Lock()
+	if c.conn != nil {
+		conn := c.conn
+		c.mu.Unlock()
+		return conn, nil
+	}
+	if d := c.dialing; d != nil {
+		c.mu.Unlock()
+		<-d.done
+		return d.conn, d.err
+	}
+	d := &dial{done: make(chan struct{})}
+	c.dialing = d
+	c.mu.Unlock()
+
+	raw, err := net.DialTimeout("tcp", c.cfg.Addr, c.cfg.Timeout)
+	if err == nil {
+		d.conn = cbyge.NewPacketConnWrap(raw)
+		if c.cfg.Code != "" {
+			if err = d.conn.Auth(c.cfg.UserID, c.cfg.Code, c.cfg.Timeout); err != nil {
+				d.conn.Close()
+				d.conn = nil
+			}
+		}
+	}
+	d.err = err
+
+	c.mu.Lock()
+	c.dialing = nil
+	if d.conn != nil {
+		localLog.Info("connected to hub", log.F("addr", c.cfg.Addr))
+		c.raw, c.conn = raw, d.conn
+		go c.read(d.conn)
+	}
+	c.mu.Unlock()
+	close(d.done)
+	return d.conn, d.err
+}
+
+// read hands answers to whoever's waiting on them. Syncs and anything else
+// the hub sends unasked are dropped.
+func (c *Client) read(conn *cbyge.PacketConn) {
+	for {
+		p, err := conn.Read()
+		if err != nil {
+			localLog.Debug("hub connection closed", log.Err(err))
+			c.drop(conn)
+			return
+		}
+		seq, err := p.Seq()
+		if err != nil || !p.IsResponse {
+			continue
+		}
+		c.mu.Lock()
+		answer, ok := c.waiting[seq]
+		delete(c.waiting, seq)
+		c.mu.Unlock()
+		if ok {
+			answer <- p
+		}
+	}
+}
+
+// drop forgets a broken connection so the next call dials again. Calls
+// waiting on it fail.
+func (c *Client) drop(conn *cbyge.PacketConn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.raw, c.conn = nil, nil
+		for seq, answer := range c.waiting {
+			close(answer)
+			delete(c.waiting, seq)
+		}
+	}
+	c.mu.Unlock()
+	conn.Close()
+}
+
+// call sends a packet built for the next sequence number. Async calls return
+// once it's written, the rest wait for the hub's answer.
+func (c *Client) call(build func(seq uint16) *cbyge.Packet, async bool) (*cbyge.Packet, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return nil, unavailable(errors.Wrapf(err, "failed to reach hub at %s", c.cfg.Addr))
+	}
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return nil, unavailable(errors.New("hub connection dropped"))
+	}
+	seq := c.seq
+	c.seq++
+	var answer chan *cbyge.Packet
+	if !async {
+		answer = make(chan *cbyge.Packet, 1)
+		c.waiting[seq] = answer
+	}
+	c.raw.SetWriteDeadline(time.Now().Add(c.cfg.Timeout))
+	err = conn.Write(build(seq))
+	c.mu.Unlock()
+	if err != nil {
+		c.drop(conn)
+		return nil, unavailable(errors.Wrap(err, "failed to send to hub"))
+	}
+	if async {
+		return nil, nil
+	}
+
+	timer := time.NewTimer(c.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case p, ok := <-answer:
+		if !ok {
+			return nil, unavailable(errors.New("hub connection dropped"))
+		}
+		return p, nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.waiting, seq)
+		c.mu.Unlock()
+		return nil, unavailable(errors.New("timed out waiting for the hub"))
+	}
+}
+
+// command sends a set command, the hub's last byte is non-zero when the
+// device didn't take it.
+func (c *Client) command(build func(seq uint16) *cbyge.Packet, async bool) error {
+	p, err := c.call(build, async)
+	if err != nil || p == nil {
+		return err
+	}
+	if len(p.Data) > 0 && p.Data[len(p.Data)-1] != 0 {
+		return cbyge.RemoteCallError
+	}
+	return nil
+}
+
+// SetStatus turns the device at index in the switch's mesh on or off.
+func (c *Client) SetStatus(switchID uint32, index int, on bool, async bool) error {
+	status := 0
+	if on {
+		status = 1
+	}
+	return c.command(func(seq uint16) *cbyge.Packet {
+		return cbyge.NewPacketSetDeviceStatus(switchID, seq, index, status)
+	}, async)
+}
+
+// SetLum sets a brightness from 0 to 100, like the cloud.
+func (c *Client) SetLum(switchID uint32, index int, lum int, async bool) error {
+	if lum < 0 || lum > 100 {
+		return errors.Errorf("brightness %d isn't between 0 and 100", lum)
+	}
+	return c.command(func(seq uint16) *cbyge.Packet {
+		return newPacketSetLum(switchID, seq, index, lum)
+	}, async)
+}
+
+// newPacketSetLum is cbyge.NewPacketSetLum, which panics for 0.
+func newPacketSetLum(switchID uint32, seq uint16, index, lum int) *cbyge.Packet {
+	return cbyge.NewPacketPipe(switchID, seq, cbyge.PacketPipeTypeSetLum, []byte{
+		0, 0, 0, 0, 0,
+		byte(index >> 8), byte(index & 0xff),
+		0, cbyge.PacketPipeTypeSetLum,
+		0, 0,
+		byte(lum),
+	})
+}
+
+func (c *Client) SetRGB(switchID uint32, index int, r, g, b uint8, async bool) error {
+	return c.command(func(seq uint16) *cbyge.Packet {
+		return cbyge.NewPacketSetRGB(switchID, seq, index, r, g, b)
+	}, async)
+}
+
+// SetCT sets a color tone from 0 warm to 100 cool.
+func (c *Client) SetCT(switchID uint32, index int, tone int, async bool) error {
+	if tone < 0 || tone > 100 {
+		return errors.Errorf("color tone %d isn't between 0 and 100", tone)
+	}
+	return c.command(func(seq uint16) *cbyge.Packet {
+		return cbyge.NewPacketSetCT(switchID, seq, index, tone)
+	}, async)
+}
+
+// Statuses asks the switch for the status of every device in its mesh.
+func (c *Client) Statuses(switchID uint32) ([]cbyge.StatusPaginatedResponse, error) {
+	p, err := c.call(func(seq uint16) *cbyge.Packet {
+		return cbyge.NewPacketGetStatusPaginated(switchID, seq)
+	}, false)
+	if err != nil {
+		return nil, err
+	}
+	if !cbyge.IsStatusPaginatedResponse(p) {
+		return nil, cbyge.RemoteCallError
+	}
+	return cbyge.DecodeStatusPaginatedResponse(p)
+}
+
+// Close hangs up, the next call dials again.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		c.drop(conn)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package local
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+const testSwitch = 4200
+
+func startMock(t *testing.T) (*Mock, *Client) {
+	t.Helper()
+	mock, err := NewMock("127.0.0.1:0", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mock.Close() })
+	client := New(Config{Addr: mock.Addr(), UserID: 1, Code: "secret", Timeout: time.Second})
+	t.Cleanup(func() { client.Close() })
+	return mock, client
+}
+
+// eventually polls until check passes, since async commands land later.
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if check() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestSetCommands(t *testing.T) {
+	mock, client := startMock(t)
+	if err := client.SetStatus(testSwitch, 3, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLum(testSwitch, 4, 40, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRGB(testSwitch, 5, 10, 20, 30, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetCT(testSwitch, 6, 20, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		index int
+		check func(d cbyge.StatusPaginatedResponse) bool
+	}{
+		{3, func(d cbyge.StatusPaginatedResponse) bool { return !d.IsOn }},
+		{4, func(d cbyge.StatusPaginatedResponse) bool { return d.IsOn && d.Brightness == 40 }},
+		{5, func(d cbyge.StatusPaginatedResponse) bool { return d.UseRGB && d.RGB == [3]uint8{10, 20, 30} }},
+		{6, func(d cbyge.StatusPaginatedResponse) bool { return !d.UseRGB && d.ColorTone == 20 }},
+	}
+	for _, tt := range tests {
+		d, ok := mock.Device(tt.index)
+		if !ok || !tt.check(d) {
+			t.Errorf("device %d is %+v", tt.index, d)
+		}
+	}
+	// nothing else in the mesh was touched
+	if d, ok := mock.Device(2); ok {
+		t.Errorf("device 2 was set to %+v", d)
+	}
+	if mock.Calls() != 4 {
+		t.Errorf("mock got %d commands, want 4", mock.Calls())
+	}
+
+	statuses, err := client.Statuses(testSwitch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 4 || statuses[0].Device != 3 || statuses[3].Device != 6 {
+		t.Errorf("statuses %+v", statuses)
+	}
+}
+
+func TestOfflineDevice(t *testing.T) {
+	mock, client := startMock(t)
+	mock.SetOffline(3, true)
+	if err := client.SetStatus(testSwitch, 3, true, false); !errors.Is(err, cbyge.RemoteCallError) {
+		t.Fatalf("got %v, want a remote call error", err)
+	}
+	// the connection is still good for the rest of the mesh
+	if err := client.SetStatus(testSwitch, 4, true, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAsyncDoesntWait(t *testing.T) {
+	mock, client := startMock(t)
+	// connect first, so only the command is timed
+	if err := client.SetStatus(testSwitch, 1, true, false); err != nil {
+		t.Fatal(err)
+	}
+	mock.SetLatency(500 * time.Millisecond)
+	start := time.Now()
+	if err := client.SetLum(testSwitch, 1, 25, true); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 250*time.Millisecond {
+		t.Fatalf("async command took %v, it waited for the answer", took)
+	}
+	eventually(t, "the brightness to land", func() bool {
+		d, _ := mock.Device(1)
+		return d.Brightness == 25
+	})
+}
+
+func TestTimeoutOnLoss(t *testing.T) {
+	mock, err := NewMock("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mock.Close()
+	client := New(Config{Addr: mock.Addr(), Timeout: 100 * time.Millisecond})
+	defer client.Close()
+
+	mock.SetLoss(1)
+	start := time.Now()
+	err = client.SetStatus(testSwitch, 1, true, false)
+	if !errors.Is(err, ErrUnavailable) || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Errorf("gave up after %v, before the timeout", took)
+	}
+
+	// nothing's left waiting, and the next command gets through
+	mock.SetLoss(0)
+	if err := client.SetStatus(testSwitch, 1, true, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	mock, client := startMock(t)
+	if err := client.SetStatus(testSwitch, 1, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hub restarts on the same address
+	addr := mock.Addr()
+	mock.Close()
+	eventually(t, "the client to notice", func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.conn == nil
+	})
+	if err := client.SetStatus(testSwitch, 1, true, false); err == nil {
+		t.Fatal("a command got through with the hub down")
+	}
+	restarted, err := NewMock(addr, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+
+	if err := client.SetLum(testSwitch, 1, 60, false); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := restarted.Device(1); d.Brightness != 60 {
+		t.Errorf("restarted hub has %+v", d)
+	}
+}
+
+func TestWrongCode(t *testing.T) {
+	mock, _ := startMock(t)
+	client := New(Config{Addr: mock.Addr(), UserID: 1, Code: "wrong", Timeout: time.Second})
+	defer client.Close()
+	if err := client.SetStatus(testSwitch, 1, true, false); err == nil {
+		t.Fatal("logged in with the wrong code")
+	}
+	if mock.Calls() != 0 {
+		t.Errorf("mock took %d commands", mock.Calls())
+	}
+}
+
+// calls made while the hub is being dialled wait for that dial instead of
+// each dialling in turn behind the lock.
+func TestConcurrentDial(t *testing.T) {
+	// a hub that takes connections and never answers the auth
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	const timeout = 200 * time.Millisecond
+	client := New(Config{Addr: listener.Addr().String(), UserID: 1, Code: "secret", Timeout: timeout})
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			errs <- client.SetStatus(testSwitch, index, true, false)
+		}(i + 1)
+	}
+	wg.Wait()
+	close(errs)
+	if took := time.Since(start); took > 3*timeout {
+		t.Errorf("5 calls took %v with a %v timeout, they dialled one after another", took, timeout)
+	}
+	for err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "failed to reach hub") {
+			t.Errorf("got %v, want the dial's error", err)
+		}
+	}
+}
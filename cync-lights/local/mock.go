@@ -0,0 +1,305 @@
+package local
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/unixpickle/cbyge"
+)
+
+var mockLog = log.For("local.mock")
+
+// mockPage is how many devices fit in one status answer, the length is a
+// byte.
+const mockPage = 10
+
+// Mock is a hub to try the local transport against without one. It speaks
+// the framing, remembers what each device was set to and answers like a hub
+// does, with a response carrying the command's sequence number followed by a
+// sync. It's one mesh, so the switch commands are addressed to is ignored.
+type Mock struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	// auth checks the user and code clients authenticate with, nil lets
+	// anyone in without
+	auth    func(userID uint32, code string) bool
+	latency time.Duration
+	loss    float64
+	devices map[int]cbyge.StatusPaginatedResponse
+	offline map[int]bool
+	conns   map[net.Conn]bool
+	calls   int
+}
+
+// NewMock listens on addr, like 127.0.0.1:0 for any free port. If code isn't
+// empty clients have to authenticate with it.
+func NewMock(addr, code string) (*Mock, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mock{
+		listener: listener,
+		devices:  map[int]cbyge.StatusPaginatedResponse{},
+		offline:  map[int]bool{},
+		conns:    map[net.Conn]bool{},
+	}
+	if code != "" {
+		m.auth = func(_ uint32, c string) bool { return c == code }
+	}
+	go m.serve()
+	return m, nil
+}
+
+// SetAuth replaces the code clients authenticate with by a check of their
+// user and code.
+func (m *Mock) SetAuth(check func(userID uint32, code string) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.auth = check
+}
+
+func (m *Mock) Addr() string {
+	return m.listener.Addr().String()
+}
+
+// SetLatency delays every answer.
+func (m *Mock) SetLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency = d
+}
+
+// SetLoss drops that fraction of commands without answering, from 0 to 1.
+func (m *Mock) SetLoss(p float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loss = p
+}
+
+// Add puts a device in the mesh the way bulbs start, on, white and at full
+// brightness. Devices are otherwise added when they're first set.
+func (m *Mock) Add(index int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.devices[index] = newMockDevice(index)
+}
+
+func newMockDevice(index int) cbyge.StatusPaginatedResponse {
+	return cbyge.StatusPaginatedResponse{Device: index, IsOn: true, Brightness: 100, ColorTone: 50}
+}
+
+// SetOffline has commands for a device fail like they do when the mesh
+// can't reach it.
+func (m *Mock) SetOffline(index int, offline bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offline[index] = offline
+}
+
+// Device is what the device at index was last set to.
+func (m *Mock) Device(index int) (cbyge.StatusPaginatedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[index]
+	return d, ok
+}
+
+// Calls is how many commands have been received.
+func (m *Mock) Calls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls
+}
+
+// Close stops listening and hangs up on every client.
+func (m *Mock) Close() error {
+	err := m.listener.Close()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for conn := range m.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (m *Mock) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		m.conns[conn] = true
+		m.mu.Unlock()
+		go m.handle(conn)
+	}
+}
+
+func (m *Mock) handle(raw net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.conns, raw)
+		m.mu.Unlock()
+		raw.Close()
+	}()
+	conn := cbyge.NewPacketConnWrap(raw)
+	m.mu.Lock()
+	authed := m.auth == nil
+	m.mu.Unlock()
+	for {
+		p, err := conn.Read()
+		if err != nil {
+			return
+		}
+		if p.Type == cbyge.PacketTypeAuth {
+			authed = m.authenticates(p)
+			answer := []byte{0, 0}
+			if !authed {
+				answer = []byte{0, 1}
+			}
+			if conn.Write(&cbyge.Packet{Type: cbyge.PacketTypeAuth, IsResponse: true, Data: answer}) != nil || !authed {
+				return
+			}
+			continue
+		}
+		if !authed || p.Type != cbyge.PacketTypePipe || len(p.Data) < 15 {
+			mockLog.Debug("ignoring packet", log.F("packet", p.String()))
+			continue
+		}
+		m.mu.Lock()
+		latency, lost := m.latency, rand.Float64() < m.loss
+		m.mu.Unlock()
+		if lost {
+			mockLog.Debug("dropping packet", log.F("packet", p.String()))
+			continue
+		}
+		time.Sleep(latency)
+		for _, answer := range m.answer(p) {
+			if err := conn.Write(answer); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// authenticates checks an auth packet, a byte, the user ID, the code's
+// length and the code.
+func (m *Mock) authenticates(p *cbyge.Packet) bool {
+	if len(p.Data) < 7 {
+		return false
+	}
+	userID := binary.BigEndian.Uint32(p.Data[1:5])
+	n := int(p.Data[6])
+	m.mu.Lock()
+	auth := m.auth
+	m.mu.Unlock()
+	return len(p.Data) >= 7+n && (auth == nil || auth(userID, string(p.Data[7:7+n])))
+}
+
+// answer applies a pipe packet and is what a hub would send back.
+func (m *Mock) answer(p *cbyge.Packet) []*cbyge.Packet {
+	switchID := binary.BigEndian.Uint32(p.Data[:4])
+	seq := binary.BigEndian.Uint16(p.Data[4:6])
+	subtype := p.Data[13]
+	payload := p.Data[15:]
+	if n := int(p.Data[14]); n <= len(payload) {
+		payload = payload[:n]
+	}
+
+	if subtype == cbyge.PacketPipeTypeGetStatusPaginated {
+		status := cbyge.NewPacketPipe(switchID, seq, cbyge.PacketPipeTypeGetStatusPaginated, m.statuses())
+		status.IsResponse = true
+		return []*cbyge.Packet{status}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls++
+	if len(payload) < 12 {
+		return []*cbyge.Packet{m.response(switchID, seq, false)}
+	}
+	index := int(payload[5])<<8 | int(payload[6])
+	if m.offline[index] {
+		return []*cbyge.Packet{m.response(switchID, seq, false)}
+	}
+	d, ok := m.devices[index]
+	if !ok {
+		d = newMockDevice(index)
+	}
+	switch subtype {
+	case cbyge.PacketPipeTypeSetStatus:
+		d.IsOn = payload[11] != 0
+	case cbyge.PacketPipeTypeSetLum:
+		d.Brightness = payload[11]
+	case cbyge.PacketPipeTypeSetCT:
+		switch {
+		case payload[11] == 0x05 && len(payload) >= 13:
+			d.IsOn, d.UseRGB, d.ColorTone = true, false, payload[12]
+		case payload[11] == 0x04 && len(payload) >= 15:
+			d.IsOn, d.UseRGB = true, true
+			copy(d.RGB[:], payload[12:15])
+		default:
+			return []*cbyge.Packet{m.response(switchID, seq, false)}
+		}
+	default:
+		return []*cbyge.Packet{m.response(switchID, seq, false)}
+	}
+	m.devices[index] = d
+	mockLog.Debug("device set", log.F("index", index), log.F("status", d))
+	return []*cbyge.Packet{
+		m.response(switchID, seq, true),
+		{Type: cbyge.PacketTypeSync, Data: p.Data[:4]},
+	}
+}
+
+// response answers a command, the last byte is 0 if it worked.
+func (m *Mock) response(switchID uint32, seq uint16, ok bool) *cbyge.Packet {
+	data := make([]byte, 7)
+	binary.BigEndian.PutUint32(data, switchID)
+	binary.BigEndian.PutUint16(data[4:], seq)
+	if !ok {
+		data[6] = 1
+	}
+	return &cbyge.Packet{Type: cbyge.PacketTypePipe, IsResponse: true, Data: data}
+}
+
+// statuses encodes the devices the way DecodeStatusPaginatedResponse reads
+// them, as many as fit in a page. Offline devices aren't in it.
+func (m *Mock) statuses() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	indexes := make([]int, 0, len(m.devices))
+	for index := range m.devices {
+		if !m.offline[index] {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	if len(indexes) > mockPage {
+		indexes = indexes[:mockPage]
+	}
+	data := make([]byte, 6, 6+24*len(indexes))
+	for _, index := range indexes {
+		d := m.devices[index]
+		entry := make([]byte, 24)
+		entry[1] = byte(index)
+		if d.IsOn {
+			entry[9] = 1
+		}
+		entry[13] = d.Brightness
+		entry[17] = d.ColorTone
+		if d.UseRGB {
+			entry[17] = 0xfe
+		}
+		copy(entry[21:], d.RGB[:])
+		data = append(data, entry...)
+	}
+	return data
+}
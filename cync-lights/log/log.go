@@ -1,38 +1,317 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/fatih/color"
+	"github.com/pkg/errors"
+)
+
+type Level int
 
-	"github.com/gosuri/uilive"
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
 )
 
-const MainColor = color.FgBlue
-const OutputColor = color.FgGreen
-const BadColor = color.FgRed
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "off"
+}
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	case "off", "none":
+		return LevelOff, nil
+	}
+	return LevelOff, errors.Errorf("unknown log level %q", s)
+}
+
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
 
-func New() *uilive.Writer {
-	writer := uilive.New()
-	writer.RefreshInterval = time.Hour
-	return writer
+// Config controls where diagnostic logs go. Levels is a comma separated list
+// of a default level and per-component overrides, e.g. "info,controller=debug".
+// Overrides apply to a component and everything below it, so "mode=debug"
+// covers mode.rainbow and mode.roll.
+type Config struct {
+	Path   string
+	Format Format
+	Levels string
 }
 
-func FPrintf(writer io.Writer, c color.Attribute, format string, a ...any) (int, error) {
-	return color.New(c).Fprintf(writer, format, a...)
+// DefaultPath is used when logging is enabled without an explicit file.
+func DefaultPath() string {
+	return filepath.Join(os.TempDir(), "cync-lights.log")
 }
 
-func FPrintln(writer io.Writer, c color.Attribute, ln string) (read int, err error) {
-	read, err = color.New(c).Fprintln(writer, ln)
+type sink struct {
+	lock      sync.Mutex
+	out       io.Writer
+	format    Format
+	level     Level
+	overrides map[string]Level
+}
+
+// everything is discarded until Setup is called, diagnostics never go to the
+// terminal the UI is drawing on
+var std = &sink{
+	out:       io.Discard,
+	format:    FormatText,
+	level:     LevelOff,
+	overrides: map[string]Level{},
+}
+
+// Setup opens the log file described by cfg and routes every Logger to it.
+// The returned func closes the file.
+func Setup(cfg Config) (func() error, error) {
+	level, overrides, err := parseLevels(cfg.Levels)
 	if err != nil {
-		return read, err
+		return nil, err
 	}
 
-	if uiliveWriter, ok := writer.(*uilive.Writer); ok {
-		err = uiliveWriter.Flush()
-		return read, err
+	format := cfg.Format
+	if format == "" {
+		format = FormatText
+	}
+	if format != FormatText && format != FormatJSON {
+		return nil, errors.Errorf("unknown log format %q", format)
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = DefaultPath()
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open log file %s", path)
 	}
 
-	return read, err
+	std.lock.Lock()
+	std.out = file
+	std.format = format
+	std.level = level
+	std.overrides = overrides
+	std.lock.Unlock()
+
+	return func() error {
+		std.lock.Lock()
+		std.out = io.Discard
+		std.lock.Unlock()
+		return file.Close()
+	}, nil
+}
+
+func parseLevels(spec string) (Level, map[string]Level, error) {
+	level := LevelInfo
+	overrides := map[string]Level{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		component, lvl, found := strings.Cut(part, "=")
+		if !found {
+			parsed, err := ParseLevel(part)
+			if err != nil {
+				return level, nil, err
+			}
+			level = parsed
+			continue
+		}
+
+		parsed, err := ParseLevel(lvl)
+		if err != nil {
+			return level, nil, err
+		}
+		overrides[strings.TrimSpace(component)] = parsed
+	}
+
+	return level, overrides, nil
+}
+
+// levelFor finds the most specific override for a dotted component name.
+func (s *sink) levelFor(component string) Level {
+	for name := component; name != ""; {
+		if lvl, ok := s.overrides[name]; ok {
+			return lvl
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return s.level
+}
+
+// Field is a key/value pair attached to a log line.
+type Field struct {
+	Key   string
+	Value any
+}
+
+func F(key string, value any) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Err(err error) Field {
+	if err == nil {
+		return Field{Key: "error", Value: nil}
+	}
+	return Field{Key: "error", Value: err.Error()}
+}
+
+// Logger writes structured lines for one component. The zero value isn't
+// usable, get one from For.
+type Logger struct {
+	component string
+	fields    []Field
+}
+
+// For returns the logger for a component such as "controller" or
+// "mode.rainbow". It's safe to call before Setup.
+func For(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// Named returns a logger for a sub-component, e.g. For("mode").Named("roll").
+func (l *Logger) Named(name string) *Logger {
+	return &Logger{
+		component: l.component + "." + name,
+		fields:    l.fields,
+	}
+}
+
+// With returns a logger that adds fields to every line.
+func (l *Logger) With(fields ...Field) *Logger {
+	return &Logger{
+		component: l.component,
+		fields:    append(append([]Field(nil), l.fields...), fields...),
+	}
+}
+
+func (l *Logger) Enabled(level Level) bool {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	return level >= std.levelFor(l.component) && level != LevelOff
+}
+
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	std.lock.Lock()
+	defer std.lock.Unlock()
+	if level < std.levelFor(l.component) || level == LevelOff {
+		return
+	}
+
+	all := append(append([]Field(nil), l.fields...), fields...)
+	now := time.Now()
+	switch std.format {
+	case FormatJSON:
+		writeJSON(std.out, now, level, l.component, msg, all)
+	default:
+		writeText(std.out, now, level, l.component, msg, all)
+	}
+}
+
+func writeJSON(w io.Writer, at time.Time, level Level, component string, msg string, fields []Field) {
+	line := map[string]any{
+		"time":      at.Format(time.RFC3339Nano),
+		"level":     level.String(),
+		"component": component,
+		"msg":       msg,
+	}
+	for _, f := range fields {
+		line[f.Key] = redact(f.Key, f.Value)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(line); err != nil {
+		fmt.Fprintf(w, `{"level":"error","component":"log","msg":"failed to encode log line","error":%q}`+"\n", err.Error())
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+func writeText(w io.Writer, at time.Time, level Level, component string, msg string, fields []Field) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s [%s] %s", at.Format("2006-01-02T15:04:05.000"), strings.ToUpper(level.String()), component, msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%s", f.Key, textValue(redact(f.Key, f.Value)))
+	}
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
+
+func textValue(v any) string {
+	switch val := v.(type) {
+	case string:
+		if strings.ContainsAny(val, " \t\"=") || val == "" {
+			return fmt.Sprintf("%q", val)
+		}
+		return val
+	case map[string]any:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(keys))
+		for _, k := range keys {
+			parts = append(parts, k+":"+textValue(val[k]))
+		}
+		return "{" + strings.Join(parts, " ") + "}"
+	}
+	return fmt.Sprintf("%v", v)
 }
@@ -0,0 +1,103 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const redacted = "<redacted>"
+
+// keys containing any of these are never written out, at any depth
+var sensitiveKeys = []string{"pass", "token", "secret", "session", "authoriz", "cookie", "mfa"}
+
+// Secret wraps a value that must never reach a log, whatever key it's under.
+type Secret string
+
+func (s Secret) String() string {
+	return redacted
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(redacted)
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact turns a field value into something safe to encode. Structs and maps
+// are flattened through their JSON form so nested secrets, like the tokens in
+// a cbyge.SessionInfo, are caught too.
+func redact(key string, value any) any {
+	if isSensitive(key) && !isEmpty(value) {
+		return redacted
+	}
+
+	switch v := value.(type) {
+	case nil, bool, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case Secret:
+		return redacted
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	var generic any
+	if err := json.Unmarshal(encoded, &generic); err != nil {
+		return string(encoded)
+	}
+	return redactNested(generic)
+}
+
+func redactNested(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for k, inner := range v {
+			if isSensitive(k) && !isEmpty(inner) {
+				v[k] = redacted
+				continue
+			}
+			v[k] = redactNested(inner)
+		}
+		return v
+	case []any:
+		for i, inner := range v {
+			v[i] = redactNested(inner)
+		}
+		return v
+	}
+	return value
+}
+
+func isEmpty(value any) bool {
+	if value == nil {
+		return true
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
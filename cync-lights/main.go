@@ -1,18 +1,29 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
-	"io"
+	"math"
 	"math/rand"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/kungfukennyg/home-office/cync-lights/calibrate"
+	"github.com/kungfukennyg/home-office/cync-lights/ci"
 	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/emulator"
+	"github.com/kungfukennyg/home-office/cync-lights/energy"
+	"github.com/kungfukennyg/home-office/cync-lights/input"
 	"github.com/kungfukennyg/home-office/cync-lights/log"
 	"github.com/kungfukennyg/home-office/cync-lights/optional"
+	"github.com/kungfukennyg/home-office/cync-lights/rules"
+	"github.com/kungfukennyg/home-office/cync-lights/trace"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/kungfukennyg/home-office/cync-lights/wake"
 	"github.com/pkg/errors"
 	"github.com/unixpickle/cbyge"
 )
@@ -20,17 +31,58 @@ import (
 const timeout time.Duration = 2 * time.Second
 
 type controller struct {
-	wrapped              *cbyge.Controller
+	backend              backend
 	mode                 Mode
 	running              bool
-	debug                bool
+	log                  *log.Logger
+	config               *config.Config
+	commands             *registry
+	recorder             *recorder
 	modes                map[string]Mode
-	devices              []*cbyge.ControllerDevice
+	devices              []*device
 	devicesLastUpdatedAt time.Time
-	userinput            chan string
-	closeCh              chan<- struct{}
+	view                 *ui.View
+	screen               *ui.Screen
+	input                *input.Mux
+	// keys for the current mode, nil if it doesn't take any
+	keys            <-chan input.Key
+	unsubscribeKeys func()
+	// tasks run on the controller loop on behalf of other goroutines
+	tasks        chan func()
+	presence     *presenceRules
+	rules        *rules.Engine
+	ruleWatchers *rules.Watchers
+	configStop   chan struct{}
+	alerts       *alerts
+	// alerting is set while an alert has the lights
+	alerting bool
+	api      *http.Server
+	wake     *wakeAlarms
+	// calibration corrects what's sent to each device
+	calibration *calibrate.Profiles
+	// usage adds up what each device draws, by the wattage models
+	usage     *energy.Meter
+	wattages  map[string]energy.Model
+	usageStop chan struct{}
+	metrics   *controllerMetrics
+	tracing   *tracing
+	// queued holds commands while the cloud is unreachable
+	queued    *queuedBackend
+	queueStop chan struct{}
+	// fake is the fake backend when running against one, for outages
+	fake *fakeBackend
+	// reconcile puts right devices that aren't doing what they were sent
+	reconcile *reconciler
+	// routes sends some devices through a local hub, nil without one
+	routes *routedBackend
 
 	lastColor map[string]colors.RGB
+	// lastKelvin is set for devices last sent a color tone rather than an RGB
+	lastKelvin map[string]int
+	lastLum    map[string]colors.Brightness
+	// scale is the global brightness every brightness is scaled by
+	scale     colors.Brightness
+	lastPower map[string]bool
 }
 
 type ErrSwitchMode struct {
@@ -44,29 +96,73 @@ func (e *ErrSwitchMode) Error() string {
 func main() {
 	args := os.Args[1:]
 
-	debug := isDebug(args)
+	logConfig, logging, err := parseLogConfig(args)
+	if err != nil {
+		fmt.Printf("[main] %v\n", err)
+		os.Exit(6)
+	}
+	if logging {
+		// lines aren't buffered, so the file can be left for the OS to close
+		_, err := log.Setup(logConfig)
+		if err != nil {
+			fmt.Printf("[main] %v\n", err)
+			os.Exit(6)
+		}
+	}
+	logger := log.For("main")
 
-	if debug {
-		// BaseUiLiveSingleLineTest()
-		// BaseUiLiveMultiLineTest()
-		// LoggerSingleLineTest()
-		// LoggerMultiLineTest(2)
-		// time.Sleep(10 * time.Second)
+	if len(args) > 0 && args[0] == "alert" {
+		if err := sendAlert(args[1:]); err != nil {
+			fmt.Printf("[alert] %v\n", err)
+			os.Exit(8)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "local-mock" {
+		if err := runLocalMock(args[1:]); err != nil {
+			fmt.Printf("[local-mock] %v\n", err)
+			os.Exit(8)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "emulator" {
+		if err := runEmulator(args[1:]); err != nil {
+			fmt.Printf("[emulator] %v\n", err)
+			os.Exit(8)
+		}
+		return
 	}
+	if cloud, ok := cloudAddr(args); ok {
+		if err := emulator.Redirect(cloud); err != nil {
+			fmt.Printf("[main] %v\n", err)
+			os.Exit(6)
+		}
+		logger.Info("using an emulated cloud", log.F("addr", cloud))
+	}
+
+	stdin := input.NewMux(os.Stdin)
+	stdin.Start()
 
-	var geController *cbyge.Controller
+	var lights backend
 	cachedSession := os.Getenv(CyncSession)
-	if cachedSession != "" {
+	if fakeDevices, ok := flagValue(args, "fake"); ok {
+		n, err := fakeDeviceCount(fakeDevices)
+		if err != nil {
+			fmt.Printf("[main] invalid --fake: %v\n", err)
+			os.Exit(6)
+		}
+		logger.Info("using fake backend", log.F("devices", n))
+		lights = newFakeBackend(n)
+	} else if cachedSession != "" {
 		sessionInfo := cbyge.SessionInfo{}
 		err := json.Unmarshal([]byte(cachedSession), &sessionInfo)
 		if err != nil {
-			fmt.Printf("[main] couldn't unmarshal cached session info %v", sessionInfo)
+			logger.Error("couldn't unmarshal cached session info", log.Err(err))
+			fmt.Printf("[main] couldn't unmarshal cached session info from %s\n", CyncSession)
 			os.Exit(5)
 		}
-		if debug {
-			fmt.Printf("[main] logging in with cached session info %v\n", cachedSession)
-		}
-		geController = cbyge.NewController(&sessionInfo, timeout)
+		logger.Debug("logging in with cached session info", log.F("session", sessionInfo), log.F("user_id", sessionInfo.UserID))
+		lights = newCloudBackend(cbyge.NewController(&sessionInfo, timeout))
 	} else {
 		user, pass := parseArgs(args)
 		if user == "" || pass == "" {
@@ -80,39 +176,116 @@ func main() {
 			fmt.Printf("[main] couldn't find %s checking env\n", ret)
 			user, pass = loadEnv()
 		}
-		if debug {
-			fmt.Printf("[main] logging in with user %v and pass <redacted>, len: %d\n", user, len(pass))
-		}
-		ret, err := MFALogin(user, pass)
+		logger.Debug("logging in", log.F("user", user), log.F("pass", log.Secret(pass)))
+		ret, err := MFALogin(stdin, user, pass)
 		if err != nil {
+			logger.Error("login failed", log.Err(err))
 			fmt.Printf("%v\n", err)
 			os.Exit(2)
 		}
-		geController = ret
+		lights = newCloudBackend(ret)
+	}
+
+	cfg, err := config.Load(config.Path())
+	if err != nil {
+		logger.Error("failed to load config", log.Err(err))
+		fmt.Printf("[main] %v\n", err)
+		os.Exit(7)
 	}
 
-	c, err := newController(geController, debug)
+	c, err := newController(lights, cfg)
 	if err != nil {
+		logger.Error("failed to create controller", log.Err(err))
+		fmt.Printf("%v\n", err)
 		os.Exit(3)
 	}
+	c.input = stdin
+	c.screen = ui.NewScreen(c.view, stdin, os.Stdout)
+	c.screen.SetCompleter(c.complete)
+	history, err := ui.LoadHistory(filepath.Join(cfg.Dir(), "history"))
+	if err != nil {
+		logger.Warn("failed to load history", log.Err(err))
+	} else {
+		c.screen.SetHistory(history)
+	}
+	err = c.screen.Start()
+	if err != nil {
+		c.exit(4, err)
+	}
 	err = c.SwitchMode(ModeCommandID)
 	if err != nil && !errors.Is(err, &ErrSwitchMode{}) {
-		fmt.Printf("%v\n", err)
-		os.Exit(4)
+		c.exit(4, err)
+	}
+	if err := c.startPresence(); err != nil {
+		logger.Warn("failed to start presence", log.Err(err))
+		c.view.Eventf(ui.ErrColor, "presence: %v", err)
+	}
+	c.startRules()
+	if err := c.startAPI(); err != nil {
+		logger.Warn("failed to start api", log.Err(err))
+		c.view.Eventf(ui.ErrColor, "api: %v", err)
 	}
+	if err := c.startWake(wake.SystemClock{}); err != nil {
+		logger.Warn("failed to start alarms", log.Err(err))
+		c.view.Eventf(ui.ErrColor, "wake: %v", err)
+	}
+	c.startUsage()
+	c.startQueue()
+	c.startReconcile()
 	for {
 		sleepMs, err := c.run()
 		if err != nil {
-			fmt.Printf("%v\n", err)
-			os.Exit(100)
+			c.exit(100, err)
 		}
 		if !c.running {
-			os.Exit(0)
+			c.exit(0, nil)
 		}
-		time.Sleep(sleepMs)
+		c.wait(sleepMs)
 	}
 }
 
+// exit tears down the screen before exiting so the terminal is left usable.
+func (c *controller) exit(code int, err error) {
+	c.screen.Stop()
+	if c.presence != nil {
+		c.presence.watcher.Stop()
+	}
+	if c.ruleWatchers != nil {
+		c.ruleWatchers.Stop()
+	}
+	if c.configStop != nil {
+		close(c.configStop)
+	}
+	if c.api != nil {
+		c.api.Close()
+	}
+	if c.wake != nil {
+		close(c.wake.stop)
+	}
+	if c.usageStop != nil {
+		close(c.usageStop)
+		c.saveUsage()
+	}
+	if c.queueStop != nil {
+		close(c.queueStop)
+		if err := c.queued.queue.Save(); err != nil {
+			c.log.Warn("failed to save queued commands", log.Err(err))
+		}
+	}
+	if c.reconcile.stop != nil {
+		close(c.reconcile.stop)
+	}
+	if c.routes != nil {
+		c.routes.hub.Close()
+	}
+	c.tracing.tracer.Close()
+	if err != nil {
+		c.log.Error("exiting", log.F("code", code), log.Err(err))
+		fmt.Printf("%v\n", err)
+	}
+	os.Exit(code)
+}
+
 const CyncUser = "CYNC_USER"
 const CyncPass = "CYNC_PASS"
 const CyncSession = "CYNC_SESSION"
@@ -125,96 +298,253 @@ func loadEnv() (user, pass string) {
 }
 
 func parseArgs(args []string) (user, pass string) {
-	if len(args) < 2 {
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") {
+			positional = append(positional, arg)
+			continue
+		}
+		// skip a flag's value given after a space
+		if name := strings.TrimPrefix(arg, "--"); !strings.Contains(name, "=") && !switches[name] && i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			i++
+		}
+	}
+	if len(positional) < 2 {
 		return "", ""
 	}
 
-	email := args[0]
-	password := args[1]
+	email := positional[0]
+	password := positional[1]
 
 	return email, password
 }
 
-func isDebug(args []string) bool {
-	for _, arg := range args {
-		if arg == "--debug" {
-			return true
+// switches are the flags that never take a value, so what follows them is
+// an arg of its own.
+var switches = map[string]bool{"debug": true}
+
+// flagValue finds a --name flag, with its value after an = or a space.
+func flagValue(args []string, name string) (value string, ok bool) {
+	for i, arg := range args {
+		if arg == "--"+name {
+			if !switches[name] && i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				return args[i+1], true
+			}
+			return "", true
+		}
+		if strings.HasPrefix(arg, "--"+name+"=") {
+			return strings.TrimPrefix(arg, "--"+name+"="), true
 		}
 	}
 
-	return false
+	return "", false
 }
 
-func newController(comp *cbyge.Controller, debug bool) (*controller, error) {
+// parseLogConfig reads --log-level, --log-file and --log-format. --debug is
+// shorthand for --log-level=debug. Logging stays off unless one is given.
+func parseLogConfig(args []string) (cfg log.Config, enabled bool, err error) {
+	if _, ok := flagValue(args, "debug"); ok {
+		cfg.Levels = "debug"
+		enabled = true
+	}
+	if levels, ok := flagValue(args, "log-level"); ok {
+		cfg.Levels = levels
+		enabled = true
+	}
+	if path, ok := flagValue(args, "log-file"); ok {
+		cfg.Path = path
+		enabled = true
+	}
+	if format, ok := flagValue(args, "log-format"); ok {
+		cfg.Format = log.Format(format)
+		enabled = true
+	}
+	if cfg.Format != "" && cfg.Format != log.FormatText && cfg.Format != log.FormatJSON {
+		return cfg, false, errors.Errorf("--log-format must be %s or %s", log.FormatText, log.FormatJSON)
+	}
+
+	return cfg, enabled, nil
+}
+
+func newController(lights backend, cfg *config.Config) (*controller, error) {
+	metrics := newControllerMetrics()
+	tracing, err := newTracing(cfg.Tracing, cfg.Dir())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tracing in config")
+	}
+	reconcile, err := newReconciler(cfg.Reconcile)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid reconcile in config")
+	}
+	view := ui.NewView()
+	// devices routed to a local hub skip the cloud
+	var routes *routedBackend
+	sender := lights
+	if cfg.Local != nil {
+		if routes, err = newRoutedBackend(lights, cfg.Local, view, metrics); err != nil {
+			return nil, errors.Wrap(err, "invalid local in config")
+		}
+		sender = routes
+	}
+	queue, queueErr := openQueue(cfg.Dir())
+	queued := &queuedBackend{
+		backend: &instrumentedBackend{backend: sender, metrics: metrics, tracing: tracing},
+		queue:   queue,
+		view:    view,
+	}
 	c := controller{
-		wrapped:   comp,
-		running:   true,
-		debug:     debug,
-		modes:     map[string]Mode{},
-		lastColor: map[string]colors.RGB{},
+		backend:    queued,
+		queued:     queued,
+		reconcile:  reconcile,
+		metrics:    metrics,
+		tracing:    tracing,
+		config:     cfg,
+		running:    true,
+		log:        log.For("controller"),
+		modes:      map[string]Mode{},
+		lastColor:  map[string]colors.RGB{},
+		lastKelvin: map[string]int{},
+		lastLum:    map[string]colors.Brightness{},
+		scale:      colors.Full,
+		lastPower:  map[string]bool{},
+		view:       view,
+	}
+	if fake, ok := lights.(*fakeBackend); ok {
+		c.fake = fake
+	}
+	c.routes = routes
+	if queueErr != nil {
+		c.log.Warn("not saving queued commands", log.Err(queueErr))
+		c.view.Eventf(ui.ErrColor, "pending: %v, not saving queued commands until it's fixed", queueErr)
 	}
+	c.tasks = make(chan func(), 16)
+	c.alerts = newAlerts()
+	c.rules = rules.New(ruleEnv{&c})
+	c.loadCalibration()
+	c.loadEnergy()
+	c.openUsage()
 	c.modes[ModeCommandID] = &ModeCommand{}
-	c.modes[ModeRainbowID] = &ModeRainbow{}
+	keys, err := newBindings(cfg.Bindings)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key bindings in config")
+	}
+	if cfg.Scale != "" {
+		if c.scale, err = colors.ParseBrightness(cfg.Scale); err != nil {
+			return nil, errors.Wrap(err, "invalid scale in config")
+		}
+	}
+	c.modes[ModeRainbowID] = &ModeRainbow{
+		liveControls: newLiveControls(keys, time.Second),
+	}
 	c.modes[ModeExperimentID] = &ModeExperiment{}
 	c.modes[ModeRollID] = &ModeRoll{
-		colors:     colors.BaseColors,
-		otherLines: map[string]io.Writer{},
+		liveControls: newLiveControls(keys, 50*time.Millisecond),
 	}
+	c.modes[ModeReplayID] = &ModeReplay{}
+	c.modes[ModeShowID] = &ModeShow{bindings: keys}
+	c.modes[ModeCIID] = &ModeCI{hook: &ci.Webhook{}}
+	c.modes[ModeFocusID] = &ModeFocus{bindings: keys}
+	c.modes[ModeCircadianID] = &ModeCircadian{}
+	c.modes[ModeWakeID] = &ModeWake{bindings: keys}
+	c.modes[ModeCalibrateID] = &ModeCalibrate{bindings: keys}
+	c.commands = defaultCommands(&c)
 	// pre-load devices
-	err := c.refreshDeviceCache()
+	err = c.refreshDeviceCache()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to refresh device cache")
 	}
+	c.routeDevices()
 	return &c, nil
 }
 
 func (c *controller) run() (time.Duration, error) {
 	// break indefinite modes on user input
 	if c.mode.isIndefinite() {
-		if c.userinput == nil {
-			userInputCh, closeCh := log.ListenForInputAsync()
-			c.userinput = userInputCh
-			c.closeCh = closeCh
-		}
-	outer:
-		for {
-			select {
-			case input, ok := <-c.userinput:
-				if !ok {
-					break outer
-				}
+		select {
+		case line, ok := <-c.screen.Lines():
+			if !ok {
+				c.running = false
+				return time.Millisecond, nil
+			}
 
-				if c.debug {
-					fmt.Printf("got user input %s (len %d)\n", input, len(input))
-				}
+			c.log.Debug("got user input", log.F("input", line))
 
-				if len(input) > 1 {
-					c.SwitchMode(ModeCommandID)
-					return time.Millisecond, nil
+			if len(line) > 0 {
+				err := c.SwitchMode(ModeCommandID)
+				if err != nil {
+					return time.Millisecond, err
 				}
-			case <-time.After(50 * time.Millisecond):
-				break outer
+				return c.modes[ModeCommandID].(*ModeCommand).execute(c, line)
 			}
+		default:
 		}
 	}
 
-	if c.debug {
-		fmt.Println("\r[controller.run] state:")
-		fmt.Printf("     \rrunning: %v\n", c.running)
-		fmt.Printf("     \rmode: %v - %+v\n", c.mode.getId(), c.mode)
+	// command mode's run is waiting for the user, not a frame, and the
+	// commands it runs are traced on their own
+	id := c.mode.getId()
+	var span *trace.Span
+	if id != ModeCommandID {
+		span = c.tracing.start("mode "+id, trace.KindInternal, trace.String("mode", id))
 	}
+	start := time.Now()
 	sleepTime, err := c.mode.run(c)
+	if id != ModeCommandID {
+		c.metrics.frames.Observe(time.Since(start).Seconds(), id)
+		span.Set(trace.String("sleep", sleepTime.String()))
+		c.tracing.end(span, err)
+	}
 	if err != nil && !errors.Is(err, &ErrSwitchMode{}) {
 		return time.Second, errors.Wrapf(err, "failed to execute mode %+v", c.mode)
 	}
-	if c.debug {
-		fmt.Printf("\r[controller.run] got sleepTime: %v\n", sleepTime)
-		fmt.Printf("\r[controller.run] mode indefinite? %v\n", c.mode.isIndefinite())
-	}
+	c.log.Debug("ran mode", log.F("mode", c.mode.getId()), log.F("sleep", sleepTime), log.F("indefinite", c.mode.isIndefinite()))
 
 	return sleepTime, nil
 }
 
+// wait sleeps between runs of the mode, waking early for the mode's keys so
+// they take effect immediately.
+func (c *controller) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return
+		case key := <-c.keys:
+			handler, ok := c.mode.(keyHandler)
+			if ok && handler.handleKey(c, key) {
+				return
+			}
+		case task := <-c.tasks:
+			task()
+		}
+	}
+}
+
+// post queues work from another goroutine to run on the controller loop,
+// between runs of the mode or while waiting for a command.
+func (c *controller) post(task func()) {
+	c.tasks <- task
+}
+
+// readLine blocks until the user submits a line from the prompt. ok is false
+// once stdin is closed.
+func (c *controller) readLine(prompt string) (line string, ok bool) {
+	c.view.SetPrompt(prompt)
+	defer c.view.SetPrompt("")
+	for {
+		select {
+		case line, ok = <-c.screen.Lines():
+			return line, ok
+		case task := <-c.tasks:
+			task()
+		}
+	}
+}
+
 // Doesn't work ):
 func Login(email string, password string) (*cbyge.Controller, error) {
 	comp, err := cbyge.NewControllerLogin(email, password)
@@ -226,13 +556,16 @@ func Login(email string, password string) (*cbyge.Controller, error) {
 }
 
 // gotta do this manual input login
-func MFALogin(email string, password string) (*cbyge.Controller, error) {
+func MFALogin(stdin *input.Mux, email string, password string) (*cbyge.Controller, error) {
 	callback, err := cbyge.Login2FA(email, password, "")
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to login 2fa")
 	}
 
-	mfaCode := scanInput("MFALogin", "enter 2FA code")
+	mfaCode, ok := scanInput(stdin, "MFALogin", "enter 2FA code")
+	if !ok {
+		return nil, errors.New("stdin closed before a 2FA code was entered")
+	}
 
 	sessionInfo, err := callback(mfaCode)
 	if err != nil {
@@ -249,22 +582,41 @@ func MFALogin(email string, password string) (*cbyge.Controller, error) {
 }
 
 func (c *controller) PrintDevices() error {
-	if c.debug {
-		fmt.Printf("[PrintDevices] Printing %d devices\n", len(c.devices))
-		for _, d := range c.devices {
-			if d == nil {
-				fmt.Println("     nil")
-			} else {
-				fmt.Printf("     %+v\n", *d)
-			}
+	c.view.Eventf(ui.TextColor, "%d devices", len(c.devices))
+	for _, d := range c.devices {
+		if d == nil {
+			c.view.Eventf(ui.TextColor, "     nil")
+		} else {
+			status := c.backend.Status(d)
+			c.view.Eventf(ui.TextColor, "     %s (%s) %+v", d.Name(), d.DeviceID(), status)
 		}
 	}
 
 	return nil
 }
 
-func (c *controller) SetStatus(device *cbyge.ControllerDevice, status bool) {
-	c.wrapped.SetDeviceStatus(device, status)
+func (c *controller) SetStatus(device *device, status bool) error {
+	err := c.backend.SetStatus(device, status)
+	c.reconcile.touch(device.DeviceID(), fieldPower)
+	changed := c.lastPower[device.DeviceID()] != status
+	if err == nil {
+		c.lastPower[device.DeviceID()] = status
+		c.recorder.power(device, status)
+		c.deviceChanged(device, true)
+	}
+	c.view.UpdateDevice(device.DeviceID(), func(row *ui.DeviceRow) {
+		if err == nil {
+			row.Power = status
+		}
+		row.Health = c.healthOf(device, "SetDeviceStatus", err)
+	})
+	switch {
+	case err != nil:
+		c.ruleEvent(rules.Event{Kind: rules.KindDevice, Key: device.Name(), Value: "error"})
+	case changed:
+		c.ruleEvent(rules.Event{Kind: rules.KindDevice, Key: device.Name(), Value: powerWord(status)})
+	}
+	return err
 }
 
 func (c *controller) Devices() error {
@@ -272,47 +624,154 @@ func (c *controller) Devices() error {
 }
 
 func (c *controller) refreshDeviceCache() error {
-	devices, err := c.wrapped.Devices()
+	devices, err := c.backend.Devices()
 	if err != nil {
 		return errors.Wrap(err, "failed to cache devices")
 	}
 	c.devices = devices
 	c.devicesLastUpdatedAt = time.Now()
+
+	rows := make([]ui.DeviceRow, 0, len(devices))
+	for _, d := range devices {
+		status := c.backend.Status(d)
+		row := ui.DeviceRow{
+			ID:     d.DeviceID(),
+			Name:   d.Name(),
+			Health: ui.HealthOffline,
+		}
+		if status.Online {
+			row.Health = ui.HealthOK
+			row.Power = status.On
+			row.Lum = status.Brightness
+			row.Color = colors.RGB{Name: "-"}
+			if status.UseRGB {
+				row.Color.RGBA.R, row.Color.RGBA.G, row.Color.RGBA.B = status.RGB[0], status.RGB[1], status.RGB[2]
+				c.lastColor[d.DeviceID()] = row.Color
+			}
+			c.lastPower[d.DeviceID()] = status.On
+			c.lastLum[d.DeviceID()] = colors.Brightness(status.Brightness).Clamp()
+		}
+		c.deviceChanged(d, status.Online)
+		rows = append(rows, row)
+	}
+	c.view.SetDevices(rows)
 	return nil
 }
 
-func (c *controller) SetRGBAsync(device *cbyge.ControllerDevice, color colors.RGB) error {
-	if c.debug {
-		fmt.Printf("[controller.SetRGBAsync] setting rgb to %+v\n", color)
-	}
+func (c *controller) SetRGBAsync(device *device, color colors.RGB) error {
+	c.log.Debug("setting rgb", log.F("device", device.DeviceID()), log.F("color", color.Name), log.F("rgb", color.GetRGB()), log.F("async", true))
 
 	c.lastColor[device.DeviceID()] = color
-	return c.wrapped.SetDeviceRGB(device, color.RGBA.R, color.RGBA.G, color.RGBA.B)
+	delete(c.lastKelvin, device.DeviceID())
+	rgb := c.calibration.For(device.Name()).RGB(color.GetRGB())
+	err := c.backend.SetRGB(device, rgb[0], rgb[1], rgb[2], true)
+	c.updateColor(device, color, "SetDeviceRGB", err)
+	return err
 }
 
-func (c *controller) SetRGB(device *cbyge.ControllerDevice, color colors.RGB) error {
-	if c.debug {
-		fmt.Printf("[controller.SetRGB] setting rgb to %+v\n", color)
-	}
+func (c *controller) SetRGB(device *device, color colors.RGB) error {
+	c.log.Debug("setting rgb", log.F("device", device.DeviceID()), log.F("color", color.Name), log.F("rgb", color.GetRGB()))
 
 	c.lastColor[device.DeviceID()] = color
-	return c.wrapped.SetDeviceRGB(device, color.RGBA.R, color.RGBA.G, color.RGBA.B)
+	delete(c.lastKelvin, device.DeviceID())
+	rgb := c.calibration.For(device.Name()).RGB(color.GetRGB())
+	err := c.backend.SetRGB(device, rgb[0], rgb[1], rgb[2], false)
+	c.updateColor(device, color, "SetDeviceRGB", err)
+	return err
 }
 
-func (c *controller) SetLum(device *cbyge.ControllerDevice, lum int) error {
-	if c.debug {
-		fmt.Printf("[controller.SetRGB] setting lum to %+v\n", lum)
+// SetCTAsync sets a tunable white bulb's color temperature. It's remembered
+// as the RGB it looks like, so scenes and replays can put it back on any
+// bulb, and as the temperature for reconciling.
+func (c *controller) SetCTAsync(device *device, kelvin int) error {
+	c.log.Debug("setting color tone", log.F("device", device.DeviceID()), log.F("kelvin", kelvin), log.F("async", true))
+
+	color := colors.Kelvin(kelvin)
+	c.lastColor[device.DeviceID()] = color
+	c.lastKelvin[device.DeviceID()] = kelvin
+	err := c.backend.SetCT(device, colors.Tone(kelvin), true)
+	c.updateColor(device, color, "SetDeviceCT", err)
+	return err
+}
+
+func (c *controller) SetLum(device *device, lum colors.Brightness) error {
+	c.log.Debug("setting lum", log.F("device", device.DeviceID()), log.F("lum", lum))
+
+	err := c.backend.SetLum(device, c.outputLum(device, lum), false)
+	if err == nil {
+		c.lastLum[device.DeviceID()] = lum
+		c.deviceChanged(device, true)
 	}
+	c.updateLum(device, lum, err)
+	return err
+}
+
+func (c *controller) SetLumAsync(device *device, lum colors.Brightness) error {
+	c.log.Debug("setting lum", log.F("device", device.DeviceID()), log.F("lum", lum), log.F("async", true))
 
-	return c.wrapped.SetDeviceLum(device, lum)
+	err := c.backend.SetLum(device, c.outputLum(device, lum), true)
+	if err == nil {
+		c.lastLum[device.DeviceID()] = lum
+		c.deviceChanged(device, true)
+	}
+	c.updateLum(device, lum, err)
+	return err
 }
 
-func (c *controller) SetLumAsync(device *cbyge.ControllerDevice, lum int) error {
-	if c.debug {
-		fmt.Printf("[controller.SetRGB] setting lum to %+v\n", lum)
+func (c *controller) updateColor(device *device, color colors.RGB, op string, err error) {
+	c.reconcile.touch(device.DeviceID(), fieldColor)
+	if err == nil {
+		c.recorder.color(device, color)
+	}
+	c.view.UpdateDevice(device.DeviceID(), func(row *ui.DeviceRow) {
+		if err == nil {
+			row.Color = color
+			row.Power = true
+		}
+		row.Health = c.healthOf(device, op, err)
+	})
+	if err != nil {
+		c.ruleEvent(rules.Event{Kind: rules.KindDevice, Key: device.Name(), Value: "error"})
 	}
+}
 
-	return c.wrapped.SetDeviceLumAsync(device, lum)
+// outputLum is the brightness a device is actually sent, scaled by the
+// global brightness and then calibrated.
+func (c *controller) outputLum(device *device, lum colors.Brightness) int {
+	return int(c.calibration.For(device.Name()).Lum(lum.Scale(c.scale)))
+}
+
+func (c *controller) updateLum(device *device, lum colors.Brightness, err error) {
+	c.reconcile.touch(device.DeviceID(), fieldBrightness)
+	if err == nil {
+		c.recorder.lum(device, lum)
+	}
+	c.view.UpdateDevice(device.DeviceID(), func(row *ui.DeviceRow) {
+		if err == nil {
+			row.Lum = int(lum)
+		}
+		row.Health = c.healthOf(device, "SetDeviceLum", err)
+	})
+	if err != nil {
+		c.ruleEvent(rules.Event{Kind: rules.KindDevice, Key: device.Name(), Value: "error"})
+	}
+}
+
+func (c *controller) healthOf(device *device, op string, err error) ui.Health {
+	if err != nil {
+		c.log.Warn("device command failed", log.F("device", device.DeviceID()), log.F("op", op), log.Err(err))
+	}
+	if err == nil && c.queued.queue.Has(device.DeviceID()) {
+		return ui.HealthPending
+	}
+	return healthOf(err)
+}
+
+func healthOf(err error) ui.Health {
+	if err != nil {
+		return ui.HealthError
+	}
+	return ui.HealthOK
 }
 
 func (c *controller) SwitchMode(newMode string) error {
@@ -322,19 +781,25 @@ func (c *controller) SwitchMode(newMode string) error {
 			modeId: newMode,
 		}
 	}
-	if c.debug {
-		fmt.Printf("[controller.SwitchMode] changing to mode %v\n", newMode)
+	c.log.Info("changing mode", log.F("mode", newMode))
+	if c.mode != nil && c.mode != mode {
+		c.mode.onExit(c)
 	}
 	c.mode = mode
-	if c.mode.isIndefinite() && c.userinput != nil {
-		c.closeCh <- struct{}{}
-		c.closeCh = nil
-		c.userinput = nil
+	c.view.SetMode(mode.getId())
+	c.subscribeKeys()
+	err := c.mode.onSwitch(c)
+	if err != nil && newMode != ModeCommandID {
+		// a mode that couldn't start can't run either
+		c.mode = c.modes[ModeCommandID]
+		c.view.SetMode(ModeCommandID)
+		c.subscribeKeys()
 	}
-	return c.mode.onSwitch(c)
+	c.metrics.setMode(c.mode.getId())
+	return err
 }
 
-func (c *controller) getLastColor(device *cbyge.ControllerDevice) optional.Optional[colors.RGB] {
+func (c *controller) getLastColor(device *device) optional.Optional[colors.RGB] {
 	rgb, ok := c.lastColor[device.DeviceID()]
 	if !ok {
 		return optional.Optional[colors.RGB]{}
@@ -343,51 +808,76 @@ func (c *controller) getLastColor(device *cbyge.ControllerDevice) optional.Optio
 	}
 }
 
-func (c *controller) assignRandomColors(devices []*cbyge.ControllerDevice) map[string]colors.RGB {
+// assignRandomColors picks a palette color for each device that looks
+// clearly different from the device's last color and from the device before
+// it, preferring colors no other device got. When the palette is too small
+// for that, the most different color wins.
+func (c *controller) assignRandomColors(devices []*device, palette []colors.RGB) map[string]colors.RGB {
 	out := make(map[string]colors.RGB, len(devices))
+	used := make(map[colors.RGB]bool, len(devices))
+	var previous *colors.RGB
 	for _, device := range devices {
+		lastColor, hasLast := c.lastColor[device.DeviceID()]
+
+		// unused colors first, each lot in a random order
+		var fresh, reused []colors.RGB
+		for _, i := range rand.Perm(len(palette)) {
+			if used[palette[i]] {
+				reused = append(reused, palette[i])
+			} else {
+				fresh = append(fresh, palette[i])
+			}
+		}
+
 		var color colors.RGB
-		// grab last color of this device
-		lastColor, ok := c.lastColor[device.DeviceID()]
-		// attempt to get a random color
-	outer:
-		for attempts := 0; attempts < 1000; attempts++ {
-			color = colors.BaseColors[indexRandom(c)]
-			// does this color match the device's current color?
-			if ok && color == lastColor {
-				continue outer
+		best := -1.0
+		for _, candidate := range append(fresh, reused...) {
+			distance := math.Inf(1)
+			if hasLast {
+				distance = colors.Distance(candidate, lastColor)
 			}
-			// did another device get assigned this color within this outer loop?
-			for _, deviceColor := range out {
-				if deviceColor == color {
-					continue outer
-				}
+			if previous != nil {
+				distance = math.Min(distance, colors.Distance(candidate, *previous))
+			}
+			if distance > best {
+				color, best = candidate, distance
+			}
+			if distance >= colors.Distinct {
+				color = candidate
+				break
 			}
-
-			break outer
 		}
+
 		// color passed our validation, assign it
 		out[device.DeviceID()] = color
 		c.lastColor[device.DeviceID()] = color
+		used[color] = true
+		previous = &color
 	}
 
 	return out
 }
 
-func indexRandom(cont *controller) int {
-	return rand.Intn(len(colors.BaseColors))
-}
+// subscribeKeys routes keypresses to the current mode if it wants them. Keys
+// are only taken while the prompt is empty so commands can still be typed.
+func (c *controller) subscribeKeys() {
+	if c.unsubscribeKeys != nil {
+		c.unsubscribeKeys()
+		c.unsubscribeKeys = nil
+		c.keys = nil
+	}
 
-func scanInput(component string, prompt string) string {
-	fmt.Printf("\r[%s] %s: ", component, prompt)
-	input := bufio.NewScanner(os.Stdin)
-	input.Scan()
-	return strings.Trim(input.Text(), "\n")
+	handler, ok := c.mode.(keyHandler)
+	if !ok || c.input == nil {
+		return
+	}
+	c.keys, c.unsubscribeKeys = c.input.Subscribe(func(k input.Key) bool {
+		return c.screen.PromptEmpty() && handler.wantsKey(k)
+	})
 }
 
-func scanInputV2(writer io.Writer, str string) string {
-	log.FPrintln(writer, log.MainColor, str)
-	input := bufio.NewScanner(os.Stdin)
-	input.Scan()
-	return strings.Trim(input.Text(), "\n")
+func scanInput(stdin *input.Mux, component string, prompt string) (string, bool) {
+	fmt.Printf("\r[%s] %s: ", component, prompt)
+	line, ok := stdin.ReadLine()
+	return strings.TrimSpace(line), ok
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+)
+
+// newTestController runs n fake devices with an empty config in a temp dir.
+func newTestController(t *testing.T, n int) (*controller, *fakeBackend) {
+	t.Helper()
+	cfg, err := config.Load(filepath.Join(t.TempDir(), "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := newFakeBackend(n)
+	c, err := newController(fb, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, fb
+}
+
+// runCommands executes each line the way the prompt does, failing on the
+// first error.
+func runCommands(t *testing.T, c *controller, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		c.recorder.command(line)
+		if err := c.commands.execute(c, line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	args := strings.Fields("alert --color red --pattern=blink3 --group desk --debug --listen")
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"color", "red", true},
+		{"pattern", "blink3", true},
+		{"group", "desk", true},
+		// a value can't be another flag
+		{"debug", "", true},
+		{"listen", "", true},
+		{"device", "", false},
+	}
+	for _, tt := range tests {
+		value, ok := flagValue(args, tt.name)
+		if value != tt.value || ok != tt.ok {
+			t.Errorf("--%s is %q, %t, want %q, %t", tt.name, value, ok, tt.value, tt.ok)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args       string
+		user, pass string
+	}{
+		{"me@example.com hunter2", "me@example.com", "hunter2"},
+		{"--log-level debug me@example.com hunter2", "me@example.com", "hunter2"},
+		{"--log-level=debug me@example.com hunter2", "me@example.com", "hunter2"},
+		// --debug never takes a value
+		{"--debug me@example.com hunter2", "me@example.com", "hunter2"},
+		{"me@example.com hunter2 --cloud 127.0.0.1:8780", "me@example.com", "hunter2"},
+		{"--cloud 127.0.0.1:8780 me@example.com", "", ""},
+	}
+	for _, tt := range tests {
+		user, pass := parseArgs(strings.Fields(tt.args))
+		if user != tt.user || pass != tt.pass {
+			t.Errorf("%q logs in as %q %q, want %q %q", tt.args, user, pass, tt.user, tt.pass)
+		}
+	}
+}
+
+func TestApplyState(t *testing.T) {
+	c, fb := newTestController(t, 3)
+	ids := []string{c.devices[0].DeviceID(), c.devices[1].DeviceID(), c.devices[2].DeviceID()}
+	// fake-1 was last seen in white mode, so its color isn't known, and
+	// nothing at all is known about fake-3
+	delete(c.lastColor, ids[0])
+	delete(c.lastColor, ids[2])
+	delete(c.lastLum, ids[2])
+	c.lastPower[ids[2]] = true
+	if err := c.SetCTAsync(c.devices[1], 3000); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := map[*device]config.DeviceState{}
+	for _, d := range c.devices {
+		saved[d] = c.deviceState(d)
+	}
+	before := len(fb.Calls())
+	for _, d := range c.devices {
+		if err := c.applyState(d, saved[d]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []fakeCall{
+		{Device: "fake-1", Op: "status", Value: "true"},
+		{Device: "fake-1", Op: "lum", Value: "100"},
+		{Device: "fake-2", Op: "status", Value: "true"},
+		{Device: "fake-2", Op: "ct", Value: fmt.Sprint(colors.Tone(3000))},
+		{Device: "fake-2", Op: "lum", Value: "100"},
+		{Device: "fake-3", Op: "status", Value: "true"},
+	}
+	if got := fb.Calls()[before:]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("restored with\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestParseLatency(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"0s", 0, false},
+		{"50ms", 50 * time.Millisecond, false},
+		{"-5ms", 0, true},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLatency(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseLatency(%q) = %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestFakeDeviceCount(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 3, false},
+		{"5", 5, false},
+		{"1", 1, false},
+		{"0", 0, true},
+		{"-2", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := fakeDeviceCount(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("fakeDeviceCount(%q) = %d, %v", tt.value, got, err)
+		}
+	}
+}
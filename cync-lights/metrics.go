@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/metrics"
+	"github.com/kungfukennyg/home-office/cync-lights/trace"
+)
+
+// commandRetryAfter is how long a failed command waits before its one retry.
+// Only commands that wait for an answer are retried, effects send async and
+// the next frame is the retry.
+const commandRetryAfter = 200 * time.Millisecond
+
+// frameBuckets are for how long a mode takes to run, effects run every 50ms
+// or so.
+var frameBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// controllerMetrics are what /metrics serves.
+type controllerMetrics struct {
+	registry   *metrics.Registry
+	commands   *metrics.Counter
+	latency    *metrics.Histogram
+	errors     *metrics.Counter
+	retries    *metrics.Counter
+	online     *metrics.Gauge
+	power      *metrics.Gauge
+	brightness *metrics.Gauge
+	mode       *metrics.Gauge
+	frames     *metrics.Histogram
+	lateFrames *metrics.Counter
+	pending    *metrics.Gauge
+	offline    *metrics.Gauge
+	drifts     *metrics.Counter
+	fallbacks  *metrics.Counter
+	hubUp      *metrics.Gauge
+	// active is the mode the mode gauge is set for
+	active string
+}
+
+func newControllerMetrics() *controllerMetrics {
+	r := metrics.NewRegistry()
+	return &controllerMetrics{
+		registry:   r,
+		commands:   r.Counter("cync_commands_total", "Device commands sent, retries included.", "device", "op"),
+		latency:    r.Histogram("cync_command_duration_seconds", "How long device commands took.", nil, "device", "op"),
+		errors:     r.Counter("cync_command_errors_total", "Device commands that failed.", "device", "op"),
+		retries:    r.Counter("cync_command_retries_total", "Failed device commands that were tried again.", "device", "op"),
+		online:     r.Gauge("cync_device_online", "1 if the device was online when last seen.", "device"),
+		power:      r.Gauge("cync_device_power", "1 if the device is on.", "device"),
+		brightness: r.Gauge("cync_device_brightness_percent", "The brightness the device was last set to, before scaling.", "device"),
+		mode:       r.Gauge("cync_mode_active", "1 for the mode that's running.", "mode"),
+		frames:     r.Histogram("cync_mode_run_seconds", "How long each run of a mode took, a frame for effects.", frameBuckets, "mode"),
+		lateFrames: r.Counter("cync_mode_late_frames_total", "Frames that took longer to send than the frame interval.", "mode"),
+		pending:    r.Gauge("cync_pending_devices", "Devices with commands queued until they can be reached."),
+		offline:    r.Gauge("cync_cloud_offline", "1 while the cloud is unreachable and commands are queued."),
+		drifts:     r.Counter("cync_device_drift_total", "Times a device was found not doing what it was last sent.", "device", "field"),
+		fallbacks:  r.Counter("cync_local_fallbacks_total", "Commands for devices routed to the hub that went through the cloud instead.", "device", "op"),
+		hubUp:      r.Gauge("cync_local_hub_up", "1 while the local hub is answering."),
+	}
+}
+
+func (m *controllerMetrics) setMode(mode string) {
+	if m.active != "" {
+		m.mode.Set(0, m.active)
+	}
+	m.active = mode
+	m.mode.Set(1, mode)
+}
+
+// deviceMetrics updates a device's gauges from what it was last sent.
+func (c *controller) deviceMetrics(d *device, online bool) {
+	m := c.metrics
+	m.online.Set(boolGauge(online), d.Name())
+	m.power.Set(boolGauge(c.lastPower[d.DeviceID()]), d.Name())
+	if lum, ok := c.lastLum[d.DeviceID()]; ok {
+		m.brightness.Set(float64(lum), d.Name())
+	}
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// instrumentedBackend counts, times and traces every command on its way to
+// the real backend.
+type instrumentedBackend struct {
+	backend
+	metrics *controllerMetrics
+	tracing *tracing
+}
+
+func (ib *instrumentedBackend) SetStatus(d *device, on bool) error {
+	return ib.send(d, "SetDeviceStatus", false, func() error { return ib.backend.SetStatus(d, on) },
+		trace.Bool("power", on))
+}
+
+func (ib *instrumentedBackend) SetRGB(d *device, r, g, b uint8, async bool) error {
+	return ib.send(d, "SetDeviceRGB", async, func() error { return ib.backend.SetRGB(d, r, g, b, async) },
+		trace.String("color.rgb", fmt.Sprintf("#%02x%02x%02x", r, g, b)))
+}
+
+func (ib *instrumentedBackend) SetLum(d *device, lum int, async bool) error {
+	return ib.send(d, "SetDeviceLum", async, func() error { return ib.backend.SetLum(d, lum, async) },
+		trace.Int("brightness", lum))
+}
+
+func (ib *instrumentedBackend) SetCT(d *device, tone int, async bool) error {
+	return ib.send(d, "SetDeviceCT", async, func() error { return ib.backend.SetCT(d, tone, async) },
+		trace.Int("tone", tone))
+}
+
+// send runs a command, retrying once if it was waiting for an answer and
+// didn't get one. A device that didn't take it, or that the cloud can't
+// reach, won't have changed its mind 200ms later.
+func (ib *instrumentedBackend) send(d *device, op string, async bool, command func() error, attrs ...trace.Attr) error {
+	span := ib.tracing.start(op, trace.KindClient, append(attrs,
+		trace.String("device.id", d.DeviceID()),
+		trace.String("device.name", d.Name()),
+		trace.Bool("async", async),
+	)...)
+	err := ib.timed(d, op, command)
+	if unreachable(err) && !async {
+		ib.metrics.retries.Inc(d.Name(), op)
+		span.Set(trace.String("first_error", err.Error()), trace.Int("retries", 1))
+		time.Sleep(commandRetryAfter)
+		err = ib.timed(d, op, command)
+	}
+	ib.tracing.end(span, err)
+	return err
+}
+
+func (ib *instrumentedBackend) timed(d *device, op string, command func() error) error {
+	start := time.Now()
+	err := command()
+	ib.metrics.commands.Inc(d.Name(), op)
+	ib.metrics.latency.Observe(time.Since(start).Seconds(), d.Name(), op)
+	if err != nil {
+		ib.metrics.errors.Inc(d.Name(), op)
+	}
+	return err
+}
+
+// handleMetrics serves the metrics for Prometheus to scrape.
+func (c *controller) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use GET"})
+		return
+	}
+	c.metrics.pending.Set(float64(c.queued.queue.Len()))
+	c.metrics.offline.Set(boolGauge(c.queued.isOffline()))
+	if c.routes != nil {
+		c.metrics.hubUp.Set(boolGauge(!c.routes.isDown()))
+	}
+	w.Header().Set("Content-Type", metrics.ContentType)
+	if err := c.metrics.registry.Write(w); err != nil {
+		apiLog.Warn("failed to write metrics", log.Err(err))
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+// failingBackend fails every status command with err.
+type failingBackend struct {
+	*fakeBackend
+	err  error
+	sent int
+}
+
+func (fb *failingBackend) SetStatus(d *device, on bool) error {
+	fb.sent++
+	return fb.err
+}
+
+// only commands that didn't get an answer are tried again
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		sent int
+	}{
+		{"no answer", errFakeOutage, 2},
+		{"device didn't take it", cbyge.RemoteCallError, 1},
+		{"cloud can't reach the device", errors.Wrap(cbyge.UnreachableError, "set device status"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, fb := newTestController(t, 1)
+			failing := &failingBackend{fakeBackend: fb, err: tt.err}
+			ib := &instrumentedBackend{backend: failing, metrics: c.metrics, tracing: c.tracing}
+			if err := ib.SetStatus(c.devices[0], false); err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if failing.sent != tt.sent {
+				t.Errorf("sent %d times, want %d", failing.sent, tt.sent)
+			}
+		})
+	}
+}
@@ -1,19 +1,16 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
-	"image/color"
-	"io"
 	"math/rand"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/gosuri/uilive"
 	"github.com/kungfukennyg/home-office/cync-lights/colors"
 	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
 	"github.com/pkg/errors"
 )
 
@@ -34,58 +31,46 @@ func (mc *ModeCommand) onSwitch(cont *controller) error {
 	return nil
 }
 
-func (mc ModeCommand) run(cont *controller) (time.Duration, error) {
+func (mc *ModeCommand) run(cont *controller) (time.Duration, error) {
 	// get a command
-	outputWriter := log.New()
-	outputWriter.Start()
-	defer outputWriter.Stop()
-	log.FPrintln(outputWriter, log.MainColor, "Enter command (h for help):")
-
-	input := bufio.NewScanner(os.Stdin)
-	input.Scan()
-	command := strings.Trim(input.Text(), "\n")
-	args := strings.Split(command, " ")
-	if len(args) < 1 {
-		return time.Second, nil
+	command, ok := cont.readLine("command (h for help)")
+	if !ok {
+		cont.running = false
+		return time.Millisecond, nil
 	}
 
-	switch strings.ToLower(args[0]) {
-	case "h", "help":
-		var modes string
-		for _, mode := range cont.modes {
-			if mode.getId() == ModeCommandID {
-				continue
-			}
+	return mc.execute(cont, command)
+}
 
-			modes += mode.getId() + ", "
-		}
-		modes = modes[:len(modes)-2]
-		log.FPrintf(outputWriter, log.OutputColor, "help, on, off, printdevices, exit, %s\n", modes)
-	case "printdevices":
-		// TODO: proper logging
-		cont.PrintDevices()
-	case "turnoff", "off":
-		for _, d := range cont.devices {
-			cont.SetStatus(d, false)
-		}
-	case "turnon", "on":
-		for _, d := range cont.devices {
-			cont.SetStatus(d, true)
-		}
-	case "exit":
-		cont.running = false
-	case ModeExperimentID, ModeRainbowID, ModeRollID:
-		err := cont.SwitchMode(args[0])
-		if err != nil {
-			return time.Millisecond, errors.Wrap(err, "failed to switch modes")
-		}
-	default:
-		log.FPrintf(outputWriter, log.OutputColor, "unrecognized command %s\n", command)
+func (mc *ModeCommand) execute(cont *controller, command string) (time.Duration, error) {
+	if strings.TrimSpace(command) == "" {
+		return time.Millisecond, nil
+	}
+	cont.view.Eventf(ui.DimColor, "> %s", command)
+	cont.recorder.command(command)
+
+	err := cont.commands.execute(cont, command)
+	if err != nil {
+		commandLog.Warn("command failed", log.F("command", command), log.Err(err))
+		cont.view.Eventf(ui.ErrColor, "%v", err)
 	}
 
 	return 1 * time.Millisecond, nil
 }
 
+// modeNames lists the modes that can be switched to from the command line.
+func (c *controller) modeNames() []string {
+	var names []string
+	for id := range c.modes {
+		if id == ModeCommandID {
+			continue
+		}
+		names = append(names, id)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (mc ModeCommand) onExit(cont *controller) {
 	//
 }
@@ -100,59 +85,44 @@ func (mc ModeCommand) getId() string {
 
 const ModeRainbowID = "rainbow"
 
+var rainbowLog = log.For("mode.rainbow")
+
 type ModeRainbow struct {
-	// logging writers
-	writer     *uilive.Writer
-	otherLines map[string]io.Writer
+	liveControls
+	shuffles int
 }
 
 func (mc *ModeRainbow) onSwitch(cont *controller) error {
-	mc.writer = log.New()
-	mc.writer.Start()
-
-	log.FPrintln(mc.writer, log.OutputColor, fmt.Sprintf("Starting Rainbow Mode..."))
+	cont.view.Eventf(ui.TextColor, "Starting Rainbow Mode...")
+	cont.view.SetModeLines("[Rainbow Mode]")
 	rand.Seed(time.Now().UnixNano())
 	return nil
 }
 
 func (mc *ModeRainbow) run(cont *controller) (time.Duration, error) {
-	if len(mc.otherLines) == 0 {
-		devices := make(map[string]io.Writer, len(cont.devices))
-		for _, d := range cont.devices {
-			if cont.debug {
-				fmt.Printf("creating writer for device %s\n", d.Name())
-			}
-			devices[d.DeviceID()] = mc.writer.Newline()
-		}
-		mc.otherLines = devices
-		mc.writer.Start()
+	if mc.paused {
+		cont.view.SetModeLines("[Rainbow Mode]", mc.status(cont))
+		return pausedSleep, nil
 	}
 
-	log.FPrintf(mc.writer, log.MainColor, "\t\t[Rainbow Mode]\n")
-
-	randomColors := cont.assignRandomColors(cont.devices)
-	for _, device := range cont.devices {
+	devices := mc.activeDevices(cont.devices)
+	randomColors := cont.assignRandomColors(devices, mc.currentPalette().Colors)
+	for _, device := range devices {
 		color := randomColors[device.DeviceID()]
 		cont.SetRGBAsync(device, color)
-		deviceWriter := mc.otherLines[device.DeviceID()]
-		rgbStr := "["
-		for _, val := range color.GetRGB() {
-			rgbStr += fmt.Sprintf("%03d, ", val)
-		}
-		rgbStr = rgbStr[:len(rgbStr)-2] + "]"
-		log.FPrintf(deviceWriter, log.OutputColor, "| %-20s | %-20s | %-20s |\n", device.Name(), color.Name, rgbStr)
-		time.Sleep(50 * time.Millisecond)
+		cont.sleep(50 * time.Millisecond)
 	}
+	mc.shuffles++
+	rainbowLog.Debug("shuffled colors", log.F("shuffles", mc.shuffles), log.F("devices", len(devices)))
 
-	log.FPrintln(mc.writer, log.MainColor, "")
+	cont.view.SetModeLines("[Rainbow Mode]", fmt.Sprintf("shuffles: %d", mc.shuffles), mc.status(cont))
 
-	return 1000 * time.Millisecond, nil
+	return mc.interval, nil
 }
 
-func (mc ModeRainbow) onExit(cont *controller) {
-	log.FPrintln(mc.writer, log.MainColor, "Exiting Rainbow Mode...")
-	mc.writer.Stop()
-	//
+func (mc *ModeRainbow) onExit(cont *controller) {
+	mc.leave(cont)
+	cont.view.Eventf(ui.TextColor, "Exiting Rainbow Mode...")
 }
 
 func (mc ModeRainbow) isIndefinite() bool {
@@ -166,69 +136,64 @@ func (mc ModeRainbow) getId() string {
 const ModeExperimentID = "experiment"
 
 type ModeExperiment struct {
-	writer     *uilive.Writer
-	otherLines map[string]io.Writer
 }
 
 func (mc *ModeExperiment) onSwitch(cont *controller) error {
+	cont.view.SetModeLines("[Experiment Mode]", "set each device to a custom color and brightness")
 	return nil
 }
 
 func (mc *ModeExperiment) run(cont *controller) (time.Duration, error) {
-	if mc.writer == nil {
-		mc.writer = log.New()
-		devices := make(map[string]io.Writer, len(cont.devices))
-		for _, d := range cont.devices {
-			if cont.debug {
-				fmt.Printf("creating writer for device %s\n", d.Name())
-			}
-			devices[d.DeviceID()] = mc.writer.Newline()
-		}
-		mc.otherLines = devices
-		mc.writer.Start()
-	}
 	for _, device := range cont.devices {
-		inputStr := scanInputV2(mc.writer, fmt.Sprintf("Enter color for device %s (or 'exit' to leave)", device.Name()))
-		split := strings.Split(inputStr, " ")
-		if len(split) < 4 {
-			if len(split) > 0 && split[0] == "exit" {
-				cont.SwitchMode(ModeCommandID)
-				return 50 * time.Millisecond, nil
-			}
-
-			log.FPrintf(mc.writer, log.BadColor, "must specify colors as space-separated RGBA 256 numbers e.g. 255 255 0 100")
+		inputStr, ok := cont.readLine(fmt.Sprintf("color for %s (or 'exit' to leave)", device.Name()))
+		if !ok {
+			cont.running = false
+			return time.Millisecond, nil
+		}
+		split := strings.Fields(inputStr)
+		if len(split) > 0 && split[0] == "exit" {
+			cont.SwitchMode(ModeCommandID)
 			return 50 * time.Millisecond, nil
 		}
-
-		r, _ := strconv.ParseUint(split[0], 10, 8)
-		g, _ := strconv.ParseUint(split[1], 10, 8)
-		b, _ := strconv.ParseUint(split[2], 10, 8)
-		a, _ := strconv.ParseUint(split[3], 10, 8)
-		customColor := colors.RGB{Name: "custom", RGBA: color.RGBA{
-			R: uint8(r),
-			G: uint8(g),
-			B: uint8(b),
-			A: uint8(a),
-		}}
-		cont.SetRGB(device, customColor)
-		cont.SetLum(device, customColor.GetLum())
-		deviceWriter, ok := mc.otherLines[device.DeviceID()]
-		if ok {
-			rgbStr := "["
-			for _, val := range []uint64{r, g, b} {
-				rgbStr += fmt.Sprintf("%03d, ", val)
-			}
-			rgbStr = rgbStr[:len(rgbStr)-2] + "]"
-			log.FPrintf(deviceWriter, log.OutputColor, "\t%s - %s\n", rgbStr, device.Name())
+		custom, lum, err := parseExperiment(split)
+		if err != nil {
+			cont.view.Eventf(ui.ErrColor, "%v", err)
+			return 50 * time.Millisecond, nil
 		}
+		cont.SetRGB(device, custom)
+		cont.SetLum(device, lum)
 	}
 
 	return 50 * time.Millisecond, nil
 }
 
+// parseExperiment reads red, green and blue 0-255 and an optional brightness
+// percentage, full if it's left off.
+func parseExperiment(words []string) (colors.RGB, colors.Brightness, error) {
+	usage := errors.New("give red, green and blue 0-255 and a brightness 0-100%, e.g. 255 255 0 30%")
+	if len(words) < 3 || len(words) > 4 {
+		return colors.RGB{}, colors.Off, usage
+	}
+	var rgb [3]uint8
+	for i := range rgb {
+		n, err := strconv.ParseUint(words[i], 10, 8)
+		if err != nil {
+			return colors.RGB{}, colors.Off, usage
+		}
+		rgb[i] = uint8(n)
+	}
+	lum := colors.Full
+	if len(words) == 4 {
+		var err error
+		if lum, err = colors.ParseBrightness(words[3]); err != nil {
+			return colors.RGB{}, colors.Off, err
+		}
+	}
+	return colors.New("custom", rgb[0], rgb[1], rgb[2]), lum, nil
+}
+
 func (mc ModeExperiment) onExit(cont *controller) {
-	mc.writer.Stop()
-	mc.writer = nil
+	//
 }
 
 func (mc ModeExperiment) isIndefinite() bool {
@@ -241,69 +206,44 @@ func (mc ModeExperiment) getId() string {
 
 const ModeRollID = "roll"
 
+var rollLog = log.For("mode.roll")
+
 type ModeRoll struct {
+	liveControls
 	colorIndex int
-	// logging writers
-	writer     *uilive.Writer
-	otherLines map[string]io.Writer
-	colors     []colors.RGB
 }
 
 func (mc *ModeRoll) onSwitch(cont *controller) error {
-	mc.writer = log.New()
-	mc.writer.Start()
-
-	log.FPrintln(mc.writer, log.OutputColor, fmt.Sprintf("Starting Rolling Mode..."))
+	cont.view.Eventf(ui.TextColor, "Starting Rolling Mode...")
+	cont.view.SetModeLines("[Rolling Mode]")
 	rand.Seed(time.Now().UnixNano())
 	return nil
 }
 
 func (mc *ModeRoll) run(cont *controller) (time.Duration, error) {
-	// setup per-device log lines
-	if len(mc.otherLines) == 0 {
-		devices := make(map[string]io.Writer, len(cont.devices))
-		for _, d := range cont.devices {
-			if cont.debug {
-				fmt.Printf("creating writer for device %s\n", d.Name())
-			}
-			devices[d.DeviceID()] = mc.writer.Newline()
-		}
-		mc.otherLines = devices
-		mc.writer.Start()
+	if mc.paused {
+		cont.view.SetModeLines("[Rolling Mode]", mc.status(cont))
+		return pausedSleep, nil
 	}
 
-	log.FPrintf(mc.writer, log.MainColor, "\t\t[Rolling Mode]\n")
-
-	for i, device := range cont.devices {
-		colorIndex := mc.colorIndex + i
-		if colorIndex >= len(mc.colors) {
-			colorIndex = colorIndex - len(mc.colors)
-		}
-		if cont.debug {
-			fmt.Printf("%s - color index: %d\n", device.Name(), colorIndex)
-		}
-		color := mc.colors[colorIndex]
+	palette := mc.currentPalette().Colors
+	for i, device := range mc.activeDevices(cont.devices) {
+		colorIndex := (mc.colorIndex + i) % len(palette)
+		rollLog.Debug("picked color", log.F("device", device.Name()), log.F("index", colorIndex))
+		color := palette[colorIndex]
 		cont.SetRGB(device, color)
-		deviceWriter := mc.otherLines[device.DeviceID()]
-		rgbStr := "["
-		for _, val := range color.GetRGB() {
-			rgbStr += fmt.Sprintf("%03d, ", val)
-		}
-		rgbStr = rgbStr[:len(rgbStr)-2] + "]"
-		log.FPrintf(deviceWriter, log.OutputColor, "\t%s (%s) - %s\n", rgbStr, color.Name, device.Name())
-		time.Sleep(50 * time.Millisecond)
+		cont.sleep(50 * time.Millisecond)
 	}
-	mc.colorIndex += 1
+	mc.colorIndex = (mc.colorIndex + 1) % len(palette)
 
-	log.FPrintln(mc.writer, log.MainColor, "")
+	cont.view.SetModeLines("[Rolling Mode]", fmt.Sprintf("palette offset: %d/%d", mc.colorIndex, len(palette)), mc.status(cont))
 
-	return 50 * time.Millisecond, nil
+	return mc.interval, nil
 }
 
-func (mc ModeRoll) onExit(cont *controller) {
-	log.FPrintln(mc.writer, log.MainColor, "Exiting Rolling Mode...")
-	mc.writer.Stop()
-	//
+func (mc *ModeRoll) onExit(cont *controller) {
+	mc.leave(cont)
+	cont.view.Eventf(ui.TextColor, "Exiting Rolling Mode...")
 }
 
 func (mc ModeRoll) isIndefinite() bool {
@@ -0,0 +1,360 @@
+// Package mqtt is just enough of an MQTT 3.1.1 client to subscribe to topics
+// at QoS 0 and receive messages. It doesn't publish.
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetSubscribe  = 8
+	packetSuback     = 9
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+
+	keepAlive   = 60 * time.Second
+	dialTimeout = 10 * time.Second
+)
+
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+type Options struct {
+	// Broker is host:port, tcp://host:port or tls://host:port
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+}
+
+// Validate checks the options before connecting. MQTT 3.1.1 only sends a
+// password after a username.
+func (o Options) Validate() error {
+	if o.Broker == "" {
+		return errors.New("no broker")
+	}
+	if o.Password != "" && o.Username == "" {
+		return errors.New("a password needs a username")
+	}
+	return nil
+}
+
+type Client struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	writeMu  sync.Mutex
+	messages chan Message
+	done     chan struct{}
+	closing  chan struct{}
+	close    sync.Once
+	nextID   uint16
+
+	errMu sync.Mutex
+	err   error
+}
+
+// Dial connects and waits for the broker to accept the connection.
+func Dial(opts Options) (*Client, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid mqtt options")
+	}
+	conn, err := dial(opts.Broker)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", opts.Broker)
+	}
+
+	c := &Client{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		messages: make(chan Message, 64),
+		done:     make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+	if err := c.connect(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	go c.pingLoop()
+	return c, nil
+}
+
+func dial(broker string) (net.Conn, error) {
+	switch {
+	case strings.HasPrefix(broker, "tls://"):
+		d := &net.Dialer{Timeout: dialTimeout}
+		return tls.DialWithDialer(d, "tcp", strings.TrimPrefix(broker, "tls://"), nil)
+	case strings.HasPrefix(broker, "tcp://"):
+		broker = strings.TrimPrefix(broker, "tcp://")
+	}
+	return net.DialTimeout("tcp", broker, dialTimeout)
+}
+
+func (c *Client) connect(opts Options) error {
+	var body []byte
+	body = appendString(body, "MQTT")
+	// protocol level 4 is 3.1.1, always a clean session
+	flags := byte(0x02)
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+	body = append(body, 4, flags)
+	body = appendUint16(body, uint16(keepAlive/time.Second))
+	body = appendString(body, opts.ClientID)
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendString(body, opts.Password)
+	}
+	if err := c.write(packetConnect<<4, body); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(dialTimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	kind, _, payload, err := c.read()
+	if err != nil {
+		return errors.Wrap(err, "no connack")
+	}
+	if kind != packetConnack || len(payload) < 2 {
+		return errors.Errorf("expected connack, got packet type %d", kind)
+	}
+	if code := payload[1]; code != 0 {
+		return errors.Errorf("broker refused the connection: %s", refusal(code))
+	}
+	return nil
+}
+
+func refusal(code byte) string {
+	switch code {
+	case 1:
+		return "unacceptable protocol version"
+	case 2:
+		return "client id rejected"
+	case 3:
+		return "server unavailable"
+	case 4:
+		return "bad username or password"
+	case 5:
+		return "not authorized"
+	}
+	return "unknown reason"
+}
+
+// Subscribe asks for messages on topics. The broker's acknowledgement arrives
+// on the read loop and isn't waited for.
+func (c *Client) Subscribe(topics ...string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	c.nextID++
+	body := appendUint16(nil, c.nextID)
+	for _, t := range topics {
+		body = appendString(body, t)
+		body = append(body, 0)
+	}
+	// subscribe has reserved flag bits 0010
+	return c.write(packetSubscribe<<4|0x02, body)
+}
+
+// Messages delivers received messages. It's closed when the connection ends,
+// Err says why.
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+func (c *Client) Close() error {
+	var err error
+	c.close.Do(func() {
+		close(c.closing)
+		c.write(packetDisconnect<<4, nil)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *Client) readLoop() {
+	defer close(c.messages)
+	defer close(c.done)
+
+	for {
+		kind, flags, payload, err := c.read()
+		if err != nil {
+			c.errMu.Lock()
+			c.err = err
+			c.errMu.Unlock()
+			return
+		}
+		if kind != packetPublish {
+			continue
+		}
+
+		msg, id, qos, err := parsePublish(flags, payload)
+		if err != nil {
+			continue
+		}
+		if qos == 1 {
+			c.write(packetPuback<<4, appendUint16(nil, id))
+		}
+		select {
+		case c.messages <- msg:
+		case <-c.closing:
+			return
+		}
+	}
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(packetPingreq<<4, nil); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func parsePublish(flags byte, payload []byte) (msg Message, id uint16, qos byte, err error) {
+	topic, rest, err := readString(payload)
+	if err != nil {
+		return msg, 0, 0, err
+	}
+	qos = flags >> 1 & 0x03
+	if qos > 0 {
+		if len(rest) < 2 {
+			return msg, 0, 0, errors.New("publish missing packet id")
+		}
+		id = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+	return Message{Topic: topic, Payload: rest}, id, qos, nil
+}
+
+func (c *Client) write(header byte, body []byte) error {
+	packet := []byte{header}
+	packet = appendLength(packet, len(body))
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(packet)
+	return errors.Wrap(err, "failed to write to broker")
+}
+
+func (c *Client) read() (kind, flags byte, payload []byte, err error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length, err := readLength(c.r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, payload, nil
+}
+
+// remaining lengths are 7 bits a byte, least significant first
+func appendLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func readLength(r io.ByteReader) (int, error) {
+	n, shift := 0, 0
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			return n, nil
+		}
+		shift += 7
+	}
+	return 0, errors.New("malformed remaining length")
+}
+
+func appendUint16(b []byte, n uint16) []byte {
+	return append(b, byte(n>>8), byte(n))
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("short string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("short string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+// Match reports whether a topic matches a subscription filter with + and #
+// wildcards.
+func Match(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
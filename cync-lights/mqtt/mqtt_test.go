@@ -0,0 +1,230 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRemainingLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, tt := range tests {
+		got := appendLength(nil, tt.n)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("appendLength(%d) = % x, want % x", tt.n, got, tt.want)
+		}
+		n, err := readLength(bytes.NewReader(tt.want))
+		if err != nil || n != tt.n {
+			t.Errorf("readLength(% x) = %d, %v, want %d", tt.want, n, err, tt.n)
+		}
+	}
+}
+
+func TestRemainingLengthErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		// four bytes is the most a length can take
+		{"too long", []byte{0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"truncated", []byte{0x80}},
+		{"empty", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n, err := readLength(bytes.NewReader(tt.data)); err == nil {
+				t.Fatalf("read %d from % x, want an error", n, tt.data)
+			}
+		})
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		qos     byte
+		payload int
+	}{
+		{"qos 0", 0, 10},
+		{"qos 1", 1, 10},
+		{"two length bytes", 0, 200},
+		{"three length bytes", 1, 16384},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte{'x'}, tt.payload)
+			body := appendString(nil, "home/desk")
+			if tt.qos > 0 {
+				body = appendUint16(body, 7)
+			}
+			body = append(body, payload...)
+
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			writer := &Client{conn: a}
+			reader := &Client{r: bufio.NewReader(b)}
+			go writer.write(packetPublish<<4|tt.qos<<1, body)
+
+			kind, flags, got, err := reader.read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != packetPublish {
+				t.Fatalf("packet type %d, want %d", kind, packetPublish)
+			}
+			msg, id, qos, err := parsePublish(flags, got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Topic != "home/desk" || !bytes.Equal(msg.Payload, payload) || qos != tt.qos {
+				t.Errorf("got topic %q, %d bytes at qos %d", msg.Topic, len(msg.Payload), qos)
+			}
+			if tt.qos > 0 && id != 7 {
+				t.Errorf("packet id %d, want 7", id)
+			}
+		})
+	}
+}
+
+func TestParsePublishErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   byte
+		payload []byte
+	}{
+		{"no topic", 0, []byte{0}},
+		{"short topic", 0, []byte{0, 5, 'h', 'o'}},
+		{"no packet id", 1 << 1, appendString(nil, "home/desk")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, _, err := parsePublish(tt.flags, tt.payload); err == nil {
+				t.Fatal("want an error")
+			}
+		})
+	}
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		flags    byte
+		refusal  byte
+		wantErr  string
+		wantBody []string
+	}{
+		{name: "anonymous", opts: Options{ClientID: "lights"}, flags: 0x02},
+		{name: "username", opts: Options{ClientID: "lights", Username: "ken"}, flags: 0x82, wantBody: []string{"ken"}},
+		{name: "password", opts: Options{ClientID: "lights", Username: "ken", Password: "hunter2"}, flags: 0xc2, wantBody: []string{"ken", "hunter2"}},
+		{name: "refused", opts: Options{ClientID: "lights"}, flags: 0x02, refusal: 4, wantErr: "bad username or password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			broker := &Client{conn: b, r: bufio.NewReader(b)}
+			got := make(chan []byte, 1)
+			go func() {
+				kind, _, body, err := broker.read()
+				if err != nil || kind != packetConnect {
+					got <- nil
+					return
+				}
+				got <- body
+				broker.write(packetConnack<<4, []byte{0, tt.refusal})
+			}()
+
+			client := &Client{conn: a, r: bufio.NewReader(a)}
+			err := client.connect(tt.opts)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+
+			body := <-got
+			name, rest, err := readString(body)
+			if err != nil || name != "MQTT" || len(rest) < 4 {
+				t.Fatalf("bad connect header % x", body)
+			}
+			if rest[0] != 4 || rest[1] != tt.flags {
+				t.Errorf("level %d flags %#x, want 4 and %#x", rest[0], rest[1], tt.flags)
+			}
+			fields := []string{}
+			for rest = rest[4:]; len(rest) > 0; {
+				var field string
+				if field, rest, err = readString(rest); err != nil {
+					t.Fatal(err)
+				}
+				fields = append(fields, field)
+			}
+			want := append([]string{tt.opts.ClientID}, tt.wantBody...)
+			if strings.Join(fields, ",") != strings.Join(want, ",") {
+				t.Errorf("payload %q, want %q", fields, want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{"broker only", Options{Broker: "localhost:1883"}, false},
+		{"username", Options{Broker: "localhost:1883", Username: "ken"}, false},
+		{"username and password", Options{Broker: "localhost:1883", Username: "ken", Password: "hunter2"}, false},
+		{"password without username", Options{Broker: "localhost:1883", Password: "hunter2"}, true},
+		{"no broker", Options{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want an error %t", err, tt.wantErr)
+			}
+		})
+	}
+	// Dial refuses before connecting anywhere
+	if _, err := Dial(Options{Broker: "localhost:1883", Password: "hunter2"}); err == nil || !strings.Contains(err.Error(), "needs a username") {
+		t.Fatalf("got %v, want the password refused", err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"home/desk", "home/desk", true},
+		{"home/desk", "home/lamp", false},
+		{"home/+", "home/desk", true},
+		{"home/+", "home/desk/on", false},
+		{"home/#", "home/desk/on", true},
+		{"+/desk", "home/desk", true},
+		{"home/desk/on", "home/desk", false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("Match(%q, %q) = %t, want %t", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/outbox"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+var offlineLog = log.For("offline")
+
+// reconnectEvery is how often the cloud is tried while it's unreachable.
+const reconnectEvery = 5 * time.Second
+
+// unreachable is true for errors that mean the command never got an answer,
+// as opposed to the cloud answering that it failed or that the device is
+// offline.
+func unreachable(err error) bool {
+	return err != nil && !errors.Is(err, cbyge.RemoteCallError) && !deviceUnreachable(err)
+}
+
+// deviceUnreachable is the cloud saying it can't reach the device. Its
+// commands are queued without holding up the others.
+func deviceUnreachable(err error) bool {
+	return errors.Is(err, cbyge.UnreachableError)
+}
+
+// queuedBackend keeps commands that can't reach the cloud in a queue instead
+// of failing them, and replays what each device should end up as once it's
+// back. While it's offline nothing is sent at all, so an effect doesn't wait
+// out a timeout every frame.
+type queuedBackend struct {
+	backend
+	queue *outbox.Queue
+	view  *ui.View
+
+	mu      sync.Mutex
+	offline bool
+	// since is when the cloud was last reachable
+	since time.Time
+}
+
+func (qb *queuedBackend) isOffline() bool {
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	return qb.offline
+}
+
+// goOffline is true the first time, so it's only announced once.
+func (qb *queuedBackend) goOffline() bool {
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	if qb.offline {
+		return false
+	}
+	qb.offline, qb.since = true, time.Now()
+	return true
+}
+
+func (qb *queuedBackend) goOnline() {
+	qb.mu.Lock()
+	defer qb.mu.Unlock()
+	qb.offline = false
+}
+
+func (qb *queuedBackend) SetStatus(d *device, on bool) error {
+	return qb.send(d, outbox.Change{Power: &on}, func() error { return qb.backend.SetStatus(d, on) })
+}
+
+func (qb *queuedBackend) SetRGB(d *device, r, g, b uint8, async bool) error {
+	rgb := [3]uint8{r, g, b}
+	return qb.send(d, outbox.Change{RGB: &rgb}, func() error { return qb.backend.SetRGB(d, r, g, b, async) })
+}
+
+func (qb *queuedBackend) SetLum(d *device, lum int, async bool) error {
+	return qb.send(d, outbox.Change{Lum: &lum}, func() error { return qb.backend.SetLum(d, lum, async) })
+}
+
+func (qb *queuedBackend) SetCT(d *device, tone int, async bool) error {
+	return qb.send(d, outbox.Change{Tone: &tone}, func() error { return qb.backend.SetCT(d, tone, async) })
+}
+
+// send queues the change if the cloud's unreachable, or turns out to be. A
+// device with changes still queued has this one queued behind them, so they
+// can't land out of order.
+func (qb *queuedBackend) send(d *device, change outbox.Change, command func() error) error {
+	if qb.isOffline() || qb.queue.Has(d.DeviceID()) {
+		qb.queue.Add(d.DeviceID(), d.Name(), change, time.Now())
+		return nil
+	}
+	err := command()
+	switch {
+	case deviceUnreachable(err):
+		offlineLog.Info("device unreachable, queueing its commands", log.F("device", d.Name()))
+	case !unreachable(err):
+		return err
+	case qb.goOffline():
+		offlineLog.Warn("cloud unreachable, queueing commands", log.F("device", d.Name()), log.Err(err))
+		qb.view.Eventf(ui.ErrColor, "cloud unreachable, queueing commands until it's back: %v", err)
+	}
+	qb.queue.Add(d.DeviceID(), d.Name(), change, time.Now())
+	return nil
+}
+
+// replay sends one intent, the power first so a device that should be off
+// isn't lit by its color on the way.
+func (qb *queuedBackend) replay(d *device, i outbox.Intent) error {
+	if i.Power != nil {
+		if err := qb.backend.SetStatus(d, *i.Power); err != nil {
+			return err
+		}
+	}
+	if i.Off() {
+		return nil
+	}
+	if i.RGB != nil {
+		if err := qb.backend.SetRGB(d, i.RGB[0], i.RGB[1], i.RGB[2], false); err != nil {
+			return err
+		}
+	}
+	if i.Tone != nil {
+		if err := qb.backend.SetCT(d, *i.Tone, false); err != nil {
+			return err
+		}
+	}
+	if i.Lum != nil {
+		return qb.backend.SetLum(d, *i.Lum, false)
+	}
+	return nil
+}
+
+// openQueue loads commands queued by a previous run. If they can't be read
+// they're left alone and this run queues in memory only.
+func openQueue(dir string) (*outbox.Queue, error) {
+	path := filepath.Join(dir, "pending.json")
+	queue, err := outbox.Open(path)
+	if err != nil {
+		return outbox.New(""), err
+	}
+	return queue, nil
+}
+
+// startQueue tries the cloud while it's unreachable and replays the queue
+// when it's back. Anything left from the last run is replayed straight away.
+func (c *controller) startQueue() {
+	c.queueStop = make(chan struct{})
+	if c.queued.queue.Len() > 0 {
+		c.view.Eventf(ui.HeaderColor, "%d devices have commands queued from last time", c.queued.queue.Len())
+		go c.post(c.replayQueue)
+	}
+	go func() {
+		ticker := time.NewTicker(reconnectEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.queueStop:
+				return
+			case <-ticker.C:
+			}
+			if err := c.queued.queue.Save(); err != nil {
+				offlineLog.Warn("failed to save queued commands", log.Err(err))
+			}
+			if c.queued.isOffline() {
+				// listing devices is cheap and needs the cloud
+				if _, err := c.queued.backend.Devices(); err != nil {
+					offlineLog.Debug("still offline", log.Err(err))
+					continue
+				}
+			} else if c.queued.queue.Len() == 0 {
+				continue
+			}
+			c.post(c.replayQueue)
+		}
+	}()
+}
+
+// replayQueue sends every device what it should be now. If the cloud drops
+// again partway the rest stays queued for next time, as do devices the cloud
+// still can't reach.
+func (c *controller) replayQueue() {
+	pending := c.queued.queue.Pending()
+	if c.queued.isOffline() && len(pending) > 0 {
+		c.view.Eventf(ui.TextColor, "cloud's back, replaying %d queued devices", len(pending))
+	}
+	c.queued.goOnline()
+	if len(pending) == 0 {
+		return
+	}
+	offlineLog.Info("replaying queued commands", log.F("devices", len(pending)))
+	replayed := 0
+	for _, i := range pending {
+		d, ok := c.deviceByID(i.ID)
+		if !ok {
+			c.view.Eventf(ui.ErrColor, "dropping queued %s for %s, it's gone", i, i.Name)
+			c.queued.queue.Done(i)
+			continue
+		}
+		err := c.queued.replay(d, i)
+		if deviceUnreachable(err) {
+			continue
+		}
+		if unreachable(err) {
+			c.queued.goOffline()
+			c.view.Eventf(ui.ErrColor, "cloud dropped again, %d devices still queued", c.queued.queue.Len())
+			break
+		}
+		if err != nil {
+			c.view.Eventf(ui.ErrColor, "%s: queued %s failed: %v", d.Name(), i, err)
+		}
+		c.queued.queue.Done(i)
+		replayed++
+		if err == nil {
+			c.view.Eventf(ui.DimColor, "%s: sent queued %s", d.Name(), i)
+		}
+		c.view.UpdateDevice(d.DeviceID(), func(row *ui.DeviceRow) {
+			row.Health = healthOf(err)
+		})
+	}
+	if err := c.queued.queue.Save(); err != nil {
+		offlineLog.Warn("failed to save queued commands", log.Err(err))
+	}
+	if replayed > 0 {
+		offlineLog.Info("replayed queued commands", log.F("devices", replayed))
+	}
+}
+
+func (c *controller) deviceByID(id string) (*device, bool) {
+	for _, d := range c.devices {
+		if d.DeviceID() == id {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// pendingStatus is what the REPL and API show about the queue.
+type pendingStatus struct {
+	Offline bool            `json:"offline"`
+	Since   *time.Time      `json:"since,omitempty"`
+	Devices []outbox.Intent `json:"devices"`
+}
+
+func (c *controller) pendingStatus() pendingStatus {
+	status := pendingStatus{Offline: c.queued.isOffline(), Devices: c.queued.queue.Pending()}
+	if status.Offline {
+		c.queued.mu.Lock()
+		since := c.queued.since
+		c.queued.mu.Unlock()
+		status.Since = &since
+	}
+	return status
+}
+
+func runPending(cont *controller, args parsedArgs) error {
+	switch args.str("action") {
+	case "replay":
+		go cont.post(cont.replayQueue)
+		return nil
+	case "clear":
+		n := cont.queued.queue.Len()
+		cont.queued.queue.Clear()
+		cont.view.Eventf(ui.TextColor, "dropped commands queued for %d devices", n)
+		return cont.queued.queue.Save()
+	}
+	status := cont.pendingStatus()
+	switch {
+	case status.Offline:
+		cont.view.Eventf(ui.ErrColor, "cloud unreachable since %s", status.Since.Format("15:04:05"))
+	case len(status.Devices) == 0:
+		cont.view.Eventf(ui.TextColor, "nothing queued, the cloud is reachable")
+	}
+	for _, i := range status.Devices {
+		cont.view.Eventf(ui.TextColor, "  %s: %s (%d changes since %s)", i.Name, i, i.Changes, i.Since.Format("15:04:05"))
+	}
+	return nil
+}
+
+// handlePending shows what's queued, POST replays it now.
+func (c *controller) handlePending(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.pendingStatus())
+	case http.MethodPost:
+		go c.postFrom(r, c.replayQueue)
+		respond(w, http.StatusAccepted, apiResult{Queued: true})
+	default:
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use GET or POST"})
+	}
+}
+
+func runOutage(cont *controller, args parsedArgs) error {
+	if cont.fake == nil {
+		return errors.New("outages can only be simulated with --fake")
+	}
+	switch args.str("action") {
+	case "on":
+		cont.fake.SetOutage(true)
+	case "off":
+		cont.fake.SetOutage(false)
+	}
+	if cont.fake.Outage() {
+		cont.view.Eventf(ui.ErrColor, "fake cloud is down")
+	} else {
+		cont.view.Eventf(ui.TextColor, "fake cloud is up")
+	}
+	return nil
+}
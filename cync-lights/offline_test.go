@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOutageReplaysFinalState(t *testing.T) {
+	c, fb := newTestController(t, 3)
+	fb.SetOutage(true)
+	runCommands(t, c,
+		"color red fake-1",
+		"dim 40% fake-1",
+		"color green fake-1",
+		"off fake-2",
+		"color blue fake-2",
+		"dim 20% fake-2",
+		"dim 30% fake-2",
+	)
+	if len(fb.Calls()) != 0 {
+		t.Fatalf("sent %v during the outage", fb.Calls())
+	}
+	if !c.queued.isOffline() || c.queued.queue.Len() != 2 {
+		t.Fatalf("offline %t with %d devices queued, want 2", c.queued.isOffline(), c.queued.queue.Len())
+	}
+
+	fb.SetOutage(false)
+	c.replayQueue()
+	// one command per setting, oldest device first, power before color
+	want := []fakeCall{
+		{Device: "fake-1", Op: "rgb", Value: "0,255,0"},
+		{Device: "fake-1", Op: "lum", Value: "40"},
+		{Device: "fake-2", Op: "status", Value: "true"},
+		{Device: "fake-2", Op: "rgb", Value: "0,0,255"},
+		{Device: "fake-2", Op: "lum", Value: "30"},
+	}
+	if got := fb.Calls(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replay sent\n%v\nwant\n%v", got, want)
+	}
+	if c.queued.isOffline() || c.queued.queue.Len() != 0 {
+		t.Errorf("offline %t with %d devices still queued", c.queued.isOffline(), c.queued.queue.Len())
+	}
+
+	// back online, commands go straight out
+	runCommands(t, c, "off fake-3")
+	if got := fb.Calls(); len(got) != len(want)+1 || got[len(want)] != (fakeCall{Device: "fake-3", Op: "status", Value: "false"}) {
+		t.Errorf("after the replay sent %v", got[len(want):])
+	}
+}
@@ -0,0 +1,226 @@
+// Package outbox keeps what devices were asked to do while they couldn't be
+// reached. Only the final state each device should end up in is kept, so
+// replaying it takes one command per setting however many were queued.
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Intent is the state a device should end up in. Nil fields weren't asked
+// for and are left alone.
+type Intent struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Power false means off, whatever else was asked for before it
+	Power *bool     `json:"power,omitempty"`
+	RGB   *[3]uint8 `json:"rgb,omitempty"`
+	// Tone is a tunable white's color tone, it replaces RGB and the other
+	// way round
+	Tone *int `json:"tone,omitempty"`
+	// Lum is the brightness as sent, already scaled and calibrated
+	Lum *int `json:"lum,omitempty"`
+	// Since is when the first queued change was made
+	Since time.Time `json:"since"`
+	// Changes is how many changes were collapsed into this
+	Changes int `json:"changes"`
+}
+
+// Off is true if the device should end up switched off, when nothing but
+// the power needs sending.
+func (i Intent) Off() bool {
+	return i.Power != nil && !*i.Power
+}
+
+func (i Intent) String() string {
+	var parts []string
+	if i.Power != nil {
+		parts = append(parts, map[bool]string{true: "on", false: "off"}[*i.Power])
+	}
+	if !i.Off() {
+		if i.RGB != nil {
+			parts = append(parts, fmt.Sprintf("rgb %d,%d,%d", i.RGB[0], i.RGB[1], i.RGB[2]))
+		}
+		if i.Tone != nil {
+			parts = append(parts, fmt.Sprintf("tone %d", *i.Tone))
+		}
+		if i.Lum != nil {
+			parts = append(parts, fmt.Sprintf("lum %d", *i.Lum))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Change is one command that couldn't be sent. Set the field it changes.
+type Change struct {
+	Power *bool
+	RGB   *[3]uint8
+	Tone  *int
+	Lum   *int
+}
+
+// apply folds a change into the intent. Colors and tones switch bulbs on,
+// so they undo an earlier off.
+func (i *Intent) apply(c Change) {
+	i.Changes++
+	if c.Power != nil {
+		i.Power = c.Power
+	}
+	if c.RGB != nil {
+		i.RGB, i.Tone = c.RGB, nil
+	}
+	if c.Tone != nil {
+		i.Tone, i.RGB = c.Tone, nil
+	}
+	if c.Lum != nil {
+		i.Lum = c.Lum
+	}
+	if (c.RGB != nil || c.Tone != nil) && i.Off() {
+		on := true
+		i.Power = &on
+	}
+}
+
+// Queue is the intents waiting for their devices, saved to a file so they
+// survive a restart. It's safe to use from any goroutine.
+type Queue struct {
+	mu      sync.Mutex
+	path    string
+	intents map[string]*Intent
+	dirty   bool
+}
+
+// New is an empty queue that saves to path, or nowhere if path is empty.
+func New(path string) *Queue {
+	return &Queue{path: path, intents: map[string]*Intent{}}
+}
+
+// Open loads the queue saved at path. A missing file is an empty queue.
+func Open(path string) (*Queue, error) {
+	q := New(path)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read queued commands")
+	}
+	var saved []*Intent
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	for _, i := range saved {
+		q.intents[i.ID] = i
+	}
+	return q, nil
+}
+
+// Add queues a change for a device.
+func (q *Queue) Add(id, name string, c Change, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i, ok := q.intents[id]
+	if !ok {
+		i = &Intent{ID: id, Name: name, Since: now}
+		q.intents[id] = i
+	}
+	i.apply(c)
+	q.dirty = true
+}
+
+// Has is true if a device has changes waiting.
+func (q *Queue) Has(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.intents[id]
+	return ok
+}
+
+// Len is how many devices have changes waiting.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.intents)
+}
+
+// Pending is a copy of every intent, oldest first.
+func (q *Queue) Pending() []Intent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]Intent, 0, len(q.intents))
+	for _, i := range q.intents {
+		out = append(out, *i)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if !out[a].Since.Equal(out[b].Since) {
+			return out[a].Since.Before(out[b].Since)
+		}
+		return out[a].Name < out[b].Name
+	})
+	return out
+}
+
+// Done drops a device's intent once it's been replayed. It's kept if
+// something new was queued since it was read.
+func (q *Queue) Done(sent Intent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i, ok := q.intents[sent.ID]; ok && i.Changes == sent.Changes {
+		delete(q.intents, sent.ID)
+		q.dirty = true
+	}
+}
+
+// Clear drops everything queued.
+func (q *Queue) Clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.intents = map[string]*Intent{}
+	q.dirty = true
+}
+
+// Save writes the queue if it's changed, to a new file renamed over the old
+// one so a crash can't leave half a file.
+func (q *Queue) Save() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.dirty || q.path == "" {
+		return nil
+	}
+	if len(q.intents) == 0 {
+		if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to save queued commands")
+		}
+		q.dirty = false
+		return nil
+	}
+	saved := make([]*Intent, 0, len(q.intents))
+	for _, i := range q.intents {
+		saved = append(saved, i)
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal queued commands")
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to save queued commands")
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return errors.Wrap(err, "failed to save queued commands")
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return errors.Wrap(err, "failed to save queued commands")
+	}
+	q.dirty = false
+	return nil
+}
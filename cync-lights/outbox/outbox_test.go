@@ -0,0 +1,141 @@
+package outbox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func power(on bool) Change {
+	return Change{Power: &on}
+}
+
+func rgb(r, g, b uint8) Change {
+	return Change{RGB: &[3]uint8{r, g, b}}
+}
+
+func tone(t int) Change {
+	return Change{Tone: &t}
+}
+
+func lum(l int) Change {
+	return Change{Lum: &l}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		changes []Change
+		want    string
+	}{
+		{"off", []Change{power(false)}, "off"},
+		// a color switches the bulb back on
+		{"off then color", []Change{power(false), rgb(255, 0, 0)}, "on, rgb 255,0,0"},
+		{"off then tone", []Change{power(false), tone(50)}, "on, tone 50"},
+		// but nothing else is sent for a bulb that ends up off
+		{"color then off", []Change{rgb(255, 0, 0), lum(40), power(false)}, "off"},
+		{"lum doesn't switch on", []Change{power(false), lum(40)}, "off"},
+		{"tone replaces rgb", []Change{rgb(255, 0, 0), tone(50)}, "tone 50"},
+		{"rgb replaces tone", []Change{tone(50), rgb(0, 0, 255)}, "rgb 0,0,255"},
+		{"last lum wins", []Change{lum(20), rgb(0, 255, 0), lum(30)}, "rgb 0,255,0, lum 30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var i Intent
+			for _, c := range tt.changes {
+				i.apply(c)
+			}
+			if i.String() != tt.want {
+				t.Errorf("got %q, want %q", i, tt.want)
+			}
+			if i.Changes != len(tt.changes) {
+				t.Errorf("%d changes counted, want %d", i.Changes, len(tt.changes))
+			}
+		})
+	}
+}
+
+func TestDone(t *testing.T) {
+	now := time.Now()
+	q := New("")
+	q.Add("1", "desk", rgb(255, 0, 0), now)
+	q.Add("2", "lamp", power(false), now)
+
+	pending := q.Pending()
+	// desk changes while its replay is in flight
+	q.Add("1", "desk", lum(40), now)
+	for _, i := range pending {
+		q.Done(i)
+	}
+
+	if q.Has("2") {
+		t.Error("lamp still queued after it was sent")
+	}
+	if !q.Has("1") {
+		t.Fatal("desk dropped though it changed after it was read")
+	}
+	if got := q.Pending()[0].String(); got != "rgb 255,0,0, lum 40" {
+		t.Errorf("desk queued as %q", got)
+	}
+}
+
+func TestPendingOrder(t *testing.T) {
+	now := time.Now()
+	q := New("")
+	q.Add("2", "lamp", power(true), now.Add(time.Second))
+	q.Add("3", "shelf", power(true), now)
+	q.Add("1", "desk", power(true), now)
+	var names []string
+	for _, i := range q.Pending() {
+		names = append(names, i.Name)
+	}
+	if want := []string{"desk", "shelf", "lamp"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("pending in order %v, want %v", names, want)
+	}
+}
+
+func TestSaveOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "pending.json")
+	since := time.Date(2026, 10, 18, 7, 0, 0, 0, time.UTC)
+	q := New(path)
+	q.Add("1", "desk", power(false), since)
+	q.Add("1", "desk", rgb(255, 0, 0), since.Add(time.Minute))
+	q.Add("2", "lamp", tone(50), since.Add(time.Second))
+	q.Add("2", "lamp", lum(30), since.Add(time.Second))
+	if err := q.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := opened.Pending(), q.Pending(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("opened\n%+v\nsaved\n%+v", got, want)
+	}
+
+	// an empty queue removes the file, and a missing file is an empty queue
+	opened.Clear()
+	if err := opened.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file still there after saving an empty queue: %v", err)
+	}
+	empty, err := Open(path)
+	if err != nil || empty.Len() != 0 {
+		t.Fatalf("got %d queued, %v", empty.Len(), err)
+	}
+}
+
+func TestOpenBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pending.json")
+	if err := os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("opened a file that isn't json")
+	}
+}
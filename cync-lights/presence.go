@@ -0,0 +1,198 @@
+package main
+
+import (
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/presence"
+	"github.com/kungfukennyg/home-office/cync-lights/rules"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+var presenceLog = log.For("presence.rules")
+
+const (
+	defaultIdleAfter = 5 * time.Minute
+	defaultIdleLum   = 20
+	presencePoll     = 5 * time.Second
+	// minPresencePoll keeps a tiny idle_after from polling flat out, or every
+	// 0s, which NewTicker panics on
+	minPresencePoll = 100 * time.Millisecond
+)
+
+// presenceRules dims the lights when nobody's at the desk and turns them off
+// when the screen locks, putting them back on the next activity. Changes
+// arrive from the watcher's goroutine and are posted to the controller loop.
+type presenceRules struct {
+	cfg     config.Presence
+	watcher *presence.Watcher
+	state   presence.State
+	paused  bool
+	// saved is how the lights were before going idle or locking, nil while
+	// someone's around
+	saved map[string]config.DeviceState
+}
+
+// startPresence starts watching if the config has a presence section.
+func (c *controller) startPresence() error {
+	if c.config.Presence == nil {
+		return nil
+	}
+	cfg := *c.config.Presence
+
+	idleAfter := defaultIdleAfter
+	if cfg.IdleAfter != "" {
+		d, err := time.ParseDuration(cfg.IdleAfter)
+		if err != nil || d <= 0 {
+			return errors.Errorf("presence idle_after %q isn't a duration like 5m", cfg.IdleAfter)
+		}
+		idleAfter = d
+	}
+	if cfg.IdleLum == 0 {
+		cfg.IdleLum = defaultIdleLum
+	}
+	if _, err := c.resolveTarget(cfg.Target); err != nil {
+		return errors.Wrap(err, "presence target")
+	}
+
+	source, err := presence.Open(cfg.Source)
+	if err != nil {
+		return err
+	}
+	poll := presencePoll
+	if idleAfter/4 < poll {
+		poll = idleAfter / 4
+	}
+	if poll < minPresencePoll {
+		poll = minPresencePoll
+	}
+
+	pr := &presenceRules{cfg: cfg}
+	pr.watcher = presence.NewWatcher(source, idleAfter, poll, func(s presence.State) {
+		c.post(func() {
+			c.ruleEvent(rules.Event{Kind: rules.KindPresence, Value: s.String()})
+			pr.changed(c, s)
+		})
+	})
+	c.presence = pr
+	pr.watcher.Start()
+	presenceLog.Info("watching presence", log.F("source", source.Name()), log.F("idle_after", idleAfter))
+	return nil
+}
+
+func (pr *presenceRules) changed(c *controller, state presence.State) {
+	prev := pr.state
+	pr.state = state
+	if pr.paused {
+		return
+	}
+
+	devices, err := c.resolveTarget(pr.cfg.Target)
+	if err != nil {
+		c.view.Eventf(ui.ErrColor, "presence: %v", err)
+		return
+	}
+	presenceLog.Info("applying presence", log.F("from", prev.String()), log.F("to", state.String()))
+
+	switch state {
+	case presence.Idle:
+		// unlocking always comes with input, so idle after locked means the
+		// lock screen timed out, leave the lights off
+		if prev == presence.Locked {
+			return
+		}
+		pr.save(c, devices)
+		c.view.Eventf(ui.DimColor, "presence: idle, dimming")
+		if pr.cfg.IdleScene != "" {
+			pr.report(c, c.loadScene(pr.cfg.IdleScene))
+			return
+		}
+		idle := colors.Brightness(pr.cfg.IdleLum).Clamp()
+		for _, d := range devices {
+			if c.lastPower[d.DeviceID()] && c.lastLum[d.DeviceID()] > idle {
+				c.SetLum(d, idle)
+			}
+		}
+	case presence.Locked:
+		pr.save(c, devices)
+		// an effect would just turn the lights back on
+		if c.mode.isIndefinite() {
+			c.SwitchMode(ModeCommandID)
+		}
+		c.view.Eventf(ui.DimColor, "presence: screen locked, lights off")
+		if pr.cfg.LockScene != "" {
+			pr.report(c, c.loadScene(pr.cfg.LockScene))
+			return
+		}
+		for _, d := range devices {
+			c.SetStatus(d, false)
+		}
+	case presence.Active:
+		pr.restore(c)
+	}
+}
+
+// save remembers the lights unless they're already saved, so going from idle
+// to locked still restores what was there before idle.
+func (pr *presenceRules) save(c *controller, devices []*device) {
+	if pr.saved != nil {
+		return
+	}
+	pr.saved = map[string]config.DeviceState{}
+	for _, d := range devices {
+		pr.saved[d.Name()] = c.deviceState(d)
+	}
+}
+
+func (pr *presenceRules) restore(c *controller) {
+	if pr.saved == nil {
+		return
+	}
+	c.view.Eventf(ui.DimColor, "presence: welcome back")
+	for name, state := range pr.saved {
+		if d, ok := c.findDevice(name); ok {
+			c.applyState(d, state)
+		}
+	}
+	pr.saved = nil
+}
+
+func (pr *presenceRules) report(c *controller, err error) {
+	if err != nil {
+		c.view.Eventf(ui.ErrColor, "presence: %v", err)
+	}
+}
+
+func runPresence(cont *controller, args parsedArgs) error {
+	pr := cont.presence
+	if pr == nil {
+		return errors.New("presence isn't configured, add a presence section to the config")
+	}
+
+	switch args.str("action") {
+	case "pause":
+		pr.paused = true
+		cont.view.Eventf(ui.TextColor, "presence paused")
+		return nil
+	case "resume":
+		pr.paused = false
+		cont.view.Eventf(ui.TextColor, "presence resumed")
+		// catch up with whatever happened while paused
+		pr.changed(cont, pr.state)
+		return nil
+	}
+
+	state, reading, err := pr.watcher.Status()
+	paused := ""
+	if pr.paused {
+		paused = ", paused"
+	}
+	cont.view.Eventf(ui.TextColor, "presence from %s: %s, idle %v%s", pr.watcher.Source(), state, reading.Idle.Round(time.Second), paused)
+	if err != nil {
+		cont.view.Eventf(ui.ErrColor, "last read failed: %v", err)
+	}
+	return nil
+}
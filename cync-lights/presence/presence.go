@@ -0,0 +1,169 @@
+// Package presence works out whether anyone is at the desk. Sources report
+// how long input has been idle and whether the screen is locked, a Watcher
+// polls one and reports when the state changes.
+package presence
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/pkg/errors"
+)
+
+var presenceLog = log.For("presence")
+
+type State int
+
+const (
+	Unknown State = iota
+	Active
+	Idle
+	Locked
+)
+
+func (s State) String() string {
+	switch s {
+	case Active:
+		return "active"
+	case Idle:
+		return "idle"
+	case Locked:
+		return "locked"
+	}
+	return "unknown"
+}
+
+// Reading is what a source knows right now.
+type Reading struct {
+	Idle   time.Duration
+	Locked bool
+}
+
+// Source is somewhere to read presence from. Read is called from the
+// watcher's goroutine only.
+type Source interface {
+	Name() string
+	Read() (Reading, error)
+}
+
+// Open makes a source from its config name: auto, logind, x11, interrupts,
+// file:<path> or socket:<path>.
+func Open(spec string) (Source, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "auto":
+		return detect(), nil
+	case "logind":
+		return newLogind(), nil
+	case "x11":
+		return &x11Source{}, nil
+	case "interrupts":
+		return newInterrupts(procInterrupts, defaultInterruptPatterns), nil
+	case "file":
+		if arg == "" {
+			return nil, errors.New("file presence source needs a path, file:<path>")
+		}
+		return &fileSource{path: arg}, nil
+	case "socket":
+		if arg == "" {
+			return nil, errors.New("socket presence source needs a path, socket:<path>")
+		}
+		return listenSocket(arg)
+	}
+	return nil, errors.Errorf("unknown presence source %q", spec)
+}
+
+// Watcher polls a source and calls changed whenever the state moves.
+type Watcher struct {
+	source    Source
+	idleAfter time.Duration
+	poll      time.Duration
+	changed   func(State)
+
+	mu      sync.Mutex
+	state   State
+	reading Reading
+	err     error
+	stop    chan struct{}
+}
+
+func NewWatcher(source Source, idleAfter, poll time.Duration, changed func(State)) *Watcher {
+	return &Watcher{
+		source:    source,
+		idleAfter: idleAfter,
+		poll:      poll,
+		changed:   changed,
+		stop:      make(chan struct{}),
+	}
+}
+
+func (w *Watcher) Start() {
+	go w.loop()
+}
+
+func (w *Watcher) Stop() {
+	close(w.stop)
+	if closer, ok := w.source.(interface{ Close() error }); ok {
+		closer.Close()
+	}
+}
+
+// Status is the last state and reading, err is the last read's error.
+func (w *Watcher) Status() (State, Reading, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state, w.reading, w.err
+}
+
+func (w *Watcher) Source() string {
+	return w.source.Name()
+}
+
+func (w *Watcher) loop() {
+	ticker := time.NewTicker(w.poll)
+	defer ticker.Stop()
+
+	for {
+		w.check()
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watcher) check() {
+	reading, err := w.source.Read()
+
+	w.mu.Lock()
+	// only log a failing source once, not every poll
+	if err != nil && w.err == nil {
+		presenceLog.Warn("failed to read presence", log.F("source", w.source.Name()), log.Err(err))
+	}
+	w.err = err
+	if err != nil {
+		w.mu.Unlock()
+		return
+	}
+	w.reading = reading
+
+	state := Active
+	switch {
+	case reading.Locked:
+		state = Locked
+	case reading.Idle >= w.idleAfter:
+		state = Idle
+	}
+	if state == w.state {
+		w.mu.Unlock()
+		return
+	}
+	presenceLog.Debug("presence changed", log.F("from", w.state.String()), log.F("to", state.String()), log.F("idle", reading.Idle))
+	w.state = state
+	w.mu.Unlock()
+
+	w.changed(state)
+}
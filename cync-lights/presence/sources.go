@@ -0,0 +1,292 @@
+package presence
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/pkg/errors"
+)
+
+const procInterrupts = "/proc/interrupts"
+
+// defaultInterruptPatterns match the interrupt lines keyboards and mice
+// usually land on, PS/2 and the USB host controllers.
+var defaultInterruptPatterns = []string{"i8042", "xhci", "ehci", "ohci", "uhci", "hid"}
+
+// detect picks the best source this machine seems to have.
+func detect() Source {
+	if _, err := exec.LookPath("loginctl"); err == nil && os.Getenv("XDG_SESSION_ID") != "" {
+		return newLogind()
+	}
+	if _, err := exec.LookPath("xprintidle"); err == nil && os.Getenv("DISPLAY") != "" {
+		return &x11Source{}
+	}
+	return newInterrupts(procInterrupts, defaultInterruptPatterns)
+}
+
+// interruptsSource watches input interrupt counters. Any change counts as
+// activity, so it can't tell input from other traffic on a shared USB
+// controller, but it needs no desktop and works over ssh. It can't see locks.
+type interruptsSource struct {
+	path       string
+	patterns   []string
+	last       uint64
+	lastChange time.Time
+}
+
+func newInterrupts(path string, patterns []string) *interruptsSource {
+	return &interruptsSource{path: path, patterns: patterns, lastChange: time.Now()}
+}
+
+func (s *interruptsSource) Name() string {
+	return "interrupts"
+}
+
+func (s *interruptsSource) Read() (Reading, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return Reading{}, errors.Wrap(err, "failed to read interrupts")
+	}
+
+	var total uint64
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !s.matches(line) {
+			continue
+		}
+		// "  1:   9   0   IR-IO-APIC    1-edge      i8042", counts per cpu
+		// follow the irq until the first word that isn't a number
+		fields := strings.Fields(line)
+		for _, f := range fields[1:] {
+			n, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				break
+			}
+			total += n
+		}
+	}
+
+	if total != s.last {
+		s.last = total
+		s.lastChange = time.Now()
+	}
+	return Reading{Idle: time.Since(s.lastChange)}, nil
+}
+
+func (s *interruptsSource) matches(line string) bool {
+	for _, p := range s.patterns {
+		if strings.Contains(line, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// logindSource asks systemd-logind about the session. IdleHint is only set
+// once the desktop decides the session is idle, so idle times shorter than
+// the desktop's own timeout never show up.
+type logindSource struct {
+	session string
+}
+
+func newLogind() *logindSource {
+	session := os.Getenv("XDG_SESSION_ID")
+	if session == "" {
+		session = "self"
+	}
+	return &logindSource{session: session}
+}
+
+func (s *logindSource) Name() string {
+	return "logind"
+}
+
+func (s *logindSource) Read() (Reading, error) {
+	out, err := exec.Command("loginctl", "show-session", s.session,
+		"-p", "IdleHint", "-p", "IdleSinceHint", "-p", "LockedHint").Output()
+	if err != nil {
+		return Reading{}, errors.Wrap(err, "loginctl failed")
+	}
+
+	props := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			props[key] = value
+		}
+	}
+
+	r := Reading{Locked: props["LockedHint"] == "yes"}
+	if props["IdleHint"] == "yes" {
+		// microseconds since the epoch
+		since, err := strconv.ParseInt(props["IdleSinceHint"], 10, 64)
+		if err == nil && since > 0 {
+			r.Idle = time.Since(time.UnixMicro(since))
+		}
+	}
+	return r, nil
+}
+
+// x11Source uses xprintidle, which reads the X screensaver extension's idle
+// time. It can't see locks.
+type x11Source struct{}
+
+func (s *x11Source) Name() string {
+	return "x11"
+}
+
+func (s *x11Source) Read() (Reading, error) {
+	out, err := exec.Command("xprintidle").Output()
+	if err != nil {
+		return Reading{}, errors.Wrap(err, "xprintidle failed")
+	}
+	ms, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return Reading{}, errors.Wrapf(err, "unexpected xprintidle output %q", out)
+	}
+	return Reading{Idle: time.Duration(ms) * time.Millisecond}, nil
+}
+
+// ParseReading reads the text format the file and socket sources take:
+// "active", "idle=5m" and "locked" words, e.g. "idle=10m locked".
+func ParseReading(text string) (Reading, error) {
+	var r Reading
+	for _, word := range strings.Fields(text) {
+		switch {
+		case word == "active":
+			r.Idle = 0
+		case word == "locked":
+			r.Locked = true
+		case word == "unlocked":
+			r.Locked = false
+		case strings.HasPrefix(word, "idle="):
+			d, err := time.ParseDuration(strings.TrimPrefix(word, "idle="))
+			if err != nil {
+				return r, errors.Wrapf(err, "bad idle time in %q", word)
+			}
+			r.Idle = d
+		default:
+			return r, errors.Errorf("unknown presence word %q", word)
+		}
+	}
+	return r, nil
+}
+
+// fileSource reads a reading from a file, made for scripts and testing. Idle
+// time keeps growing from when the file was last written, so writing
+// "active" to it is a keypress.
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) Name() string {
+	return "file:" + s.path
+}
+
+func (s *fileSource) Read() (Reading, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return Reading{}, errors.Wrap(err, "failed to stat presence file")
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return Reading{}, errors.Wrap(err, "failed to read presence file")
+	}
+	r, err := ParseReading(string(data))
+	r.Idle += time.Since(info.ModTime())
+	return r, err
+}
+
+// socketSource listens on a unix socket for lines in the file format, e.g.
+// echo active | nc -U presence.sock. The last line received wins.
+type socketSource struct {
+	path     string
+	listener net.Listener
+
+	mu       sync.Mutex
+	reading  Reading
+	received time.Time
+}
+
+func listenSocket(path string) (*socketSource, error) {
+	// a socket left by a previous run would make listen fail
+	if err := removeSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %s", path)
+	}
+	s := &socketSource{path: path, listener: l, received: time.Now()}
+	go s.accept()
+	return s, nil
+}
+
+func (s *socketSource) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *socketSource) serve(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		r, err := ParseReading(scanner.Text())
+		if err != nil {
+			presenceLog.Warn("bad presence message", log.F("socket", s.path), log.Err(err))
+			continue
+		}
+		s.mu.Lock()
+		s.reading, s.received = r, time.Now()
+		s.mu.Unlock()
+	}
+}
+
+func (s *socketSource) Name() string {
+	return "socket:" + s.path
+}
+
+func (s *socketSource) Read() (Reading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.reading
+	r.Idle += time.Since(s.received)
+	return r, nil
+}
+
+func (s *socketSource) Close() error {
+	err := s.listener.Close()
+	if rerr := removeSocket(s.path); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// removeSocket removes a socket at path, refusing to touch anything else
+// there in case the path is wrong.
+func removeSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to check %s", path)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.Errorf("%s exists and isn't a socket, not removing it", path)
+	}
+	return errors.Wrapf(os.Remove(path), "failed to remove old socket %s", path)
+}
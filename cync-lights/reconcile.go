@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/rules"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+var reconcileLog = log.For("reconcile")
+
+const (
+	defaultReconcileEvery = time.Minute
+	// reconcileSettle is how long after a device was sent something before
+	// the cloud's status for it is trusted, it lags behind commands
+	reconcileSettle = 10 * time.Second
+	// giveUpAfter is how many passes in a row a device can drift before
+	// it's left alone, it's probably something it can't do
+	giveUpAfter = 3
+	// keptDrifts is how many drifts are kept to show
+	keptDrifts = 50
+	// rgbTolerance and lumTolerance absorb rounding on the way back
+	rgbTolerance = 2
+	lumTolerance = 1
+)
+
+// unreconciled is implemented by modes that change devices faster than the
+// cloud's status keeps up with, like animations. Their next frame puts any
+// drift right anyway, so while skipsReconcile is true nothing is compared.
+type unreconciled interface {
+	skipsReconcile() bool
+}
+
+func (lc *liveControls) skipsReconcile() bool {
+	return !lc.paused
+}
+
+func (mr *ModeReplay) skipsReconcile() bool {
+	return true
+}
+
+func (ms *ModeShow) skipsReconcile() bool {
+	return !ms.paused && !ms.preview
+}
+
+// field is a bit for each part of a device's state that's reconciled.
+type field uint8
+
+const (
+	fieldPower field = 1 << iota
+	fieldColor
+	fieldBrightness
+)
+
+// drift is one thing a device was found doing that it wasn't sent.
+type drift struct {
+	At     time.Time `json:"at"`
+	Device string    `json:"device"`
+	// Field is power, color or brightness
+	Field string `json:"field"`
+	Want  string `json:"want"`
+	Got   string `json:"got"`
+}
+
+func (d drift) String() string {
+	return fmt.Sprintf("%s is %s, should be %s", d.Field, d.Got, d.Want)
+}
+
+// reconciler is the state of reconciling. Only the loop touches it.
+type reconciler struct {
+	// every is 0 when reconciling is off, it can still be run by hand
+	every time.Duration
+	stop  chan struct{}
+	// sent is when each device was last sent something
+	sent map[string]time.Time
+	// owned is what each device has been sent since starting, only that is
+	// reconciled, the rest is whatever the device was found doing
+	owned map[string]field
+	// streak is how many passes in a row each device has drifted
+	streak map[string]int
+	last   time.Time
+	drifts []drift
+}
+
+func newReconciler(cfg *config.Reconcile) (*reconciler, error) {
+	r := &reconciler{every: defaultReconcileEvery, sent: map[string]time.Time{}, owned: map[string]field{}, streak: map[string]int{}}
+	if cfg == nil {
+		return r, nil
+	}
+	if strings.EqualFold(cfg.Interval, "off") {
+		r.every = 0
+		return r, nil
+	}
+	every, err := configDuration(cfg.Interval, defaultReconcileEvery)
+	if err != nil {
+		return nil, err
+	}
+	r.every = every
+	return r, nil
+}
+
+// touch notes a device was just sent something, so its status is stale for
+// a while and it gets another chance if it had drifted.
+func (r *reconciler) touch(id string, f field) {
+	r.sent[id] = time.Now()
+	r.owned[id] |= f
+	delete(r.streak, id)
+}
+
+func (r *reconciler) record(d drift) {
+	r.drifts = append(r.drifts, d)
+	if len(r.drifts) > keptDrifts {
+		r.drifts = r.drifts[len(r.drifts)-keptDrifts:]
+	}
+}
+
+// startReconcile reads what devices are doing every interval and has the
+// loop put right whatever drifted.
+func (c *controller) startReconcile() {
+	if c.reconcile.every <= 0 {
+		return
+	}
+	c.reconcile.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(c.reconcile.every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.reconcile.stop:
+				return
+			case <-ticker.C:
+			}
+			if c.queued.isOffline() {
+				continue
+			}
+			c.readAndReconcile(false)
+		}
+	}()
+}
+
+// readAndReconcile asks the cloud what every device is doing and posts the
+// comparison to the loop. It blocks on the cloud so it's run off the loop.
+func (c *controller) readAndReconcile(manual bool) {
+	taken := time.Now()
+	actual, err := c.readActual()
+	if err != nil {
+		reconcileLog.Debug("couldn't read devices", log.Err(err))
+		if manual {
+			c.post(func() { c.view.Eventf(ui.ErrColor, "reconcile: %v", err) })
+		}
+		return
+	}
+	c.post(func() { c.reconcileDevices(actual, taken, manual) })
+}
+
+// readActual is each device's status by ID, fresh from the cloud. Listing
+// devices is what refreshes them.
+func (c *controller) readActual() (map[string]deviceStatus, error) {
+	devices, err := c.queued.backend.Devices()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read devices")
+	}
+	actual := make(map[string]deviceStatus, len(devices))
+	for _, d := range devices {
+		actual[d.DeviceID()] = c.queued.backend.Status(d)
+	}
+	return actual, nil
+}
+
+// reconcileDevices sends devices that drifted what they were last sent.
+// Devices sent something since the status was read, offline, or waiting on
+// queued commands are skipped, as is everything during an alert or a mode
+// that opts out.
+func (c *controller) reconcileDevices(actual map[string]deviceStatus, taken time.Time, manual bool) {
+	if mode, ok := c.mode.(unreconciled); ok && mode.skipsReconcile() {
+		reconcileLog.Debug("mode skips reconciling", log.F("mode", c.mode.getId()))
+		if manual {
+			c.view.Eventf(ui.DimColor, "not reconciling while %s is running", c.mode.getId())
+		}
+		return
+	}
+	if c.alerting {
+		return
+	}
+	c.reconcile.last = time.Now()
+	checked, drifted := 0, 0
+	for _, d := range c.devices {
+		id := d.DeviceID()
+		status, ok := actual[id]
+		if !ok || !status.Online || c.queued.queue.Has(id) || c.reconcile.sent[id].After(taken.Add(-reconcileSettle)) {
+			continue
+		}
+		checked++
+		drifts := c.drifted(d, status)
+		if len(drifts) == 0 {
+			delete(c.reconcile.streak, id)
+			continue
+		}
+		drifted++
+		c.correct(d, drifts)
+	}
+	if manual {
+		c.view.Eventf(ui.TextColor, "reconciled %d devices, %d drifted", checked, drifted)
+	}
+}
+
+// correct reports a device's drift and sends it what it's missing, unless
+// it keeps drifting however often it's sent.
+func (c *controller) correct(d *device, drifts []drift) {
+	id := d.DeviceID()
+	streak := c.reconcile.streak[id] + 1
+	if streak > giveUpAfter {
+		return
+	}
+	var fields []string
+	for _, dr := range drifts {
+		c.reconcile.record(dr)
+		c.metrics.drifts.Inc(d.Name(), dr.Field)
+		fields = append(fields, dr.String())
+		reconcileLog.Info("device drifted", log.F("device", d.Name()), log.F("field", dr.Field), log.F("want", dr.Want), log.F("got", dr.Got))
+	}
+	c.ruleEvent(rules.Event{Kind: rules.KindDevice, Key: d.Name(), Value: "drift"})
+	if streak == giveUpAfter {
+		c.view.Eventf(ui.ErrColor, "%s keeps drifting (%s), leaving it alone until it's sent something", d.Name(), strings.Join(fields, "; "))
+		c.reconcile.streak[id] = streak
+		return
+	}
+	c.view.Eventf(ui.PendingColor, "%s drifted: %s, sending it again", d.Name(), strings.Join(fields, "; "))
+	c.resend(d, drifts)
+	c.reconcile.streak[id] = streak
+}
+
+// drifted compares what the cloud says a device is doing with what it was
+// last sent. Color and brightness don't matter for devices that are meant to
+// be off.
+func (c *controller) drifted(d *device, status deviceStatus) []drift {
+	id := d.DeviceID()
+	owned := c.reconcile.owned[id]
+	now := time.Now()
+	var out []drift
+	on := status.On
+	if owned&fieldPower != 0 {
+		on = c.lastPower[id]
+		if status.On != on {
+			out = append(out, drift{At: now, Device: d.Name(), Field: "power", Want: powerWord(on), Got: powerWord(status.On)})
+		}
+	}
+	if !on {
+		return out
+	}
+	got := "white"
+	if status.UseRGB {
+		got = rgbWord(status.RGB)
+	}
+	if owned&fieldColor != 0 {
+		if kelvin, ok := c.lastKelvin[id]; ok {
+			if status.UseRGB {
+				out = append(out, drift{At: now, Device: d.Name(), Field: "color", Want: fmt.Sprintf("%dK", kelvin), Got: got})
+			}
+		} else if color, ok := c.lastColor[id]; ok {
+			want := c.calibration.For(d.Name()).RGB(color.GetRGB())
+			if !status.UseRGB || !nearRGB(want, status.RGB) {
+				out = append(out, drift{At: now, Device: d.Name(), Field: "color", Want: rgbWord(want), Got: got})
+			}
+		}
+	}
+	if lum, ok := c.lastLum[id]; ok && owned&fieldBrightness != 0 {
+		want := c.outputLum(d, lum)
+		if abs(want-status.Brightness) > lumTolerance {
+			out = append(out, drift{At: now, Device: d.Name(), Field: "brightness", Want: fmt.Sprintf("%d%%", want), Got: fmt.Sprintf("%d%%", status.Brightness)})
+		}
+	}
+	return out
+}
+
+// resend sends what drifted, the power first as a bulb that should be off
+// only needs that.
+func (c *controller) resend(d *device, drifts []drift) {
+	id := d.DeviceID()
+	for _, dr := range drifts {
+		switch dr.Field {
+		case "power":
+			c.SetStatus(d, c.lastPower[id])
+			if !c.lastPower[id] {
+				return
+			}
+		case "color":
+			if kelvin, ok := c.lastKelvin[id]; ok {
+				c.SetCTAsync(d, kelvin)
+			} else {
+				c.SetRGB(d, c.lastColor[id])
+			}
+		case "brightness":
+			c.SetLum(d, c.lastLum[id])
+		}
+	}
+}
+
+func rgbWord(rgb [3]uint8) string {
+	return fmt.Sprintf("%d,%d,%d", rgb[0], rgb[1], rgb[2])
+}
+
+func nearRGB(a, b [3]uint8) bool {
+	for i := range a {
+		if abs(int(a[i])-int(b[i])) > rgbTolerance {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// reconcileStatus is what the REPL and API show about reconciling.
+type reconcileStatus struct {
+	// Interval is empty when reconciling only runs by hand
+	Interval string     `json:"interval,omitempty"`
+	Last     *time.Time `json:"last,omitempty"`
+	Drifts   []drift    `json:"drifts"`
+}
+
+func (c *controller) reconcileStatus() reconcileStatus {
+	status := reconcileStatus{Drifts: append([]drift{}, c.reconcile.drifts...)}
+	if c.reconcile.every > 0 {
+		status.Interval = c.reconcile.every.String()
+	}
+	if !c.reconcile.last.IsZero() {
+		last := c.reconcile.last
+		status.Last = &last
+	}
+	return status
+}
+
+func runReconcile(cont *controller, args parsedArgs) error {
+	if args.str("action") == "now" {
+		go cont.readAndReconcile(true)
+		return nil
+	}
+	status := cont.reconcileStatus()
+	switch {
+	case status.Interval == "":
+		cont.view.Eventf(ui.TextColor, "reconciling is off, reconcile now runs it once")
+	case status.Last == nil:
+		cont.view.Eventf(ui.TextColor, "reconciling every %s, not run yet", status.Interval)
+	default:
+		cont.view.Eventf(ui.TextColor, "reconciling every %s, last at %s", status.Interval, status.Last.Format("15:04:05"))
+	}
+	if len(status.Drifts) == 0 {
+		cont.view.Eventf(ui.TextColor, "no drift seen")
+	}
+	for _, d := range status.Drifts {
+		cont.view.Eventf(ui.TextColor, "  %s %s: %s", d.At.Format("15:04:05"), d.Device, d)
+	}
+	return nil
+}
+
+// handleReconcile shows recent drift, POST reconciles now.
+func (c *controller) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		done := make(chan reconcileStatus, 1)
+		go c.postFrom(r, func() { done <- c.reconcileStatus() })
+		select {
+		case status := <-done:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+		case <-time.After(apiTimeout / 2):
+			respond(w, http.StatusServiceUnavailable, apiResult{Reason: "the controller is busy, try again"})
+		}
+	case http.MethodPost:
+		go c.readAndReconcile(false)
+		respond(w, http.StatusAccepted, apiResult{Queued: true})
+	default:
+		respond(w, http.StatusMethodNotAllowed, apiResult{Reason: "use GET or POST"})
+	}
+}
+
+func runPowerCycle(cont *controller, args parsedArgs) error {
+	if cont.fake == nil {
+		return errors.New("power cycles can only be simulated with --fake")
+	}
+	d, _ := cont.findDevice(args.str("device"))
+	cont.fake.PowerCycle(d.DeviceID())
+	cont.view.Eventf(ui.TextColor, "%s came back white at full brightness", d.Name())
+	return nil
+}
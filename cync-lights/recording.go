@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+var recordLog = log.For("record")
+
+const (
+	eventCommand = "command"
+	eventPower   = "power"
+	eventColor   = "color"
+	eventLum     = "lum"
+)
+
+// recordedEvent is one line of a recording. At is milliseconds since the
+// recording started.
+type recordedEvent struct {
+	At     int64     `json:"at_ms"`
+	Kind   string    `json:"kind"`
+	Line   string    `json:"line,omitempty"`
+	Device string    `json:"device,omitempty"`
+	Power  bool      `json:"power,omitempty"`
+	Color  string    `json:"color,omitempty"`
+	RGB    *[3]uint8 `json:"rgb,omitempty"`
+	Lum    int       `json:"lum,omitempty"`
+}
+
+// recorder appends commands and device changes to a JSON lines file. A nil
+// recorder ignores everything, so the controller can call it unconditionally.
+type recorder struct {
+	path   string
+	file   *os.File
+	enc    *json.Encoder
+	start  time.Time
+	events int
+}
+
+func startRecording(path string) (*recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, errors.Wrap(err, "failed to create recordings dir")
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create recording %s", path)
+	}
+	return &recorder{
+		path:  path,
+		file:  file,
+		enc:   json.NewEncoder(file),
+		start: time.Now(),
+	}, nil
+}
+
+func (r *recorder) write(e recordedEvent) {
+	if r == nil {
+		return
+	}
+	e.At = time.Since(r.start).Milliseconds()
+	if err := r.enc.Encode(e); err != nil {
+		recordLog.Error("failed to write event", log.F("path", r.path), log.Err(err))
+		return
+	}
+	r.events++
+}
+
+func (r *recorder) command(line string) {
+	r.write(recordedEvent{Kind: eventCommand, Line: line})
+}
+
+func (r *recorder) power(d *device, on bool) {
+	r.write(recordedEvent{Kind: eventPower, Device: d.Name(), Power: on})
+}
+
+func (r *recorder) color(d *device, color colors.RGB) {
+	rgb := color.GetRGB()
+	r.write(recordedEvent{Kind: eventColor, Device: d.Name(), Color: color.Name, RGB: &rgb})
+}
+
+func (r *recorder) lum(d *device, lum colors.Brightness) {
+	r.write(recordedEvent{Kind: eventLum, Device: d.Name(), Lum: int(lum)})
+}
+
+func (r *recorder) stop() error {
+	if r == nil {
+		return nil
+	}
+	return errors.Wrap(r.file.Close(), "failed to close recording")
+}
+
+func loadRecording(path string) ([]recordedEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open recording %s", path)
+	}
+	defer file.Close()
+
+	var events []recordedEvent
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var e recordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, n)
+		}
+		events = append(events, e)
+	}
+	return events, errors.Wrapf(scanner.Err(), "failed to read recording %s", path)
+}
+
+// recordingPath puts bare names in the recordings dir next to the config.
+func (c *controller) recordingPath(name string) string {
+	return c.configFile("recordings", name, ".jsonl")
+}
+
+// configFile resolves a bare name to a file in a dir next to the config,
+// adding ext if it has none. Names with a path are used as they are.
+func (c *controller) configFile(dir, name, ext string) string {
+	if strings.ContainsRune(name, os.PathSeparator) {
+		return name
+	}
+	if filepath.Ext(name) == "" {
+		name += ext
+	}
+	return filepath.Join(c.config.Dir(), dir, name)
+}
+
+func runRecord(cont *controller, args parsedArgs) error {
+	switch args.str("action") {
+	case "start":
+		if !args.has("file") {
+			return errors.New("usage: record start <file>")
+		}
+		if cont.recorder != nil {
+			return errors.Errorf("already recording to %s", cont.recorder.path)
+		}
+		rec, err := startRecording(cont.recordingPath(args.str("file")))
+		if err != nil {
+			return err
+		}
+		cont.recorder = rec
+		cont.view.Eventf(ui.TextColor, "recording to %s", rec.path)
+	case "stop":
+		if cont.recorder == nil {
+			return errors.New("not recording")
+		}
+		rec := cont.recorder
+		cont.recorder = nil
+		if err := rec.stop(); err != nil {
+			return err
+		}
+		cont.view.Eventf(ui.TextColor, "recorded %d events to %s", rec.events, rec.path)
+	}
+	return nil
+}
+
+func runReplay(cont *controller, args parsedArgs) error {
+	events, err := loadRecording(cont.recordingPath(args.str("file")))
+	if err != nil {
+		return err
+	}
+	speed := 1.0
+	if args.has("speed") {
+		speed = args.float("speed")
+	}
+
+	replay := cont.modes[ModeReplayID].(*ModeReplay)
+	replay.load(args.str("file"), events, speed)
+	return cont.SwitchMode(ModeReplayID)
+}
+
+const ModeReplayID = "replay"
+
+// ModeReplay plays a recording back. Device changes are applied in the order
+// and at the offsets they were recorded, scaled by speed, and commands are
+// only shown since their effects are already in the recording. Nothing is
+// random, so the same recording always produces the same calls.
+type ModeReplay struct {
+	name   string
+	events []recordedEvent
+	speed  float64
+	next   int
+	start  time.Time
+}
+
+func (mr *ModeReplay) load(name string, events []recordedEvent, speed float64) {
+	mr.name = name
+	mr.events = events
+	mr.speed = speed
+	mr.next = 0
+}
+
+func (mr *ModeReplay) onSwitch(cont *controller) error {
+	if mr.events == nil {
+		return errors.New("nothing to replay, use replay <file> [speed]")
+	}
+	mr.start = time.Now()
+	cont.view.Eventf(ui.TextColor, "replaying %s (%d events) at %gx", mr.name, len(mr.events), mr.speed)
+	return nil
+}
+
+func (mr *ModeReplay) run(cont *controller) (time.Duration, error) {
+	elapsed := time.Duration(float64(time.Since(mr.start)) * mr.speed)
+	for mr.next < len(mr.events) && time.Duration(mr.events[mr.next].At)*time.Millisecond <= elapsed {
+		mr.apply(cont, mr.events[mr.next])
+		mr.next++
+	}
+
+	cont.view.SetModeLines(fmt.Sprintf("[Replay] %s", mr.name),
+		fmt.Sprintf("%d/%d events at %gx, %v in", mr.next, len(mr.events), mr.speed, elapsed.Round(time.Second)))
+
+	if mr.next >= len(mr.events) {
+		cont.view.Eventf(ui.TextColor, "finished replaying %s", mr.name)
+		return time.Millisecond, cont.SwitchMode(ModeCommandID)
+	}
+
+	wait := time.Duration(float64(time.Duration(mr.events[mr.next].At)*time.Millisecond-elapsed) / mr.speed)
+	if wait > time.Second {
+		wait = time.Second
+	}
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait, nil
+}
+
+func (mr *ModeReplay) apply(cont *controller, e recordedEvent) {
+	if e.Kind == eventCommand {
+		cont.view.Eventf(ui.DimColor, "replay> %s", e.Line)
+		return
+	}
+
+	d, ok := cont.findDevice(e.Device)
+	if !ok {
+		recordLog.Warn("recording names an unknown device", log.F("device", e.Device))
+		return
+	}
+	switch e.Kind {
+	case eventPower:
+		cont.SetStatus(d, e.Power)
+	case eventColor:
+		if e.RGB == nil {
+			recordLog.Warn("color event without rgb", log.F("device", e.Device))
+			return
+		}
+		cont.SetRGBAsync(d, colors.New(e.Color, e.RGB[0], e.RGB[1], e.RGB[2]))
+	case eventLum:
+		cont.SetLumAsync(d, colors.Brightness(e.Lum).Clamp())
+	}
+}
+
+func (mr *ModeReplay) onExit(cont *controller) {
+	if mr.next < len(mr.events) {
+		cont.view.Eventf(ui.TextColor, "stopped replaying %s at %d/%d", mr.name, mr.next, len(mr.events))
+	}
+}
+
+func (mr *ModeReplay) isIndefinite() bool {
+	return true
+}
+
+func (mr *ModeReplay) getId() string {
+	return ModeReplayID
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// replayAll plays a recording back as fast as it'll go.
+func replayAll(t *testing.T, c *controller, path string) {
+	t.Helper()
+	events, err := loadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := c.modes[ModeReplayID].(*ModeReplay)
+	replay.load(filepath.Base(path), events, 1e6)
+	if err := c.SwitchMode(ModeReplayID); err != nil {
+		t.Fatal(err)
+	}
+	for c.mode.getId() == ModeReplayID {
+		if _, err := c.mode.run(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplayMatchesRecording(t *testing.T) {
+	c, recorded := newTestController(t, 3)
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	rec, err := startRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.recorder = rec
+	runCommands(t, c,
+		"color red fake-1",
+		"dim 40% fake-2",
+		"off fake-3",
+		"color blue fake-2",
+		"on fake-3",
+	)
+	c.recorder = nil
+	if err := rec.stop(); err != nil {
+		t.Fatal(err)
+	}
+	want := recorded.Calls()
+	if len(want) == 0 {
+		t.Fatal("the commands sent nothing")
+	}
+
+	// the same calls every time, whatever the controller did before
+	for i := 0; i < 2; i++ {
+		replayer, fb := newTestController(t, 3)
+		replayAll(t, replayer, path)
+		if got := fb.Calls(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("replay %d sent\n%v\nrecording sent\n%v", i+1, got, want)
+		}
+	}
+}
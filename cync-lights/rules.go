@@ -0,0 +1,260 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/rules"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+var rulesLog = log.For("rules.controller")
+
+// configPoll is how often the config is checked for edits to reload.
+const configPoll = 2 * time.Second
+
+// ruleEnv is the controller as the rules engine sees it.
+type ruleEnv struct {
+	c *controller
+}
+
+func (env ruleEnv) Now() time.Time {
+	return time.Now()
+}
+
+func (env ruleEnv) Mode() string {
+	if env.c.mode == nil {
+		return ""
+	}
+	return env.c.mode.getId()
+}
+
+func (env ruleEnv) GroupState(group string) (string, error) {
+	devices, err := env.c.resolveTarget(group)
+	if err != nil {
+		return "", err
+	}
+	on := 0
+	for _, d := range devices {
+		if env.c.lastPower[d.DeviceID()] {
+			on++
+		}
+	}
+	switch on {
+	case 0:
+		return "off", nil
+	case len(devices):
+		return "on", nil
+	}
+	return "mixed", nil
+}
+
+func (env ruleEnv) Do(a config.Action) error {
+	c := env.c
+	switch {
+	case a.Scene != "":
+		return c.loadScene(a.Scene)
+	case a.Mode != "":
+		return c.SwitchMode(a.Mode)
+	case a.Color != "":
+		color, err := colors.Parse(a.Color)
+		if err != nil {
+			return err
+		}
+		devices, err := c.resolveTarget(a.Target)
+		if err != nil {
+			return err
+		}
+		for _, d := range devices {
+			if err := c.SetRGB(d, color); err != nil {
+				return err
+			}
+		}
+		return nil
+	case a.Notify != "":
+		c.notify(a.Notify)
+		return nil
+	case a.Command != "":
+		return c.commands.execute(c, a.Command)
+	}
+	return errors.New("action does nothing")
+}
+
+// notify shows a message in the event log, and on the desktop when
+// notify-send is installed.
+func (c *controller) notify(message string) {
+	c.view.Eventf(ui.HeaderColor, "%s", message)
+	path, err := exec.LookPath("notify-send")
+	if err != nil {
+		return
+	}
+	cmd := exec.Command(path, "cync-lights", message)
+	if err := cmd.Start(); err != nil {
+		rulesLog.Warn("notify-send failed", log.Err(err))
+		return
+	}
+	go cmd.Wait()
+}
+
+// startRules loads the rules from the config, starts their watchers and
+// reloads them whenever the config file changes.
+func (c *controller) startRules() {
+	c.loadRules()
+	c.configStop = make(chan struct{})
+	go c.watchConfig()
+}
+
+func (c *controller) loadRules() {
+	for _, err := range c.rules.Load(c.config.Rules) {
+		c.view.Eventf(ui.ErrColor, "rule %v", err)
+		rulesLog.Warn("invalid rule", log.Err(err))
+	}
+	if c.ruleWatchers != nil {
+		c.ruleWatchers.Stop()
+	}
+	c.ruleWatchers = rules.Watch(c.rules.Rules(), c.config.MQTT, func(ev rules.Event) {
+		c.post(func() { c.rules.Handle(ev) })
+	})
+	rulesLog.Info("loaded rules", log.F("rules", len(c.rules.Rules())))
+}
+
+// ruleEvent passes something that happened on the controller loop to the
+// rules. Devices flashing for an alert aren't really changing, so those
+// events are dropped.
+func (c *controller) ruleEvent(ev rules.Event) {
+	if c.alerting && ev.Kind == rules.KindDevice {
+		return
+	}
+	c.rules.Handle(ev)
+}
+
+// watchConfig polls the config file and reloads it when it's edited.
+func (c *controller) watchConfig() {
+	path := c.config.File()
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(configPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.configStop:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modified) {
+			continue
+		}
+		modified = info.ModTime()
+		c.post(func() { c.reloadConfig(path) })
+	}
+}
+
+// reloadConfig picks up edits to the parts of the config that can change
+// while running: groups, scenes, aliases, rules, the mqtt broker,
+// calibration, energy and the brightness scale. Key bindings and presence need a
+// restart.
+func (c *controller) reloadConfig(path string) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		c.view.Eventf(ui.ErrColor, "not reloading config: %v", err)
+		return
+	}
+	c.config.Groups = cfg.Groups
+	c.config.Scenes = cfg.Scenes
+	c.config.Aliases = cfg.Aliases
+	c.config.Rules = cfg.Rules
+	c.config.MQTT = cfg.MQTT
+	c.config.Calibration = cfg.Calibration
+	c.config.Energy = cfg.Energy
+	if c.routes != nil && cfg.Local != nil {
+		// the hub itself needs a restart to change
+		c.config.Local.Devices = cfg.Local.Devices
+		c.routeDevices()
+	}
+	c.loadRules()
+	c.loadCalibration()
+	c.loadEnergy()
+	if cfg.Scale != c.config.Scale {
+		scale := colors.Full
+		if cfg.Scale != "" {
+			if scale, err = colors.ParseBrightness(cfg.Scale); err != nil {
+				c.view.Eventf(ui.ErrColor, "not changing scale: %v", err)
+				scale = c.scale
+			}
+		}
+		c.config.Scale = cfg.Scale
+		c.setScale(scale)
+	}
+	c.view.Eventf(ui.DimColor, "reloaded config, %d rules", len(c.rules.Rules()))
+}
+
+func runRules(cont *controller, args parsedArgs) error {
+	engine := cont.rules
+	switch args.str("action") {
+	case "", "list":
+		loaded := engine.Rules()
+		if len(loaded) == 0 {
+			cont.view.Eventf(ui.TextColor, "no rules, add some to the config")
+		}
+		for _, r := range loaded {
+			last := "never fired"
+			if at, ok := engine.LastFired(r.Name); ok {
+				last = "fired " + at.Format("Jan 2 15:04:05")
+			}
+			disabled := ""
+			if r.Disabled {
+				disabled = " (disabled)"
+			}
+			cont.view.Eventf(ui.TextColor, "%s: when %s, %s%s", r.Name, rules.Describe(r.When), last, disabled)
+		}
+	case "why":
+		trace, ok := engine.Why(args.str("name"))
+		if !ok {
+			if args.has("name") {
+				return errors.Errorf("%s hasn't been triggered yet", args.str("name"))
+			}
+			return errors.New("no rule has been triggered yet")
+		}
+		result := "didn't run"
+		if trace.Fired {
+			result = "ran"
+		}
+		cont.view.Eventf(ui.HeaderColor, "%s %s at %s", trace.Rule, result, trace.Event.At.Format("15:04:05"))
+		for _, step := range trace.Steps {
+			cont.view.Eventf(ui.TextColor, "  %s", step)
+		}
+	case "fire":
+		if !args.has("event") {
+			return errors.New("usage: rules fire <event>")
+		}
+		cont.rules.Handle(rules.Event{Kind: rules.KindEvent, Key: args.str("event")})
+	case "reload":
+		cont.reloadConfig(cont.config.File())
+	}
+	return nil
+}
+
+// ruleNames completes rule names for rules why.
+func (c *controller) ruleNames() []string {
+	var names []string
+	for _, r := range c.rules.Rules() {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+func powerWord(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
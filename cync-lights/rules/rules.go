@@ -0,0 +1,418 @@
+// Package rules runs "when X, if Y, then Z" rules from the config. Events
+// come from the watchers in this package and from the controller, the
+// engine matches them against triggers, checks conditions and hands actions
+// back to the controller through Env.
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/mqtt"
+	"github.com/pkg/errors"
+)
+
+var rulesLog = log.For("rules")
+
+// Event kinds, one per trigger kind.
+const (
+	KindTime     = "time"
+	KindDevice   = "device"
+	KindEvent    = "event"
+	KindMQTT     = "mqtt"
+	KindFile     = "file"
+	KindCommand  = "command"
+	KindPresence = "presence"
+)
+
+// maxDepth stops rules whose actions trigger each other from looping forever.
+const maxDepth = 4
+
+// Event is something that happened. Key says what it happened to, a device
+// name, topic or path, and Value what happened, a state, payload or exit
+// status.
+type Event struct {
+	Kind  string
+	Key   string
+	Value string
+	At    time.Time
+}
+
+func (e Event) String() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%s %s", e.Kind, e.Key)
+	}
+	return fmt.Sprintf("%s %s = %s", e.Kind, e.Key, e.Value)
+}
+
+// Env is what rules can see and do.
+type Env interface {
+	Now() time.Time
+	Mode() string
+	// GroupState is on, off or mixed
+	GroupState(group string) (string, error)
+	Do(a config.Action) error
+}
+
+// Trace is the explanation of a rule's last match, whether or not it ran.
+type Trace struct {
+	Rule  string
+	Event Event
+	Fired bool
+	Steps []string
+}
+
+type rule struct {
+	config.Rule
+	cooldown time.Duration
+	at       clock
+	days     map[time.Weekday]bool
+	between  []window
+}
+
+type Engine struct {
+	env   Env
+	rules []*rule
+	// fired is when each rule last ran, kept across reloads
+	fired  map[string]time.Time
+	traces map[string]Trace
+	last   string
+	depth  int
+}
+
+func New(env Env) *Engine {
+	return &Engine{env: env, fired: map[string]time.Time{}, traces: map[string]Trace{}}
+}
+
+// Load replaces the rules. Invalid rules are left out and returned as errors,
+// the rest still load.
+func (e *Engine) Load(rules []config.Rule) []error {
+	var problems []error
+	var loaded []*rule
+	seen := map[string]bool{}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if seen[r.Name] {
+			problems = append(problems, errors.Errorf("%s: name used twice", r.Name))
+			continue
+		}
+		seen[r.Name] = true
+
+		compiled, err := compile(r)
+		if err != nil {
+			problems = append(problems, errors.Wrap(err, r.Name))
+			continue
+		}
+		loaded = append(loaded, compiled)
+	}
+	e.rules = loaded
+	return problems
+}
+
+func compile(r config.Rule) (*rule, error) {
+	c := &rule{Rule: r}
+	if n := triggerKinds(r.When); n != 1 {
+		return nil, errors.Errorf("needs exactly one trigger, has %d", n)
+	}
+	if len(r.Then) == 0 {
+		return nil, errors.New("has no actions")
+	}
+
+	if r.Cooldown != "" {
+		d, err := time.ParseDuration(r.Cooldown)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad cooldown")
+		}
+		c.cooldown = d
+	}
+	if r.When.At != "" {
+		at, err := parseClock(r.When.At)
+		if err != nil {
+			return nil, err
+		}
+		c.at = at
+	}
+	if len(r.When.Days) > 0 {
+		c.days = map[time.Weekday]bool{}
+		for _, day := range r.When.Days {
+			wd, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, errors.Errorf("unknown day %q", day)
+			}
+			c.days[wd] = true
+		}
+	}
+	if r.When.Command != "" && r.When.Every != "" {
+		if _, err := time.ParseDuration(r.When.Every); err != nil {
+			return nil, errors.Wrap(err, "bad every")
+		}
+	}
+
+	for i, cond := range r.If {
+		if n := conditionKinds(cond); n != 1 {
+			return nil, errors.Errorf("condition %d needs exactly one of between, group or mode, has %d", i+1, n)
+		}
+		if cond.Group != "" && !groupStates[cond.State] {
+			return nil, errors.Errorf("condition %d: group %s needs a state of on, off or mixed", i+1, cond.Group)
+		}
+		if cond.Between == nil {
+			continue
+		}
+		if len(cond.Between) != 2 {
+			return nil, errors.New("between needs a start and an end")
+		}
+		from, err := parseClock(cond.Between[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(cond.Between[1])
+		if err != nil {
+			return nil, err
+		}
+		c.between = append(c.between, window{from, to})
+	}
+	return c, nil
+}
+
+func triggerKinds(t config.Trigger) int {
+	n := 0
+	for _, set := range []bool{t.At != "", t.Device != "", t.Event != "", t.Topic != "", t.File != "", t.Command != "", t.Presence != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+func conditionKinds(c config.Condition) int {
+	n := 0
+	for _, set := range []bool{c.Between != nil, c.Group != "", c.Mode != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// groupStates are what Env.GroupState returns.
+var groupStates = map[string]bool{"on": true, "off": true, "mixed": true}
+
+// Rules returns the loaded rules.
+func (e *Engine) Rules() []config.Rule {
+	rules := make([]config.Rule, len(e.rules))
+	for i, r := range e.rules {
+		rules[i] = r.Rule
+	}
+	return rules
+}
+
+func (e *Engine) LastFired(name string) (time.Time, bool) {
+	at, ok := e.fired[name]
+	return at, ok
+}
+
+// Why explains a rule's last match, or the most recent match of any rule if
+// name is empty.
+func (e *Engine) Why(name string) (Trace, bool) {
+	if name == "" {
+		name = e.last
+	}
+	t, ok := e.traces[name]
+	return t, ok
+}
+
+// Handle runs every rule the event triggers. Actions can cause more events,
+// which are handled straight away up to maxDepth deep.
+func (e *Engine) Handle(ev Event) {
+	if ev.At.IsZero() {
+		ev.At = e.env.Now()
+	}
+	if e.depth >= maxDepth {
+		rulesLog.Warn("rules triggering each other too deep, dropping event", log.F("event", ev.String()))
+		return
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+
+	for _, r := range e.rules {
+		if r.Disabled || !r.matches(ev) {
+			continue
+		}
+		e.run(r, ev)
+	}
+}
+
+func (e *Engine) run(r *rule, ev Event) {
+	t := Trace{Rule: r.Name, Event: ev, Steps: []string{"when " + ev.String()}}
+	defer func() {
+		e.traces[r.Name] = t
+		e.last = r.Name
+	}()
+
+	if last, ok := e.fired[r.Name]; ok && r.cooldown > 0 && ev.At.Sub(last) < r.cooldown {
+		t.Steps = append(t.Steps, fmt.Sprintf("cooling down, last ran %v ago, cooldown %v", ev.At.Sub(last).Round(time.Second), r.cooldown))
+		return
+	}
+
+	between := 0
+	for _, cond := range r.If {
+		var w window
+		if cond.Between != nil {
+			w = r.between[between]
+			between++
+		}
+		ok, why := e.check(cond, w, ev.At)
+		if cond.Not {
+			ok, why = !ok, "not "+why
+		}
+		t.Steps = append(t.Steps, fmt.Sprintf("if %s: %v", why, ok))
+		if !ok {
+			return
+		}
+	}
+
+	t.Fired = true
+	e.fired[r.Name] = ev.At
+	rulesLog.Info("rule fired", log.F("rule", r.Name), log.F("event", ev.String()))
+	for _, a := range r.Then {
+		err := e.env.Do(a)
+		result := "ok"
+		if err != nil {
+			result = err.Error()
+			rulesLog.Warn("rule action failed", log.F("rule", r.Name), log.F("action", describeAction(a)), log.Err(err))
+		}
+		t.Steps = append(t.Steps, fmt.Sprintf("then %s: %s", describeAction(a), result))
+	}
+}
+
+func (r *rule) matches(ev Event) bool {
+	w := r.When
+	switch ev.Kind {
+	case KindTime:
+		if w.At == "" {
+			return false
+		}
+		return ev.Key == r.at.String() && (r.days == nil || r.days[ev.At.Weekday()])
+	case KindDevice:
+		return w.Device != "" && (w.Device == "*" || strings.EqualFold(w.Device, ev.Key)) &&
+			(w.State == "" || w.State == ev.Value)
+	case KindEvent:
+		return w.Event != "" && w.Event == ev.Key
+	case KindMQTT:
+		return w.Topic != "" && mqtt.Match(w.Topic, ev.Key) && (w.Payload == "" || w.Payload == ev.Value)
+	case KindFile:
+		return w.File != "" && w.File == ev.Key
+	case KindCommand:
+		return w.Command != "" && w.Command == ev.Key && (w.Exit == nil || fmt.Sprint(*w.Exit) == ev.Value)
+	case KindPresence:
+		return w.Presence != "" && w.Presence == ev.Value
+	}
+	return false
+}
+
+// check evaluates a condition, returning what was checked for the trace.
+func (e *Engine) check(cond config.Condition, window window, now time.Time) (bool, string) {
+	switch {
+	case cond.Between != nil:
+		return window.contains(now), fmt.Sprintf("between %s and %s (now %s)", window[0], window[1], now.Format("15:04"))
+	case cond.Group != "":
+		state, err := e.env.GroupState(cond.Group)
+		if err != nil {
+			return false, fmt.Sprintf("group %s is %s (%v)", cond.Group, cond.State, err)
+		}
+		return state == cond.State, fmt.Sprintf("group %s is %s (it's %s)", cond.Group, cond.State, state)
+	case cond.Mode != "":
+		mode := e.env.Mode()
+		return mode == cond.Mode, fmt.Sprintf("mode is %s (it's %s)", cond.Mode, mode)
+	}
+	return true, "empty condition"
+}
+
+func describeAction(a config.Action) string {
+	switch {
+	case a.Scene != "":
+		return "scene " + a.Scene
+	case a.Mode != "":
+		return "mode " + a.Mode
+	case a.Color != "":
+		target := a.Target
+		if target == "" {
+			target = "all"
+		}
+		return fmt.Sprintf("color %s %s", target, a.Color)
+	case a.Notify != "":
+		return fmt.Sprintf("notify %q", a.Notify)
+	case a.Command != "":
+		return fmt.Sprintf("command %q", a.Command)
+	}
+	return "nothing"
+}
+
+// Describe is a one line summary of a trigger.
+func Describe(t config.Trigger) string {
+	switch {
+	case t.At != "":
+		if len(t.Days) > 0 {
+			return fmt.Sprintf("at %s on %s", t.At, strings.Join(t.Days, ","))
+		}
+		return "at " + t.At
+	case t.Device != "":
+		if t.State != "" {
+			return fmt.Sprintf("device %s turns %s", t.Device, t.State)
+		}
+		return fmt.Sprintf("device %s changes", t.Device)
+	case t.Event != "":
+		return "event " + t.Event
+	case t.Topic != "":
+		return "mqtt " + t.Topic
+	case t.File != "":
+		return "file " + t.File + " changes"
+	case t.Command != "":
+		return fmt.Sprintf("command %q exit status", t.Command)
+	case t.Presence != "":
+		return "presence " + t.Presence
+	}
+	return "nothing"
+}
+
+// clock is minutes since midnight.
+type clock int
+
+func parseClock(s string) (clock, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("%q isn't a time like 07:30", s)
+	}
+	return clock(t.Hour()*60 + t.Minute()), nil
+}
+
+func clockOf(t time.Time) clock {
+	return clock(t.Hour()*60 + t.Minute())
+}
+
+func (c clock) String() string {
+	return fmt.Sprintf("%02d:%02d", c/60, c%60)
+}
+
+// window is a [from, to) time of day range, which wraps midnight if to is
+// earlier than from.
+type window [2]clock
+
+func (w window) contains(t time.Time) bool {
+	now := clockOf(t)
+	from, to := w[0], w[1]
+	if from <= to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
@@ -0,0 +1,255 @@
+package rules
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/pkg/errors"
+)
+
+type fakeEnv struct {
+	now    time.Time
+	mode   string
+	groups map[string]string
+	done   []string
+}
+
+func (f *fakeEnv) Now() time.Time { return f.now }
+func (f *fakeEnv) Mode() string   { return f.mode }
+
+func (f *fakeEnv) GroupState(group string) (string, error) {
+	state, ok := f.groups[group]
+	if !ok {
+		return "", errors.Errorf("no group %s", group)
+	}
+	return state, nil
+}
+
+func (f *fakeEnv) Do(a config.Action) error {
+	f.done = append(f.done, describeAction(a))
+	if a.Notify == "fail" {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+// Monday 2026-10-19
+func monday(hour, minute int) time.Time {
+	return time.Date(2026, 10, 19, hour, minute, 0, 0, time.UTC)
+}
+
+func load(t *testing.T, env *fakeEnv, rules ...config.Rule) *Engine {
+	t.Helper()
+	e := New(env)
+	if problems := e.Load(rules); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	return e
+}
+
+var notify = []config.Action{{Notify: "hi"}}
+
+func TestLoadProblems(t *testing.T) {
+	// a misspelled key is dropped when the config's read
+	var misspelled config.Condition
+	if err := json.Unmarshal([]byte(`{"mdoe": "away"}`), &misspelled); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		rule config.Rule
+		want string
+	}{
+		{"no trigger", config.Rule{Then: notify}, "exactly one trigger"},
+		{"two triggers", config.Rule{When: config.Trigger{Event: "a", File: "b"}, Then: notify}, "exactly one trigger"},
+		{"no actions", config.Rule{When: config.Trigger{Event: "a"}}, "no actions"},
+		{"bad cooldown", config.Rule{When: config.Trigger{Event: "a"}, Then: notify, Cooldown: "soon"}, "bad cooldown"},
+		{"bad time", config.Rule{When: config.Trigger{At: "7am"}, Then: notify}, "isn't a time"},
+		{"unknown day", config.Rule{When: config.Trigger{At: "07:00", Days: []string{"funday"}}, Then: notify}, "unknown day"},
+		{"empty condition", config.Rule{When: config.Trigger{Event: "a"}, If: []config.Condition{{}}, Then: notify}, "exactly one of"},
+		{"misspelled condition", config.Rule{When: config.Trigger{Event: "a"}, If: []config.Condition{misspelled}, Then: notify}, "exactly one of"},
+		{"two conditions in one", config.Rule{When: config.Trigger{Event: "a"}, If: []config.Condition{{Mode: "away", Group: "desk", State: "on"}}, Then: notify}, "exactly one of"},
+		{"group without state", config.Rule{When: config.Trigger{Event: "a"}, If: []config.Condition{{Group: "desk"}}, Then: notify}, "needs a state"},
+		{"group with a bad state", config.Rule{When: config.Trigger{Event: "a"}, If: []config.Condition{{Group: "desk", State: "dim"}}, Then: notify}, "needs a state"},
+		{"between one time", config.Rule{When: config.Trigger{Event: "a"}, If: []config.Condition{{Between: []string{"22:00"}}}, Then: notify}, "start and an end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := New(&fakeEnv{})
+			tt.rule.Name = "r"
+			good := config.Rule{Name: "good", When: config.Trigger{Event: "a"}, Then: notify}
+			problems := e.Load([]config.Rule{tt.rule, good})
+			if len(problems) != 1 || !strings.Contains(problems[0].Error(), tt.want) {
+				t.Fatalf("got %v, want one containing %q", problems, tt.want)
+			}
+			// the rest still load
+			if rules := e.Rules(); len(rules) != 1 || rules[0].Name != "good" {
+				t.Errorf("loaded %v", rules)
+			}
+		})
+	}
+
+	problems := New(&fakeEnv{}).Load([]config.Rule{
+		{Name: "twice", When: config.Trigger{Event: "a"}, Then: notify},
+		{Name: "twice", When: config.Trigger{Event: "b"}, Then: notify},
+	})
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), "name used twice") {
+		t.Errorf("got %v, want the name used twice", problems)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	exit := 1
+	tests := []struct {
+		name  string
+		when  config.Trigger
+		event Event
+		want  bool
+	}{
+		{"at", config.Trigger{At: "07:30"}, Event{Kind: KindTime, Key: "07:30", At: monday(7, 30)}, true},
+		{"at another time", config.Trigger{At: "07:30"}, Event{Kind: KindTime, Key: "07:31", At: monday(7, 31)}, false},
+		{"at on the day", config.Trigger{At: "07:30", Days: []string{"mon"}}, Event{Kind: KindTime, Key: "07:30", At: monday(7, 30)}, true},
+		{"at on another day", config.Trigger{At: "07:30", Days: []string{"tue"}}, Event{Kind: KindTime, Key: "07:30", At: monday(7, 30)}, false},
+		{"device", config.Trigger{Device: "Desk"}, Event{Kind: KindDevice, Key: "desk", Value: "on"}, true},
+		{"any device", config.Trigger{Device: "*", State: "error"}, Event{Kind: KindDevice, Key: "lamp", Value: "error"}, true},
+		{"device in another state", config.Trigger{Device: "desk", State: "off"}, Event{Kind: KindDevice, Key: "desk", Value: "on"}, false},
+		{"event", config.Trigger{Event: "wake"}, Event{Kind: KindEvent, Key: "wake"}, true},
+		{"another kind", config.Trigger{Event: "wake"}, Event{Kind: KindFile, Key: "wake"}, false},
+		{"mqtt wildcard", config.Trigger{Topic: "home/+/on"}, Event{Kind: KindMQTT, Key: "home/desk/on", Value: "1"}, true},
+		{"mqtt payload", config.Trigger{Topic: "home/desk", Payload: "on"}, Event{Kind: KindMQTT, Key: "home/desk", Value: "off"}, false},
+		{"file", config.Trigger{File: "/tmp/x"}, Event{Kind: KindFile, Key: "/tmp/x"}, true},
+		{"command exit", config.Trigger{Command: "ping", Exit: &exit}, Event{Kind: KindCommand, Key: "ping", Value: "1"}, true},
+		{"command other exit", config.Trigger{Command: "ping", Exit: &exit}, Event{Kind: KindCommand, Key: "ping", Value: "0"}, false},
+		{"presence", config.Trigger{Presence: "idle"}, Event{Kind: KindPresence, Value: "idle"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &fakeEnv{now: monday(12, 0)}
+			e := load(t, env, config.Rule{Name: "r", When: tt.when, Then: notify})
+			e.Handle(tt.event)
+			if fired := len(env.done) > 0; fired != tt.want {
+				t.Errorf("fired %t, want %t", fired, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditions(t *testing.T) {
+	tests := []struct {
+		name string
+		cond config.Condition
+		now  time.Time
+		want bool
+	}{
+		{"inside a window", config.Condition{Between: []string{"09:00", "17:00"}}, monday(12, 0), true},
+		{"window's end isn't in it", config.Condition{Between: []string{"09:00", "17:00"}}, monday(17, 0), false},
+		{"window wraps midnight, late", config.Condition{Between: []string{"22:00", "06:00"}}, monday(23, 30), true},
+		{"window wraps midnight, early", config.Condition{Between: []string{"22:00", "06:00"}}, monday(5, 59), true},
+		{"window wraps midnight, daytime", config.Condition{Between: []string{"22:00", "06:00"}}, monday(12, 0), false},
+		{"not in a window", config.Condition{Between: []string{"09:00", "17:00"}, Not: true}, monday(12, 0), false},
+		{"group on", config.Condition{Group: "desk", State: "on"}, monday(12, 0), true},
+		{"group off", config.Condition{Group: "desk", State: "off"}, monday(12, 0), false},
+		{"unknown group", config.Condition{Group: "attic", State: "on"}, monday(12, 0), false},
+		{"mode", config.Condition{Mode: "home"}, monday(12, 0), true},
+		{"not mode", config.Condition{Mode: "home", Not: true}, monday(12, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &fakeEnv{now: tt.now, mode: "home", groups: map[string]string{"desk": "on"}}
+			e := load(t, env, config.Rule{Name: "r", When: config.Trigger{Event: "a"}, If: []config.Condition{tt.cond}, Then: notify})
+			e.Handle(Event{Kind: KindEvent, Key: "a"})
+			if fired := len(env.done) > 0; fired != tt.want {
+				t.Errorf("fired %t, want %t", fired, tt.want)
+			}
+		})
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	env := &fakeEnv{now: monday(12, 0)}
+	e := load(t, env, config.Rule{Name: "r", When: config.Trigger{Event: "a"}, Then: notify, Cooldown: "10m"})
+	ev := Event{Kind: KindEvent, Key: "a"}
+	e.Handle(ev)
+	env.now = env.now.Add(9 * time.Minute)
+	e.Handle(ev)
+	if len(env.done) != 1 {
+		t.Fatalf("ran %d times inside the cooldown", len(env.done))
+	}
+	if at, _ := e.LastFired("r"); !at.Equal(monday(12, 0)) {
+		t.Errorf("last fired %v", at)
+	}
+
+	// cooling down doesn't restart the cooldown
+	env.now = env.now.Add(time.Minute)
+	e.Handle(ev)
+	if len(env.done) != 2 {
+		t.Fatalf("ran %d times, want again once the cooldown's over", len(env.done))
+	}
+
+	// a reload keeps when it last ran
+	if problems := e.Load([]config.Rule{{Name: "r", When: config.Trigger{Event: "a"}, Then: notify, Cooldown: "10m"}}); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	e.Handle(ev)
+	if len(env.done) != 2 {
+		t.Errorf("ran again after a reload inside the cooldown")
+	}
+}
+
+func TestWhy(t *testing.T) {
+	env := &fakeEnv{now: monday(12, 0), mode: "home", groups: map[string]string{"desk": "off"}}
+	e := load(t, env,
+		config.Rule{
+			Name: "lights",
+			When: config.Trigger{Event: "a"},
+			If: []config.Condition{
+				{Between: []string{"09:00", "17:00"}},
+				{Mode: "home"},
+			},
+			Then:     []config.Action{{Color: "red"}, {Notify: "fail"}},
+			Cooldown: "1h",
+		},
+		config.Rule{
+			Name: "desk",
+			When: config.Trigger{Event: "b"},
+			If:   []config.Condition{{Group: "desk", State: "on"}},
+			Then: notify,
+		},
+	)
+	if _, ok := e.Why(""); ok {
+		t.Fatal("a trace before anything happened")
+	}
+
+	e.Handle(Event{Kind: KindEvent, Key: "a"})
+	got, ok := e.Why("")
+	want := Trace{
+		Rule:  "lights",
+		Event: Event{Kind: KindEvent, Key: "a", At: monday(12, 0)},
+		Fired: true,
+		Steps: []string{
+			"when event a",
+			"if between 09:00 and 17:00 (now 12:00): true",
+			"if mode is home (it's home): true",
+			"then color all red: ok",
+			`then notify "fail": failed`,
+		},
+	}
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	e.Handle(Event{Kind: KindEvent, Key: "b"})
+	if got, _ := e.Why(""); got.Rule != "desk" || got.Fired || got.Steps[len(got.Steps)-1] != "if group desk is on (it's off): false" {
+		t.Errorf("desk traced %+v", got)
+	}
+
+	env.now = env.now.Add(time.Minute)
+	e.Handle(Event{Kind: KindEvent, Key: "a"})
+	if got, _ := e.Why("lights"); got.Fired || got.Steps[len(got.Steps)-1] != "cooling down, last ran 1m0s ago, cooldown 1h0m0s" {
+		t.Errorf("lights traced %+v", got)
+	}
+}
@@ -0,0 +1,227 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/mqtt"
+	"github.com/pkg/errors"
+)
+
+const (
+	filePoll       = 2 * time.Second
+	defaultEvery   = time.Minute
+	mqttRetryAfter = 5 * time.Second
+	mqttMaxRetry   = 5 * time.Minute
+)
+
+// Watchers produce events for the triggers that need watching: times,
+// files, commands and MQTT topics. Events are passed to emit from the
+// watchers' goroutines.
+type Watchers struct {
+	ctx  context.Context
+	stop context.CancelFunc
+	emit func(Event)
+}
+
+// Watch starts whatever watchers the rules need.
+func Watch(rules []config.Rule, broker *config.MQTT, emit func(Event)) *Watchers {
+	ctx, stop := context.WithCancel(context.Background())
+	w := &Watchers{ctx: ctx, stop: stop, emit: emit}
+
+	clock := false
+	files := map[string]bool{}
+	commands := map[string]time.Duration{}
+	var topics []string
+	for _, r := range rules {
+		if r.Disabled {
+			continue
+		}
+		t := r.When
+		switch {
+		case t.At != "":
+			clock = true
+		case t.File != "":
+			files[t.File] = true
+		case t.Command != "":
+			every := defaultEvery
+			if d, err := time.ParseDuration(t.Every); err == nil && d > 0 {
+				every = d
+			}
+			if prev, ok := commands[t.Command]; !ok || every < prev {
+				commands[t.Command] = every
+			}
+		case t.Topic != "":
+			topics = append(topics, t.Topic)
+		}
+	}
+
+	if clock {
+		go w.watchClock()
+	}
+	if len(files) > 0 {
+		go w.watchFiles(files)
+	}
+	for command, every := range commands {
+		go w.watchCommand(command, every)
+	}
+	if len(topics) > 0 {
+		if broker == nil || broker.Broker == "" {
+			rulesLog.Warn("rules use mqtt topics but there's no mqtt broker in the config")
+		} else {
+			go w.watchMQTT(*broker, topics)
+		}
+	}
+	return w
+}
+
+// Stop ends every watcher. One might still emit an event it was already
+// sending.
+func (w *Watchers) Stop() {
+	w.stop()
+}
+
+func (w *Watchers) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-w.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// watchClock emits a time event at the start of every minute.
+func (w *Watchers) watchClock() {
+	for {
+		now := time.Now()
+		if !w.sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now)) {
+			return
+		}
+		now = time.Now()
+		w.emit(Event{Kind: KindTime, Key: clockOf(now).String(), At: now})
+	}
+}
+
+// watchFiles polls modification times, a file appearing counts as a change
+// but files that exist when watching starts don't.
+func (w *Watchers) watchFiles(files map[string]bool) {
+	modified := map[string]time.Time{}
+	for path := range files {
+		if info, err := os.Stat(path); err == nil {
+			modified[path] = info.ModTime()
+		}
+	}
+
+	for w.sleep(filePoll) {
+		for path := range files {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().Equal(modified[path]) {
+				continue
+			}
+			modified[path] = info.ModTime()
+			w.emit(Event{Kind: KindFile, Key: path})
+		}
+	}
+}
+
+// watchCommand runs a command through the shell every so often, emitting its
+// exit status whenever it changes. The first run always emits.
+func (w *Watchers) watchCommand(command string, every time.Duration) {
+	last := ""
+	for {
+		ctx, cancel := context.WithTimeout(w.ctx, every)
+		err := exec.CommandContext(ctx, "sh", "-c", command).Run()
+		cancel()
+		if w.ctx.Err() != nil {
+			return
+		}
+
+		status := "0"
+		var exitErr *exec.ExitError
+		switch {
+		case errors.As(err, &exitErr):
+			status = strconv.Itoa(exitErr.ExitCode())
+		case err != nil:
+			rulesLog.Warn("failed to run rule command", log.F("command", command), log.Err(err))
+			status = "-1"
+		}
+		if status != last {
+			last = status
+			w.emit(Event{Kind: KindCommand, Key: command, Value: status})
+		}
+
+		if !w.sleep(every) {
+			return
+		}
+	}
+}
+
+// watchMQTT stays subscribed to the topics, reconnecting with backoff.
+func (w *Watchers) watchMQTT(broker config.MQTT, topics []string) {
+	clientLog := rulesLog.With(log.F("broker", broker.Broker))
+	opts := mqtt.Options{
+		Broker:   broker.Broker,
+		ClientID: broker.ClientID,
+		Username: broker.Username,
+		Password: broker.Password,
+	}
+	// retrying won't fix the config
+	if err := opts.Validate(); err != nil {
+		clientLog.Error("not connecting to mqtt", log.Err(err))
+		return
+	}
+	retry := mqttRetryAfter
+	for {
+		client, err := mqtt.Dial(opts)
+		if err == nil {
+			if err = client.Subscribe(topics...); err != nil {
+				client.Close()
+			}
+		}
+		if err != nil {
+			clientLog.Warn("mqtt connection failed", log.F("retry", retry), log.Err(err))
+			if !w.sleep(retry) {
+				return
+			}
+			retry *= 2
+			if retry > mqttMaxRetry {
+				retry = mqttMaxRetry
+			}
+			continue
+		}
+
+		clientLog.Info("subscribed", log.F("topics", topics))
+		retry = mqttRetryAfter
+		if !w.forward(client) {
+			return
+		}
+		clientLog.Warn("mqtt connection lost", log.Err(client.Err()))
+	}
+}
+
+// forward passes messages on until the connection drops, returning false if
+// the watchers were stopped instead.
+func (w *Watchers) forward(client *mqtt.Client) bool {
+	defer client.Close()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return false
+		case msg, ok := <-client.Messages():
+			if !ok {
+				return true
+			}
+			w.emit(Event{Kind: KindMQTT, Key: msg.Topic, Value: string(msg.Payload)})
+		}
+	}
+}
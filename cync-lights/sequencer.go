@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/fseq"
+	"github.com/kungfukennyg/home-office/cync-lights/input"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/show"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+var showLog = log.For("mode.show")
+
+const (
+	ModeShowID = "show"
+	// showFrame is how often a playing show samples its timeline
+	showFrame = 100 * time.Millisecond
+	// showMaxRate is roughly how many device updates a second the lights
+	// keep up with before commands start queueing
+	showMaxRate  = 20
+	showSeekStep = 5 * time.Second
+	// showLagWarning limits how often falling behind is reported
+	showLagWarning = 5 * time.Second
+	showLaneWidth  = 48
+	// showListCues is how many cues show check lists before summarising
+	showListCues = 20
+)
+
+// showPath puts bare names in the shows dir next to the config.
+func (c *controller) showPath(name string) string {
+	return c.configFile("shows", name, ".json")
+}
+
+// resolveShowTarget is the show package's view of resolveTarget.
+func (c *controller) resolveShowTarget(target string) ([]string, error) {
+	devices, err := c.resolveTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(devices))
+	for i, d := range devices {
+		names[i] = d.Name()
+	}
+	return names, nil
+}
+
+func (c *controller) loadShow(name string) (*show.Timeline, error) {
+	s, err := show.Load(c.showPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return show.Compile(s, c.resolveShowTarget)
+}
+
+// parseShowPosition reads a seek position, a duration or a beat number.
+func parseShowPosition(t *show.Timeline, s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	beat, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.Errorf("%q isn't a duration like 1m30s or a beat number", s)
+	}
+	if t.Show.BPM == 0 {
+		return 0, errors.Errorf("%s has no bpm to count beats with", t.Show.Name)
+	}
+	return t.Show.Time(show.Cue{Beat: &beat}), nil
+}
+
+func runShow(cont *controller, args parsedArgs) error {
+	action, name := args.str("action"), args.str("file")
+	switch action {
+	case "check":
+		return checkShow(cont, name)
+	case "import":
+		return importShow(cont, name, args.str("output"))
+	}
+
+	t, err := cont.loadShow(name)
+	if err != nil {
+		return err
+	}
+	var from time.Duration
+	if args.has("from") {
+		if from, err = parseShowPosition(t, args.str("from")); err != nil {
+			return err
+		}
+	}
+
+	ms := cont.modes[ModeShowID].(*ModeShow)
+	ms.load(name, t, from, action == "preview")
+	return cont.SwitchMode(ModeShowID)
+}
+
+// checkShow validates a show and describes it without touching any lights.
+func checkShow(cont *controller, name string) error {
+	s, err := show.Load(cont.showPath(name))
+	if err != nil {
+		return err
+	}
+	if problems := s.Validate(cont.resolveShowTarget); len(problems) > 0 {
+		for _, p := range problems {
+			cont.view.Eventf(ui.ErrColor, "%v", p)
+		}
+		return errors.Errorf("%s has %d problems", name, len(problems))
+	}
+
+	t, err := show.Compile(s, cont.resolveShowTarget)
+	if err != nil {
+		return err
+	}
+	tempo := ""
+	if s.BPM > 0 {
+		tempo = fmt.Sprintf(", %g bpm", s.BPM)
+	}
+	loop := ""
+	if s.Loop {
+		loop = ", loops"
+	}
+	cont.view.Eventf(ui.HeaderColor, "%s: %d cues over %v%s%s", showTitle(t, name), len(s.Cues), t.Length, tempo, loop)
+	cues := t.Cues()
+	for i, cue := range cues {
+		if i == showListCues {
+			cont.view.Eventf(ui.TextColor, "... %d more cues", len(cues)-i)
+			break
+		}
+		cont.view.Eventf(ui.TextColor, "%9v  %s", cue.At, describeCue(cue))
+	}
+	for _, d := range t.Devices {
+		cont.view.Eventf(ui.TextColor, "%-16s|%s|", d, t.Lane(d, showLaneWidth))
+	}
+
+	peak, at := t.PeakRate(showFrame)
+	if peak > showMaxRate {
+		cont.view.Eventf(ui.ErrColor, "peaks at %d updates/s around %v, the lights manage about %d/s so it will lag there",
+			peak, at.Round(time.Second), showMaxRate)
+		return nil
+	}
+	cont.view.Eventf(ui.TextColor, "ok, peaks at %d updates/s", peak)
+	return nil
+}
+
+// importShow converts the sequence a mapping file points at into a cue file
+// named after the mapping, or out if given.
+func importShow(cont *controller, mapping, out string) error {
+	m, err := show.LoadMapping(cont.showPath(mapping))
+	if err != nil {
+		return err
+	}
+	seq, err := fseq.Read(m.SequencePath())
+	if err != nil {
+		return err
+	}
+	s, err := show.Import(m, seq, cont.resolveShowTarget, showMaxRate)
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		out = strings.TrimSuffix(filepath.Base(mapping), filepath.Ext(mapping)) + "-show"
+	}
+	path := cont.showPath(out)
+	if err := s.Save(path); err != nil {
+		return err
+	}
+	cont.view.Eventf(ui.TextColor, "imported %s (fseq %s, %d channels, %d frames every %v) as %d cues in %s",
+		filepath.Base(m.SequencePath()), seq.Version(), seq.Span(), seq.Frames(), seq.Step, len(s.Cues), path)
+	showLog.Info("imported sequence", log.F("sequence", m.SequencePath()), log.F("cues", len(s.Cues)), log.F("show", path))
+	return checkShow(cont, path)
+}
+
+func describeCue(cue show.CueInfo) string {
+	var parts []string
+	if cue.Cue.Power != "" {
+		parts = append(parts, cue.Cue.Power)
+	}
+	if cue.Cue.Color != "" {
+		parts = append(parts, cue.Cue.Color)
+	}
+	if cue.Cue.Lum != nil {
+		parts = append(parts, fmt.Sprintf("%d%%", *cue.Cue.Lum))
+	}
+	if cue.Cue.Fade > 0 {
+		parts = append(parts, fmt.Sprintf("fade %v", time.Duration(cue.Cue.Fade)))
+	}
+	return fmt.Sprintf("%s -> %s", strings.Join(parts, " "), strings.Join(cue.Devices, ", "))
+}
+
+func showTitle(t *show.Timeline, file string) string {
+	if t.Show.Name != "" {
+		return t.Show.Name
+	}
+	return file
+}
+
+// ModeShow plays a cue file. Every frame it samples the timeline for each
+// device and sends only what changed, so fades cost a command per step and
+// held cues cost nothing. A preview drives the device table without sending
+// anything to the lights.
+type ModeShow struct {
+	bindings bindings
+	name     string
+	timeline *show.Timeline
+	preview  bool
+	// start is when position 0 was, moved on seek and resume
+	start  time.Time
+	pos    time.Duration
+	paused bool
+	// sent is the last state applied to each device
+	sent map[string]show.State
+
+	late     int
+	lastWarn time.Time
+}
+
+func (ms *ModeShow) load(name string, t *show.Timeline, from time.Duration, preview bool) {
+	ms.name = name
+	ms.timeline = t
+	ms.preview = preview
+	ms.pos = from
+	ms.paused = false
+}
+
+func (ms *ModeShow) onSwitch(cont *controller) error {
+	if ms.timeline == nil {
+		return errors.New("nothing to play, use show play <file>")
+	}
+	ms.sent = map[string]show.State{}
+	ms.late = 0
+	ms.lastWarn = time.Time{}
+	ms.start = time.Now().Add(-ms.pos)
+
+	verb := "playing"
+	if ms.preview {
+		verb = "previewing"
+	}
+	cont.view.Eventf(ui.TextColor, "%s %s (%v)", verb, showTitle(ms.timeline, ms.name), ms.timeline.Length)
+	if peak, at := ms.timeline.PeakRate(showFrame); peak > showMaxRate && !ms.preview {
+		cont.view.Eventf(ui.ErrColor, "%s peaks at %d updates/s around %v, expect lag", ms.name, peak, at.Round(time.Second))
+	}
+	return nil
+}
+
+func (ms *ModeShow) run(cont *controller) (time.Duration, error) {
+	if ms.paused {
+		ms.status(cont)
+		return pausedSleep, nil
+	}
+
+	pos, done := ms.timeline.Wrap(time.Since(ms.start))
+	if ms.timeline.Show.Loop && pos < ms.pos {
+		// looped, keep start close so the position stays small
+		ms.start = time.Now().Add(-pos)
+	}
+	ms.pos = pos
+
+	began := time.Now()
+	for _, name := range ms.timeline.Devices {
+		if state, ok := ms.timeline.At(name, pos); ok {
+			ms.apply(cont, name, state)
+		}
+	}
+	ms.checkLag(cont, time.Since(began))
+	ms.status(cont)
+
+	if done {
+		cont.view.Eventf(ui.TextColor, "finished %s", showTitle(ms.timeline, ms.name))
+		ms.timeline = nil
+		return time.Millisecond, cont.SwitchMode(ModeCommandID)
+	}
+
+	wait := showFrame - time.Since(began)
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait, nil
+}
+
+// apply sends whatever differs from the last state sent to a device.
+func (ms *ModeShow) apply(cont *controller, name string, state show.State) {
+	prev, seen := ms.sent[name]
+	if show.Changes(prev, state, seen) == 0 {
+		return
+	}
+	ms.sent[name] = state
+
+	d, ok := cont.findDevice(name)
+	if !ok {
+		showLog.Warn("show names a device that went away", log.F("device", name))
+		return
+	}
+	color := colors.New("show", state.RGB[0], state.RGB[1], state.RGB[2])
+
+	if ms.preview {
+		cont.view.UpdateDevice(d.DeviceID(), func(row *ui.DeviceRow) {
+			row.Power = state.Power
+			if state.HasColor {
+				row.Color = color
+			}
+			if state.HasLum {
+				row.Lum = int(state.Lum)
+			}
+		})
+		return
+	}
+
+	if !seen || prev.Power != state.Power {
+		cont.SetStatus(d, state.Power)
+	}
+	if !state.Power {
+		return
+	}
+	if state.HasColor && (!seen || !prev.HasColor || prev.RGB != state.RGB) {
+		cont.SetRGBAsync(d, color)
+	}
+	if state.HasLum && (!seen || !prev.HasLum || prev.Lum != state.Lum) {
+		cont.SetLumAsync(d, state.Lum)
+	}
+}
+
+// checkLag reports frames that took longer to send than the frame interval,
+// which means the cues are denser than the lights can follow.
+func (ms *ModeShow) checkLag(cont *controller, took time.Duration) {
+	if took <= showFrame {
+		return
+	}
+	ms.late++
+	cont.metrics.lateFrames.Inc(ModeShowID)
+	showLog.Debug("frame overran", log.F("took", took), log.F("position", ms.pos))
+	if time.Since(ms.lastWarn) < showLagWarning {
+		return
+	}
+	ms.lastWarn = time.Now()
+	cont.view.Eventf(ui.ErrColor, "falling behind at %v: a frame took %v, %d late so far", ms.pos.Round(time.Second), took.Round(time.Millisecond), ms.late)
+	showLog.Warn("lights can't keep up with the show", log.F("show", ms.name), log.F("position", ms.pos), log.F("took", took), log.F("late", ms.late))
+}
+
+func (ms *ModeShow) status(cont *controller) {
+	state := "playing"
+	switch {
+	case ms.paused:
+		state = "paused"
+	case ms.preview:
+		state = "preview"
+	}
+	beat := ""
+	if bpm := ms.timeline.Show.BPM; bpm > 0 {
+		beat = fmt.Sprintf(" | beat %.1f", ms.pos.Minutes()*bpm)
+	}
+	late := ""
+	if ms.late > 0 {
+		late = fmt.Sprintf(" | %d late frames", ms.late)
+	}
+	cont.view.SetModeLines(fmt.Sprintf("[Show] %s", showTitle(ms.timeline, ms.name)),
+		fmt.Sprintf("%s | %v / %v%s%s | %s for keys", state, ms.pos.Round(100*time.Millisecond), ms.timeline.Length, beat, late, ms.bindings.keyFor(actionHelp)))
+}
+
+func (ms *ModeShow) seek(to time.Duration) {
+	if to < 0 {
+		to = 0
+	}
+	if to > ms.timeline.Length {
+		to = ms.timeline.Length
+	}
+	ms.pos = to
+	ms.start = time.Now().Add(-to)
+}
+
+func (ms *ModeShow) wantsKey(k input.Key) bool {
+	switch ms.bindings[keyName(k)] {
+	case actionPause, actionQuit, actionHelp, actionForward, actionBack:
+		return true
+	}
+	return false
+}
+
+func (ms *ModeShow) handleKey(cont *controller, k input.Key) bool {
+	switch ms.bindings[keyName(k)] {
+	case actionPause:
+		ms.paused = !ms.paused
+		if !ms.paused {
+			ms.start = time.Now().Add(-ms.pos)
+		}
+		return true
+	case actionForward:
+		ms.seek(ms.pos + showSeekStep)
+		return true
+	case actionBack:
+		ms.seek(ms.pos - showSeekStep)
+		return true
+	case actionQuit:
+		cont.SwitchMode(ModeCommandID)
+		return true
+	case actionHelp:
+		for _, line := range ms.bindings.describe(ms.wantsKey) {
+			cont.view.Eventf(ui.TextColor, "%s", line)
+		}
+	}
+	return false
+}
+
+func (ms *ModeShow) onExit(cont *controller) {
+	if ms.timeline != nil {
+		cont.view.Eventf(ui.TextColor, "stopped %s at %v", showTitle(ms.timeline, ms.name), ms.pos.Round(time.Second))
+		ms.timeline = nil
+	}
+}
+
+func (ms *ModeShow) isIndefinite() bool {
+	return true
+}
+
+func (ms *ModeShow) getId() string {
+	return ModeShowID
+}
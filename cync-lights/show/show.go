@@ -0,0 +1,170 @@
+package show
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/pkg/errors"
+)
+
+// Duration is a time.Duration that reads and writes as "1.5s", "250ms" etc.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.Wrap(err, "durations are strings like \"1.5s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Cue sets some devices to a state at a point in the show. It's placed
+// either at an absolute time or on a beat of the show's tempo grid.
+type Cue struct {
+	At      *Duration `json:"at,omitempty"`
+	Beat    *float64  `json:"beat,omitempty"`
+	Targets []string  `json:"targets"`
+	// Power is "on" or "off", a color or brightness implies on
+	Power string `json:"power,omitempty"`
+	Color string `json:"color,omitempty"`
+	Lum   *int   `json:"lum,omitempty"`
+	// Fade is how long to take getting from the previous state to this one
+	Fade Duration `json:"fade,omitempty"`
+}
+
+// Show is a timeline of cues, as stored in a cue file.
+type Show struct {
+	Name string  `json:"name"`
+	BPM  float64 `json:"bpm,omitempty"`
+	Loop bool    `json:"loop,omitempty"`
+	// Length overrides where the show ends, by default the end of the last
+	// cue's fade
+	Length Duration `json:"length,omitempty"`
+	Cues   []Cue    `json:"cues"`
+}
+
+func Load(path string) (*Show, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read show %s", path)
+	}
+
+	var s Show
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse show %s", path)
+	}
+	return &s, nil
+}
+
+// Time is where a cue lands, resolving beats against the tempo.
+func (s *Show) Time(c Cue) time.Duration {
+	if c.At != nil {
+		return time.Duration(*c.At)
+	}
+	if c.Beat != nil && s.BPM > 0 {
+		return time.Duration(*c.Beat * float64(time.Minute) / s.BPM)
+	}
+	return 0
+}
+
+// Resolver expands a cue target into device names.
+type Resolver func(target string) ([]string, error)
+
+// Validate checks everything that can be checked without playing the show.
+// It returns every problem found rather than stopping at the first.
+func (s *Show) Validate(resolve Resolver) []error {
+	var problems []error
+	add := func(i int, format string, a ...any) {
+		problems = append(problems, fmt.Errorf("cue %d: %s", i+1, fmt.Sprintf(format, a...)))
+	}
+
+	if len(s.Cues) == 0 {
+		problems = append(problems, errors.New("show has no cues"))
+	}
+	if s.BPM < 0 {
+		problems = append(problems, errors.New("bpm can't be negative"))
+	}
+	if s.Loop && s.end() <= 0 {
+		problems = append(problems, errors.New("a looping show needs a length or cues after 0s"))
+	}
+
+	for i, c := range s.Cues {
+		switch {
+		case c.At == nil && c.Beat == nil:
+			add(i, "needs at or beat")
+		case c.At != nil && c.Beat != nil:
+			add(i, "has both at and beat")
+		case c.Beat != nil && s.BPM == 0:
+			add(i, "uses beat but the show has no bpm")
+		case c.At != nil && *c.At < 0, c.Beat != nil && *c.Beat < 0:
+			add(i, "is before the start of the show")
+		}
+
+		if len(c.Targets) == 0 {
+			add(i, "has no targets")
+		}
+		for _, target := range c.Targets {
+			if _, err := resolve(target); err != nil {
+				add(i, "%v", err)
+			}
+		}
+
+		if c.Power != "" && c.Power != "on" && c.Power != "off" {
+			add(i, "power must be on or off, not %q", c.Power)
+		}
+		if c.Color != "" {
+			if _, err := colors.Parse(c.Color); err != nil {
+				add(i, "%v", err)
+			}
+		}
+		if c.Lum != nil {
+			if _, err := colors.NewBrightness(*c.Lum); err != nil {
+				add(i, "%v", err)
+			}
+		}
+		if c.Fade < 0 {
+			add(i, "fade can't be negative")
+		}
+		if c.Power == "" && c.Color == "" && c.Lum == nil {
+			add(i, "doesn't change anything")
+		}
+	}
+
+	return problems
+}
+
+// end is the explicit length, or when the last fade finishes.
+func (s *Show) end() time.Duration {
+	if s.Length > 0 {
+		return time.Duration(s.Length)
+	}
+	var end time.Duration
+	for _, c := range s.Cues {
+		if t := s.Time(c) + time.Duration(c.Fade); t > end {
+			end = t
+		}
+	}
+	return end
+}
+
+// sorted returns the cues in play order, keeping file order for ties.
+func (s *Show) sorted() []Cue {
+	cues := append([]Cue(nil), s.Cues...)
+	sort.SliceStable(cues, func(i, j int) bool {
+		return s.Time(cues[i]) < s.Time(cues[j])
+	})
+	return cues
+}
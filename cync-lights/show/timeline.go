@@ -0,0 +1,243 @@
+package show
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/pkg/errors"
+)
+
+// State is what a device should be doing at a point in the show. Color and
+// Lum are only meaningful once a cue has set them.
+type State struct {
+	Power    bool
+	RGB      [3]uint8
+	HasColor bool
+	Lum      colors.Brightness
+	HasLum   bool
+}
+
+// keyframe moves a device from one state to another, starting at start and
+// taking fade to get there.
+type keyframe struct {
+	start time.Duration
+	fade  time.Duration
+	from  State
+	to    State
+	cue   int
+}
+
+// Timeline is a validated show with its targets resolved to devices.
+type Timeline struct {
+	Show    *Show
+	Length  time.Duration
+	Devices []string
+	frames  map[string][]keyframe
+}
+
+// Compile validates the show and resolves it against the current devices.
+func Compile(s *Show, resolve Resolver) (*Timeline, error) {
+	if problems := s.Validate(resolve); len(problems) > 0 {
+		msgs := make([]string, len(problems))
+		for i, p := range problems {
+			msgs[i] = p.Error()
+		}
+		return nil, errors.Errorf("invalid show: %s", strings.Join(msgs, "; "))
+	}
+
+	t := &Timeline{Show: s, Length: s.end(), frames: map[string][]keyframe{}}
+	current := map[string]State{}
+	for i, c := range s.sorted() {
+		var rgb [3]uint8
+		if c.Color != "" {
+			color, _ := colors.Parse(c.Color)
+			rgb = color.GetRGB()
+		}
+
+		for _, target := range c.Targets {
+			names, _ := resolve(target)
+			for _, name := range names {
+				from, seen := current[name]
+				to := from
+				to.Power = c.Power != "off"
+				if c.Color != "" {
+					to.RGB, to.HasColor = rgb, true
+				}
+				if c.Lum != nil {
+					to.Lum, to.HasLum = colors.Brightness(*c.Lum), true
+				}
+				// a device's first cue has nothing to fade from
+				fade := time.Duration(c.Fade)
+				if !seen {
+					from, fade = to, 0
+					t.Devices = append(t.Devices, name)
+				}
+
+				t.frames[name] = append(t.frames[name], keyframe{start: s.Time(c), fade: fade, from: from, to: to, cue: i})
+				current[name] = to
+			}
+		}
+	}
+	sort.Strings(t.Devices)
+	return t, nil
+}
+
+// At returns the state of a device at a point in the show, ok is false
+// before its first cue.
+func (t *Timeline) At(device string, at time.Duration) (state State, ok bool) {
+	frames := t.frames[device]
+	i := sort.Search(len(frames), func(i int) bool {
+		return frames[i].start > at
+	}) - 1
+	if i < 0 {
+		return State{}, false
+	}
+
+	kf := frames[i]
+	if kf.fade == 0 || at >= kf.start+kf.fade {
+		return kf.to, true
+	}
+	return blend(kf.from, kf.to, float64(at-kf.start)/float64(kf.fade)), true
+}
+
+// Fading reports whether a device is part way through a fade.
+func (t *Timeline) Fading(device string, at time.Duration) bool {
+	for _, kf := range t.frames[device] {
+		if kf.fade > 0 && at >= kf.start && at < kf.start+kf.fade {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap maps a position onto the show, looping it if the show loops.
+func (t *Timeline) Wrap(at time.Duration) (time.Duration, bool) {
+	if at < 0 {
+		at = 0
+	}
+	if at < t.Length {
+		return at, false
+	}
+	if !t.Show.Loop || t.Length <= 0 {
+		return t.Length, true
+	}
+	return at % t.Length, false
+}
+
+// blend goes part way from one state to another. Turning on happens at the
+// start of a fade and turning off at the end, so a fade out is visible.
+func blend(from, to State, p float64) State {
+	s := to
+	s.Power = from.Power || to.Power
+	if from.HasColor && to.HasColor {
+		for i := range s.RGB {
+			s.RGB[i] = uint8(float64(from.RGB[i]) + (float64(to.RGB[i])-float64(from.RGB[i]))*p + 0.5)
+		}
+	}
+	if from.HasLum && to.HasLum {
+		s.Lum = from.Lum + colors.Brightness(float64(to.Lum-from.Lum)*p+0.5)
+	}
+	return s
+}
+
+// PeakRate estimates the busiest second of the show in device updates,
+// sampling every step as a player running at that frame interval would.
+func (t *Timeline) PeakRate(step time.Duration) (peak int, at time.Duration) {
+	if step <= 0 {
+		step = 100 * time.Millisecond
+	}
+
+	last := map[string]State{}
+	var window []int
+	perSecond := int(time.Second / step)
+	if perSecond < 1 {
+		perSecond = 1
+	}
+
+	sum := 0
+	for pos := time.Duration(0); pos <= t.Length; pos += step {
+		updates := 0
+		for _, d := range t.Devices {
+			s, ok := t.At(d, pos)
+			if !ok {
+				continue
+			}
+			prev, seen := last[d]
+			updates += Changes(prev, s, seen)
+			last[d] = s
+		}
+
+		window = append(window, updates)
+		sum += updates
+		if len(window) > perSecond {
+			sum -= window[0]
+			window = window[1:]
+		}
+		if sum > peak {
+			peak, at = sum, pos
+		}
+	}
+	return peak, at
+}
+
+// Changes counts the backend calls needed to get from prev to next.
+func Changes(prev, next State, seen bool) int {
+	if !seen {
+		prev = State{Power: !next.Power}
+	}
+	n := 0
+	if prev.Power != next.Power {
+		n++
+	}
+	if next.Power && next.HasColor && (!prev.HasColor || prev.RGB != next.RGB) {
+		n++
+	}
+	if next.Power && next.HasLum && (!prev.HasLum || prev.Lum != next.Lum) {
+		n++
+	}
+	return n
+}
+
+// CueInfo describes a cue in play order, for previews.
+type CueInfo struct {
+	At      time.Duration
+	Cue     Cue
+	Devices []string
+}
+
+func (t *Timeline) Cues() []CueInfo {
+	cues := t.Show.sorted()
+	infos := make([]CueInfo, len(cues))
+	for i, c := range cues {
+		infos[i] = CueInfo{At: t.Show.Time(c), Cue: c}
+	}
+	for _, d := range t.Devices {
+		for _, kf := range t.frames[d] {
+			infos[kf.cue].Devices = append(infos[kf.cue].Devices, d)
+		}
+	}
+	return infos
+}
+
+// Lane draws a device's part in the show as width characters: '#' on, '~'
+// fading, '.' off and ' ' before its first cue.
+func (t *Timeline) Lane(device string, width int) string {
+	lane := make([]rune, width)
+	for i := range lane {
+		at := time.Duration(float64(t.Length) * float64(i) / float64(width))
+		s, ok := t.At(device, at)
+		switch {
+		case !ok:
+			lane[i] = ' '
+		case t.Fading(device, at):
+			lane[i] = '~'
+		case s.Power:
+			lane[i] = '#'
+		default:
+			lane[i] = '.'
+		}
+	}
+	return string(lane)
+}
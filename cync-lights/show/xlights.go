@@ -0,0 +1,238 @@
+package show
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/fseq"
+	"github.com/pkg/errors"
+)
+
+// Mapping says how to turn a sequence rendered for pixels, as exported from
+// xLights, into a show for a handful of bulbs. Every target, a device or a
+// group, follows one RGB source: three channels starting at Channel, a single
+// pixel of a model, or a whole model averaged together.
+type Mapping struct {
+	Name string `json:"name,omitempty"`
+	// Sequence is the FSEQ file, relative to the mapping file
+	Sequence string `json:"sequence"`
+	// FPS overrides the frame rate the sequence is resampled to
+	FPS     float64           `json:"fps,omitempty"`
+	Loop    bool              `json:"loop,omitempty"`
+	Models  map[string]Model  `json:"models,omitempty"`
+	Targets map[string]Source `json:"targets"`
+
+	dir string
+}
+
+// Model is a run of RGB pixels, as laid out in xLights. Start is the 1-based
+// channel of its first pixel, the way xLights numbers them.
+type Model struct {
+	Start  int `json:"start"`
+	Pixels int `json:"pixels"`
+}
+
+type Source struct {
+	// Channel is the 1-based channel of the red value
+	Channel int    `json:"channel,omitempty"`
+	Model   string `json:"model,omitempty"`
+	// Pixel picks one 0-based pixel of Model, otherwise the model is averaged
+	Pixel *int `json:"pixel,omitempty"`
+}
+
+func LoadMapping(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read mapping %s", path)
+	}
+	var m Mapping
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse mapping %s", path)
+	}
+	m.dir = filepath.Dir(path)
+	return &m, nil
+}
+
+// SequencePath is where the mapped sequence is.
+func (m *Mapping) SequencePath() string {
+	if filepath.IsAbs(m.Sequence) {
+		return m.Sequence
+	}
+	return filepath.Join(m.dir, m.Sequence)
+}
+
+// channels lists the 0-based channels of each pixel a source averages.
+func (m *Mapping) channels(src Source, span int) ([]int, error) {
+	var pixels []int
+	switch {
+	case src.Model != "" && src.Channel != 0:
+		return nil, errors.New("has both a channel and a model")
+	case src.Channel != 0:
+		pixels = []int{src.Channel - 1}
+	case src.Model != "":
+		model, ok := m.Models[src.Model]
+		if !ok {
+			return nil, errors.Errorf("unknown model %q", src.Model)
+		}
+		if model.Start < 1 || model.Pixels < 1 {
+			return nil, errors.Errorf("model %s needs a start channel and pixel count", src.Model)
+		}
+		if src.Pixel != nil {
+			if *src.Pixel < 0 || *src.Pixel >= model.Pixels {
+				return nil, errors.Errorf("model %s has no pixel %d", src.Model, *src.Pixel)
+			}
+			pixels = []int{model.Start - 1 + *src.Pixel*3}
+			break
+		}
+		for p := 0; p < model.Pixels; p++ {
+			pixels = append(pixels, model.Start-1+p*3)
+		}
+	default:
+		return nil, errors.New("needs a channel or a model")
+	}
+
+	for _, ch := range pixels {
+		if ch < 0 || ch+3 > span {
+			return nil, errors.Errorf("channel %d is outside the sequence's %d channels", ch+1, span)
+		}
+	}
+	return pixels, nil
+}
+
+// Import resamples a sequence into a show. Each output frame averages the
+// sequence frames it covers, and a target only gets a cue when its color or
+// brightness changes. With no FPS in the mapping the rate is picked so every
+// target changing every frame stays under maxRate updates a second.
+func Import(m *Mapping, seq *fseq.Sequence, resolve Resolver, maxRate int) (*Show, error) {
+	if len(m.Targets) == 0 {
+		return nil, errors.New("mapping has no targets")
+	}
+
+	targets := make([]string, 0, len(m.Targets))
+	for target := range m.Targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	sources := map[string][]int{}
+	devices := 0
+	var problems []string
+	for _, target := range targets {
+		names, err := resolve(target)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		devices += len(names)
+		pixels, err := m.channels(m.Targets[target], seq.Span())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", target, err))
+			continue
+		}
+		sources[target] = pixels
+	}
+	if len(problems) > 0 {
+		return nil, errors.Errorf("invalid mapping: %s", strings.Join(problems, "; "))
+	}
+
+	step := m.frameStep(seq, devices, maxRate)
+	perFrame := int(step / seq.Step)
+	if perFrame < 1 {
+		perFrame = 1
+	}
+
+	s := &Show{Name: m.Name, Loop: m.Loop, Length: Duration(seq.Duration())}
+	last := map[string]Cue{}
+	for first := 0; first < seq.Frames(); first += perFrame {
+		end := first + perFrame
+		if end > seq.Frames() {
+			end = seq.Frames()
+		}
+		at := Duration(time.Duration(first) * seq.Step)
+
+		for _, target := range targets {
+			cue := sampleCue(seq, sources[target], first, end)
+			if prev, ok := last[target]; ok && sameCue(prev, cue) {
+				continue
+			}
+			last[target] = cue
+			cue.At = &at
+			cue.Targets = []string{target}
+			s.Cues = append(s.Cues, cue)
+		}
+	}
+	return s, nil
+}
+
+// frameStep picks the output frame interval, a whole number of sequence steps.
+func (m *Mapping) frameStep(seq *fseq.Sequence, devices, maxRate int) time.Duration {
+	fps := m.FPS
+	if fps <= 0 {
+		// a color and a brightness change per device per frame
+		fps = float64(maxRate) / float64(2*devices)
+	}
+	step := time.Duration(float64(time.Second) / fps)
+	if step < seq.Step {
+		return seq.Step
+	}
+	return step.Round(seq.Step)
+}
+
+// sampleCue averages pixels over frames [first, end) into a cue. Bulbs take
+// a color and a brightness separately, so the color is scaled up to full and
+// the brightest channel becomes the brightness.
+func sampleCue(seq *fseq.Sequence, pixels []int, first, end int) Cue {
+	var sum [3]float64
+	for f := first; f < end; f++ {
+		for _, ch := range pixels {
+			for i := range sum {
+				sum[i] += float64(seq.Value(f, ch+i))
+			}
+		}
+	}
+	n := float64((end - first) * len(pixels))
+	peak := 0.0
+	for i := range sum {
+		sum[i] /= n
+		peak = math.Max(peak, sum[i])
+	}
+	if peak < 1 {
+		return Cue{Power: "off"}
+	}
+
+	var rgb [3]uint8
+	for i := range sum {
+		rgb[i] = uint8(math.Round(sum[i] * 255 / peak))
+	}
+	lum := int(math.Ceil(peak * float64(colors.Full) / 255))
+	return Cue{Color: fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2]), Lum: &lum}
+}
+
+func sameCue(a, b Cue) bool {
+	if a.Power != b.Power || a.Color != b.Color {
+		return false
+	}
+	if a.Lum == nil || b.Lum == nil {
+		return a.Lum == b.Lum
+	}
+	return *a.Lum == *b.Lum
+}
+
+// Save writes a show as a cue file.
+func (s *Show) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to create shows dir")
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to encode show")
+	}
+	return errors.Wrapf(os.WriteFile(path, append(data, '\n'), 0o644), "failed to write show %s", path)
+}
@@ -0,0 +1,74 @@
+// Package sun works out sunrise, solar noon and sunset locally, with the
+// sunrise equation NOAA's calculator is based on. It's accurate to a minute
+// or two, which is plenty for lighting.
+package sun
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// unixEpoch is the Julian date of 1970-01-01 00:00 UTC
+	unixEpoch = 2440587.5
+	// j2000 is the Julian date of 2000-01-01 12:00 UTC
+	j2000 = 2451545.0
+	// horizon allows for refraction and the sun's radius
+	horizon = -0.833
+	tilt    = 23.4397
+)
+
+// Day is when the sun rises, peaks and sets.
+type Day struct {
+	Sunrise time.Time
+	Noon    time.Time
+	Sunset  time.Time
+	// Polar is true when the sun doesn't rise or doesn't set that day,
+	// Sunrise and Sunset are then the same as Noon
+	Polar bool
+}
+
+// On computes the sun's day for the date of day in its location, at a
+// latitude and longitude in degrees, east and north positive. Times are in
+// day's location.
+func On(day time.Time, lat, lon float64) Day {
+	y, m, d := day.Date()
+	n := math.Ceil(julian(time.Date(y, m, d, 0, 0, 0, 0, time.UTC)) - j2000 + 0.0008)
+
+	meanNoon := n - lon/360
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sin(anomaly) + 0.0200*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := j2000 + meanNoon + 0.0053*sin(anomaly) - 0.0069*sin(2*ecliptic)
+
+	declination := math.Asin(sin(ecliptic) * sin(tilt))
+	cosHour := (sin(horizon) - sin(lat)*math.Sin(declination)) / (cos(lat) * math.Cos(declination))
+
+	loc := day.Location()
+	out := Day{Noon: fromJulian(transit).In(loc)}
+	if cosHour < -1 || cosHour > 1 {
+		out.Sunrise, out.Sunset, out.Polar = out.Noon, out.Noon, true
+		return out
+	}
+	hour := math.Acos(cosHour) * 180 / math.Pi / 360
+	out.Sunrise = fromJulian(transit - hour).In(loc)
+	out.Sunset = fromJulian(transit + hour).In(loc)
+	return out
+}
+
+func julian(t time.Time) float64 {
+	return float64(t.Unix())/86400 + unixEpoch
+}
+
+func fromJulian(j float64) time.Time {
+	seconds := (j - unixEpoch) * 86400
+	return time.Unix(int64(math.Round(seconds)), 0)
+}
+
+func sin(deg float64) float64 {
+	return math.Sin(deg * math.Pi / 180)
+}
+
+func cos(deg float64) float64 {
+	return math.Cos(deg * math.Pi / 180)
+}
@@ -0,0 +1,226 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The OTLP JSON encoding of ExportTraceServiceRequest, only the parts used.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string     `json:"traceId"`
+		SpanID       string     `json:"spanId"`
+		ParentSpanID string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         Kind       `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       otlpStatus `json:"status"`
+	}
+	otlpAttr struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		String *string  `json:"stringValue,omitempty"`
+		Bool   *bool    `json:"boolValue,omitempty"`
+		Int    *string  `json:"intValue,omitempty"`
+		Double *float64 `json:"doubleValue,omitempty"`
+	}
+	otlpStatus struct {
+		// Code is 0 unset, 1 ok or 2 error
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func value(v interface{}) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{String: &v}
+	case bool:
+		return otlpValue{Bool: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{Int: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{Int: &s}
+	case float64:
+		return otlpValue{Double: &v}
+	case time.Duration:
+		s := v.String()
+		return otlpValue{String: &s}
+	}
+	s := fmt.Sprint(v)
+	return otlpValue{String: &s}
+}
+
+func attrs(in []Attr) []otlpAttr {
+	out := make([]otlpAttr, 0, len(in))
+	for _, a := range in {
+		out = append(out, otlpAttr{Key: a.Key, Value: value(a.Value)})
+	}
+	return out
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// encode is a batch as an OTLP request body.
+func encode(service string, spans []*Span) ([]byte, error) {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.id[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      nanos(s.start),
+			End:        nanos(s.end),
+			Attributes: attrs(s.attrs),
+		}
+		if s.parent != nil {
+			span.ParentSpanID = hex.EncodeToString(s.parent.id[:])
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		out = append(out, span)
+	}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: attrs([]Attr{String("service.name", service)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: service}, Spans: out}},
+	}}})
+}
+
+// HTTPExporter posts spans to an OTLP/HTTP collector as JSON.
+type HTTPExporter struct {
+	service  string
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewHTTPExporter sends to endpoint, like http://localhost:4318, adding
+// /v1/traces unless the endpoint already has a path.
+func NewHTTPExporter(service, endpoint string, headers map[string]string) *HTTPExporter {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if !strings.Contains(strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://"), "/") {
+		endpoint += "/v1/traces"
+	}
+	return &HTTPExporter{service: service, endpoint: endpoint, headers: headers, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (e *HTTPExporter) Export(spans []*Span) error {
+	body, err := encode(e.service, spans)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode spans")
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send spans")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return errors.Errorf("collector answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (e *HTTPExporter) Close() error {
+	return nil
+}
+
+// FileExporter appends each batch to a file as a line of OTLP JSON, the
+// format the collector's otlpjsonfile receiver reads.
+type FileExporter struct {
+	service string
+	mu      sync.Mutex
+	f       *os.File
+}
+
+func NewFileExporter(service, path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open trace file")
+	}
+	return &FileExporter{service: service, f: f}, nil
+}
+
+func (e *FileExporter) Export(spans []*Span) error {
+	body, err := encode(e.service, spans)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode spans")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.f.Write(append(body, '\n'))
+	return errors.Wrap(err, "failed to write spans")
+}
+
+func (e *FileExporter) Close() error {
+	return e.f.Close()
+}
+
+// Exporters sends every batch to each of them.
+type Exporters []Exporter
+
+func (es Exporters) Export(spans []*Span) error {
+	var first error
+	for _, e := range es {
+		if err := e.Export(spans); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (es Exporters) Close() error {
+	var first error
+	for _, e := range es {
+		if err := e.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
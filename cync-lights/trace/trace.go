@@ -0,0 +1,226 @@
+// Package trace records spans in the shape OpenTelemetry uses and exports
+// them as OTLP JSON, over HTTP to a collector or to a file. A nil Tracer and
+// the nil spans it starts do nothing, so tracing costs nothing when it's off.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+)
+
+var traceLog = log.For("trace")
+
+const (
+	// batchSize spans are exported together, or whatever's ended every
+	// flushEvery
+	batchSize  = 256
+	flushEvery = 2 * time.Second
+	// queued is how many ended spans can wait for the exporter before new
+	// ones are dropped, the lights matter more than their traces
+	queued = 4096
+)
+
+// Kind is what a span is doing, as OTLP numbers them.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Attr is a span attribute. Values are strings, bools, ints or floats,
+// anything else is written with %v.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+func Int(key string, value int) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Span is one timed piece of work.
+type Span struct {
+	tracer  *Tracer
+	parent  *Span
+	traceID [16]byte
+	id      [8]byte
+	name    string
+	kind    Kind
+	start   time.Time
+	end     time.Time
+	attrs   []Attr
+	err     error
+}
+
+// Parent is the span this one is part of, nil for the root.
+func (s *Span) Parent() *Span {
+	if s == nil {
+		return nil
+	}
+	return s.parent
+}
+
+// Set adds attributes.
+func (s *Span) Set(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// Fail marks the span as failed if err isn't nil.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.err = err
+}
+
+// End finishes the span and queues it for export. A span is used by one
+// goroutine until it ends.
+func (s *Span) End() {
+	if s == nil || !s.end.IsZero() {
+		return
+	}
+	s.end = time.Now()
+	s.tracer.queue(s)
+}
+
+// TraceID is the span's trace as hex, for logs.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// Exporter sends batches of spans somewhere.
+type Exporter interface {
+	Export(spans []*Span) error
+	Close() error
+}
+
+// Tracer starts spans and exports them in the background.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	ended    chan *Span
+	done     chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+	drops  int
+}
+
+// New starts exporting. service names the resource the spans come from.
+func New(service string, exporter Exporter) *Tracer {
+	t := &Tracer{service: service, exporter: exporter, ended: make(chan *Span, queued), done: make(chan struct{})}
+	go t.export()
+	return t
+}
+
+// Start begins a span under parent, or a new trace if parent is nil.
+func (t *Tracer) Start(parent *Span, name string, kind Kind, attrs ...Attr) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, parent: parent, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent != nil {
+		s.traceID = parent.traceID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.id[:])
+	return s
+}
+
+// queue hands an ended span to the exporter, dropping it if the exporter's
+// behind or closed.
+func (t *Tracer) queue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.ended <- s:
+		return
+	default:
+	}
+	t.drops++
+	if t.drops == 1 || t.drops%1000 == 0 {
+		traceLog.Warn("dropping spans, the exporter can't keep up", log.F("dropped", t.drops))
+	}
+}
+
+func (t *Tracer) export() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			traceLog.Warn("failed to export spans", log.F("spans", len(batch)), log.Err(err))
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-t.ended:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close exports what's left and stops, spans that end later are dropped.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	t.closed = true
+	close(t.ended)
+	t.mu.Unlock()
+	<-t.done
+	return t.exporter.Close()
+}
+
+type contextKey struct{}
+
+// WithSpan carries a span in a context, for HTTP handlers.
+func WithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext is the span WithSpan put in ctx, nil if there isn't one.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(contextKey{}).(*Span)
+	return s
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/trace"
+	"github.com/pkg/errors"
+)
+
+const defaultService = "cync-lights"
+
+// tracing knows the span the controller loop is working under, so whatever
+// it calls is traced as part of it. Only the loop touches current. With no
+// tracing config the tracer is nil and every span is a no-op.
+type tracing struct {
+	tracer  *trace.Tracer
+	current *trace.Span
+}
+
+// newTracing sets up exporting to a collector, a file next to the config or
+// both.
+func newTracing(cfg *config.Tracing, dir string) (*tracing, error) {
+	if cfg == nil {
+		return &tracing{}, nil
+	}
+	service := cfg.Service
+	if service == "" {
+		service = defaultService
+	}
+	var exporters trace.Exporters
+	if cfg.Endpoint != "" {
+		exporters = append(exporters, trace.NewHTTPExporter(service, cfg.Endpoint, cfg.Headers))
+	}
+	if cfg.File != "" {
+		path := cfg.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		file, err := trace.NewFileExporter(service, path)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, file)
+	}
+	if len(exporters) == 0 {
+		return nil, errors.New("tracing needs an endpoint, a file or both")
+	}
+	return &tracing{tracer: trace.New(service, exporters)}, nil
+}
+
+// start begins a span under the current one and makes it current.
+func (t *tracing) start(name string, kind trace.Kind, attrs ...trace.Attr) *trace.Span {
+	span := t.tracer.Start(t.current, name, kind, attrs...)
+	if span != nil {
+		t.current = span
+	}
+	return span
+}
+
+// end finishes a span from start, failed if err isn't nil, and makes its
+// parent current again.
+func (t *tracing) end(span *trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	span.Fail(err)
+	span.End()
+	t.current = span.Parent()
+}
+
+// in wraps a task posted to the loop so it's traced under span, which was
+// started on another goroutine.
+func (t *tracing) in(span *trace.Span, task func()) func() {
+	return func() {
+		outer := t.current
+		t.current = span
+		defer func() { t.current = outer }()
+		task()
+	}
+}
+
+// sleep is time.Sleep, traced so time spent waiting between device commands
+// shows up apart from the commands.
+func (c *controller) sleep(d time.Duration) {
+	span := c.tracing.start("sleep", trace.KindInternal, trace.String("duration", d.String()))
+	time.Sleep(d)
+	c.tracing.end(span, nil)
+}
+
+// statusRecorder remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// traced starts a trace for every API request. Handlers find the span in
+// the request's context to trace what they post to the loop under it.
+func (c *controller) traced(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := c.tracing.tracer.Start(nil, r.Method+" "+r.URL.Path, trace.KindServer,
+			trace.String("http.method", r.Method),
+			trace.String("http.target", r.URL.RequestURI()),
+		)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(trace.WithSpan(r.Context(), span)))
+		span.Set(trace.Int("http.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.Fail(errors.New(http.StatusText(recorder.status)))
+		}
+		span.End()
+	})
+}
+
+// postFrom posts a task for an API request, traced under the request.
+func (c *controller) postFrom(r *http.Request, task func()) {
+	c.post(c.tracing.in(trace.FromContext(r.Context()), task))
+}
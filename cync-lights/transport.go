@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/local"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+	"github.com/unixpickle/cbyge"
+)
+
+var transportLog = log.For("transport")
+
+const (
+	defaultLocalTimeout = 2 * time.Second
+	// localRetryAfter is how long devices go through the cloud once the hub
+	// stops answering, so an effect doesn't wait out a timeout every frame
+	localRetryAfter   = 30 * time.Second
+	defaultMockListen = "127.0.0.1:23779"
+)
+
+// routedBackend sends devices routed to a local hub through it, and
+// everything else, including whatever the hub fails, through the cloud.
+type routedBackend struct {
+	backend
+	hub      *local.Client
+	switchID uint32
+	view     *ui.View
+	metrics  *controllerMetrics
+
+	mu sync.Mutex
+	// local is the IDs of the devices routed to the hub
+	local map[string]bool
+	// down is set while the hub isn't answering, it's tried again after
+	// retryAt
+	down    bool
+	retryAt time.Time
+	// statuses is what the hub last said about its devices, by ID
+	statuses map[string]deviceStatus
+}
+
+func newRoutedBackend(cloud backend, cfg *config.Local, view *ui.View, metrics *controllerMetrics) (*routedBackend, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("local needs the hub's addr")
+	}
+	timeout, err := configDuration(cfg.Timeout, defaultLocalTimeout)
+	if err != nil {
+		return nil, err
+	}
+	hub := local.New(local.Config{Addr: cfg.Addr, UserID: cfg.UserID, Code: cfg.Code, Timeout: timeout})
+	return &routedBackend{
+		backend:  cloud,
+		hub:      hub,
+		switchID: cfg.Switch,
+		view:     view,
+		metrics:  metrics,
+		local:    map[string]bool{},
+		statuses: map[string]deviceStatus{},
+	}, nil
+}
+
+// meshIndex is a device's place in its mesh, the last three digits of its
+// ID as cbyge has it.
+func meshIndex(d *device) int {
+	id, _ := strconv.ParseUint(d.DeviceID(), 10, 64)
+	return int(id % 1000)
+}
+
+// route sets which devices go through the hub.
+func (rb *routedBackend) route(id string, local bool) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if local {
+		rb.local[id] = true
+	} else {
+		delete(rb.local, id)
+		delete(rb.statuses, id)
+	}
+}
+
+func (rb *routedBackend) reset() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.local = map[string]bool{}
+	rb.statuses = map[string]deviceStatus{}
+}
+
+// transport is how a device's commands are sent right now.
+func (rb *routedBackend) transport(id string) string {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	switch {
+	case !rb.local[id]:
+		return "cloud"
+	case rb.down:
+		return "local, using the cloud while the hub is down"
+	}
+	return "local"
+}
+
+// useHub is true for devices routed to the hub, unless it's down and not
+// due to be tried again.
+func (rb *routedBackend) useHub(d *device) bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.local[d.DeviceID()] && (!rb.down || time.Now().After(rb.retryAt))
+}
+
+func (rb *routedBackend) isDown() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.down
+}
+
+// hubDown is announced the first time, the hub's tried again in a while.
+func (rb *routedBackend) hubDown(err error) {
+	rb.mu.Lock()
+	first := !rb.down
+	rb.down, rb.retryAt = true, time.Now().Add(localRetryAfter)
+	rb.mu.Unlock()
+	if first {
+		transportLog.Warn("hub unreachable, using the cloud", log.F("addr", rb.hub.Addr()), log.Err(err))
+		rb.view.Eventf(ui.ErrColor, "hub at %s isn't answering, using the cloud: %v", rb.hub.Addr(), err)
+	}
+}
+
+func (rb *routedBackend) hubUp() {
+	rb.mu.Lock()
+	was := rb.down
+	rb.down = false
+	rb.mu.Unlock()
+	if was {
+		transportLog.Info("hub is back", log.F("addr", rb.hub.Addr()))
+		rb.view.Eventf(ui.TextColor, "hub at %s is back", rb.hub.Addr())
+	}
+}
+
+func (rb *routedBackend) SetStatus(d *device, on bool) error {
+	return rb.send(d, "SetDeviceStatus",
+		func() error { return rb.hub.SetStatus(rb.switchID, meshIndex(d), on, false) },
+		func() error { return rb.backend.SetStatus(d, on) })
+}
+
+func (rb *routedBackend) SetRGB(d *device, r, g, b uint8, async bool) error {
+	return rb.send(d, "SetDeviceRGB",
+		func() error { return rb.hub.SetRGB(rb.switchID, meshIndex(d), r, g, b, async) },
+		func() error { return rb.backend.SetRGB(d, r, g, b, async) })
+}
+
+func (rb *routedBackend) SetLum(d *device, lum int, async bool) error {
+	return rb.send(d, "SetDeviceLum",
+		func() error { return rb.hub.SetLum(rb.switchID, meshIndex(d), lum, async) },
+		func() error { return rb.backend.SetLum(d, lum, async) })
+}
+
+func (rb *routedBackend) SetCT(d *device, tone int, async bool) error {
+	return rb.send(d, "SetDeviceCT",
+		func() error { return rb.hub.SetCT(rb.switchID, meshIndex(d), tone, async) },
+		func() error { return rb.backend.SetCT(d, tone, async) })
+}
+
+// send tries the hub for devices routed to it and the cloud if that fails.
+// The hub answering that the device didn't take it doesn't make it down,
+// the cloud might still reach the device another way. A command the hub
+// client refused to send is an error either way.
+func (rb *routedBackend) send(d *device, op string, hub, cloud func() error) error {
+	if !rb.useHub(d) {
+		return cloud()
+	}
+	err := hub()
+	switch {
+	case err == nil:
+		rb.hubUp()
+		return nil
+	case errors.Is(err, cbyge.RemoteCallError):
+		transportLog.Debug("hub couldn't reach device, using the cloud", log.F("device", d.Name()), log.F("op", op))
+	case errors.Is(err, local.ErrUnavailable):
+		rb.hubDown(err)
+	default:
+		return err
+	}
+	rb.metrics.fallbacks.Inc(d.Name(), op)
+	return cloud()
+}
+
+// Devices lists devices from the cloud, then asks the hub how the ones
+// routed to it are doing.
+func (rb *routedBackend) Devices() ([]*device, error) {
+	devices, err := rb.backend.Devices()
+	if err != nil {
+		return nil, err
+	}
+	rb.mu.Lock()
+	routed := len(rb.local) > 0 && !rb.down
+	rb.mu.Unlock()
+	if !routed {
+		return devices, nil
+	}
+	statuses, err := rb.hub.Statuses(rb.switchID)
+	if err != nil {
+		transportLog.Debug("couldn't read statuses from the hub", log.Err(err))
+		return devices, nil
+	}
+	byIndex := make(map[int]cbyge.StatusPaginatedResponse, len(statuses))
+	for _, s := range statuses {
+		byIndex[s.Device] = s
+	}
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for _, d := range devices {
+		s, ok := byIndex[meshIndex(d)]
+		if !ok || !rb.local[d.DeviceID()] {
+			continue
+		}
+		rb.statuses[d.DeviceID()] = deviceStatus{Online: true, On: s.IsOn, Brightness: int(s.Brightness), UseRGB: s.UseRGB, RGB: s.RGB}
+	}
+	return devices, nil
+}
+
+// Status is what the hub last said for devices routed to it, while it's up
+// and has said something.
+func (rb *routedBackend) Status(d *device) deviceStatus {
+	rb.mu.Lock()
+	status, ok := rb.statuses[d.DeviceID()]
+	ok = ok && rb.local[d.DeviceID()] && !rb.down
+	rb.mu.Unlock()
+	if ok {
+		return status
+	}
+	return rb.backend.Status(d)
+}
+
+// routeDevices routes the devices and groups in the local config through the
+// hub.
+func (c *controller) routeDevices() {
+	if c.routes == nil {
+		return
+	}
+	c.routes.reset()
+	for _, target := range c.config.Local.Devices {
+		devices, err := c.resolveTarget(target)
+		if err != nil {
+			c.view.Eventf(ui.ErrColor, "local: %v", err)
+			continue
+		}
+		for _, d := range devices {
+			c.routes.route(d.DeviceID(), true)
+		}
+	}
+}
+
+func runTransport(cont *controller, args parsedArgs) error {
+	action := args.str("action")
+	if action == "local" || action == "cloud" {
+		if cont.routes == nil {
+			return errors.New("there's no hub, add a local section to the config")
+		}
+		devices, err := cont.resolveTarget(args.str("target"))
+		if err != nil {
+			return err
+		}
+		for _, d := range devices {
+			cont.routes.route(d.DeviceID(), action == "local")
+		}
+		cont.view.Eventf(ui.TextColor, "sending %d devices through the %s until restarted", len(devices), map[string]string{"local": "hub", "cloud": "cloud"}[action])
+		return nil
+	}
+	if cont.routes == nil {
+		cont.view.Eventf(ui.TextColor, "everything goes through the cloud, add a local section to the config to use a hub")
+		return nil
+	}
+	cont.view.Eventf(ui.TextColor, "hub at %s", cont.routes.hub.Addr())
+	for _, d := range cont.devices {
+		cont.view.Eventf(ui.TextColor, "  %s: %s", d.Name(), cont.routes.transport(d.DeviceID()))
+	}
+	return nil
+}
+
+// runLocalMock serves a mock hub until interrupted, to try the local
+// transport without one:
+//
+//	cync-lights local-mock [--listen=127.0.0.1:23779] [--code=<code>] [--latency=5ms]
+func runLocalMock(args []string) error {
+	addr, _ := flagValue(args, "listen")
+	if addr == "" {
+		addr = defaultMockListen
+	}
+	code, _ := flagValue(args, "code")
+	mock, err := local.NewMock(addr, code)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen")
+	}
+	if latency, ok := flagValue(args, "latency"); ok {
+		d, err := parseLatency(latency)
+		if err != nil {
+			mock.Close()
+			return errors.Wrap(err, "invalid --latency")
+		}
+		mock.SetLatency(d)
+	}
+	fmt.Printf("[local-mock] listening on %s, route devices to it with \"local\": {\"addr\": %q, \"devices\": [\"all\"]}\n", mock.Addr(), mock.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	fmt.Printf("[local-mock] %d commands received\n", mock.Calls())
+	return mock.Close()
+}
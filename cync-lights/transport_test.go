@@ -0,0 +1,131 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/kungfukennyg/home-office/cync-lights/local"
+)
+
+// newHubController runs n fake devices with fake-1 routed through a mock hub.
+func newHubController(t *testing.T, n int) (*controller, *fakeBackend, *local.Mock) {
+	t.Helper()
+	hub, err := local.NewMock("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { hub.Close() })
+	cfg, err := config.Load(filepath.Join(t.TempDir(), "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Local = &config.Local{Addr: hub.Addr(), Devices: []string{"fake-1"}, Timeout: "200ms"}
+	fb := newFakeBackend(n)
+	c, err := newController(fb, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.routes.hub.Close() })
+	return c, fb, hub
+}
+
+func TestRoutedFallback(t *testing.T) {
+	c, fb, hub := newHubController(t, 2)
+	runCommands(t, c, "off fake-1", "off fake-2")
+	if d, _ := hub.Device(1); d.IsOn || hub.Calls() != 1 {
+		t.Fatalf("hub has fake-1 as %+v after %d commands", d, hub.Calls())
+	}
+	if calls := fb.Calls(); len(calls) != 1 || calls[0].Device != "fake-2" {
+		t.Fatalf("cloud got %v, want only fake-2", calls)
+	}
+
+	// the hub goes away, fake-1 falls back to the cloud
+	addr := hub.Addr()
+	hub.Close()
+	before := time.Now()
+	runCommands(t, c, "on fake-1")
+	if !c.routes.isDown() {
+		t.Fatal("hub isn't marked down")
+	}
+	if calls := fb.Calls(); calls[len(calls)-1] != (fakeCall{Device: "fake-1", Op: "status", Value: "true"}) {
+		t.Fatalf("cloud got %v, want fake-1 switched on", calls)
+	}
+	c.routes.mu.Lock()
+	retryAt := c.routes.retryAt
+	c.routes.mu.Unlock()
+	if retryAt.Before(before.Add(localRetryAfter)) {
+		t.Errorf("hub retried at %v, sooner than %v from now", retryAt, localRetryAfter)
+	}
+	if got := c.routes.transport(c.devices[0].DeviceID()); got != "local, using the cloud while the hub is down" {
+		t.Errorf("fake-1 transport %q", got)
+	}
+
+	// the hub's back, but isn't tried until the retry's due
+	restarted, err := local.NewMock(addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	runCommands(t, c, "off fake-1")
+	if restarted.Calls() != 0 {
+		t.Fatalf("hub tried %d times before the retry was due", restarted.Calls())
+	}
+
+	c.routes.mu.Lock()
+	c.routes.retryAt = time.Now().Add(-time.Second)
+	c.routes.mu.Unlock()
+	cloudCalls := len(fb.Calls())
+	runCommands(t, c, "on fake-1")
+	if d, _ := restarted.Device(1); !d.IsOn || restarted.Calls() != 1 {
+		t.Fatalf("hub has fake-1 as %+v after %d commands", d, restarted.Calls())
+	}
+	if c.routes.isDown() {
+		t.Error("hub still marked down after answering")
+	}
+	if len(fb.Calls()) != cloudCalls {
+		t.Errorf("cloud got %v after the hub came back", fb.Calls()[cloudCalls:])
+	}
+}
+
+// the hub answering that a device didn't take a command isn't the hub
+// being down
+func TestRoutedDeviceUnreachable(t *testing.T) {
+	c, fb, hub := newHubController(t, 1)
+	hub.SetOffline(1, true)
+	runCommands(t, c, "off fake-1")
+	if c.routes.isDown() {
+		t.Fatal("hub marked down for a device it couldn't reach")
+	}
+	if calls := fb.Calls(); len(calls) != 1 {
+		t.Fatalf("cloud got %v, want the fallback", calls)
+	}
+	hub.SetOffline(1, false)
+	runCommands(t, c, "on fake-1")
+	if len(fb.Calls()) != 1 {
+		t.Errorf("cloud got %v, want the hub used again", fb.Calls())
+	}
+}
+
+// the hub client refusing a command doesn't make the hub down, and isn't
+// sent to the cloud instead
+func TestRoutedRefused(t *testing.T) {
+	c, fb, hub := newHubController(t, 1)
+	d := c.devices[0]
+	if err := c.routes.SetLum(d, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := hub.Device(1); s.Brightness != 0 || hub.Calls() != 1 {
+		t.Fatalf("hub has fake-1 as %+v after %d commands", s, hub.Calls())
+	}
+	if err := c.routes.SetCT(d, 101, false); err == nil {
+		t.Fatal("a color tone of 101 was sent")
+	}
+	if c.routes.isDown() {
+		t.Error("hub marked down for a command it was never sent")
+	}
+	if calls := fb.Calls(); len(calls) != 0 {
+		t.Errorf("cloud got %v", calls)
+	}
+}
@@ -0,0 +1,78 @@
+package ui
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// History keeps prompt lines in a file so they survive restarts.
+type History struct {
+	path  string
+	lines []string
+}
+
+// LoadHistory reads the history file at path, a missing file is empty. The
+// file is compacted once it grows well past what the prompt keeps.
+func LoadHistory(path string) (*History, error) {
+	h := &History{path: path}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open history %s", path)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read history %s", path)
+	}
+
+	if len(h.lines) > 2*maxHistory {
+		h.lines = h.lines[len(h.lines)-maxHistory:]
+		if err := h.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *History) Lines() []string {
+	return h.lines
+}
+
+// Append adds a line to the end of the file.
+func (h *History) Append(line string) error {
+	if line == "" {
+		return nil
+	}
+	h.lines = append(h.lines, line)
+
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to create history dir")
+	}
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open history %s", h.path)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(line + "\n")
+	return errors.Wrap(err, "failed to append to history")
+}
+
+func (h *History) rewrite() error {
+	data := strings.Join(h.lines, "\n") + "\n"
+	err := os.WriteFile(h.path, []byte(data), 0o600)
+	return errors.Wrapf(err, "failed to rewrite history %s", h.path)
+}
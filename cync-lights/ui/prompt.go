@@ -0,0 +1,253 @@
+package ui
+
+import (
+	"strings"
+
+	"github.com/kungfukennyg/home-office/cync-lights/input"
+)
+
+const maxHistory = 500
+
+// Completer returns the candidates for the last word of line.
+type Completer func(line string) []string
+
+// Prompt is the editable command line at the bottom of the screen.
+type Prompt struct {
+	buf     []rune
+	cursor  int
+	history []string
+	// histPos indexes into history while browsing, len(history) means the
+	// line being edited
+	histPos int
+	saved   []rune
+
+	// reverse search state, query is matched against history from the
+	// newest entry back, starting before searchPos
+	searching bool
+	query     []rune
+	searchPos int
+
+	Complete Completer
+}
+
+// Search returns the reverse search query, active is false when not searching.
+func (p *Prompt) Search() (query string, active bool) {
+	return string(p.query), p.searching
+}
+
+// SetHistory replaces the history, oldest first.
+func (p *Prompt) SetHistory(lines []string) {
+	p.history = append([]string(nil), lines...)
+	if len(p.history) > maxHistory {
+		p.history = p.history[len(p.history)-maxHistory:]
+	}
+	p.histPos = len(p.history)
+}
+
+func (p *Prompt) Line() string {
+	return string(p.buf)
+}
+
+func (p *Prompt) Cursor() int {
+	return p.cursor
+}
+
+// HandleKey applies a keypress. It returns the submitted line once enter is
+// pressed, and any completion candidates that should be shown to the user.
+func (p *Prompt) HandleKey(k input.Key) (line string, submitted bool, candidates []string) {
+	if p.searching && p.handleSearchKey(k) {
+		return "", false, nil
+	}
+
+	switch k.Code {
+	case input.KeyRune:
+		p.insert(k.Rune)
+	case input.KeyEnter:
+		line = strings.TrimSpace(string(p.buf))
+		p.addHistory(line)
+		p.buf = p.buf[:0]
+		p.cursor = 0
+		return line, true, nil
+	case input.KeyBackspace:
+		if p.cursor > 0 {
+			p.buf = append(p.buf[:p.cursor-1], p.buf[p.cursor:]...)
+			p.cursor--
+		}
+	case input.KeyDelete:
+		if p.cursor < len(p.buf) {
+			p.buf = append(p.buf[:p.cursor], p.buf[p.cursor+1:]...)
+		}
+	case input.KeyLeft:
+		if p.cursor > 0 {
+			p.cursor--
+		}
+	case input.KeyRight:
+		if p.cursor < len(p.buf) {
+			p.cursor++
+		}
+	case input.KeyHome, input.KeyCtrlA:
+		p.cursor = 0
+	case input.KeyEnd, input.KeyCtrlE:
+		p.cursor = len(p.buf)
+	case input.KeyCtrlU:
+		p.buf = p.buf[:0]
+		p.cursor = 0
+	case input.KeyCtrlW:
+		start := p.cursor
+		for start > 0 && p.buf[start-1] == ' ' {
+			start--
+		}
+		for start > 0 && p.buf[start-1] != ' ' {
+			start--
+		}
+		p.buf = append(p.buf[:start], p.buf[p.cursor:]...)
+		p.cursor = start
+	case input.KeyUp:
+		p.browse(-1)
+	case input.KeyDown:
+		p.browse(1)
+	case input.KeyTab:
+		return "", false, p.complete()
+	case input.KeyCtrlR:
+		p.searching = true
+		p.query = p.query[:0]
+		p.searchPos = len(p.history)
+		p.saved = append([]rune(nil), p.buf...)
+	}
+
+	return "", false, nil
+}
+
+// handleSearchKey updates a reverse search. Keys that don't edit the search
+// end it, keeping the match, and return false so they're handled as normal.
+func (p *Prompt) handleSearchKey(k input.Key) bool {
+	switch k.Code {
+	case input.KeyRune:
+		p.query = append(p.query, k.Rune)
+		p.searchPos = len(p.history)
+		p.searchBack()
+		return true
+	case input.KeyBackspace:
+		if len(p.query) > 0 {
+			p.query = p.query[:len(p.query)-1]
+		}
+		p.searchPos = len(p.history)
+		p.searchBack()
+		return true
+	case input.KeyCtrlR:
+		p.searchBack()
+		return true
+	case input.KeyEscape, input.KeyCtrlU:
+		p.searching = false
+		p.set(string(p.saved))
+		return true
+	}
+
+	p.searching = false
+	p.histPos = len(p.history)
+	return false
+}
+
+// searchBack moves to the next older history entry containing the query.
+func (p *Prompt) searchBack() {
+	query := string(p.query)
+	for i := p.searchPos - 1; i >= 0; i-- {
+		if strings.Contains(p.history[i], query) {
+			p.searchPos = i
+			p.set(p.history[i])
+			return
+		}
+	}
+}
+
+func (p *Prompt) insert(r rune) {
+	p.buf = append(p.buf, 0)
+	copy(p.buf[p.cursor+1:], p.buf[p.cursor:])
+	p.buf[p.cursor] = r
+	p.cursor++
+}
+
+func (p *Prompt) set(line string) {
+	p.buf = []rune(line)
+	p.cursor = len(p.buf)
+}
+
+func (p *Prompt) addHistory(line string) {
+	p.histPos = len(p.history)
+	p.saved = nil
+	if line == "" {
+		return
+	}
+	if len(p.history) > 0 && p.history[len(p.history)-1] == line {
+		return
+	}
+
+	p.history = append(p.history, line)
+	if len(p.history) > maxHistory {
+		p.history = p.history[len(p.history)-maxHistory:]
+	}
+	p.histPos = len(p.history)
+}
+
+func (p *Prompt) browse(dir int) {
+	next := p.histPos + dir
+	if next < 0 || next > len(p.history) {
+		return
+	}
+
+	if p.histPos == len(p.history) {
+		p.saved = append([]rune(nil), p.buf...)
+	}
+	p.histPos = next
+	if next == len(p.history) {
+		p.set(string(p.saved))
+		return
+	}
+	p.set(p.history[next])
+}
+
+// complete expands the word before the cursor. A single candidate is filled in
+// completely, otherwise the common prefix is and the candidates are returned.
+func (p *Prompt) complete() []string {
+	if p.Complete == nil {
+		return nil
+	}
+
+	head := string(p.buf[:p.cursor])
+	tail := string(p.buf[p.cursor:])
+	wordStart := strings.LastIndex(head, " ") + 1
+	word := head[wordStart:]
+
+	var matches []string
+	for _, candidate := range p.Complete(head) {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(word)) {
+			matches = append(matches, candidate)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil
+	case 1:
+		head = head[:wordStart] + matches[0] + " "
+	default:
+		head = head[:wordStart] + commonPrefix(matches)
+	}
+	p.buf = []rune(head + tail)
+	p.cursor = len([]rune(head))
+
+	if len(matches) > 1 {
+		return matches
+	}
+	return nil
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(strings.ToLower(w), strings.ToLower(prefix)) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,318 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kungfukennyg/home-office/cync-lights/input"
+)
+
+const (
+	frameInterval = 50 * time.Millisecond
+	clockInterval = time.Second
+	maxModeLines  = 8
+)
+
+const (
+	HeaderColor = color.FgBlue
+	TextColor   = color.FgGreen
+	ErrColor    = color.FgRed
+	DimColor    = color.FgHiBlack
+	// PendingColor is for devices waiting on queued commands
+	PendingColor = color.FgYellow
+)
+
+// Screen renders a View full-screen and owns the command line at the bottom.
+// Each frame is written in one go to avoid the flicker of line-by-line
+// rendering.
+type Screen struct {
+	view *View
+	in   *input.Mux
+	out  *os.File
+
+	promptLock sync.Mutex
+	prompt     Prompt
+	history    *History
+
+	lines       chan string
+	closeLines  sync.Once
+	unsubscribe func()
+	stopCh      chan struct{}
+	stopped     sync.Once
+	wg          sync.WaitGroup
+}
+
+func NewScreen(view *View, in *input.Mux, out *os.File) *Screen {
+	return &Screen{
+		view:   view,
+		in:     in,
+		out:    out,
+		lines:  make(chan string, 16),
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (s *Screen) SetCompleter(c Completer) {
+	s.promptLock.Lock()
+	defer s.promptLock.Unlock()
+	s.prompt.Complete = c
+}
+
+// SetHistory loads the prompt's history and keeps appending to it.
+func (s *Screen) SetHistory(h *History) {
+	s.promptLock.Lock()
+	defer s.promptLock.Unlock()
+	s.history = h
+	s.prompt.SetHistory(h.Lines())
+}
+
+// Lines delivers submitted command lines. It's closed when stdin is.
+func (s *Screen) Lines() <-chan string {
+	return s.lines
+}
+
+// PromptEmpty reports whether nothing has been typed at the prompt, so single
+// key shortcuts won't eat the start of a command.
+func (s *Screen) PromptEmpty() bool {
+	s.promptLock.Lock()
+	defer s.promptLock.Unlock()
+	return len(s.prompt.buf) == 0 && !s.prompt.searching
+}
+
+func (s *Screen) Start() error {
+	if err := s.in.SetRaw(true); err != nil {
+		return err
+	}
+	keys, unsubscribe := s.in.Subscribe(nil)
+	s.unsubscribe = unsubscribe
+	fmt.Fprint(s.out, "\x1b[?1049h\x1b[H\x1b[2J")
+
+	s.wg.Add(2)
+	go s.renderLoop()
+	go s.keyLoop(keys)
+	return nil
+}
+
+// Stop leaves the alternate screen and restores the terminal. It's safe to
+// call more than once.
+func (s *Screen) Stop() {
+	s.stopped.Do(func() {
+		close(s.stopCh)
+		s.wg.Wait()
+		if s.unsubscribe != nil {
+			s.unsubscribe()
+		}
+		fmt.Fprint(s.out, "\x1b[?1049l\x1b[?25h")
+		s.in.SetRaw(false)
+	})
+}
+
+func (s *Screen) keyLoop(keys <-chan input.Key) {
+	defer s.wg.Done()
+
+	for {
+		var key input.Key
+		select {
+		case <-s.stopCh:
+			return
+		case <-s.in.Done():
+			s.endLines()
+			return
+		case key = <-keys:
+		}
+
+		switch {
+		case key.Code == input.KeyCtrlC:
+			s.submit("exit")
+			continue
+		case key.Code == input.KeyCtrlD && s.PromptEmpty():
+			s.endLines()
+			return
+		}
+
+		s.promptLock.Lock()
+		line, submitted, candidates := s.prompt.HandleKey(key)
+		history := s.history
+		s.promptLock.Unlock()
+		if submitted && history != nil {
+			if err := history.Append(line); err != nil {
+				s.view.Eventf(ErrColor, "%v", err)
+			}
+		}
+		if len(candidates) > 0 {
+			s.view.Eventf(DimColor, "%s", strings.Join(candidates, "  "))
+		}
+		if submitted {
+			s.submit(line)
+		}
+		s.view.markDirty()
+	}
+}
+
+func (s *Screen) endLines() {
+	s.closeLines.Do(func() {
+		close(s.lines)
+	})
+}
+
+func (s *Screen) submit(line string) {
+	select {
+	case s.lines <- line:
+	case <-s.stopCh:
+	}
+}
+
+func (s *Screen) renderLoop() {
+	defer s.wg.Done()
+
+	frame := time.NewTicker(frameInterval)
+	defer frame.Stop()
+	clock := time.NewTicker(clockInterval)
+	defer clock.Stop()
+
+	dirty := true
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-s.view.dirty:
+			dirty = true
+		case <-clock.C:
+			dirty = true
+		case <-frame.C:
+			if dirty {
+				s.render()
+				dirty = false
+			}
+		}
+	}
+}
+
+func (s *Screen) render() {
+	width, height, err := input.Size(int(s.out.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+
+	snap := s.view.snapshot()
+	s.promptLock.Lock()
+	promptLine, cursor := s.prompt.Line(), s.prompt.Cursor()
+	query, searching := s.prompt.Search()
+	s.promptLock.Unlock()
+
+	var lines []string
+	header := fit(fmt.Sprintf(" cync-lights  mode: %s", snap.mode), width-9)
+	lines = append(lines, paint(HeaderColor, fmt.Sprintf("%-*s%s", width-9, header, time.Now().Format("15:04:05"))))
+	lines = append(lines, "")
+
+	lines = append(lines, paint(HeaderColor, fit(" Devices", width)))
+	lines = append(lines, paint(DimColor, fit(fmt.Sprintf("  %-3s %-20s    %-13s %-16s %4s %-5s %-7s", "#", "NAME", "COLOR", "RGB", "LUM", "POWER", "HEALTH"), width)))
+	for i, d := range snap.devices {
+		lines = append(lines, deviceLine(i+1, d, width))
+	}
+	lines = append(lines, "")
+
+	lines = append(lines, paint(HeaderColor, fit(" Mode", width)))
+	modeLines := snap.modeLines
+	if len(modeLines) > maxModeLines {
+		modeLines = modeLines[:maxModeLines]
+	}
+	for _, l := range modeLines {
+		lines = append(lines, paint(TextColor, fit("  "+l, width)))
+	}
+	lines = append(lines, "")
+
+	lines = append(lines, paint(HeaderColor, fit(" Events", width)))
+	room := height - len(lines) - 1
+	events := snap.events
+	if room < 0 {
+		room = 0
+	}
+	if len(events) > room {
+		events = events[len(events)-room:]
+	}
+	for _, e := range events {
+		lines = append(lines, paint(e.Color, fit(fmt.Sprintf("  %s %s", e.At.Format("15:04:05"), e.Text), width)))
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	if len(lines) > height-1 {
+		lines = lines[:height-1]
+	}
+
+	label := "> "
+	if snap.prompt != "" {
+		label = snap.prompt + " > "
+	}
+	if searching {
+		label = fmt.Sprintf("(search '%s') > ", query)
+	}
+	promptText := fit(label+promptLine, width)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[?25l\x1b[H")
+	for _, l := range lines {
+		buf.WriteString(l)
+		buf.WriteString("\x1b[K\r\n")
+	}
+	buf.WriteString(paint(HeaderColor, promptText))
+	buf.WriteString("\x1b[K")
+	col := len([]rune(label)) + cursor + 1
+	if col > width {
+		col = width
+	}
+	fmt.Fprintf(&buf, "\x1b[%d;%dH\x1b[?25h", height, col)
+	s.out.Write(buf.Bytes())
+}
+
+func deviceLine(n int, d DeviceRow, width int) string {
+	power := "off"
+	if d.Power {
+		power = "on"
+	}
+	rgb := d.Color.GetRGB()
+	text := fmt.Sprintf("  %-3d %-20s ", n, fit(d.Name, 20))
+	rest := fmt.Sprintf(" %-13s [%03d, %03d, %03d]  %4d %-5s %-7s", fit(d.Color.Name, 13), rgb[0], rgb[1], rgb[2], d.Lum, power, d.Health)
+
+	healthColor := TextColor
+	switch d.Health {
+	case HealthError, HealthOffline:
+		healthColor = ErrColor
+	case HealthPending:
+		healthColor = PendingColor
+	}
+	if len([]rune(text))+2 > width {
+		return paint(healthColor, fit(text, width))
+	}
+	return paint(healthColor, text) + swatch(rgb) + paint(healthColor, fit(rest, width-len([]rune(text))-2))
+}
+
+// swatch draws a two cell block in the device's current color using 24-bit
+// background escapes.
+func swatch(rgb [3]uint8) string {
+	if color.NoColor {
+		return "##"
+	}
+	return fmt.Sprintf("\x1b[48;2;%d;%d;%dm  \x1b[0m", rgb[0], rgb[1], rgb[2])
+}
+
+func paint(c color.Attribute, s string) string {
+	return color.New(c).Sprint(s)
+}
+
+func fit(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}
@@ -0,0 +1,182 @@
+package ui
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+)
+
+const maxEvents = 200
+
+type Health int
+
+const (
+	HealthUnknown Health = iota
+	HealthOK
+	HealthError
+	HealthOffline
+	// HealthPending has commands queued until the cloud is reachable
+	HealthPending
+)
+
+func (h Health) String() string {
+	switch h {
+	case HealthOK:
+		return "ok"
+	case HealthError:
+		return "error"
+	case HealthOffline:
+		return "offline"
+	case HealthPending:
+		return "pending"
+	}
+	return "?"
+}
+
+// DeviceRow is one line of the device table.
+type DeviceRow struct {
+	ID     string
+	Name   string
+	Color  colors.RGB
+	Lum    int
+	Power  bool
+	Health Health
+}
+
+type Event struct {
+	At    time.Time
+	Color color.Attribute
+	Text  string
+}
+
+// View is the model every mode renders into. It's safe to update from any
+// goroutine, the Screen picks up changes on its next frame.
+type View struct {
+	mu        sync.Mutex
+	devices   []*DeviceRow
+	mode      string
+	modeLines []string
+	events    []Event
+	prompt    string
+
+	dirty chan struct{}
+}
+
+func NewView() *View {
+	return &View{
+		dirty: make(chan struct{}, 1),
+	}
+}
+
+// SetDevices resets the device table, keeping any state already known for
+// devices that are still present.
+func (v *View) SetDevices(rows []DeviceRow) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	old := make(map[string]*DeviceRow, len(v.devices))
+	for _, row := range v.devices {
+		old[row.ID] = row
+	}
+	v.devices = make([]*DeviceRow, 0, len(rows))
+	for i := range rows {
+		row := rows[i]
+		if prev, ok := old[row.ID]; ok {
+			prev.Name = row.Name
+			v.devices = append(v.devices, prev)
+			continue
+		}
+		v.devices = append(v.devices, &row)
+	}
+	v.markDirty()
+}
+
+func (v *View) UpdateDevice(id string, update func(row *DeviceRow)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, row := range v.devices {
+		if row.ID == id {
+			update(row)
+			v.markDirty()
+			return
+		}
+	}
+}
+
+// SetMode switches the mode panel to a new mode, clearing its status lines.
+func (v *View) SetMode(name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.mode = name
+	v.modeLines = nil
+	v.markDirty()
+}
+
+func (v *View) SetModeLines(lines ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.modeLines = append(v.modeLines[:0], lines...)
+	v.markDirty()
+}
+
+func (v *View) SetPrompt(prompt string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.prompt = prompt
+	v.markDirty()
+}
+
+// Eventf appends a line to the scrolling event log.
+func (v *View) Eventf(c color.Attribute, format string, a ...any) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.events = append(v.events, Event{
+		At:    time.Now(),
+		Color: c,
+		Text:  fmt.Sprintf(format, a...),
+	})
+	if len(v.events) > maxEvents {
+		v.events = v.events[len(v.events)-maxEvents:]
+	}
+	v.markDirty()
+}
+
+func (v *View) markDirty() {
+	select {
+	case v.dirty <- struct{}{}:
+	default:
+	}
+}
+
+type snapshot struct {
+	devices   []DeviceRow
+	mode      string
+	modeLines []string
+	events    []Event
+	prompt    string
+}
+
+func (v *View) snapshot() snapshot {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s := snapshot{
+		devices:   make([]DeviceRow, len(v.devices)),
+		mode:      v.mode,
+		modeLines: append([]string(nil), v.modeLines...),
+		events:    append([]Event(nil), v.events...),
+		prompt:    v.prompt,
+	}
+	for i, row := range v.devices {
+		s.devices[i] = *row
+	}
+	return s
+}
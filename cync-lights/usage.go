@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/energy"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/pkg/errors"
+)
+
+var usageLog = log.For("usage")
+
+// usageSave is how often the totals are written out, at most this much is
+// lost if cync-lights is killed.
+const usageSave = 5 * time.Minute
+
+// loadEnergy compiles the wattage tables.
+func (c *controller) loadEnergy() {
+	models, problems := energy.Compile(c.config.Energy)
+	for _, err := range problems {
+		c.view.Eventf(ui.ErrColor, "energy %v", err)
+	}
+	if c.config.Energy != nil {
+		for name, model := range c.config.Energy.Devices {
+			if _, ok := models[model]; !ok {
+				c.view.Eventf(ui.ErrColor, "energy device %s: no model called %s", name, model)
+			}
+		}
+	}
+	c.wattages = models
+}
+
+// openUsage loads the saved totals. If they can't be read they're left alone
+// rather than overwritten, and this run's usage isn't saved.
+func (c *controller) openUsage() {
+	meter, err := energy.Open(filepath.Join(c.config.Dir(), "usage.json"))
+	if err != nil {
+		usageLog.Warn("not saving usage", log.Err(err))
+		c.view.Eventf(ui.ErrColor, "usage: %v, not saving usage until it's fixed", err)
+		meter = energy.NewMeter("")
+	}
+	c.usage = meter
+}
+
+// startUsage saves the totals every so often.
+func (c *controller) startUsage() {
+	c.usageStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(usageSave)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.usageStop:
+				return
+			case <-ticker.C:
+			}
+			c.saveUsage()
+		}
+	}()
+}
+
+func (c *controller) saveUsage() {
+	now := time.Now()
+	c.usage.Flush(now)
+	if err := c.usage.Save(now); err != nil {
+		usageLog.Warn("failed to save usage", log.Err(err))
+	}
+}
+
+// wattageOf is the model a device's draw is estimated with: the one the
+// energy config gives it, its calibration model's, or the default.
+func (c *controller) wattageOf(d *device) energy.Model {
+	if cfg := c.config.Energy; cfg != nil {
+		for name, model := range cfg.Devices {
+			if strings.EqualFold(name, d.Name()) {
+				if m, ok := c.wattages[model]; ok {
+					return m
+				}
+			}
+		}
+	}
+	if m, ok := c.wattages[c.calibration.For(d.Name()).Model]; ok {
+		return m
+	}
+	return c.wattages[energy.DefaultModel]
+}
+
+// deviceChanged brings the usage meter and the device gauges up to date
+// after a device is sent something or seen.
+func (c *controller) deviceChanged(d *device, online bool) {
+	c.meter(d, online)
+	c.deviceMetrics(d, online)
+}
+
+// meter tells the usage meter what a device is drawing now, from what it
+// was last sent. Offline devices aren't drawing anything as far as we know.
+func (c *controller) meter(d *device, online bool) {
+	if !online {
+		c.usage.Set(d.Name(), false, 0, time.Now())
+		return
+	}
+	on := c.lastPower[d.DeviceID()]
+	lum := c.calibration.For(d.Name()).Lum(c.lastLum[d.DeviceID()].Scale(c.scale))
+	c.usage.Set(d.Name(), on, c.wattageOf(d).Watts(on, lum), time.Now())
+}
+
+// usageReport is usage over a period for devices and the groups they're in.
+type usageReport struct {
+	Period   string      `json:"period"`
+	From     string      `json:"from"`
+	To       string      `json:"to"`
+	Currency string      `json:"currency,omitempty"`
+	Devices  []usageLine `json:"devices"`
+	Groups   []usageLine `json:"groups"`
+	Total    usageLine   `json:"total"`
+	price    float64
+}
+
+type usageLine struct {
+	Name    string  `json:"name"`
+	KWh     float64 `json:"kwh"`
+	HoursOn float64 `json:"hours_on"`
+	Cost    float64 `json:"cost"`
+}
+
+// rounded drops the noise that adding up seconds leaves.
+func (l usageLine) rounded() usageLine {
+	l.KWh = math.Round(l.KWh*1e4) / 1e4
+	l.HoursOn = math.Round(l.HoursOn*100) / 100
+	l.Cost = math.Round(l.Cost*1e4) / 1e4
+	return l
+}
+
+func (c *controller) price() (float64, string) {
+	if c.config.Energy == nil {
+		return 0, ""
+	}
+	return c.config.Energy.Price, c.config.Energy.Currency
+}
+
+// usageFor reports a period so far. An empty target is every device that
+// used anything, including ones no longer around.
+func (c *controller) usageFor(period, target string) (usageReport, error) {
+	now := time.Now()
+	from, err := energy.Since(period, now)
+	if err != nil {
+		return usageReport{}, err
+	}
+	if strings.EqualFold(target, "all") {
+		target = ""
+	}
+	var only map[string]bool
+	if target != "" {
+		devices, err := c.resolveTarget(target)
+		if err != nil {
+			return usageReport{}, err
+		}
+		only = map[string]bool{}
+		for _, d := range devices {
+			only[d.Name()] = true
+		}
+	}
+
+	c.usage.Flush(now)
+	price, currency := c.price()
+	report := usageReport{
+		Period:   period,
+		From:     from.Format("2006-01-02"),
+		To:       now.Format("2006-01-02"),
+		Currency: currency,
+		Devices:  []usageLine{},
+		Groups:   []usageLine{},
+		Total:    usageLine{Name: "total"},
+		price:    price,
+	}
+	totals := c.usage.Totals(from, now)
+	for name, u := range totals {
+		if only != nil && !only[name] {
+			continue
+		}
+		line := usageLine{Name: name, KWh: u.KWh(), HoursOn: u.Hours(), Cost: u.KWh() * price}
+		report.Devices = append(report.Devices, line.rounded())
+		report.Total.KWh += line.KWh
+		report.Total.Cost += line.Cost
+	}
+	report.Total = report.Total.rounded()
+	sort.Slice(report.Devices, func(i, j int) bool { return report.Devices[i].Name < report.Devices[j].Name })
+
+	for group, members := range c.config.Groups {
+		if target != "" && target != group {
+			continue
+		}
+		line := usageLine{Name: group}
+		for _, name := range members {
+			for device, u := range totals {
+				if strings.EqualFold(device, name) {
+					line.KWh += u.KWh()
+					line.HoursOn += u.Hours()
+				}
+			}
+		}
+		line.Cost = line.KWh * price
+		report.Groups = append(report.Groups, line.rounded())
+	}
+	sort.Slice(report.Groups, func(i, j int) bool { return report.Groups[i].Name < report.Groups[j].Name })
+	return report, nil
+}
+
+func (r usageReport) format(line usageLine) string {
+	s := fmt.Sprintf("%.3f kWh, %.1fh on", line.KWh, line.HoursOn)
+	if line.Name == "total" {
+		s = fmt.Sprintf("%.3f kWh", line.KWh)
+	}
+	if r.price > 0 {
+		s += fmt.Sprintf(", %.2f", line.Cost)
+		if r.Currency != "" {
+			s += " " + r.Currency
+		}
+	}
+	return s
+}
+
+// groupsOf is the groups a device is in.
+func (c *controller) groupsOf(device string) []string {
+	var groups []string
+	for group, members := range c.config.Groups {
+		for _, name := range members {
+			if strings.EqualFold(name, device) {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// usageRows is every device's usage each day of a period so far.
+func (c *controller) usageRows(period string) ([]energy.Row, error) {
+	now := time.Now()
+	from, err := energy.Since(period, now)
+	if err != nil {
+		return nil, err
+	}
+	c.usage.Flush(now)
+	rows := c.usage.Rows(from, now)
+	for i := range rows {
+		rows[i].Groups = c.groupsOf(rows[i].Device)
+	}
+	return rows, nil
+}
+
+func periodName(period string) string {
+	if period == "day" {
+		return "today"
+	}
+	return "this " + period
+}
+
+func runUsage(cont *controller, args parsedArgs) error {
+	if args.str("action") == "export" {
+		return exportUsage(cont, args.str("target"))
+	}
+	period := args.str("action")
+	if period == "" {
+		period = "day"
+	}
+	report, err := cont.usageFor(period, args.str("target"))
+	if err != nil {
+		return err
+	}
+	cont.view.Eventf(ui.HeaderColor, "usage %s, since %s: %s", periodName(period), report.From, report.format(report.Total))
+	if len(report.Devices) == 0 {
+		cont.view.Eventf(ui.DimColor, "nothing used yet")
+	}
+	for _, line := range report.Devices {
+		cont.view.Eventf(ui.TextColor, "  %s: %s", line.Name, report.format(line))
+	}
+	for _, line := range report.Groups {
+		cont.view.Eventf(ui.TextColor, "  group %s: %s", line.Name, report.format(line))
+	}
+	return nil
+}
+
+// exportUsage writes this month's daily usage as CSV, to usage-<month>.csv
+// in exports next to the config unless it's given a file.
+func exportUsage(cont *controller, file string) error {
+	if file == "" {
+		file = "usage-" + time.Now().Format("2006-01")
+	}
+	path := cont.configFile("exports", file, ".csv")
+	rows, err := cont.usageRows("month")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to export usage")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to export usage")
+	}
+	defer f.Close()
+	price, _ := cont.price()
+	if err := energy.WriteCSV(f, rows, price); err != nil {
+		return err
+	}
+	cont.view.Eventf(ui.TextColor, "exported %d rows to %s", len(rows), path)
+	return nil
+}
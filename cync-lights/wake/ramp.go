@@ -0,0 +1,44 @@
+package wake
+
+import "github.com/kungfukennyg/home-office/cync-lights/colors"
+
+// stage is a point on the sunrise ramp.
+type stage struct {
+	at  float64
+	rgb [3]uint8
+	lum colors.Brightness
+}
+
+// sunrise goes from a faint deep red through orange to daylight. Brightness
+// climbs slowly at first, a dark room makes the first few percent look
+// bright.
+var sunrise = []stage{
+	{at: 0, rgb: [3]uint8{255, 0, 0}, lum: 1},
+	{at: 0.25, rgb: [3]uint8{255, 30, 0}, lum: 5},
+	{at: 0.5, rgb: [3]uint8{255, 90, 0}, lum: 20},
+	{at: 0.7, rgb: [3]uint8{255, 150, 40}, lum: 45},
+	{at: 0.85, rgb: [3]uint8{255, 200, 130}, lum: 75},
+	{at: 1, rgb: [3]uint8{255, 244, 229}, lum: 100},
+}
+
+// Ramp is the color and brightness p of the way through the ramp, 0 at the
+// start and 1 at the wake up time.
+func Ramp(p float64) (rgb [3]uint8, lum colors.Brightness) {
+	if p <= 0 {
+		return sunrise[0].rgb, sunrise[0].lum
+	}
+	for i := 1; i < len(sunrise); i++ {
+		to := sunrise[i]
+		if p > to.at {
+			continue
+		}
+		from := sunrise[i-1]
+		f := (p - from.at) / (to.at - from.at)
+		for c := range rgb {
+			rgb[c] = uint8(float64(from.rgb[c]) + (float64(to.rgb[c])-float64(from.rgb[c]))*f + 0.5)
+		}
+		return rgb, from.lum + colors.Brightness(float64(to.lum-from.lum)*f+0.5)
+	}
+	last := sunrise[len(sunrise)-1]
+	return last.rgb, last.lum
+}
@@ -0,0 +1,291 @@
+// Package wake schedules sunrise alarms and works out the ramp from off to
+// daylight. Everything takes the time from a Clock, so alarms can be tried
+// against a FakeClock without waiting for the morning.
+package wake
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultRamp   = 30 * time.Minute
+	DefaultHold   = 30 * time.Minute
+	DefaultSnooze = 9 * time.Minute
+)
+
+// Clock tells the time.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real time.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock only moves when told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Alarm is a compiled config.Alarm.
+type Alarm struct {
+	Name   string
+	Target string
+	Ramp   time.Duration
+	Hold   time.Duration
+	// at is the wake up time as time since midnight
+	at time.Duration
+	// days is nil for every day
+	days     map[time.Weekday]bool
+	disabled bool
+}
+
+func (a *Alarm) Disabled() bool {
+	return a.disabled
+}
+
+// Days describes which days the alarm goes off.
+func (a *Alarm) Days() string {
+	if a.days == nil {
+		return "every day"
+	}
+	var names []string
+	for _, day := range []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday} {
+		if a.days[day] {
+			names = append(names, strings.ToLower(day.String()[:3]))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// next is the first wake up time at or after from. The time is on the
+// clock, so it stays put on days the clocks change.
+func (a *Alarm) next(from time.Time) time.Time {
+	y, m, d := from.Date()
+	hour, minute := int(a.at/time.Hour), int(a.at%time.Hour/time.Minute)
+	for i := 0; i <= 7; i++ {
+		at := time.Date(y, m, d+i, hour, minute, 0, 0, from.Location())
+		if at.Before(from) {
+			continue
+		}
+		if a.days == nil || a.days[at.Weekday()] {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+// Occurrence is one time an alarm goes off.
+type Occurrence struct {
+	Alarm *Alarm
+	// At is the wake up time, the ramp starts Alarm.Ramp before
+	At time.Time
+}
+
+func (o Occurrence) Start() time.Time {
+	return o.At.Add(-o.Alarm.Ramp)
+}
+
+func (o Occurrence) End() time.Time {
+	return o.At.Add(o.Alarm.Hold)
+}
+
+func (o Occurrence) String() string {
+	return fmt.Sprintf("%s at %s", o.Alarm.Name, o.At.Format("Mon Jan 2 15:04"))
+}
+
+// Schedule keeps track of the alarms, which occurrences are skipped and
+// which have gone off. It's safe to use from any goroutine.
+type Schedule struct {
+	mu     sync.Mutex
+	alarms []*Alarm
+	// skipped and started are occurrences by alarm name
+	skipped map[string]time.Time
+	started map[string]time.Time
+}
+
+var weekdays = map[string][]time.Weekday{
+	"sun": {time.Sunday}, "mon": {time.Monday}, "tue": {time.Tuesday}, "wed": {time.Wednesday},
+	"thu": {time.Thursday}, "fri": {time.Friday}, "sat": {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// Compile checks every alarm, returning all the problems at once.
+func Compile(alarms []config.Alarm) (*Schedule, []error) {
+	s := &Schedule{skipped: map[string]time.Time{}, started: map[string]time.Time{}}
+	var problems []error
+	seen := map[string]bool{}
+	for i, cfg := range alarms {
+		if cfg.Name == "" {
+			cfg.Name = fmt.Sprintf("alarm-%d", i+1)
+		}
+		if seen[cfg.Name] {
+			problems = append(problems, errors.Errorf("%s: name used twice", cfg.Name))
+			continue
+		}
+		seen[cfg.Name] = true
+
+		a, err := compile(cfg)
+		if err != nil {
+			problems = append(problems, errors.Wrap(err, cfg.Name))
+			continue
+		}
+		s.alarms = append(s.alarms, a)
+	}
+	return s, problems
+}
+
+func compile(cfg config.Alarm) (*Alarm, error) {
+	a := &Alarm{Name: cfg.Name, Target: cfg.Target, Ramp: DefaultRamp, Hold: DefaultHold, disabled: cfg.Disabled}
+	at, err := time.Parse("15:04", cfg.At)
+	if err != nil {
+		return nil, errors.Errorf("at %q isn't a time like 07:00", cfg.At)
+	}
+	a.at = time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute
+
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{{"ramp", cfg.Ramp, &a.Ramp}, {"hold", cfg.Hold, &a.Hold}} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil || parsed < 0 {
+			return nil, errors.Errorf("%s %q isn't a duration like 30m", d.name, d.value)
+		}
+		*d.to = parsed
+	}
+	if a.Ramp < time.Minute {
+		return nil, errors.New("ramp should be at least a minute")
+	}
+
+	if len(cfg.Days) > 0 {
+		a.days = map[time.Weekday]bool{}
+		for _, day := range cfg.Days {
+			days, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, errors.Errorf("unknown day %q, use mon-sun, weekdays or weekends", day)
+			}
+			for _, d := range days {
+				a.days[d] = true
+			}
+		}
+	}
+	return a, nil
+}
+
+// Alarms lists the alarms, disabled ones included.
+func (s *Schedule) Alarms() []*Alarm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Alarm(nil), s.alarms...)
+}
+
+// Next is an alarm's next occurrence whose ramp hasn't started yet, and
+// whether it's skipped.
+func (s *Schedule) Next(a *Alarm, now time.Time) (o Occurrence, skipped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o = Occurrence{Alarm: a, At: a.next(now.Add(a.Ramp))}
+	return o, s.skipped[a.Name].Equal(o.At)
+}
+
+// Upcoming is every enabled alarm's next occurrence, soonest first.
+func (s *Schedule) Upcoming(now time.Time) []Occurrence {
+	var out []Occurrence
+	for _, a := range s.Alarms() {
+		if a.disabled {
+			continue
+		}
+		o, _ := s.Next(a, now)
+		out = append(out, o)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].At.Before(out[j].At) })
+	return out
+}
+
+// Due returns an occurrence whose ramp has started and which hasn't been
+// started or skipped, marking it started. An alarm whose ramp started while
+// nothing was running still goes off if it's not over yet.
+func (s *Schedule) Due(now time.Time) (Occurrence, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.alarms {
+		if a.disabled {
+			continue
+		}
+		// the occurrence that would be ringing or holding right now
+		o := Occurrence{Alarm: a, At: a.next(now.Add(-a.Hold))}
+		if o.At.IsZero() || now.Before(o.Start()) || !now.Before(o.End()) {
+			continue
+		}
+		if s.skipped[a.Name].Equal(o.At) || s.started[a.Name].Equal(o.At) {
+			continue
+		}
+		s.started[a.Name] = o.At
+		return o, true
+	}
+	return Occurrence{}, false
+}
+
+// Skip skips the next occurrence of the named alarm, or of whichever alarm
+// goes off next if name is empty.
+func (s *Schedule) Skip(name string, now time.Time) (Occurrence, error) {
+	upcoming := s.Upcoming(now)
+	for _, o := range upcoming {
+		if name != "" && o.Alarm.Name != name {
+			continue
+		}
+		s.mu.Lock()
+		s.skipped[o.Alarm.Name] = o.At
+		s.mu.Unlock()
+		return o, nil
+	}
+	if name != "" {
+		return Occurrence{}, errors.Errorf("no enabled alarm called %s", name)
+	}
+	return Occurrence{}, errors.New("no alarms to skip")
+}
+
+// Unskip undoes every skip.
+func (s *Schedule) Unskip() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skipped = map[string]time.Time{}
+}
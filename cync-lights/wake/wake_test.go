@@ -0,0 +1,192 @@
+package wake
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/kungfukennyg/home-office/cync-lights/config"
+)
+
+func schedule(t *testing.T, alarms ...config.Alarm) *Schedule {
+	t.Helper()
+	s, problems := Compile(alarms)
+	if len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	return s
+}
+
+// Monday 2026-10-19
+func monday(hour, minute int) time.Time {
+	return time.Date(2026, 10, 19, hour, minute, 0, 0, time.UTC)
+}
+
+func TestDue(t *testing.T) {
+	tests := []struct {
+		name string
+		// minutes after 06:00 on the monday
+		now int
+		due bool
+	}{
+		{"before the ramp", 29, false},
+		{"ramp starts", 30, true},
+		// the controller was down when the ramp started
+		{"mid ramp", 45, true},
+		{"holding", 89, true},
+		{"over", 90, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := schedule(t, config.Alarm{Name: "work", At: "07:00"})
+			clock := NewFakeClock(monday(6, 0).Add(time.Duration(tt.now) * time.Minute))
+			o, due := s.Due(clock.Now())
+			if due != tt.due {
+				t.Fatalf("due %t, want %t", due, tt.due)
+			}
+			if !due {
+				return
+			}
+			if !o.At.Equal(monday(7, 0)) {
+				t.Errorf("occurrence at %v, want 07:00", o.At)
+			}
+			// it only goes off once
+			clock.Advance(time.Minute)
+			if _, again := s.Due(clock.Now()); again {
+				t.Error("due again after starting")
+			}
+		})
+	}
+}
+
+func TestSkipOnlyNext(t *testing.T) {
+	s := schedule(t, config.Alarm{Name: "work", At: "07:00"})
+	clock := NewFakeClock(monday(6, 0))
+	o, err := s.Skip("", clock.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.At.Equal(monday(7, 0)) {
+		t.Fatalf("skipped %v, want monday 07:00", o.At)
+	}
+	if _, skipped := s.Next(o.Alarm, clock.Now()); !skipped {
+		t.Error("next occurrence isn't marked skipped")
+	}
+
+	clock.Set(monday(6, 45))
+	if o, due := s.Due(clock.Now()); due {
+		t.Fatalf("%v went off while skipped", o)
+	}
+	clock.Advance(24 * time.Hour)
+	o, due := s.Due(clock.Now())
+	if !due || !o.At.Equal(monday(7, 0).AddDate(0, 0, 1)) {
+		t.Fatalf("got %v, %t, want tuesday's alarm", o, due)
+	}
+}
+
+func TestDays(t *testing.T) {
+	tests := []struct {
+		name  string
+		alarm config.Alarm
+		now   time.Time
+		want  time.Time
+	}{
+		{
+			// the ramp starts on monday for an alarm set for tuesday
+			name:  "ramp across midnight",
+			alarm: config.Alarm{At: "00:10", Days: []string{"tue"}},
+			now:   monday(23, 45),
+			want:  time.Date(2026, 10, 20, 0, 10, 0, 0, time.UTC),
+		},
+		{
+			name:  "not on monday",
+			alarm: config.Alarm{At: "00:10", Days: []string{"mon"}},
+			now:   monday(23, 45),
+		},
+		{
+			name:  "weekends",
+			alarm: config.Alarm{At: "09:00", Days: []string{"weekends"}},
+			now:   monday(8, 45),
+		},
+		{
+			name:  "weekdays",
+			alarm: config.Alarm{At: "09:00", Days: []string{"weekdays"}},
+			now:   monday(8, 45),
+			want:  monday(9, 0),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.alarm.Name = "alarm"
+			s := schedule(t, tt.alarm)
+			o, due := s.Due(NewFakeClock(tt.now).Now())
+			if due != !tt.want.IsZero() {
+				t.Fatalf("due %t at %v", due, tt.now)
+			}
+			if due && !o.At.Equal(tt.want) {
+				t.Errorf("occurrence at %v, want %v", o.At, tt.want)
+			}
+		})
+	}
+}
+
+func TestDST(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the clocks go forward on 2026-03-08 and back on 2026-11-01, both at
+	// 02:00
+	for _, day := range []time.Time{
+		time.Date(2026, 3, 8, 0, 0, 0, 0, newYork),
+		time.Date(2026, 11, 1, 0, 0, 0, 0, newYork),
+	} {
+		t.Run(day.Format("Jan 2"), func(t *testing.T) {
+			s := schedule(t, config.Alarm{Name: "work", At: "07:00", Days: []string{"sun"}})
+			// the saturday evening before, the alarm is still 07:00
+			clock := NewFakeClock(day.Add(-4 * time.Hour))
+			upcoming := s.Upcoming(clock.Now())
+			if len(upcoming) != 1 {
+				t.Fatalf("upcoming %v", upcoming)
+			}
+			if h, m, _ := upcoming[0].At.Clock(); h != 7 || m != 0 {
+				t.Errorf("next alarm at %s, want 07:00", upcoming[0].At.Format("15:04"))
+			}
+
+			clock.Set(time.Date(day.Year(), day.Month(), day.Day(), 6, 30, 0, 0, newYork))
+			o, due := s.Due(clock.Now())
+			if !due {
+				t.Fatal("not due at 06:30")
+			}
+			if h, _, _ := o.At.Clock(); h != 7 || o.At.Sub(clock.Now()) != 30*time.Minute {
+				t.Errorf("went off for %s, want 07:00", o.At.Format("15:04"))
+			}
+		})
+	}
+}
+
+func TestRampMonotonic(t *testing.T) {
+	rgb, lum := Ramp(0)
+	if rgb != sunrise[0].rgb || lum != sunrise[0].lum {
+		t.Errorf("ramp starts at %v %d", rgb, lum)
+	}
+	rgb, lum = Ramp(1)
+	if last := sunrise[len(sunrise)-1]; rgb != last.rgb || lum != last.lum {
+		t.Errorf("ramp ends at %v %d", rgb, lum)
+	}
+
+	prevRGB, prevLum := Ramp(-0.1)
+	for i := 0; i <= 1100; i++ {
+		p := float64(i) / 1000
+		rgb, lum := Ramp(p)
+		if lum < prevLum {
+			t.Fatalf("brightness drops from %d to %d at %.3f", prevLum, lum, p)
+		}
+		for c := range rgb {
+			if rgb[c] < prevRGB[c] {
+				t.Fatalf("channel %d drops from %d to %d at %.3f", c, prevRGB[c], rgb[c], p)
+			}
+		}
+		prevRGB, prevLum = rgb, lum
+	}
+}
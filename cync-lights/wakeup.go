@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kungfukennyg/home-office/cync-lights/colors"
+	"github.com/kungfukennyg/home-office/cync-lights/input"
+	"github.com/kungfukennyg/home-office/cync-lights/log"
+	"github.com/kungfukennyg/home-office/cync-lights/ui"
+	"github.com/kungfukennyg/home-office/cync-lights/wake"
+	"github.com/pkg/errors"
+)
+
+const ModeWakeID = "wake"
+
+var wakeLog = log.For("mode.wake")
+
+const (
+	wakePoll = time.Second
+	// wakeSteps is roughly how many updates a ramp gets, enough that every
+	// brightness percent is its own step
+	wakeSteps    = 400
+	wakeMinFrame = 200 * time.Millisecond
+	wakeMaxFrame = 5 * time.Second
+	// wakeRerampAfterSnooze is how long the lights take to come back up
+	wakeRerampAfterSnooze = time.Minute
+	testRamp              = time.Minute
+	testHold              = 10 * time.Second
+)
+
+// wakeAlarms watches the schedule and starts wake mode when an alarm's ramp
+// begins. The clock is swappable so alarms can be tried with a fake one.
+type wakeAlarms struct {
+	clock    wake.Clock
+	schedule *wake.Schedule
+	snooze   time.Duration
+	stop     chan struct{}
+	// ringing is the alarm going off, kept after it's dismissed so it can
+	// still be snoozed until its hold is over
+	ringing *ringing
+}
+
+type ringing struct {
+	occurrence wake.Occurrence
+	// the ramp runs from start to end, then holds at daylight until hold
+	start, end, hold time.Time
+	snoozes          int
+	dismissed        bool
+}
+
+// startWake starts watching for alarms if the config has any.
+func (c *controller) startWake(clock wake.Clock) error {
+	if c.config.Wake == nil {
+		return nil
+	}
+	snooze, err := configDuration(c.config.Wake.Snooze, wake.DefaultSnooze)
+	if err != nil {
+		return errors.Wrap(err, "wake snooze")
+	}
+	schedule, problems := wake.Compile(c.config.Wake.Alarms)
+	for _, err := range problems {
+		c.view.Eventf(ui.ErrColor, "alarm %v", err)
+	}
+	for _, a := range schedule.Alarms() {
+		if _, err := c.resolveTarget(a.Target); err != nil {
+			c.view.Eventf(ui.ErrColor, "alarm %s: %v", a.Name, err)
+		}
+	}
+
+	w := &wakeAlarms{clock: clock, schedule: schedule, snooze: snooze, stop: make(chan struct{})}
+	c.wake = w
+	go w.watch(c)
+	if next := schedule.Upcoming(clock.Now()); len(next) > 0 {
+		wakeLog.Info("next alarm", log.F("alarm", next[0].String()))
+	}
+	return nil
+}
+
+func (w *wakeAlarms) watch(c *controller) {
+	ticker := time.NewTicker(wakePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		if o, ok := w.schedule.Due(w.clock.Now()); ok {
+			c.post(func() { c.ring(o) })
+		}
+	}
+}
+
+// ring starts an alarm going off.
+func (c *controller) ring(o wake.Occurrence) {
+	c.wake.ringing = &ringing{occurrence: o, start: o.Start(), end: o.At, hold: o.End()}
+	wakeLog.Info("alarm going off", log.F("alarm", o.String()))
+	c.view.Eventf(ui.HeaderColor, "alarm %s, sunrise until %s", o.Alarm.Name, o.At.Format("15:04"))
+	if err := c.SwitchMode(ModeWakeID); err != nil {
+		c.view.Eventf(ui.ErrColor, "alarm %s: %v", o.Alarm.Name, err)
+	}
+}
+
+// snoozeAlarm turns the lights off for the snooze, then brings them back up.
+func (c *controller) snoozeAlarm() error {
+	if c.wake == nil {
+		return errors.New("no alarms are configured, add a wake section to the config")
+	}
+	r := c.wake.ringing
+	now := c.wake.clock.Now()
+	if r == nil || !now.Before(r.hold) {
+		return errors.New("no alarm to snooze")
+	}
+	r.start = now.Add(c.wake.snooze)
+	r.end = r.start.Add(wakeRerampAfterSnooze)
+	r.hold = r.end.Add(r.occurrence.Alarm.Hold)
+	r.snoozes++
+	r.dismissed = false
+	c.view.Eventf(ui.TextColor, "snoozing until %s", r.start.Format("15:04"))
+	if c.mode.getId() == ModeWakeID {
+		// start over so the lights go off now
+		return c.modes[ModeWakeID].onSwitch(c)
+	}
+	return c.SwitchMode(ModeWakeID)
+}
+
+// ModeWake plays the sunrise for whatever alarm is ringing, then holds at
+// daylight. Any command dismisses it, wake snooze snoozes it.
+type ModeWake struct {
+	bindings bindings
+	devices  []*device
+	sentRGB  [3]uint8
+	sentLum  colors.Brightness
+	sentOff  bool
+}
+
+func (mw *ModeWake) onSwitch(cont *controller) error {
+	if cont.wake == nil || cont.wake.ringing == nil {
+		return errors.New("no alarm is going off, wake test tries one")
+	}
+	devices, err := cont.resolveTarget(cont.wake.ringing.occurrence.Alarm.Target)
+	if err != nil {
+		return err
+	}
+	mw.devices = devices
+	mw.sentLum = -1
+	mw.sentOff = false
+	return nil
+}
+
+func (mw *ModeWake) run(cont *controller) (time.Duration, error) {
+	r := cont.wake.ringing
+	now := cont.wake.clock.Now()
+	mw.lines(cont, r, now)
+
+	switch {
+	case !now.Before(r.hold):
+		cont.view.Eventf(ui.TextColor, "good morning")
+		r.dismissed = true
+		return time.Millisecond, cont.SwitchMode(ModeCommandID)
+	case now.Before(r.start):
+		// snoozing
+		if !mw.sentOff {
+			mw.sentOff = true
+			mw.sentLum = -1
+			for _, d := range mw.devices {
+				cont.SetStatus(d, false)
+			}
+		}
+		return wakeMaxFrame, nil
+	}
+
+	p := float64(now.Sub(r.start)) / float64(r.end.Sub(r.start))
+	if p > 1 {
+		p = 1
+	}
+	rgb, lum := wake.Ramp(p)
+	mw.apply(cont, rgb, lum)
+
+	if p >= 1 {
+		return wakeMaxFrame, nil
+	}
+	frame := r.end.Sub(r.start) / wakeSteps
+	switch {
+	case frame < wakeMinFrame:
+		frame = wakeMinFrame
+	case frame > wakeMaxFrame:
+		frame = wakeMaxFrame
+	}
+	return frame, nil
+}
+
+// apply sends what's changed, brightness in single percent steps.
+func (mw *ModeWake) apply(cont *controller, rgb [3]uint8, lum colors.Brightness) {
+	first := mw.sentLum < 0
+	for _, d := range mw.devices {
+		if first && (mw.sentOff || !cont.lastPower[d.DeviceID()]) {
+			cont.SetStatus(d, true)
+		}
+		if first || rgb != mw.sentRGB {
+			cont.SetRGBAsync(d, colors.New("sunrise", rgb[0], rgb[1], rgb[2]))
+		}
+		if lum != mw.sentLum {
+			cont.SetLumAsync(d, lum)
+		}
+	}
+	mw.sentRGB, mw.sentLum, mw.sentOff = rgb, lum, false
+}
+
+func (mw *ModeWake) lines(cont *controller, r *ringing, now time.Time) {
+	state := fmt.Sprintf("sunrise until %s", r.end.Format("15:04"))
+	switch {
+	case now.Before(r.start):
+		state = fmt.Sprintf("snoozing until %s", r.start.Format("15:04"))
+	case !now.Before(r.end):
+		state = fmt.Sprintf("daylight until %s", r.hold.Format("15:04"))
+	}
+	snoozes := ""
+	if r.snoozes > 0 {
+		snoozes = fmt.Sprintf(" | snoozed %d times", r.snoozes)
+	}
+	cont.view.SetModeLines(fmt.Sprintf("[Wake] %s", r.occurrence.Alarm.Name),
+		fmt.Sprintf("%s%s | %s snooze, %s dismiss", state, snoozes, mw.bindings.keyFor(actionSnooze), mw.bindings.keyFor(actionQuit)))
+}
+
+func (mw *ModeWake) wantsKey(k input.Key) bool {
+	switch mw.bindings[keyName(k)] {
+	case actionSnooze, actionQuit, actionHelp:
+		return true
+	}
+	return false
+}
+
+func (mw *ModeWake) handleKey(cont *controller, k input.Key) bool {
+	switch mw.bindings[keyName(k)] {
+	case actionSnooze:
+		if err := cont.snoozeAlarm(); err != nil {
+			cont.view.Eventf(ui.ErrColor, "%v", err)
+		}
+		return true
+	case actionQuit:
+		cont.SwitchMode(ModeCommandID)
+		return true
+	case actionHelp:
+		for _, line := range mw.bindings.describe(mw.wantsKey) {
+			cont.view.Eventf(ui.TextColor, "%s", line)
+		}
+	}
+	return false
+}
+
+// onExit dismisses the alarm and leaves the lights as they are, wake snooze
+// still works until the hold would have ended.
+func (mw *ModeWake) onExit(cont *controller) {
+	r := cont.wake.ringing
+	if r != nil && !r.dismissed {
+		r.dismissed = true
+		cont.view.Eventf(ui.TextColor, "alarm %s dismissed", r.occurrence.Alarm.Name)
+	}
+}
+
+func (mw *ModeWake) isIndefinite() bool {
+	return true
+}
+
+func (mw *ModeWake) getId() string {
+	return ModeWakeID
+}
+
+func runWake(cont *controller, args parsedArgs) error {
+	w := cont.wake
+	if w == nil {
+		return errors.New("no alarms are configured, add a wake section to the config")
+	}
+	now := w.clock.Now()
+	name := args.str("alarm")
+
+	switch args.str("action") {
+	case "", "list":
+		alarms := w.schedule.Alarms()
+		if len(alarms) == 0 {
+			cont.view.Eventf(ui.TextColor, "no alarms")
+		}
+		for _, a := range alarms {
+			o, skipped := w.schedule.Next(a, now)
+			next := "next " + o.At.Format("Mon Jan 2 15:04")
+			if skipped {
+				next += " (skipped)"
+			}
+			if a.Disabled() {
+				next = "disabled"
+			}
+			cont.view.Eventf(ui.TextColor, "%s: %s, %v ramp, %s", a.Name, a.Days(), a.Ramp, next)
+		}
+	case "snooze":
+		return cont.snoozeAlarm()
+	case "skip":
+		o, err := w.schedule.Skip(name, now)
+		if err != nil {
+			return err
+		}
+		cont.view.Eventf(ui.TextColor, "skipping %s", o)
+	case "unskip":
+		w.schedule.Unskip()
+		cont.view.Eventf(ui.TextColor, "no alarms skipped")
+	case "test":
+		// a quick sunrise on the named alarm's lights
+		test := &wake.Alarm{Name: "test", Ramp: testRamp, Hold: testHold}
+		for _, a := range w.schedule.Alarms() {
+			if a.Name == name || (name == "" && test.Target == "") {
+				test.Target = a.Target
+			}
+		}
+		cont.ring(wake.Occurrence{Alarm: test, At: now.Add(testRamp)})
+	}
+	return nil
+}
+
+// alarmNames completes alarm names for wake skip and wake test.
+func (c *controller) alarmNames() []string {
+	if c.wake == nil {
+		return nil
+	}
+	var names []string
+	for _, a := range c.wake.schedule.Alarms() {
+		names = append(names, a.Name)
+	}
+	return names
+}
@@ -3,15 +3,14 @@ module github.com/kungfukennyg/home-office
 go 1.18
 
 require (
-	github.com/gosuri/uilive v0.0.4
+	github.com/fatih/color v1.13.0
 	github.com/pkg/errors v0.9.1
 	github.com/unixpickle/cbyge v0.0.0-20211109221948-459be53a48ca
+	golang.org/x/sys v0.0.0-20220731174439-a90be440212d
 )
 
 require (
-	github.com/fatih/color v1.13.0 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
 	github.com/unixpickle/essentials v1.3.0 // indirect
-	golang.org/x/sys v0.0.0-20220731174439-a90be440212d // indirect
 )